@@ -3,6 +3,7 @@ package common
 import (
 	"os"
 	"sync"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -18,11 +19,30 @@ type Config struct {
 	DB           *DBConfig           `yaml:"db"`
 	ThirdService *ThirdServiceConfig `yaml:"thirdService"`
 	Event        *EventConfig        `yaml:"event"`
+	Subscription *SubscriptionConfig `yaml:"subscription"`
+	Presence     *PresenceConfig     `yaml:"presence"`
+	Ephemeral    *EphemeralConfig    `yaml:"ephemeral"`
+	ReadReceipt  *ReadReceiptConfig  `yaml:"readReceipt"`
+	Fallback     *FallbackConfig     `yaml:"fallback"`
+	Callback     *CallbackConfig     `yaml:"callback"`
+	Priority     *PriorityConfig     `yaml:"priority"`
+	Push         *PushConfig         `yaml:"push"`
+	SlowConsumer *SlowConsumerConfig `yaml:"slowConsumer"`
+	Inbound      *InboundConfig      `yaml:"inbound"`
+	Compression  *CompressionConfig  `yaml:"compression"`
+	Replay       *ReplayConfig       `yaml:"replay"`
+	Revision     *RevisionConfig     `yaml:"revision"`
+	Retention    *RetentionConfig    `yaml:"retention"`
+	UserData     *UserDataConfig     `yaml:"userData"`
+	Encryption   *EncryptionConfig   `yaml:"encryption"`
+	Tenancy      *TenancyConfig      `yaml:"tenancy"`
 }
 
 type ServerConfig struct {
 	PublicAddr  string `yaml:"publicAddr"`
 	PrivateAddr string `yaml:"privateAddr"`
+	// 信任的反向代理地址(IP或CIDR), 仅来自这些地址的请求按 X-Forwarded-For 取客户端IP; 为空时客户端IP为连接的对端地址
+	TrustedProxies []string `yaml:"trustedProxies"`
 }
 
 type MQConfig struct {
@@ -50,6 +70,170 @@ type EventConfig struct {
 	Topics []string `yaml:"topics"`
 }
 
+type SubscriptionConfig struct {
+	PublicPrefixes []string `yaml:"publicPrefixes"` // 所有已登录用户均可订阅的频道前缀, 如 news:
+	MaxPerConn     int      `yaml:"maxPerConn"`     // 单个连接最多订阅的频道数
+}
+
+type PresenceConfig struct {
+	Topic string `yaml:"topic"` // 在线状态变更事件发布的 topic, 为空则不发布
+}
+
+type EphemeralConfig struct {
+	Rate  float64 `yaml:"rate"`  // 每个发送者每秒允许发送的临时消息数
+	Burst int     `yaml:"burst"` // 突发上限
+}
+
+type ReadReceiptConfig struct {
+	NotifySender bool `yaml:"notifySender"` // 聊天消息被读取后是否向发送者推送已读回执
+}
+
+type FallbackConfig struct {
+	ScanInterval time.Duration         `yaml:"scanInterval"` // 扫描间隔
+	MaxAge       time.Duration         `yaml:"maxAge"`       // 超过该时间的消息不再降级通知
+	MaxAttempts  int                   `yaml:"maxAttempts"`  // 每个通道的最大尝试次数
+	Rules        []*FallbackRule       `yaml:"rules"`
+	Webhook      *WebhookChannelConfig `yaml:"webhook"`
+	Email        *EmailChannelConfig   `yaml:"email"`
+	Mobile       *MobileChannelConfig  `yaml:"mobile"`
+}
+
+// FallbackRule 来自 Topic 的消息在 Delay 后仍未被客户端确认, 则通过 Channels 降级通知
+type FallbackRule struct {
+	Topic    string        `yaml:"topic"`
+	Delay    time.Duration `yaml:"delay"`
+	Channels []string      `yaml:"channels"`
+}
+
+type WebhookChannelConfig struct {
+	URL string `yaml:"url"`
+}
+
+type EmailChannelConfig struct {
+	Addr     string `yaml:"addr"` // SMTP服务地址, host:port
+	From     string `yaml:"from"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+type MobileChannelConfig struct {
+	GatewayURL string `yaml:"gatewayUrl"`
+	APIKey     string `yaml:"apiKey"`
+}
+
+type CallbackConfig struct {
+	Enabled      bool              `yaml:"enabled"`      // 是否回调投递状态, 启用时必须配置 Secret
+	Secret       string            `yaml:"secret"`       // HMAC-SHA256 签名密钥
+	MaxAttempts  int               `yaml:"maxAttempts"`  // 最大尝试次数, 超过后放弃
+	PollInterval time.Duration     `yaml:"pollInterval"` // 发件箱轮询间隔
+	Topics       map[string]string `yaml:"topics"`       // topic -> 回调地址, 消息未指定回调地址时使用
+}
+
+type PriorityConfig struct {
+	Topics map[string]string `yaml:"topics"` // topic -> 优先级(high/normal/low), 消息未指定优先级时使用
+}
+
+type PushConfig struct {
+	Workers             int           `yaml:"workers"`             // 推送协程数, 按用户ID分片, 同一用户的消息由同一协程按序推送
+	QueueSize           int           `yaml:"queueSize"`           // 新消息队列与每个推送协程的队列长度(各优先级合计)
+	StatusBatchSize     int           `yaml:"statusBatchSize"`     // 推送状态批量写入的最大条数
+	StatusFlushInterval time.Duration `yaml:"statusFlushInterval"` // 推送状态批量写入的最大间隔
+	SweepInterval       time.Duration `yaml:"sweepInterval"`       // 补偿推送扫描间隔
+	SweepMinAge         time.Duration `yaml:"sweepMinAge"`         // 推送记录创建超过该时间仍未推送成功才补偿, 避免与正常推送重复
+	SweepLease          time.Duration `yaml:"sweepLease"`          // 补偿推送租约时长
+	SweepMaxAttempts    int           `yaml:"sweepMaxAttempts"`    // 每条推送记录的最大补偿次数
+}
+
+// SlowConsumerConfig 连接发送缓冲区已满时的处理策略
+type SlowConsumerConfig struct {
+	Policy          string        `yaml:"policy"`          // drop-oldest: 丢弃最早的待发送消息; drop-newest: 丢弃新消息; disconnect: 缓冲区持续已满超过 DisconnectAfter 后断开连接
+	BufferSize      int           `yaml:"bufferSize"`      // 每个连接的发送缓冲区长度(各优先级合计)
+	DisconnectAfter time.Duration `yaml:"disconnectAfter"` // disconnect 策略下缓冲区持续已满的最长时间, 期间新消息被丢弃
+}
+
+// InboundConfig 客户端上行消息与建连限制
+type InboundConfig struct {
+	MaxFrameSize    int64         `yaml:"maxFrameSize"`    // 单条上行消息的最大字节数, 超过时以关闭码 1009 断开连接
+	ConnRate        float64       `yaml:"connRate"`        // 每个连接每秒允许的上行消息数
+	ConnBurst       int           `yaml:"connBurst"`       // 每个连接的突发上行消息数
+	UserRate        float64       `yaml:"userRate"`        // 每个用户(所有连接合计)每秒允许的上行消息数
+	UserBurst       int           `yaml:"userBurst"`       // 每个用户的突发上行消息数
+	MaxViolations   int           `yaml:"maxViolations"`   // 超过限流的消息被丢弃并回复错误帧, 一个计数窗口内累计达到该次数后以关闭码 1008 断开连接
+	ViolationWindow time.Duration `yaml:"violationWindow"` // 超过限流次数的计数窗口, 距窗口开始超过该时长后重新计数
+	UpgradeRate     float64       `yaml:"upgradeRate"`     // 公共端口每个IP每秒允许的建连数
+	UpgradeBurst    int           `yaml:"upgradeBurst"`    // 公共端口每个IP的突发建连数
+}
+
+// CompressionConfig 下行消息压缩
+type CompressionConfig struct {
+	Enabled   bool     `yaml:"enabled"`   // 是否协商 permessage-deflate
+	Level     int      `yaml:"level"`     // permessage-deflate 压缩级别, 1(最快)-9(最小)
+	Threshold int      `yaml:"threshold"` // 编码后不小于该字节数的消息才压缩, 小消息压缩收益低于开销
+	Payloads  []string `yaml:"payloads"`  // 允许客户端选择的消息体压缩算法(gzip/snappy), 用于无法协商 permessage-deflate 的客户端
+}
+
+// ReplayConfig 用户上线时补推离线消息
+type ReplayConfig struct {
+	BatchSize   int           `yaml:"batchSize"`   // 每批补推的消息数, 客户端确认整批后再补推下一批
+	AckTimeout  time.Duration `yaml:"ackTimeout"`  // 等待客户端确认一批消息的最长时间, 超时后停止补推
+	MaxAge      time.Duration `yaml:"maxAge"`      // 只补推该时间内保存的消息, 更早的消息由客户端通过同步接口获取
+	MaxCount    int           `yaml:"maxCount"`    // 每次上线最多补推的消息数
+	Concurrency int           `yaml:"concurrency"` // 同时补推的用户数
+}
+
+// RevisionConfig 聊天消息的发送者撤回/编辑消息的时限, 消息生产者通过 MQ/HTTP 撤回不受限制
+type RevisionConfig struct {
+	RecallWindow time.Duration `yaml:"recallWindow"` // 发送后可撤回的时限
+	EditWindow   time.Duration `yaml:"editWindow"`   // 发送后可编辑的时限
+}
+
+// RetentionConfig 过期数据清理, 分批删除以避免长时间锁表
+type RetentionConfig struct {
+	Enabled     bool             `yaml:"enabled"`     // 是否定期清理, 未启用时仍可通过私有接口手动触发
+	DryRun      bool             `yaml:"dryRun"`      // 只统计将要删除的数据, 不删除
+	Interval    time.Duration    `yaml:"interval"`    // 清理间隔
+	BatchSize   int              `yaml:"batchSize"`   // 每批删除的行数
+	BatchPause  time.Duration    `yaml:"batchPause"`  // 批次之间的间隔, 降低对线上读写的影响
+	Undelivered time.Duration    `yaml:"undelivered"` // 未推送成功的推送记录最长保留时间, 0 表示不清理
+	Rules       []*RetentionRule `yaml:"rules"`
+}
+
+// RetentionRule 按消息类型配置的保留时间, 超过 MaxAge 的消息及其推送记录被删除; 未配置的类型永久保留
+type RetentionRule struct {
+	Type   string        `yaml:"type"` // notification/chat/broadcast/channel/revision
+	MaxAge time.Duration `yaml:"maxAge"`
+}
+
+// UserDataConfig 用户数据导出与删除
+type UserDataConfig struct {
+	AuthoredChat string `yaml:"authoredChat"` // 删除用户数据时对其发送的聊天消息的处理: scrub(缺省): 清除内容与发送者, 其它接收者保留消息记录; delete: 删除消息; keep: 保留
+	BatchSize    int    `yaml:"batchSize"`    // 每批导出/删除的行数
+}
+
+// EncryptionConfig 消息内容加密; 关闭加密后仍可读取已加密的内容, 需保留主密钥
+type EncryptionConfig struct {
+	Enabled         bool          `yaml:"enabled"`         // 新保存的内容是否加密
+	Provider        string        `yaml:"provider"`        // 主密钥提供方, 目前支持 local
+	KeyFile         string        `yaml:"keyFile"`         // local: 主密钥文件, 每行 "<主密钥ID>:<base64 编码的32字节密钥>"
+	MasterKeyID     string        `yaml:"masterKeyID"`     // 生成数据密钥使用的主密钥ID
+	RefreshInterval time.Duration `yaml:"refreshInterval"` // 重新加载当前数据密钥的间隔, 其它实例轮换数据密钥后生效
+	BatchSize       int           `yaml:"batchSize"`       // 轮换时每批重新加密的行数
+}
+
+// TenancyConfig 多租户: 按组织隔离消息、连接与推送记录
+type TenancyConfig struct {
+	Enabled       bool                    `yaml:"enabled"`       // 启用后消息必须属于某个组织, 只推送给该组织的用户; 关闭时不能配置组织配额
+	AllowCrossOrg bool                    `yaml:"allowCrossOrg"` // 是否允许发布不属于任何组织的在线/全员/频道广播, 推送给所有组织的用户
+	DefaultQuota  *TenantQuota            `yaml:"defaultQuota"`  // 未单独配置的组织使用的配额
+	Quotas        map[string]*TenantQuota `yaml:"quotas"`        // 组织ID -> 配额
+}
+
+// TenantQuota 组织配额, 0 表示不限制
+type TenantQuota struct {
+	MaxConnectionsPerInstance int   `yaml:"maxConnectionsPerInstance"` // 单个实例上的最大连接数, 各实例分别计数, 组织的总连接数上限约为该值乘以实例数
+	MaxMessagesPerDay         int64 `yaml:"maxMessagesPerDay"`         // 每天(UTC)最多发布的消息数, 包括聊天消息, 所有实例共享计数
+}
+
 func NewConfig() *Config {
 	configOnce.Do(func() {
 		content, err := os.ReadFile("config.yaml")
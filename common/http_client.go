@@ -14,6 +14,8 @@ import (
 type HTTPClient interface {
 	GET(ctx context.Context, url string, header map[string]interface{}) (status int, resBody interface{}, err error)
 	POST(ctx context.Context, url string, header map[string]interface{}, body interface{}) (status int, resBody interface{}, err error)
+	// POSTRaw 发送请求到第三方地址(如webhook), 不解析统一响应格式, 非2xx状态码返回错误
+	POSTRaw(ctx context.Context, url string, header map[string]interface{}, body []byte) (status int, resBody []byte, err error)
 }
 
 type httpClient struct {
@@ -73,6 +75,33 @@ func (c *httpClient) POST(ctx context.Context, url string, header map[string]int
 	return c.do(req)
 }
 
+func (c *httpClient) POSTRaw(ctx context.Context, url string, header map[string]interface{}, body []byte) (status int, resBody []byte, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	c.setHeader(req, header)
+
+	response, err := c.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer response.Body.Close()
+
+	status = response.StatusCode
+	resBody, err = io.ReadAll(response.Body)
+	if err != nil {
+		err = fmt.Errorf("read response body failed, err: %w", err)
+		return
+	}
+	if status < http.StatusOK || status >= http.StatusMultipleChoices {
+		err = fmt.Errorf("http request failed, status code: %d, response: %s", status, string(resBody))
+		return
+	}
+	return
+}
+
 func (c *httpClient) do(req *http.Request) (status int, resBody interface{}, err error) {
 	response, err := c.client.Do(req)
 	if err != nil {
@@ -0,0 +1,13 @@
+package common
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// NewID 生成32位十六进制随机ID
+func NewID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,111 @@
+package common
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// 计数器名称
+const (
+	MetricMessagesPublished = "messages_published" // 接收到的新消息
+	MetricMessagesScheduled = "messages_scheduled" // 定时投递的消息
+	MetricMessagesDelivered = "messages_delivered" // 推送到客户端连接的消息(按用户计)
+	MetricMessagesExpired   = "messages_expired"   // 过期未推送的消息(按用户计, 广播消息按条计)
+	MetricMessagesAbandoned = "messages_abandoned" // 补偿次数用完仍未推送成功的推送记录
+	MetricMessagesRecalled  = "messages_recalled"  // 撤回的消息
+	MetricMessagesEdited    = "messages_edited"    // 消息编辑次数
+
+	MetricSlowConsumerDropOldest = "slow_consumer_drop_oldest" // 慢连接丢弃最早的待发送消息
+	MetricSlowConsumerDropNewest = "slow_consumer_drop_newest" // 慢连接丢弃新消息
+	MetricSlowConsumerDisconnect = "slow_consumer_disconnect"  // 慢连接被断开
+
+	MetricInboundRateLimited = "inbound_rate_limited" // 超过限流被丢弃的上行消息
+	MetricInboundTooLarge    = "inbound_too_large"    // 超过大小限制的上行消息
+	MetricInboundDisconnect  = "inbound_disconnect"   // 因多次超过限流被断开的连接
+	MetricUpgradeRateLimited = "upgrade_rate_limited" // 超过建连限流被拒绝的请求
+
+	MetricRetentionRuns           = "retention_runs"            // 执行的清理次数(含 dry-run)
+	MetricRetentionMessagesPurged = "retention_messages_purged" // 清理删除的消息
+	MetricRetentionRecordsPurged  = "retention_records_purged"  // 清理删除的推送记录
+
+	MetricQuotaConnectionsRejected = "quota_connections_rejected" // 超过组织连接数配额被拒绝的建连
+	MetricQuotaMessagesRejected    = "quota_messages_rejected"    // 超过组织每日消息数配额被拒绝的消息
+	MetricCrossOrgRejected         = "cross_org_rejected"         // 跨组织投递被拒绝的消息
+
+	MetricAdminDisconnect = "admin_disconnect" // 通过管理接口断开的连接
+)
+
+var (
+	counters       sync.Map // name -> *int64
+	tenantCounters sync.Map // 租户ID -> *sync.Map(name -> *int64)
+)
+
+// IncCounter 计数器加一
+func IncCounter(name string) {
+	AddCounter(name, 1)
+}
+
+// AddCounter 计数器加 delta
+func AddCounter(name string, delta int64) {
+	v, ok := counters.Load(name)
+	if !ok {
+		v, _ = counters.LoadOrStore(name, new(int64))
+	}
+	atomic.AddInt64(v.(*int64), delta)
+}
+
+// Counters 获取所有计数器的当前值
+func Counters() map[string]int64 {
+	out := make(map[string]int64)
+	counters.Range(func(key, value any) bool {
+		out[key.(string)] = atomic.LoadInt64(value.(*int64))
+		return true
+	})
+	return out
+}
+
+// AddTenantCounter 租户的计数器加 delta, 同时累加全局计数器; 租户ID为空(未启用多租户或不属于任何组织)时只累加全局计数器
+func AddTenantCounter(tenantID, name string, delta int64) {
+	AddCounter(name, delta)
+	if tenantID == "" {
+		return
+	}
+	v, ok := tenantCounters.Load(tenantID)
+	if !ok {
+		v, _ = tenantCounters.LoadOrStore(tenantID, &sync.Map{})
+	}
+	c, ok := v.(*sync.Map).Load(name)
+	if !ok {
+		c, _ = v.(*sync.Map).LoadOrStore(name, new(int64))
+	}
+	atomic.AddInt64(c.(*int64), delta)
+}
+
+// IncTenantCounter 租户的计数器加一
+func IncTenantCounter(tenantID, name string) {
+	AddTenantCounter(tenantID, name, 1)
+}
+
+// TenantCounters 获取所有租户的计数器当前值: 租户ID -> 计数器名称 -> 值
+func TenantCounters() map[string]map[string]int64 {
+	out := make(map[string]map[string]int64)
+	tenantCounters.Range(func(key, value any) bool {
+		out[key.(string)] = TenantCountersOf(key.(string))
+		return true
+	})
+	return out
+}
+
+// TenantCountersOf 获取一个租户的计数器当前值
+func TenantCountersOf(tenantID string) map[string]int64 {
+	out := make(map[string]int64)
+	v, ok := tenantCounters.Load(tenantID)
+	if !ok {
+		return out
+	}
+	v.(*sync.Map).Range(func(key, value any) bool {
+		out[key.(string)] = atomic.LoadInt64(value.(*int64))
+		return true
+	})
+	return out
+}
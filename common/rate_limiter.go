@@ -0,0 +1,61 @@
+package common
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+type limiterEntry struct {
+	limiter  *rate.Limiter
+	lastUsed time.Time
+}
+
+// KeyedLimiter 按 key(用户ID/IP等) 隔离的令牌桶限流器, 长时间未使用的 key 会被定期清理
+type KeyedLimiter struct {
+	limit    rate.Limit
+	burst    int
+	idleTTL  time.Duration
+	limiters map[string]*limiterEntry
+	mu       sync.Mutex
+}
+
+func NewKeyedLimiter(r float64, burst int) *KeyedLimiter {
+	l := &KeyedLimiter{
+		limit:    rate.Limit(r),
+		burst:    burst,
+		idleTTL:  time.Minute * 10,
+		limiters: make(map[string]*limiterEntry),
+	}
+	go l.cleanupWorker()
+	return l
+}
+
+func (l *KeyedLimiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry, ok := l.limiters[key]
+	if !ok {
+		entry = &limiterEntry{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.limiters[key] = entry
+	}
+	entry.lastUsed = time.Now()
+	return entry.limiter.Allow()
+}
+
+func (l *KeyedLimiter) cleanupWorker() {
+	ticker := time.NewTicker(l.idleTTL)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		l.mu.Lock()
+		for key, entry := range l.limiters {
+			if time.Since(entry.lastUsed) > l.idleTTL {
+				delete(l.limiters, key)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
@@ -0,0 +1,73 @@
+package dbaccess
+
+import (
+	"MessagePushService/interfaces"
+	"context"
+	"database/sql"
+	"sync"
+)
+
+var (
+	dbAuditOnce     sync.Once
+	dbAuditInstance *dbAudit
+)
+
+type dbAudit struct {
+	db *sql.DB
+}
+
+func NewDBAudit(db *sql.DB) interfaces.IDBAudit {
+	dbAuditOnce.Do(func() {
+		dbAuditInstance = &dbAudit{db: db}
+	})
+
+	return dbAuditInstance
+}
+
+func (a *dbAudit) Add(ctx context.Context, log *interfaces.DBAuditLog) (int64, error) {
+	strSQL := `
+		INSERT INTO t_audit_log
+			(action, subject_org_id, subject_user_id, operator, reason, status, details)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`
+	result, err := a.db.ExecContext(ctx, strSQL, log.Action, log.SubjectOrgID, log.SubjectUserID, log.Operator, log.Reason, log.Status, log.Details)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func (a *dbAudit) Finish(ctx context.Context, id int64, status, details string) error {
+	_, err := a.db.ExecContext(ctx, "UPDATE t_audit_log SET status = ?, details = ?, finished_at = NOW() WHERE id = ?", status, details, id)
+	return err
+}
+
+func (a *dbAudit) GetBySubject(ctx context.Context, orgID, userID string, limit int) (out []*interfaces.DBAuditLog, err error) {
+	strSQL := `
+		SELECT id, action, subject_org_id, subject_user_id, operator, reason, status, details, created_at, finished_at
+		FROM t_audit_log
+		WHERE subject_org_id = ? AND subject_user_id = ?
+		ORDER BY id DESC
+		LIMIT ?
+	`
+	rows, err := a.db.QueryContext(ctx, strSQL, orgID, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		tmp := &interfaces.DBAuditLog{}
+		var finishedAt sql.NullTime
+		err = rows.Scan(&tmp.ID, &tmp.Action, &tmp.SubjectOrgID, &tmp.SubjectUserID, &tmp.Operator, &tmp.Reason, &tmp.Status, &tmp.Details, &tmp.CreatedAt, &finishedAt)
+		if err != nil {
+			return nil, err
+		}
+		if finishedAt.Valid {
+			tmp.FinishedAt = &finishedAt.Time
+		}
+		out = append(out, tmp)
+	}
+
+	return
+}
@@ -0,0 +1,112 @@
+package dbaccess
+
+import (
+	"MessagePushService/interfaces"
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+var (
+	dbCallbackOutboxOnce     sync.Once
+	dbCallbackOutboxInstance *dbCallbackOutbox
+)
+
+type dbCallbackOutbox struct {
+	db *sql.DB
+}
+
+func NewDBCallbackOutbox(db *sql.DB) interfaces.IDBCallbackOutbox {
+	dbCallbackOutboxOnce.Do(func() {
+		dbCallbackOutboxInstance = &dbCallbackOutbox{db: db}
+	})
+
+	return dbCallbackOutboxInstance
+}
+
+func (o *dbCallbackOutbox) Add(ctx context.Context, outbox *interfaces.DBCallbackOutbox) (err error) {
+	strSQL := `
+		INSERT INTO t_callback_outbox
+			(event_id, message_id, org_id, user_id, event, url, payload)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err = o.db.ExecContext(ctx, strSQL, outbox.EventID, outbox.MessageID, outbox.OrgID, outbox.UserID, outbox.Event, outbox.URL, outbox.Payload)
+	if err != nil {
+		return
+	}
+	return
+}
+
+func (o *dbCallbackOutbox) GetDue(ctx context.Context, limit int) (out []*interfaces.DBCallbackOutbox, err error) {
+	strSQL := `
+		SELECT id, event_id, message_id, org_id, user_id, event, url, payload, status, attempts, next_attempt_at
+		FROM t_callback_outbox
+		WHERE status = ? AND next_attempt_at <= NOW()
+		ORDER BY next_attempt_at ASC
+		LIMIT ?
+	`
+	rows, err := o.db.QueryContext(ctx, strSQL, interfaces.CallbackOutboxStatusPending, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		tmp := &interfaces.DBCallbackOutbox{}
+		err = rows.Scan(&tmp.ID, &tmp.EventID, &tmp.MessageID, &tmp.OrgID, &tmp.UserID, &tmp.Event, &tmp.URL, &tmp.Payload, &tmp.Status, &tmp.Attempts, &tmp.NextAttemptAt)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, tmp)
+	}
+
+	return
+}
+
+func (o *dbCallbackOutbox) Claim(ctx context.Context, id int64, leaseUntil time.Time) (ok bool, err error) {
+	strSQL := `
+		UPDATE t_callback_outbox
+		SET next_attempt_at = ?
+		WHERE id = ? AND status = ? AND next_attempt_at <= NOW()
+	`
+	result, err := o.db.ExecContext(ctx, strSQL, leaseUntil, id, interfaces.CallbackOutboxStatusPending)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+func (o *dbCallbackOutbox) MarkSent(ctx context.Context, id int64) (err error) {
+	strSQL := `
+		UPDATE t_callback_outbox
+		SET status = ?, attempts = attempts + 1, last_error = ''
+		WHERE id = ?
+	`
+	_, err = o.db.ExecContext(ctx, strSQL, interfaces.CallbackOutboxStatusSent, id)
+	if err != nil {
+		return
+	}
+	return
+}
+
+func (o *dbCallbackOutbox) MarkFailed(ctx context.Context, id int64, nextAttemptAt time.Time, dead bool, lastError string) (err error) {
+	status := interfaces.CallbackOutboxStatusPending
+	if dead {
+		status = interfaces.CallbackOutboxStatusDead
+	}
+	strSQL := `
+		UPDATE t_callback_outbox
+		SET status = ?, attempts = attempts + 1, next_attempt_at = ?, last_error = ?
+		WHERE id = ?
+	`
+	_, err = o.db.ExecContext(ctx, strSQL, status, nextAttemptAt, lastError, id)
+	if err != nil {
+		return
+	}
+	return
+}
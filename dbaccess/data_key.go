@@ -0,0 +1,145 @@
+package dbaccess
+
+import (
+	"MessagePushService/interfaces"
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+)
+
+var (
+	dbDataKeyOnce     sync.Once
+	dbDataKeyInstance *dbDataKey
+)
+
+type dbDataKey struct {
+	db *sql.DB
+}
+
+func NewDBDataKey(db *sql.DB) interfaces.IDBDataKey {
+	dbDataKeyOnce.Do(func() {
+		dbDataKeyInstance = &dbDataKey{db: db}
+	})
+
+	return dbDataKeyInstance
+}
+
+func (d *dbDataKey) Add(ctx context.Context, key *interfaces.DBDataKey) error {
+	_, err := d.db.ExecContext(ctx, "INSERT INTO t_data_key (id, master_key_id, wrapped_key) VALUES (?, ?, ?)", key.ID, key.MasterKeyID, key.WrappedKey)
+	return err
+}
+
+func (d *dbDataKey) GetByID(ctx context.Context, id string) (*interfaces.DBDataKey, error) {
+	out := &interfaces.DBDataKey{}
+	err := d.db.QueryRowContext(ctx, "SELECT id, master_key_id, wrapped_key, created_at FROM t_data_key WHERE id = ?", id).
+		Scan(&out.ID, &out.MasterKeyID, &out.WrappedKey, &out.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = fmt.Errorf("%w, dataKeyID: %s", interfaces.ErrRecordNotFound, id)
+		}
+		return nil, err
+	}
+	return out, nil
+}
+
+func (d *dbDataKey) GetLatest(ctx context.Context, masterKeyID string) (*interfaces.DBDataKey, error) {
+	strSQL := `
+		SELECT id, master_key_id, wrapped_key, created_at
+		FROM t_data_key
+		WHERE master_key_id = ?
+		ORDER BY created_at DESC, id DESC
+		LIMIT 1
+	`
+	out := &interfaces.DBDataKey{}
+	err := d.db.QueryRowContext(ctx, strSQL, masterKeyID).Scan(&out.ID, &out.MasterKeyID, &out.WrappedKey, &out.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return out, nil
+}
+
+func (d *dbDataKey) GetStaleContents(ctx context.Context, table interfaces.ContentTable, keyID, afterID string, limit int) (out []*interfaces.DBContent, err error) {
+	strSQL := fmt.Sprintf("SELECT id, %s, content, key_id FROM %s WHERE id > ? AND key_id <> ? ORDER BY id ASC LIMIT ?",
+		contentMessageIDColumn(table), contentTableName(table))
+	rows, err := d.db.QueryContext(ctx, strSQL, afterID, keyID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		tmp := &interfaces.DBContent{}
+		err = rows.Scan(&tmp.ID, &tmp.MessageID, &tmp.Content, &tmp.KeyID)
+		if err != nil {
+			return nil, err
+		}
+		tmp.Previous = tmp.Content
+		out = append(out, tmp)
+	}
+
+	return out, rows.Err()
+}
+
+func (d *dbDataKey) UpdateContents(ctx context.Context, table interfaces.ContentTable, contents []*interfaces.DBContent) (affected int64, err error) {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+
+		cErr := tx.Commit()
+		if cErr != nil {
+			err = cErr
+			return
+		}
+	}()
+
+	// 按读取时的内容更新, 期间被编辑/清除的行不覆盖
+	strSQL := fmt.Sprintf("UPDATE %s SET content = ?, key_id = ? WHERE id = ? AND content = ?", contentTableName(table))
+	stmt, err := tx.PrepareContext(ctx, strSQL)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	for _, c := range contents {
+		var result sql.Result
+		result, err = stmt.ExecContext(ctx, c.Content, c.KeyID, c.ID, c.Previous)
+		if err != nil {
+			return 0, err
+		}
+		var n int64
+		n, err = result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		affected += n
+	}
+
+	return affected, nil
+}
+
+// contentTableName 表名拼接到 SQL 中, 只允许保存消息内容的表
+func contentTableName(table interfaces.ContentTable) string {
+	switch table {
+	case interfaces.ContentTableMessage, interfaces.ContentTableEdit:
+		return string(table)
+	}
+	panic(fmt.Sprintf("invalid content table %q", table))
+}
+
+// contentMessageIDColumn 内容所属消息ID的列, 编辑历史的内容属于原消息
+func contentMessageIDColumn(table interfaces.ContentTable) string {
+	if table == interfaces.ContentTableEdit {
+		return "message_id"
+	}
+	return "id"
+}
@@ -0,0 +1,147 @@
+package dbaccess
+
+import (
+	"MessagePushService/interfaces"
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	dbFallbackOnce     sync.Once
+	dbFallbackInstance *dbFallback
+)
+
+type dbFallback struct {
+	db *sql.DB
+}
+
+func NewDBFallback(db *sql.DB) interfaces.IDBFallback {
+	dbFallbackOnce.Do(func() {
+		dbFallbackInstance = &dbFallback{db: db}
+	})
+
+	return dbFallbackInstance
+}
+
+func (f *dbFallback) GetCandidates(ctx context.Context, topic string, channels []string, after, before time.Time, maxAttempts, limit int) (out []*interfaces.DBFallbackCandidate, err error) {
+	if len(channels) == 0 {
+		return
+	}
+
+	placeholders := make([]string, 0, len(channels))
+	channelArgs := make([]interface{}, 0, len(channels))
+	for _, channel := range channels {
+		placeholders = append(placeholders, "?")
+		channelArgs = append(channelArgs, channel)
+	}
+
+	// 所有通道均已投递成功或达到重试上限的推送记录不再处理
+	pending := `(
+		SELECT COUNT(*) FROM t_fallback_attempt fa
+		WHERE fa.org_id = %[1]s.org_id AND fa.user_id = %[1]s.user_id AND fa.message_id = m.id
+			AND fa.channel IN (` + strings.Join(placeholders, ",") + `)
+			AND (fa.status = ? OR fa.attempts >= ?)
+	) < ?`
+	// 降级延迟从消息实际投递的时间开始计算: 定时消息为 deliver_at, 其余为创建时间; 尚未到投递时间或已过期的消息不降级
+	dispatchedAt := `IF(m.deliver_at > 0, m.deliver_at, UNIX_TIMESTAMP(m.created_at))`
+	deliverable := `m.deliver_at <= UNIX_TIMESTAMP() AND (m.expires_at = 0 OR m.expires_at > UNIX_TIMESTAMP())`
+	// 指定用户的消息取推送记录; 组织/全员广播的推送记录在投递时生成, 离线用户没有推送记录,
+	// 按 t_user_presence 中连接过本服务的用户展开, 尚未生成推送记录或未确认的用户需要降级通知
+	strSQL := `
+		SELECT org_id, user_id, message_id FROM (
+			SELECT um.org_id, um.user_id, um.message_id, ` + dispatchedAt + ` AS dispatched_at
+			FROM t_message m
+			JOIN t_user_message um ON um.message_id = m.id
+			WHERE
+				m.topic = ?
+				AND ` + dispatchedAt + ` BETWEEN ? AND ?
+				AND ` + deliverable + `
+				AND m.audience_type NOT IN (?, ?)
+				AND um.push_status NOT IN (?, ?)
+				AND m.recalled_at = 0
+				AND ` + fmt.Sprintf(pending, "um") + `
+			UNION ALL
+			SELECT p.org_id, p.user_id, m.id, ` + dispatchedAt + ` AS dispatched_at
+			FROM t_message m
+			JOIN t_user_presence p ON (m.audience_type = ? AND p.org_id = m.audience_id) OR (m.audience_type = ? AND (m.org_id = '' OR p.org_id = m.org_id))
+			LEFT JOIN t_user_message um ON um.message_id = m.id AND um.org_id = p.org_id AND um.user_id = p.user_id
+			WHERE
+				m.topic = ?
+				AND ` + dispatchedAt + ` BETWEEN ? AND ?
+				AND ` + deliverable + `
+				AND m.audience_type IN (?, ?)
+				AND (um.id IS NULL OR um.push_status NOT IN (?, ?))
+				AND m.recalled_at = 0
+				AND ` + fmt.Sprintf(pending, "p") + `
+		) t
+		ORDER BY dispatched_at ASC
+		LIMIT ?
+	`
+	pendingArgs := append(append([]interface{}{}, channelArgs...), interfaces.FallbackStatusSuccess, maxAttempts, len(channels))
+	args := []interface{}{topic, after.Unix(), before.Unix(), interfaces.AudienceTypeOrg, interfaces.AudienceTypeAll, interfaces.MessagePushStatusAcked, interfaces.MessagePushStatusRecalled}
+	args = append(args, pendingArgs...)
+	args = append(args, interfaces.AudienceTypeOrg, interfaces.AudienceTypeAll, topic, after.Unix(), before.Unix(), interfaces.AudienceTypeOrg, interfaces.AudienceTypeAll, interfaces.MessagePushStatusAcked, interfaces.MessagePushStatusRecalled)
+	args = append(args, pendingArgs...)
+	args = append(args, limit)
+	rows, err := f.db.QueryContext(ctx, strSQL, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		tmp := &interfaces.DBFallbackCandidate{}
+		err = rows.Scan(&tmp.OrgID, &tmp.UserID, &tmp.MessageID)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, tmp)
+	}
+
+	return
+}
+
+func (f *dbFallback) GetAttempts(ctx context.Context, orgID, userID, msgID string) (out []*interfaces.DBFallbackAttempt, err error) {
+	strSQL := `
+		SELECT org_id, user_id, message_id, channel, status, attempts, error
+		FROM t_fallback_attempt
+		WHERE org_id = ? AND user_id = ? AND message_id = ?
+	`
+	rows, err := f.db.QueryContext(ctx, strSQL, orgID, userID, msgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		tmp := &interfaces.DBFallbackAttempt{}
+		err = rows.Scan(&tmp.OrgID, &tmp.UserID, &tmp.MessageID, &tmp.Channel, &tmp.Status, &tmp.Attempts, &tmp.Error)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, tmp)
+	}
+
+	return
+}
+
+func (f *dbFallback) AddAttempt(ctx context.Context, attempt *interfaces.DBFallbackAttempt) (err error) {
+	strSQL := `
+		INSERT INTO t_fallback_attempt
+			(org_id, user_id, message_id, channel, status, attempts, error)
+		VALUES (?, ?, ?, ?, ?, 1, ?)
+		ON DUPLICATE KEY UPDATE
+			status = VALUES(status),
+			attempts = attempts + 1,
+			error = VALUES(error)
+	`
+	_, err = f.db.ExecContext(ctx, strSQL, attempt.OrgID, attempt.UserID, attempt.MessageID, attempt.Channel, attempt.Status, attempt.Error)
+	if err != nil {
+		return
+	}
+	return
+}
@@ -5,8 +5,10 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
 var (
@@ -15,12 +17,36 @@ var (
 )
 
 type dbMessage struct {
-	db *sql.DB
+	db            *sql.DB
+	contentCipher interfaces.ILogicsContentCipher
 }
 
-func NewDBMessage(db *sql.DB) interfaces.IDBMessage {
+// messageColumns t_message 查询列, 与 scanMessage 的字段顺序一致, 查询时表别名需为 m
+const messageColumns = `
+	m.id, m.org_id, m.type, m.content, m.key_id, m.timestamp, m.audience_type, m.audience_id, m.sender_id, m.room_id, m.topic, m.callback_url, m.deliver_at, m.expires_at, m.priority, m.recalled_at, m.edited_at, m.created_at, m.updated_at
+`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanMessage(row rowScanner) (out *interfaces.DBMessage, err error) {
+	out = &interfaces.DBMessage{}
+	err = row.Scan(&out.ID, &out.OrgID, &out.Type, &out.Content, &out.KeyID, &out.Timestamp, &out.AudienceType, &out.AudienceID, &out.SenderID, &out.RoomID, &out.Topic, &out.CallbackURL, &out.DeliverAt, &out.ExpiresAt, &out.Priority, &out.RecalledAt, &out.EditedAt, &out.CreatedAt, &out.UpdatedAt)
+	return
+}
+
+// scanInboxMessage 查询列为 messageColumns 加上 um.seq
+func scanInboxMessage(row rowScanner) (out *interfaces.DBMessage, err error) {
+	out = &interfaces.DBMessage{}
+	err = row.Scan(&out.ID, &out.OrgID, &out.Type, &out.Content, &out.KeyID, &out.Timestamp, &out.AudienceType, &out.AudienceID, &out.SenderID, &out.RoomID, &out.Topic, &out.CallbackURL, &out.DeliverAt, &out.ExpiresAt, &out.Priority, &out.RecalledAt, &out.EditedAt, &out.CreatedAt, &out.UpdatedAt, &out.Seq)
+	return
+}
+
+// NewDBMessage contentCipher 用于保存前加密消息内容
+func NewDBMessage(db *sql.DB, contentCipher interfaces.ILogicsContentCipher) interfaces.IDBMessage {
 	dbMessageOnce.Do(func() {
-		dbMessageInstance = &dbMessage{db: db}
+		dbMessageInstance = &dbMessage{db: db, contentCipher: contentCipher}
 	})
 
 	return dbMessageInstance
@@ -44,28 +70,56 @@ func (m *dbMessage) Add(ctx context.Context, userIDs []string, message *interfac
 		}
 	}()
 
+	// 指定用户的推送记录与消息属于同一租户
+	recipients := make([]userSeqKey, 0, len(userIDs))
+	for _, userID := range userIDs {
+		recipients = append(recipients, userSeqKey{orgID: message.OrgID, userID: userID})
+	}
+	return m.insertMessage(ctx, tx, message, recipients)
+}
+
+// insertMessage 在事务中保存消息及其推送记录, 推送记录属于各接收用户所在的租户
+func (m *dbMessage) insertMessage(ctx context.Context, tx *sql.Tx, message *interfaces.DBMessage, recipients []userSeqKey) (err error) {
 	strSQL1 := `
 	INSERT INTO t_message 
-		(id, type, content, timestamp) 
-	VALUES (?, ?, ?, ?)
+		(id, org_id, type, content, key_id, timestamp, audience_type, audience_id, sender_id, room_id, topic, callback_url, deliver_at, expires_at, priority) 
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 `
 	strSQL2 := `
 	INSERT INTO t_user_message 
-		(user_id, message_id) 
+		(org_id, user_id, message_id, seq) 
 	VALUES 
 `
-	var placeholders []string = make([]string, 0, len(userIDs))
-	var args []interface{} = make([]interface{}, 0, len(userIDs))
-	for _, userID := range userIDs {
-		placeholders = append(placeholders, "(?, ?)")
-		args = append(args, userID, message.ID)
+
+	content, keyID, err := m.contentCipher.Encrypt(message.Content, message.ID)
+	if err != nil {
+		return
+	}
+	_, err = tx.ExecContext(ctx, strSQL1, message.ID, message.OrgID, message.Type, content, keyID, message.Timestamp, message.AudienceType, message.AudienceID, message.SenderID, message.RoomID, message.Topic, message.CallbackURL, message.DeliverAt, message.ExpiresAt, message.Priority)
+	if err != nil {
+		return
+	}
+	// 广播类消息只存储一份, 推送记录在投递时生成
+	if len(recipients) == 0 {
+		return
 	}
-	strSQL2 += strings.Join(placeholders, ",")
 
-	_, err = tx.ExecContext(ctx, strSQL1, message.ID, message.Type, message.Content, message.Timestamp)
+	counts := make(map[userSeqKey]int64, len(recipients))
+	for _, recipient := range recipients {
+		counts[recipient] = 1
+	}
+	seqs, err := allocSeqs(ctx, tx, counts)
 	if err != nil {
 		return
 	}
+	var placeholders []string = make([]string, 0, len(recipients))
+	var args []interface{} = make([]interface{}, 0, len(recipients)*4)
+	for _, recipient := range recipients {
+		placeholders = append(placeholders, "(?, ?, ?, ?)")
+		args = append(args, recipient.orgID, recipient.userID, message.ID, seqs[recipient])
+	}
+	strSQL2 += strings.Join(placeholders, ",")
+
 	_, err = tx.ExecContext(ctx, strSQL2, args...)
 	if err != nil {
 		return
@@ -74,19 +128,75 @@ func (m *dbMessage) Add(ctx context.Context, userIDs []string, message *interfac
 	return
 }
 
+// userSeqKey 收件箱序号表的主键
+type userSeqKey struct {
+	orgID  string
+	userID string
+}
+
+// allocSeqs 在事务中为每个用户分配 counts 个连续的收件箱序号, 返回各用户分配后的最大序号; 整批只执行一次写入与一次查询
+// 按主键顺序写入, 避免并发事务交叉加锁导致死锁; 序号行锁持有到事务提交, 同一用户的序号按提交顺序递增
+func allocSeqs(ctx context.Context, tx *sql.Tx, counts map[userSeqKey]int64) (map[userSeqKey]int64, error) {
+	keys := make([]userSeqKey, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].orgID != keys[j].orgID {
+			return keys[i].orgID < keys[j].orgID
+		}
+		return keys[i].userID < keys[j].userID
+	})
+
+	values := make([]string, 0, len(keys))
+	conds := make([]string, 0, len(keys))
+	insertArgs := make([]interface{}, 0, len(keys)*3)
+	selectArgs := make([]interface{}, 0, len(keys)*2)
+	for _, key := range keys {
+		values = append(values, "(?, ?, ?)")
+		conds = append(conds, "(?, ?)")
+		insertArgs = append(insertArgs, key.orgID, key.userID, counts[key])
+		selectArgs = append(selectArgs, key.orgID, key.userID)
+	}
+
+	strSQL1 := `
+		INSERT INTO t_user_seq (org_id, user_id, seq) VALUES ` + strings.Join(values, ",") + `
+		ON DUPLICATE KEY UPDATE seq = seq + VALUES(seq)
+	`
+	_, err := tx.ExecContext(ctx, strSQL1, insertArgs...)
+	if err != nil {
+		return nil, err
+	}
+
+	strSQL2 := "SELECT org_id, user_id, seq FROM t_user_seq WHERE (org_id, user_id) IN (" + strings.Join(conds, ",") + ")"
+	rows, err := tx.QueryContext(ctx, strSQL2, selectArgs...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make(map[userSeqKey]int64, len(keys))
+	for rows.Next() {
+		var key userSeqKey
+		var seq int64
+		err = rows.Scan(&key.orgID, &key.userID, &seq)
+		if err != nil {
+			return nil, err
+		}
+		out[key] = seq
+	}
+	return out, rows.Err()
+}
+
 func (m *dbMessage) GetByID(ctx context.Context, messageID string) (out *interfaces.DBMessage, userIDs []string, err error) {
-	out = &interfaces.DBMessage{}
 	userIDs = make([]string, 0)
 	strSQL := `
-		SELECT 
-			m.id, m.type, m.content, m.timestamp, m.created_at, m.updated_at
+		SELECT ` + messageColumns + `
 		FROM t_message m 
 		WHERE 
 			m.id = ?
 	`
-	err = m.db.
-		QueryRowContext(ctx, strSQL, messageID).
-		Scan(&out.ID, &out.Type, &out.Content, &out.Timestamp, &out.CreatedAt, &out.UpdatedAt)
+	out, err = scanMessage(m.db.QueryRowContext(ctx, strSQL, messageID))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			err = fmt.Errorf("%w, messageID: %s", interfaces.ErrRecordNotFound, messageID)
@@ -95,76 +205,433 @@ func (m *dbMessage) GetByID(ctx context.Context, messageID string) (out *interfa
 		return
 	}
 
-	rows, err := m.db.QueryContext(ctx, "SELECT user_id FROM t_user_message WHERE message_id = ?", messageID)
+	rows, err := m.db.QueryContext(ctx, "SELECT org_id, user_id, seq FROM t_user_message WHERE message_id = ?", messageID)
 	if err != nil {
 		return nil, nil, err
 	}
 	defer rows.Close()
+	out.RecipientSeqs = make(map[string]int64)
 	for rows.Next() {
-		var userID string
-		err = rows.Scan(&userID)
+		var orgID, userID string
+		var seq int64
+		err = rows.Scan(&orgID, &userID, &seq)
 		if err != nil {
 			return nil, nil, err
 		}
 		userIDs = append(userIDs, userID)
+		if seq > 0 {
+			out.RecipientSeqs[userID] = seq
+		}
+		if orgID != out.OrgID {
+			if out.RecipientOrgIDs == nil {
+				out.RecipientOrgIDs = make(map[string]string)
+			}
+			out.RecipientOrgIDs[userID] = orgID
+		}
 	}
 
 	return
 }
 
-func (m *dbMessage) GetByPushStatus(ctx context.Context, status interfaces.MessagePushStatus) (out *interfaces.DBMessage, userIDs []string, err error) {
-	out = &interfaces.DBMessage{}
-	err = m.db.
-		QueryRowContext(ctx, "SELECT * FROM t_message WHERE push_status = ? order by created_at asc limit 1", status).
-		Scan(&out.ID, &out.Type, &out.Content, &out.Timestamp, &out.CreatedAt, &out.UpdatedAt)
+func (m *dbMessage) GetByUserID(ctx context.Context, tenantID, userID string, status interfaces.MessagePushStatus, since time.Time, limit int) (out []*interfaces.DBMessage, err error) {
+	strSQL := `
+		SELECT ` + messageColumns + `, um.seq
+		FROM t_user_message um
+		JOIN t_message m ON m.id = um.message_id
+		WHERE
+			um.org_id = ? AND um.user_id = ? AND um.push_status = ? AND um.created_at >= ?
+			AND m.deliver_at <= UNIX_TIMESTAMP()
+		ORDER BY um.seq ASC, um.id ASC
+		LIMIT ?
+	`
+	return m.queryInbox(ctx, strSQL, tenantID, userID, status, since, limit)
+}
+
+func (m *dbMessage) CountByUserID(ctx context.Context, tenantID, userID string, status interfaces.MessagePushStatus, before time.Time) (count int, err error) {
+	strSQL := `
+		SELECT COUNT(*) FROM t_user_message
+		WHERE org_id = ? AND user_id = ? AND push_status = ? AND created_at < ?
+	`
+	err = m.db.QueryRowContext(ctx, strSQL, tenantID, userID, status, before).Scan(&count)
+	return
+}
+
+func (m *dbMessage) GetAfterSeq(ctx context.Context, tenantID, userID string, afterSeq int64, limit int) (out []*interfaces.DBMessage, err error) {
+	strSQL := `
+		SELECT ` + messageColumns + `, um.seq
+		FROM t_user_message um
+		JOIN t_message m ON m.id = um.message_id
+		WHERE
+			um.org_id = ? AND um.user_id = ? AND um.seq > ?
+			AND m.deliver_at <= UNIX_TIMESTAMP()
+			AND (m.expires_at = 0 OR m.expires_at > UNIX_TIMESTAMP())
+			AND m.recalled_at = 0
+		ORDER BY um.seq ASC
+		LIMIT ?
+	`
+	return m.queryInbox(ctx, strSQL, tenantID, userID, afterSeq, limit)
+}
+
+func (m *dbMessage) queryInbox(ctx context.Context, strSQL string, args ...interface{}) (out []*interfaces.DBMessage, err error) {
+	rows, err := m.db.QueryContext(ctx, strSQL, args...)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			err = fmt.Errorf("%w, status: %d", interfaces.ErrRecordNotFound, status)
-			return
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		tmp, err := scanInboxMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, tmp)
+	}
+
+	return
+}
+
+func (m *dbMessage) GetLatestSeq(ctx context.Context, tenantID, userID string) (seq int64, err error) {
+	err = m.db.QueryRowContext(ctx, "SELECT seq FROM t_user_seq WHERE org_id = ? AND user_id = ?", tenantID, userID).Scan(&seq)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return
+}
+
+func (m *dbMessage) GetPendingBroadcasts(ctx context.Context, tenantID, userID, orgID string, since time.Time, limit int) (out []*interfaces.DBMessage, err error) {
+	strSQL := `
+		SELECT ` + messageColumns + `
+		FROM t_message m
+		WHERE
+			((m.audience_type = ? AND m.audience_id = ?) OR m.audience_type = ?)
+			AND m.org_id IN (?, '')
+			AND m.created_at >= ?
+			AND m.deliver_at <= UNIX_TIMESTAMP()
+			AND (m.expires_at = 0 OR m.expires_at > UNIX_TIMESTAMP())
+			AND m.recalled_at = 0
+			AND NOT EXISTS (
+				SELECT 1 FROM t_user_message um WHERE um.org_id = ? AND um.user_id = ? AND um.message_id = m.id
+			)
+		ORDER BY m.created_at ASC
+		LIMIT ?
+	`
+	rows, err := m.db.QueryContext(ctx, strSQL, interfaces.AudienceTypeOrg, orgID, interfaces.AudienceTypeAll, tenantID, since, tenantID, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		tmp, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
 		}
+		out = append(out, tmp)
+	}
+
+	return
+}
+
+func (m *dbMessage) UpdateStatus(ctx context.Context, tenantID, userID, msgID string, status interfaces.MessagePushStatus) (err error) {
+	strSQL := `
+		UPDATE t_user_message
+		SET 
+			push_status = ?
+		WHERE 
+			org_id = ? AND user_id = ? AND message_id = ?
+	`
+	_, err = m.db.ExecContext(ctx, strSQL, status, tenantID, userID, msgID)
+	if err != nil {
 		return
 	}
+	return
+}
 
-	rows, err := m.db.QueryContext(ctx, "SELECT user_id FROM t_user_message WHERE message_id = ?", out.ID)
+// UpsertStatus 用于客户端确认: 广播、在线用户、频道消息的推送记录由批量写入异步生成, 确认可能先于推送记录落库,
+// 此时按消息创建推送记录, 之后的批量写入不会覆盖已确认的状态; 只为非指定用户的消息创建, 避免客户端确认任意消息ID生成推送记录
+func (m *dbMessage) UpsertStatus(ctx context.Context, tenantID, userID, msgID string, status interfaces.MessagePushStatus) (err error) {
+	strSQL1 := `
+		UPDATE t_user_message
+		SET
+			push_status = IF(push_status = ?, push_status, ?)
+		WHERE
+			org_id = ? AND user_id = ? AND message_id = ?
+	`
+	result, err := m.db.ExecContext(ctx, strSQL1, interfaces.MessagePushStatusRecalled, status, tenantID, userID, msgID)
 	if err != nil {
 		return
 	}
-	defer rows.Close()
+	affected, err := result.RowsAffected()
+	if err != nil || affected > 0 {
+		return
+	}
 
+	strSQL2 := `
+		INSERT INTO t_user_message
+			(org_id, user_id, message_id, push_status)
+		SELECT ?, ?, m.id, ?
+		FROM t_message m
+		WHERE m.id = ? AND m.audience_type <> ? AND (? = '' OR m.org_id IN ('', ?))
+		ON DUPLICATE KEY UPDATE
+			push_status = IF(push_status = ?, push_status, VALUES(push_status))
+	`
+	_, err = m.db.ExecContext(ctx, strSQL2, tenantID, userID, status, msgID, interfaces.AudienceTypeUsers, tenantID, tenantID, interfaces.MessagePushStatusRecalled)
+	return
+}
+
+func (m *dbMessage) BatchUpsertStatus(ctx context.Context, items []*interfaces.DBPushStatus) (err error) {
+	if len(items) == 0 {
+		return nil
+	}
+
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+
+		cErr := tx.Commit()
+		if cErr != nil {
+			err = cErr
+			return
+		}
+	}()
+
+	placeholders := make([]string, 0, len(items))
+	conds := make([]string, 0, len(items))
+	args := make([]interface{}, 0, len(items)*4+2)
+	keyArgs := make([]interface{}, 0, len(items)*3)
+	for _, item := range items {
+		placeholders = append(placeholders, "(?, ?, ?, ?)")
+		conds = append(conds, "(?, ?, ?)")
+		args = append(args, item.OrgID, item.UserID, item.MessageID, item.PushStatus)
+		keyArgs = append(keyArgs, item.OrgID, item.UserID, item.MessageID)
+	}
+	args = append(args, interfaces.MessagePushStatusAcked, interfaces.MessagePushStatusRecalled)
+
+	// 批量写入是异步的, 客户端的确认可能先于推送成功状态落库, 已确认的状态不能被覆盖; 推送过程中被撤回的记录保持已撤回
+	strSQL := `
+		INSERT INTO t_user_message
+			(org_id, user_id, message_id, push_status)
+		VALUES ` + strings.Join(placeholders, ",") + `
+		ON DUPLICATE KEY UPDATE
+			push_status = IF(push_status IN (?, ?), push_status, VALUES(push_status))
+	`
+	_, err = tx.ExecContext(ctx, strSQL, args...)
+	if err != nil {
+		return err
+	}
+
+	return assignPendingSeqs(ctx, tx, conds, keyArgs)
+}
+
+// assignPendingSeqs 为本批中尚无序号的推送记录(广播、在线用户、频道消息投递时新建的记录)分配收件箱序号, 使其可以通过同步获取
+func assignPendingSeqs(ctx context.Context, tx *sql.Tx, conds []string, keyArgs []interface{}) (err error) {
+	strSQL1 := `
+		SELECT id, org_id, user_id FROM t_user_message
+		WHERE (org_id, user_id, message_id) IN (` + strings.Join(conds, ",") + `) AND seq = 0
+		ORDER BY id ASC
+		FOR UPDATE
+	`
+	rows, err := tx.QueryContext(ctx, strSQL1, keyArgs...)
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	var keys []userSeqKey
+	counts := make(map[userSeqKey]int64)
 	for rows.Next() {
-		var userID string
-		err = rows.Scan(&userID)
+		var id int64
+		var key userSeqKey
+		err = rows.Scan(&id, &key.orgID, &key.userID)
 		if err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+		keys = append(keys, key)
+		counts[key]++
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil || len(ids) == 0 {
+		return err
+	}
+
+	seqs, err := allocSeqs(ctx, tx, counts)
+	if err != nil {
+		return err
+	}
+
+	// 同一用户本批分配的序号为 (最大序号-数量, 最大序号], 按记录创建顺序依次使用
+	cases := make([]string, 0, len(ids))
+	args := make([]interface{}, 0, len(ids)*3)
+	for i, id := range ids {
+		seq := seqs[keys[i]] - counts[keys[i]] + 1
+		seqs[keys[i]]++
+		cases = append(cases, "WHEN ? THEN ?")
+		args = append(args, id, seq)
+	}
+	inPlaceholders := make([]string, 0, len(ids))
+	for _, id := range ids {
+		inPlaceholders = append(inPlaceholders, "?")
+		args = append(args, id)
+	}
+	strSQL2 := "UPDATE t_user_message SET seq = CASE id " + strings.Join(cases, " ") + " END WHERE id IN (" + strings.Join(inPlaceholders, ",") + ")"
+	_, err = tx.ExecContext(ctx, strSQL2, args...)
+	return err
+}
+
+func (m *dbMessage) MarkRead(ctx context.Context, tenantID, userID, msgID string, upTo bool) (out []*interfaces.DBReadMessage, err error) {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
 			return
 		}
-		userIDs = append(userIDs, userID)
+
+		cErr := tx.Commit()
+		if cErr != nil {
+			err = cErr
+			return
+		}
+	}()
+
+	var rowID int64
+	err = tx.QueryRowContext(ctx, "SELECT id FROM t_user_message WHERE org_id = ? AND user_id = ? AND message_id = ?", tenantID, userID, msgID).Scan(&rowID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = fmt.Errorf("%w, userID: %s, messageID: %s", interfaces.ErrRecordNotFound, userID, msgID)
+		}
+		return nil, err
+	}
+
+	// 推送记录主键自增, 主键不大于该记录的即为之前的消息
+	cond := "um.id = ?"
+	if upTo {
+		cond = "um.id <= ?"
+	}
+
+	strSQL := `
+		SELECT um.message_id, m.type, m.sender_id
+		FROM t_user_message um
+		JOIN t_message m ON m.id = um.message_id
+		WHERE um.org_id = ? AND um.user_id = ? AND um.read_at IS NULL AND ` + cond + `
+		FOR UPDATE
+	`
+	rows, err := tx.QueryContext(ctx, strSQL, tenantID, userID, rowID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		tmp := &interfaces.DBReadMessage{}
+		err = rows.Scan(&tmp.MessageID, &tmp.Type, &tmp.SenderID)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		out = append(out, tmp)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE t_user_message um SET um.read_at = NOW() WHERE um.org_id = ? AND um.user_id = ? AND um.read_at IS NULL AND "+cond, tenantID, userID, rowID)
+	if err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+func (m *dbMessage) CountUnread(ctx context.Context, tenantID, userID string) (out []*interfaces.DBUnreadCount, err error) {
+	strSQL := `
+		SELECT m.type, m.room_id, COUNT(*)
+		FROM t_user_message um
+		JOIN t_message m ON m.id = um.message_id
+		WHERE um.org_id = ? AND um.user_id = ? AND um.read_at IS NULL AND m.recalled_at = 0 AND m.type NOT IN (?, ?)
+		GROUP BY m.type, m.room_id
+	`
+	// 已撤回的消息与撤回/编辑事件不计入未读数
+	rows, err := m.db.QueryContext(ctx, strSQL, tenantID, userID, interfaces.MessageTypeRecall, interfaces.MessageTypeEdit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		tmp := &interfaces.DBUnreadCount{}
+		err = rows.Scan(&tmp.Type, &tmp.RoomID, &tmp.Count)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, tmp)
+	}
+
+	return
+}
+
+func (m *dbMessage) GetDueScheduled(ctx context.Context, before int64, limit int) (out []*interfaces.DBMessage, err error) {
+	strSQL := `
+		SELECT ` + messageColumns + `
+		FROM t_message m
+		WHERE m.scheduled_dispatched = 0 AND m.deliver_at > 0 AND m.deliver_at <= ? AND m.recalled_at = 0
+		ORDER BY m.deliver_at ASC
+		LIMIT ?
+	`
+	rows, err := m.db.QueryContext(ctx, strSQL, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		tmp, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, tmp)
 	}
 
 	return
 }
 
-func (m *dbMessage) GetByUserID(ctx context.Context, userID string, status interfaces.MessagePushStatus, limit int) (out []*interfaces.DBMessage, err error) {
+func (m *dbMessage) ClaimScheduled(ctx context.Context, messageID string) (bool, error) {
 	strSQL := `
-		SELECT
-			id,
-			type,
-			content,
-			timestamp,
-			created_at,
-			updated_at
-		FROM t_message WHERE id IN (
-			SELECT message_id FROM t_user_message WHERE user_id = ? AND push_status = ? ORDER BY created_at ASC
-		) LIMIT ?
+		UPDATE t_message
+		SET
+			scheduled_dispatched = 1
+		WHERE
+			id = ? AND scheduled_dispatched = 0 AND deliver_at <= UNIX_TIMESTAMP()
 	`
-	rows, err := m.db.QueryContext(ctx, strSQL, userID, status, limit)
+	result, err := m.db.ExecContext(ctx, strSQL, messageID)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected == 1, nil
+}
+
+func (m *dbMessage) GetRecipientStatus(ctx context.Context, messageID string) (out []*interfaces.DBRecipientStatus, err error) {
+	rows, err := m.db.QueryContext(ctx, "SELECT org_id, user_id, push_status, read_at IS NOT NULL FROM t_user_message WHERE message_id = ?", messageID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		tmp := &interfaces.DBMessage{}
-		err = rows.Scan(&tmp.ID, &tmp.Type, &tmp.Content, &tmp.Timestamp, &tmp.CreatedAt, &tmp.UpdatedAt)
+		tmp := &interfaces.DBRecipientStatus{}
+		err = rows.Scan(&tmp.OrgID, &tmp.UserID, &tmp.PushStatus, &tmp.Read)
 		if err != nil {
 			return nil, err
 		}
@@ -174,17 +641,317 @@ func (m *dbMessage) GetByUserID(ctx context.Context, userID string, status inter
 	return
 }
 
-func (m *dbMessage) UpdateStatus(ctx context.Context, userID, msgID string, status interfaces.MessagePushStatus) (err error) {
+func (m *dbMessage) GetRedeliverable(ctx context.Context, tenantID string, userIDs []string, statuses []interfaces.MessagePushStatus, since, before time.Time, maxAttempts, limit int) (out []*interfaces.DBUserMessage, err error) {
+	if len(userIDs) == 0 || len(statuses) == 0 {
+		return nil, nil
+	}
+
+	userPlaceholders := make([]string, 0, len(userIDs))
+	statusPlaceholders := make([]string, 0, len(statuses))
+	args := make([]interface{}, 0, len(userIDs)+len(statuses)+5)
+	args = append(args, tenantID)
+	for _, userID := range userIDs {
+		userPlaceholders = append(userPlaceholders, "?")
+		args = append(args, userID)
+	}
+	for _, status := range statuses {
+		statusPlaceholders = append(statusPlaceholders, "?")
+		args = append(args, status)
+	}
+	args = append(args, since, before, maxAttempts, limit)
+
+	// 未到定时投递时间的消息不补偿
+	strSQL := `
+		SELECT um.id, um.user_id, um.message_id, um.push_status, um.attempts
+		FROM t_user_message um
+		JOIN t_message m ON m.id = um.message_id
+		WHERE
+			um.org_id = ?
+			AND um.user_id IN (` + strings.Join(userPlaceholders, ",") + `)
+			AND um.push_status IN (` + strings.Join(statusPlaceholders, ",") + `)
+			AND um.created_at >= ? AND um.created_at < ?
+			AND um.attempts < ?
+			AND (um.lease_until IS NULL OR um.lease_until < NOW())
+			AND m.deliver_at <= UNIX_TIMESTAMP()
+		ORDER BY um.id ASC
+		LIMIT ?
+	`
+	rows, err := m.db.QueryContext(ctx, strSQL, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		tmp := &interfaces.DBUserMessage{}
+		err = rows.Scan(&tmp.ID, &tmp.UserID, &tmp.MessageID, &tmp.PushStatus, &tmp.Attempts)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, tmp)
+	}
+
+	return
+}
+
+func (m *dbMessage) ClaimRedelivery(ctx context.Context, id int64, leaseUntil time.Time) (bool, error) {
 	strSQL := `
 		UPDATE t_user_message
-		SET 
-			push_status = ?
-		WHERE 
-			user_id = ? AND message_id = ?
+		SET
+			lease_until = ?, push_status = ?, attempts = attempts + 1
+		WHERE
+			id = ? AND (lease_until IS NULL OR lease_until < NOW())
 	`
-	_, err = m.db.ExecContext(ctx, strSQL, status, userID, msgID)
+	result, err := m.db.ExecContext(ctx, strSQL, leaseUntil, interfaces.MessagePushStatusSending, id)
 	if err != nil {
-		return
+		return false, err
 	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected == 1, nil
+}
+
+func (m *dbMessage) AbandonExhausted(ctx context.Context, tenantID string, userIDs []string, statuses []interfaces.MessagePushStatus, maxAttempts, limit int) (out []*interfaces.DBUserMessage, err error) {
+	if len(userIDs) == 0 || len(statuses) == 0 {
+		return nil, nil
+	}
+
+	userPlaceholders := make([]string, 0, len(userIDs))
+	statusPlaceholders := make([]string, 0, len(statuses))
+	statusArgs := make([]interface{}, 0, len(statuses))
+	args := make([]interface{}, 0, len(userIDs)+len(statuses)+3)
+	args = append(args, tenantID)
+	for _, userID := range userIDs {
+		userPlaceholders = append(userPlaceholders, "?")
+		args = append(args, userID)
+	}
+	for _, status := range statuses {
+		statusPlaceholders = append(statusPlaceholders, "?")
+		statusArgs = append(statusArgs, status)
+	}
+	args = append(args, statusArgs...)
+	args = append(args, maxAttempts, limit)
+
+	// 租约未过期的记录可能仍在进行最后一次补偿, 等租约过期后再判断
+	strSQL := `
+		SELECT um.id, um.user_id, um.message_id, um.push_status, um.attempts
+		FROM t_user_message um
+		WHERE
+			um.org_id = ?
+			AND um.user_id IN (` + strings.Join(userPlaceholders, ",") + `)
+			AND um.push_status IN (` + strings.Join(statusPlaceholders, ",") + `)
+			AND um.attempts >= ?
+			AND (um.lease_until IS NULL OR um.lease_until < NOW())
+		ORDER BY um.id ASC
+		LIMIT ?
+	`
+	rows, err := m.db.QueryContext(ctx, strSQL, args...)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []*interfaces.DBUserMessage
+	for rows.Next() {
+		tmp := &interfaces.DBUserMessage{}
+		err = rows.Scan(&tmp.ID, &tmp.UserID, &tmp.MessageID, &tmp.PushStatus, &tmp.Attempts)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		candidates = append(candidates, tmp)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// 多个实例可能同时扫描到同一条记录, 按状态条件更新, 只有更新成功的实例返回该记录
+	strSQL = `
+		UPDATE t_user_message
+		SET push_status = ?
+		WHERE id = ? AND push_status IN (` + strings.Join(statusPlaceholders, ",") + `) AND (lease_until IS NULL OR lease_until < NOW())
+	`
+	for _, candidate := range candidates {
+		result, err := m.db.ExecContext(ctx, strSQL, append([]interface{}{interfaces.MessagePushStatusAbandoned, candidate.ID}, statusArgs...)...)
+		if err != nil {
+			return out, err
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return out, err
+		}
+		if affected == 1 {
+			out = append(out, candidate)
+		}
+	}
+	return out, nil
+}
+
+func (m *dbMessage) Recall(ctx context.Context, messageID string, event *interfaces.DBMessage) (userIDs []string, err error) {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+
+		cErr := tx.Commit()
+		if cErr != nil {
+			err = cErr
+			return
+		}
+	}()
+
+	var recalledAt int64
+	err = tx.QueryRowContext(ctx, "SELECT recalled_at FROM t_message WHERE id = ? FOR UPDATE", messageID).Scan(&recalledAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = fmt.Errorf("%w, messageID: %s", interfaces.ErrRecordNotFound, messageID)
+		}
+		return nil, err
+	}
+	if recalledAt > 0 {
+		return nil, interfaces.ErrMessageRecalled
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE t_message SET recalled_at = UNIX_TIMESTAMP() WHERE id = ?", messageID)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE t_user_message SET push_status = ? WHERE message_id = ? AND push_status IN (?, ?)",
+		interfaces.MessagePushStatusRecalled, messageID, interfaces.MessagePushStatusUnhandled, interfaces.MessagePushStatusFailed)
+	if err != nil {
+		return nil, err
+	}
+
+	userIDs, err = m.saveRevisionEvent(ctx, tx, messageID, event)
+	return
+}
+
+func (m *dbMessage) Edit(ctx context.Context, messageID, editorID, content string, event *interfaces.DBMessage) (userIDs []string, err error) {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+
+		cErr := tx.Commit()
+		if cErr != nil {
+			err = cErr
+			return
+		}
+	}()
+
+	var previous, previousKeyID string
+	var recalledAt int64
+	err = tx.QueryRowContext(ctx, "SELECT content, key_id, recalled_at FROM t_message WHERE id = ? FOR UPDATE", messageID).Scan(&previous, &previousKeyID, &recalledAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = fmt.Errorf("%w, messageID: %s", interfaces.ErrRecordNotFound, messageID)
+		}
+		return nil, err
+	}
+	if recalledAt > 0 {
+		return nil, interfaces.ErrMessageRecalled
+	}
+
+	// 编辑前的内容连同数据密钥ID原样保存
+	_, err = tx.ExecContext(ctx, "INSERT INTO t_message_edit (message_id, content, key_id, editor_id) VALUES (?, ?, ?, ?)", messageID, previous, previousKeyID, editorID)
+	if err != nil {
+		return nil, err
+	}
+	content, keyID, err := m.contentCipher.Encrypt(content, messageID)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE t_message SET content = ?, key_id = ?, edited_at = UNIX_TIMESTAMP() WHERE id = ?", content, keyID, messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	userIDs, err = m.saveRevisionEvent(ctx, tx, messageID, event)
 	return
 }
+
+// saveRevisionEvent 保存撤回/编辑事件, 接收者为已推送或正在推送该消息的用户; 尚未推送的用户之后收到的是撤回/编辑后的结果
+// 广播类消息的事件同样只发给已收到原消息的用户, 推送记录属于各接收用户所在的租户
+func (m *dbMessage) saveRevisionEvent(ctx context.Context, tx *sql.Tx, messageID string, event *interfaces.DBMessage) (userIDs []string, err error) {
+	rows, err := tx.QueryContext(ctx, "SELECT org_id, user_id FROM t_user_message WHERE message_id = ? AND push_status IN (?, ?, ?)",
+		messageID, interfaces.MessagePushStatusSending, interfaces.MessagePushStatusSuccess, interfaces.MessagePushStatusAcked)
+	if err != nil {
+		return nil, err
+	}
+	var recipients []userSeqKey
+	for rows.Next() {
+		var recipient userSeqKey
+		err = rows.Scan(&recipient.orgID, &recipient.userID)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		recipients = append(recipients, recipient)
+		userIDs = append(userIDs, recipient.userID)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(recipients) == 0 {
+		return nil, nil
+	}
+	err = m.insertMessage(ctx, tx, event, recipients)
+	if err != nil {
+		return nil, err
+	}
+	return userIDs, nil
+}
+
+func (m *dbMessage) GetEdits(ctx context.Context, messageID string) (out []*interfaces.DBMessageEdit, err error) {
+	rows, err := m.db.QueryContext(ctx, "SELECT message_id, content, key_id, editor_id, created_at FROM t_message_edit WHERE message_id = ? ORDER BY id ASC", messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		tmp := &interfaces.DBMessageEdit{}
+		err = rows.Scan(&tmp.MessageID, &tmp.Content, &tmp.KeyID, &tmp.EditorID, &tmp.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, tmp)
+	}
+
+	return
+}
+
+func (m *dbMessage) HasChatted(ctx context.Context, tenantID, userID, peerID string) (bool, error) {
+	strSQL := `
+		SELECT 1
+		FROM t_message m
+		JOIN t_user_message um ON um.message_id = m.id
+		WHERE m.org_id = ? AND m.sender_id = ? AND m.type = ? AND um.org_id = ? AND um.user_id = ?
+		LIMIT 1
+	`
+	// 分别按两个方向查询, 均可使用 idx_org_id_sender_id
+	for _, pair := range [][2]string{{userID, peerID}, {peerID, userID}} {
+		var one int
+		err := m.db.QueryRowContext(ctx, strSQL, tenantID, pair[0], interfaces.MessageTypeChatRoom, tenantID, pair[1]).Scan(&one)
+		if err == nil {
+			return true, nil
+		}
+		if err != sql.ErrNoRows {
+			return false, err
+		}
+	}
+	return false, nil
+}
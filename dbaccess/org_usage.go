@@ -0,0 +1,57 @@
+package dbaccess
+
+import (
+	"MessagePushService/interfaces"
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+var (
+	dbOrgUsageOnce     sync.Once
+	dbOrgUsageInstance *dbOrgUsage
+)
+
+type dbOrgUsage struct {
+	db *sql.DB
+}
+
+func NewDBOrgUsage(db *sql.DB) interfaces.IDBOrgUsage {
+	dbOrgUsageOnce.Do(func() {
+		dbOrgUsageInstance = &dbOrgUsage{db: db}
+	})
+
+	return dbOrgUsageInstance
+}
+
+func (u *dbOrgUsage) AddMessages(ctx context.Context, orgID string, day time.Time, delta, limit int64) (bool, error) {
+	// 超过上限时保持原值, 此时影响行数为 0; 多实例并发时由行锁保证不会超发
+	strSQL := `
+		INSERT INTO t_org_usage
+			(org_id, day, messages)
+		VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE
+			messages = IF(? = 0 OR messages + VALUES(messages) <= ?, GREATEST(messages + VALUES(messages), 0), messages)
+	`
+	if limit > 0 && delta > limit {
+		return false, nil
+	}
+	result, err := u.db.ExecContext(ctx, strSQL, orgID, day.UTC().Format("2006-01-02"), delta, limit, limit)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (u *dbOrgUsage) GetMessages(ctx context.Context, orgID string, day time.Time) (messages int64, err error) {
+	err = u.db.QueryRowContext(ctx, "SELECT messages FROM t_org_usage WHERE org_id = ? AND day = ?", orgID, day.UTC().Format("2006-01-02")).Scan(&messages)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return
+}
@@ -0,0 +1,76 @@
+package dbaccess
+
+import (
+	"MessagePushService/interfaces"
+	"context"
+	"database/sql"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	dbPresenceOnce     sync.Once
+	dbPresenceInstance *dbPresence
+)
+
+type dbPresence struct {
+	db *sql.DB
+}
+
+func NewDBPresence(db *sql.DB) interfaces.IDBPresence {
+	dbPresenceOnce.Do(func() {
+		dbPresenceInstance = &dbPresence{db: db}
+	})
+
+	return dbPresenceInstance
+}
+
+func (p *dbPresence) UpsertLastSeen(ctx context.Context, tenantID, userID string, lastSeen time.Time) (err error) {
+	strSQL := `
+		INSERT INTO t_user_presence
+			(org_id, user_id, last_seen_at)
+		VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE
+			last_seen_at = VALUES(last_seen_at)
+	`
+	_, err = p.db.ExecContext(ctx, strSQL, tenantID, userID, lastSeen)
+	if err != nil {
+		return
+	}
+	return
+}
+
+func (p *dbPresence) GetLastSeen(ctx context.Context, tenantID string, userIDs []string) (out map[string]time.Time, err error) {
+	out = make(map[string]time.Time, len(userIDs))
+	if len(userIDs) == 0 {
+		return
+	}
+
+	placeholders := make([]string, 0, len(userIDs))
+	args := make([]interface{}, 0, len(userIDs)+1)
+	args = append(args, tenantID)
+	for _, userID := range userIDs {
+		placeholders = append(placeholders, "?")
+		args = append(args, userID)
+	}
+	strSQL := `SELECT user_id, last_seen_at FROM t_user_presence WHERE org_id = ? AND user_id IN (` + strings.Join(placeholders, ",") + `)`
+
+	rows, err := p.db.QueryContext(ctx, strSQL, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userID string
+		var lastSeen time.Time
+		err = rows.Scan(&userID, &lastSeen)
+		if err != nil {
+			return nil, err
+		}
+		out[userID] = lastSeen
+	}
+
+	return
+}
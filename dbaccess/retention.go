@@ -0,0 +1,204 @@
+package dbaccess
+
+import (
+	"MessagePushService/interfaces"
+	"context"
+	"database/sql"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	dbRetentionOnce     sync.Once
+	dbRetentionInstance *dbRetention
+)
+
+type dbRetention struct {
+	db *sql.DB
+}
+
+func NewDBRetention(db *sql.DB) interfaces.IDBRetention {
+	dbRetentionOnce.Do(func() {
+		dbRetentionInstance = &dbRetention{db: db}
+	})
+
+	return dbRetentionInstance
+}
+
+// expiredMessageCond 可按保留时间清理的消息: 已到投递时间, 定时消息已分派(撤回的除外), 且没有仍在等待推送的推送记录
+// 等待推送的推送记录由 retention.undelivered 清理后, 消息才会被清理
+func expiredMessageCond(pending []interfaces.MessagePushStatus) (string, []interface{}) {
+	statusPlaceholders, args := inPlaceholders(pending)
+	return `
+			m.type = ? AND m.created_at < ?
+			AND m.deliver_at <= UNIX_TIMESTAMP()
+			AND (m.deliver_at = 0 OR m.scheduled_dispatched = 1 OR m.recalled_at > 0)
+			AND NOT EXISTS (
+				SELECT 1 FROM t_user_message p WHERE p.message_id = m.id AND p.push_status IN (` + statusPlaceholders + `)
+			)
+	`, args
+}
+
+func (r *dbRetention) GetMessageIDsBefore(ctx context.Context, messageType int, before time.Time, pending []interfaces.MessagePushStatus, limit int) (out []string, err error) {
+	cond, statusArgs := expiredMessageCond(pending)
+	args := append([]interface{}{messageType, before}, statusArgs...)
+	args = append(args, limit)
+	strSQL := `
+		SELECT m.id FROM t_message m
+		WHERE ` + cond + `
+		ORDER BY m.created_at ASC
+		LIMIT ?
+	`
+	rows, err := r.db.QueryContext(ctx, strSQL, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, id)
+	}
+
+	return
+}
+
+func (r *dbRetention) CountMessagesBefore(ctx context.Context, messageType int, before time.Time, pending []interfaces.MessagePushStatus) (messages, records int64, err error) {
+	cond, statusArgs := expiredMessageCond(pending)
+	args := append([]interface{}{messageType, before}, statusArgs...)
+	err = r.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM t_message m WHERE "+cond, args...).Scan(&messages)
+	if err != nil {
+		return
+	}
+
+	strSQL := `
+		SELECT COUNT(*) FROM t_user_message um
+		JOIN t_message m ON m.id = um.message_id
+		WHERE ` + cond
+	err = r.db.QueryRowContext(ctx, strSQL, args...).Scan(&records)
+	return
+}
+
+func (r *dbRetention) DeleteUserMessages(ctx context.Context, messageIDs []string, limit int) (int64, error) {
+	if len(messageIDs) == 0 {
+		return 0, nil
+	}
+
+	placeholders, args := inPlaceholders(messageIDs)
+	args = append(args, limit)
+	result, err := r.db.ExecContext(ctx, "DELETE FROM t_user_message WHERE message_id IN ("+placeholders+") LIMIT ?", args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (r *dbRetention) DeleteMessages(ctx context.Context, messageIDs []string) (affected int64, err error) {
+	if len(messageIDs) == 0 {
+		return 0, nil
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+
+		cErr := tx.Commit()
+		if cErr != nil {
+			err = cErr
+			return
+		}
+	}()
+
+	return deleteMessagesTx(ctx, tx, messageIDs)
+}
+
+func (r *dbRetention) DeleteUserMessagesByStatus(ctx context.Context, statuses []interfaces.MessagePushStatus, before time.Time, limit int) (int64, error) {
+	if len(statuses) == 0 {
+		return 0, nil
+	}
+
+	// 先按主键选出一批再删除, 多表 DELETE 不支持 LIMIT; 未到定时投递时间的消息不清理
+	statusPlaceholders, args := inPlaceholders(statuses)
+	args = append(args, before, limit)
+	strSQL := `
+		SELECT um.id FROM t_user_message um
+		JOIN t_message m ON m.id = um.message_id
+		WHERE
+			um.push_status IN (` + statusPlaceholders + `)
+			AND um.created_at < ?
+			AND m.deliver_at <= UNIX_TIMESTAMP()
+		ORDER BY um.id ASC
+		LIMIT ?
+	`
+	rows, err := r.db.QueryContext(ctx, strSQL, args...)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		err = rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	// 选出后状态可能已变为推送成功, 删除时再次校验状态
+	idPlaceholders, idArgs := inPlaceholders(ids)
+	_, statusArgs := inPlaceholders(statuses)
+	result, err := r.db.ExecContext(ctx, "DELETE FROM t_user_message WHERE id IN ("+idPlaceholders+") AND push_status IN ("+statusPlaceholders+")", append(idArgs, statusArgs...)...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (r *dbRetention) CountUserMessagesByStatus(ctx context.Context, statuses []interfaces.MessagePushStatus, before time.Time) (count int64, err error) {
+	if len(statuses) == 0 {
+		return 0, nil
+	}
+
+	statusPlaceholders, args := inPlaceholders(statuses)
+	args = append(args, before)
+	strSQL := `
+		SELECT COUNT(*) FROM t_user_message um
+		JOIN t_message m ON m.id = um.message_id
+		WHERE
+			um.push_status IN (` + statusPlaceholders + `)
+			AND um.created_at < ?
+			AND m.deliver_at <= UNIX_TIMESTAMP()
+	`
+	err = r.db.QueryRowContext(ctx, strSQL, args...).Scan(&count)
+	return
+}
+
+// inPlaceholders 生成 IN 子句的占位符与参数
+func inPlaceholders[T any](values []T) (string, []interface{}) {
+	placeholders := make([]string, 0, len(values))
+	args := make([]interface{}, 0, len(values))
+	for _, v := range values {
+		placeholders = append(placeholders, "?")
+		args = append(args, v)
+	}
+	return strings.Join(placeholders, ","), args
+}
@@ -0,0 +1,368 @@
+package dbaccess
+
+import (
+	"MessagePushService/interfaces"
+	"context"
+	"database/sql"
+	"sync"
+)
+
+var (
+	dbUserDataOnce     sync.Once
+	dbUserDataInstance *dbUserData
+)
+
+type dbUserData struct {
+	db            *sql.DB
+	contentCipher interfaces.ILogicsContentCipher
+}
+
+// NewDBUserData contentCipher 用于加密清除后的聊天消息内容
+func NewDBUserData(db *sql.DB, contentCipher interfaces.ILogicsContentCipher) interfaces.IDBUserData {
+	dbUserDataOnce.Do(func() {
+		dbUserDataInstance = &dbUserData{db: db, contentCipher: contentCipher}
+	})
+
+	return dbUserDataInstance
+}
+
+func (u *dbUserData) GetInbox(ctx context.Context, tenantID, userID string, afterID int64, limit int) (out []*interfaces.DBInboxRecord, err error) {
+	strSQL := `
+		SELECT um.id, um.push_status, um.read_at IS NOT NULL, um.created_at, ` + messageColumns + `, um.seq
+		FROM t_user_message um
+		JOIN t_message m ON m.id = um.message_id
+		WHERE um.org_id = ? AND um.user_id = ? AND um.id > ?
+		ORDER BY um.id ASC
+		LIMIT ?
+	`
+	rows, err := u.db.QueryContext(ctx, strSQL, tenantID, userID, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		tmp := &interfaces.DBInboxRecord{Message: &interfaces.DBMessage{}}
+		m := tmp.Message
+		err = rows.Scan(&tmp.ID, &tmp.PushStatus, &tmp.Read, &tmp.CreatedAt,
+			&m.ID, &m.OrgID, &m.Type, &m.Content, &m.KeyID, &m.Timestamp, &m.AudienceType, &m.AudienceID, &m.SenderID, &m.RoomID, &m.Topic, &m.CallbackURL, &m.DeliverAt, &m.ExpiresAt, &m.Priority, &m.RecalledAt, &m.EditedAt, &m.CreatedAt, &m.UpdatedAt, &m.Seq)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, tmp)
+	}
+
+	return
+}
+
+// authoredTypes 用户发送的消息: 聊天消息, 以及用户撤回/编辑聊天消息时产生的事件(编辑事件带有编辑后的内容)
+var authoredTypes = []interfaces.MessageType{interfaces.MessageTypeChatRoom, interfaces.MessageTypeEdit, interfaces.MessageTypeRecall}
+
+func (u *dbUserData) GetAuthored(ctx context.Context, tenantID, userID, afterID string, limit int) (out []*interfaces.DBMessage, err error) {
+	typePlaceholders, typeArgs := inPlaceholders(authoredTypes)
+	strSQL := `
+		SELECT ` + messageColumns + `
+		FROM t_message m
+		WHERE m.org_id = ? AND m.sender_id = ? AND m.type IN (` + typePlaceholders + `) AND m.id > ?
+		ORDER BY m.id ASC
+		LIMIT ?
+	`
+	args := append([]interface{}{tenantID, userID}, typeArgs...)
+	rows, err := u.db.QueryContext(ctx, strSQL, append(args, afterID, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		tmp, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, tmp)
+	}
+
+	return
+}
+
+func (u *dbUserData) GetEditsByEditor(ctx context.Context, tenantID, userID string) (out []*interfaces.DBMessageEdit, err error) {
+	strSQL := `
+		SELECT e.message_id, e.content, e.key_id, e.editor_id, e.created_at
+		FROM t_message_edit e
+		JOIN t_message m ON m.id = e.message_id
+		WHERE m.org_id = ? AND e.editor_id = ?
+		ORDER BY e.id ASC
+	`
+	rows, err := u.db.QueryContext(ctx, strSQL, tenantID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		tmp := &interfaces.DBMessageEdit{}
+		err = rows.Scan(&tmp.MessageID, &tmp.Content, &tmp.KeyID, &tmp.EditorID, &tmp.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, tmp)
+	}
+
+	return
+}
+
+func (u *dbUserData) DeleteInbox(ctx context.Context, tenantID, userID string, limit int) (records, messages int64, err error) {
+	tx, err := u.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+
+		cErr := tx.Commit()
+		if cErr != nil {
+			err = cErr
+			return
+		}
+	}()
+
+	rows, err := tx.QueryContext(ctx, "SELECT id, message_id FROM t_user_message WHERE org_id = ? AND user_id = ? ORDER BY id ASC LIMIT ? FOR UPDATE", tenantID, userID, limit)
+	if err != nil {
+		return 0, 0, err
+	}
+	var ids []int64
+	var messageIDs []string
+	for rows.Next() {
+		var id int64
+		var messageID string
+		err = rows.Scan(&id, &messageID)
+		if err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		ids = append(ids, id)
+		messageIDs = append(messageIDs, messageID)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, 0, err
+	}
+	if len(ids) == 0 {
+		return 0, 0, nil
+	}
+
+	idPlaceholders, idArgs := inPlaceholders(ids)
+	result, err := tx.ExecContext(ctx, "DELETE FROM t_user_message WHERE id IN ("+idPlaceholders+")", idArgs...)
+	if err != nil {
+		return 0, 0, err
+	}
+	records, err = result.RowsAffected()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// 指定用户的消息没有任何接收者后不再可见, 连同编辑历史一起删除; 广播类消息的推送记录在投递时生成, 不删除
+	messagePlaceholders, messageArgs := inPlaceholders(messageIDs)
+	orphanSQL := `
+		SELECT m.id FROM t_message m
+		WHERE m.id IN (` + messagePlaceholders + `) AND m.audience_type = ?
+			AND NOT EXISTS (SELECT 1 FROM t_user_message um WHERE um.message_id = m.id)
+	`
+	rows, err = tx.QueryContext(ctx, orphanSQL, append(messageArgs, interfaces.AudienceTypeUsers)...)
+	if err != nil {
+		return 0, 0, err
+	}
+	var orphans []string
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		orphans = append(orphans, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, 0, err
+	}
+	if len(orphans) == 0 {
+		return records, 0, nil
+	}
+
+	messages, err = deleteMessagesTx(ctx, tx, orphans)
+	return records, messages, err
+}
+
+func (u *dbUserData) ScrubAuthored(ctx context.Context, tenantID, userID, content string, limit int) (affected int64, err error) {
+	tx, err := u.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+
+		cErr := tx.Commit()
+		if cErr != nil {
+			err = cErr
+			return
+		}
+	}()
+
+	ids, err := selectAuthoredTx(ctx, tx, tenantID, userID, limit)
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+
+	placeholders, args := inPlaceholders(ids)
+	_, err = tx.ExecContext(ctx, "DELETE FROM t_message_edit WHERE message_id IN ("+placeholders+")", args...)
+	if err != nil {
+		return 0, err
+	}
+	// 清除发送者后下一批不会再选中这些消息; 密文绑定消息ID, 逐条加密
+	stmt, err := tx.PrepareContext(ctx, "UPDATE t_message SET content = ?, key_id = ?, sender_id = '', edited_at = 0 WHERE id = ?")
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	for _, id := range ids {
+		var encrypted, keyID string
+		encrypted, keyID, err = u.contentCipher.Encrypt(content, id)
+		if err != nil {
+			return 0, err
+		}
+		var result sql.Result
+		result, err = stmt.ExecContext(ctx, encrypted, keyID, id)
+		if err != nil {
+			return 0, err
+		}
+		var n int64
+		n, err = result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		affected += n
+	}
+	return affected, nil
+}
+
+func (u *dbUserData) DeleteAuthored(ctx context.Context, tenantID, userID string, limit int) (messages, records int64, err error) {
+	tx, err := u.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+
+		cErr := tx.Commit()
+		if cErr != nil {
+			err = cErr
+			return
+		}
+	}()
+
+	ids, err := selectAuthoredTx(ctx, tx, tenantID, userID, limit)
+	if err != nil || len(ids) == 0 {
+		return 0, 0, err
+	}
+
+	placeholders, args := inPlaceholders(ids)
+	result, err := tx.ExecContext(ctx, "DELETE FROM t_user_message WHERE message_id IN ("+placeholders+")", args...)
+	if err != nil {
+		return 0, 0, err
+	}
+	records, err = result.RowsAffected()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	messages, err = deleteMessagesTx(ctx, tx, ids)
+	return messages, records, err
+}
+
+func (u *dbUserData) DeleteUserState(ctx context.Context, tenantID, userID string) (affected int64, err error) {
+	tx, err := u.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+
+		cErr := tx.Commit()
+		if cErr != nil {
+			err = cErr
+			return
+		}
+	}()
+
+	// 编辑记录按所属消息的租户限定; 降级通知与回调记录保存接收用户的租户, 跨组织广播的记录也能删除
+	for _, strSQL := range []string{
+		"DELETE e FROM t_message_edit e JOIN t_message m ON m.id = e.message_id WHERE m.org_id = ? AND e.editor_id = ?",
+		"DELETE FROM t_user_seq WHERE org_id = ? AND user_id = ?",
+		"DELETE FROM t_user_presence WHERE org_id = ? AND user_id = ?",
+		"DELETE FROM t_fallback_attempt WHERE org_id = ? AND user_id = ?",
+		"DELETE FROM t_callback_outbox WHERE org_id = ? AND user_id = ?",
+	} {
+		var result sql.Result
+		result, err = tx.ExecContext(ctx, strSQL, tenantID, userID)
+		if err != nil {
+			return 0, err
+		}
+		var n int64
+		n, err = result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		affected += n
+	}
+
+	return affected, nil
+}
+
+// selectAuthoredTx 锁定租户内用户发送的一批聊天消息及撤回/编辑事件
+func selectAuthoredTx(ctx context.Context, tx *sql.Tx, tenantID, userID string, limit int) (ids []string, err error) {
+	typePlaceholders, typeArgs := inPlaceholders(authoredTypes)
+	args := append([]interface{}{tenantID, userID}, typeArgs...)
+	rows, err := tx.QueryContext(ctx, "SELECT id FROM t_message WHERE org_id = ? AND sender_id = ? AND type IN ("+typePlaceholders+") LIMIT ? FOR UPDATE", append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// deleteMessagesTx 删除消息及其编辑历史
+func deleteMessagesTx(ctx context.Context, tx *sql.Tx, messageIDs []string) (int64, error) {
+	placeholders, args := inPlaceholders(messageIDs)
+	_, err := tx.ExecContext(ctx, "DELETE FROM t_message_edit WHERE message_id IN ("+placeholders+")", args...)
+	if err != nil {
+		return 0, err
+	}
+	result, err := tx.ExecContext(ctx, "DELETE FROM t_message WHERE id IN ("+placeholders+")", args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,50 @@
+package drivenadapters
+
+import (
+	"MessagePushService/common"
+	"MessagePushService/interfaces"
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	FallbackChannelWebhook = "webhook"
+	FallbackChannelEmail   = "email"
+	FallbackChannelMobile  = "mobile"
+)
+
+// NewFallbackChannels 根据配置创建降级通知通道, 未配置的通道不创建
+func NewFallbackChannels(config *common.Config, client common.HTTPClient) (channels []interfaces.IDrivenFallbackChannel) {
+	if config.Fallback == nil {
+		return
+	}
+	if config.Fallback.Webhook != nil && config.Fallback.Webhook.URL != "" {
+		channels = append(channels, NewWebhookChannel(config.Fallback.Webhook, client))
+	}
+	if config.Fallback.Email != nil && config.Fallback.Email.Addr != "" {
+		channels = append(channels, NewEmailChannel(config.Fallback.Email))
+	}
+	if config.Fallback.Mobile != nil && config.Fallback.Mobile.GatewayURL != "" {
+		channels = append(channels, NewMobileChannel(config.Fallback.Mobile, client))
+	}
+	return
+}
+
+// notificationText 从消息内容中提取通知标题与正文, 内容中没有 title/content 字段时使用整个内容
+func notificationText(message *interfaces.LogicsMessage) (title, text string) {
+	title = "您有一条新消息"
+	if content, ok := message.Content.(map[string]interface{}); ok {
+		if v, ok := content["title"].(string); ok && v != "" {
+			title = v
+		}
+		if v, ok := content["content"].(string); ok && v != "" {
+			return title, v
+		}
+	}
+
+	data, err := json.Marshal(message.Content)
+	if err != nil {
+		return title, fmt.Sprintf("%v", message.Content)
+	}
+	return title, string(data)
+}
@@ -0,0 +1,52 @@
+package drivenadapters
+
+import (
+	"MessagePushService/common"
+	"MessagePushService/interfaces"
+	"context"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+)
+
+type emailChannel struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func NewEmailChannel(config *common.EmailChannelConfig) interfaces.IDrivenFallbackChannel {
+	c := &emailChannel{
+		addr: config.Addr,
+		from: config.From,
+	}
+	if config.Username != "" {
+		host, _, _ := net.SplitHostPort(config.Addr)
+		c.auth = smtp.PlainAuth("", config.Username, config.Password, host)
+	}
+	return c
+}
+
+func (c *emailChannel) Name() string {
+	return FallbackChannelEmail
+}
+
+func (c *emailChannel) Send(ctx context.Context, contact *interfaces.UserContact, message *interfaces.LogicsMessage) error {
+	if contact.Email == "" {
+		return fmt.Errorf("user %s has no email", contact.UserID)
+	}
+
+	title, text := notificationText(message)
+	var b strings.Builder
+	b.WriteString("From: " + c.from + "\r\n")
+	b.WriteString("To: " + contact.Email + "\r\n")
+	b.WriteString("Subject: " + mime.BEncoding.Encode("UTF-8", title) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(text)
+
+	return smtp.SendMail(c.addr, c.auth, c.from, []string{contact.Email}, []byte(b.String()))
+}
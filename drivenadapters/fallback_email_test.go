@@ -0,0 +1,129 @@
+package drivenadapters
+
+import (
+	"MessagePushService/common"
+	"MessagePushService/interfaces"
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+// smtpStub 只实现发送一封邮件所需的命令, 记录收到的信封与邮件内容
+type smtpStub struct {
+	listener net.Listener
+	done     chan struct{}
+
+	from string
+	to   []string
+	data string
+}
+
+func newSMTPStub(t *testing.T) *smtpStub {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	s := &smtpStub{listener: listener, done: make(chan struct{})}
+	go s.serve()
+	return s
+}
+
+func (s *smtpStub) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *smtpStub) Close() {
+	s.listener.Close()
+}
+
+func (s *smtpStub) serve() {
+	defer close(s.done)
+	conn, err := s.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(line string) {
+		conn.Write([]byte(line + "\r\n"))
+	}
+	reply("220 stub ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 stub")
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			s.from = strings.Trim(line[len("MAIL FROM:"):], "<>")
+			reply("250 OK")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			s.to = append(s.to, strings.Trim(line[len("RCPT TO:"):], "<>"))
+			reply("250 OK")
+		case cmd == "DATA":
+			reply("354 end with .")
+			var b strings.Builder
+			for {
+				dataLine, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if dataLine == ".\r\n" {
+					break
+				}
+				b.WriteString(dataLine)
+			}
+			s.data = b.String()
+			reply("250 OK")
+		case cmd == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func TestEmailChannelSend(t *testing.T) {
+	stub := newSMTPStub(t)
+	defer stub.Close()
+
+	channel := NewEmailChannel(&common.EmailChannelConfig{Addr: stub.Addr(), From: "noreply@example.com"})
+	message := &interfaces.LogicsMessage{
+		ID:      "m1",
+		Content: map[string]interface{}{"title": "新消息", "content": "you have a new message"},
+	}
+	err := channel.Send(context.Background(), &interfaces.UserContact{UserID: "u1", Email: "u1@example.com"}, message)
+	if err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	<-stub.done
+
+	if stub.from != "noreply@example.com" {
+		t.Errorf("MAIL FROM = %q", stub.from)
+	}
+	if len(stub.to) != 1 || stub.to[0] != "u1@example.com" {
+		t.Errorf("RCPT TO = %v", stub.to)
+	}
+	if !strings.Contains(stub.data, "To: u1@example.com\r\n") || !strings.Contains(stub.data, "you have a new message") {
+		t.Errorf("data = %q", stub.data)
+	}
+	if !strings.Contains(stub.data, "Subject: =?UTF-8?b?") {
+		t.Errorf("subject is not encoded, data = %q", stub.data)
+	}
+}
+
+func TestEmailChannelSendWithoutEmail(t *testing.T) {
+	channel := NewEmailChannel(&common.EmailChannelConfig{Addr: "127.0.0.1:0", From: "noreply@example.com"})
+	err := channel.Send(context.Background(), &interfaces.UserContact{UserID: "u1"}, &interfaces.LogicsMessage{ID: "m1"})
+	if err == nil {
+		t.Fatal("Send() error = nil, want error for user without email")
+	}
+}
@@ -0,0 +1,55 @@
+package drivenadapters
+
+import (
+	"MessagePushService/common"
+	"MessagePushService/interfaces"
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// mobileChannel 通过移动推送网关(APNs/FCM/厂商通道的统一代理)发送通知
+type mobileChannel struct {
+	gatewayURL string
+	apiKey     string
+	client     common.HTTPClient
+}
+
+func NewMobileChannel(config *common.MobileChannelConfig, client common.HTTPClient) interfaces.IDrivenFallbackChannel {
+	return &mobileChannel{
+		gatewayURL: config.GatewayURL,
+		apiKey:     config.APIKey,
+		client:     client,
+	}
+}
+
+func (c *mobileChannel) Name() string {
+	return FallbackChannelMobile
+}
+
+func (c *mobileChannel) Send(ctx context.Context, contact *interfaces.UserContact, message *interfaces.LogicsMessage) error {
+	if len(contact.DeviceTokens) == 0 {
+		return fmt.Errorf("user %s has no device token", contact.UserID)
+	}
+
+	title, text := notificationText(message)
+	body, err := json.Marshal(map[string]interface{}{
+		"tokens": contact.DeviceTokens,
+		"title":  title,
+		"body":   text,
+		"data": map[string]interface{}{
+			"message_id": message.ID,
+			"type":       message.Type,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	header := map[string]interface{}{}
+	if c.apiKey != "" {
+		header["Authorization"] = "Bearer " + c.apiKey
+	}
+	_, _, err = c.client.POSTRaw(ctx, c.gatewayURL, header, body)
+	return err
+}
@@ -0,0 +1,41 @@
+package drivenadapters
+
+import (
+	"MessagePushService/common"
+	"MessagePushService/interfaces"
+	"context"
+	"encoding/json"
+)
+
+type webhookChannel struct {
+	url    string
+	client common.HTTPClient
+}
+
+func NewWebhookChannel(config *common.WebhookChannelConfig, client common.HTTPClient) interfaces.IDrivenFallbackChannel {
+	return &webhookChannel{
+		url:    config.URL,
+		client: client,
+	}
+}
+
+func (c *webhookChannel) Name() string {
+	return FallbackChannelWebhook
+}
+
+func (c *webhookChannel) Send(ctx context.Context, contact *interfaces.UserContact, message *interfaces.LogicsMessage) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"user_id":    contact.UserID,
+		"message_id": message.ID,
+		"type":       message.Type,
+		"topic":      message.Topic,
+		"content":    message.Content,
+		"timestamp":  message.Timestamp,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, _, err = c.client.POSTRaw(ctx, c.url, nil, body)
+	return err
+}
@@ -0,0 +1,60 @@
+package drivenadapters
+
+import (
+	"MessagePushService/common"
+	"MessagePushService/interfaces"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWebhookChannelSend(t *testing.T) {
+	var got map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("method = %s, want POST", r.Method)
+		}
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Errorf("unmarshal body: %v", err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	channel := NewWebhookChannel(&common.WebhookChannelConfig{URL: server.URL}, common.NewHTTPClient())
+	message := &interfaces.LogicsMessage{
+		ID:        "m1",
+		Type:      interfaces.MessageTypeChatRoom,
+		Topic:     "core.users.notify",
+		Content:   map[string]interface{}{"title": "hello"},
+		Timestamp: 1700000000,
+	}
+	err := channel.Send(context.Background(), &interfaces.UserContact{UserID: "u1"}, message)
+	if err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+
+	if got["user_id"] != "u1" || got["message_id"] != "m1" || got["topic"] != "core.users.notify" {
+		t.Errorf("body = %v", got)
+	}
+	if content, _ := got["content"].(map[string]interface{}); content["title"] != "hello" {
+		t.Errorf("content = %v", got["content"])
+	}
+}
+
+func TestWebhookChannelSendError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	channel := NewWebhookChannel(&common.WebhookChannelConfig{URL: server.URL}, common.NewHTTPClient())
+	err := channel.Send(context.Background(), &interfaces.UserContact{UserID: "u1"}, &interfaces.LogicsMessage{ID: "m1"})
+	if err == nil {
+		t.Fatal("Send() error = nil, want error on 500")
+	}
+}
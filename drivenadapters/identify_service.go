@@ -3,6 +3,7 @@ package drivenadapters
 import (
 	"MessagePushService/common"
 	"MessagePushService/interfaces"
+	"context"
 	"fmt"
 
 	"github.com/gin-gonic/gin"
@@ -14,6 +15,15 @@ type identifyService struct {
 }
 
 func NewIdentifyService(config *common.Config, client common.HTTPClient) interfaces.IDrivenIdentifyService {
+	return newIdentifyService(config, client)
+}
+
+// NewUserContact 用户联系方式由身份认证服务提供
+func NewUserContact(config *common.Config, client common.HTTPClient) interfaces.IDrivenUserContact {
+	return newIdentifyService(config, client)
+}
+
+func newIdentifyService(config *common.Config, client common.HTTPClient) *identifyService {
 	return &identifyService{
 		addr:   config.ThirdService.IdentifyServiceAddr,
 		client: client,
@@ -37,3 +47,28 @@ func (s *identifyService) Instrospect(ctx *gin.Context) (userInfo *interfaces.Us
 
 	return
 }
+
+func (s *identifyService) GetContact(ctx context.Context, userID string) (contact *interfaces.UserContact, err error) {
+	url := fmt.Sprintf("%s/api/v1/identify-service/users/%s/contact", s.addr, userID)
+
+	_, resBody, err := s.client.GET(ctx, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	data, ok := resBody.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid contact response, userID: %s", userID)
+	}
+	contact = &interfaces.UserContact{UserID: userID}
+	contact.Email, _ = data["email"].(string)
+	contact.Phone, _ = data["phone"].(string)
+	if tokens, ok := data["device_tokens"].([]interface{}); ok {
+		for _, token := range tokens {
+			if t, ok := token.(string); ok && t != "" {
+				contact.DeviceTokens = append(contact.DeviceTokens, t)
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,136 @@
+package drivenadapters
+
+import (
+	"MessagePushService/common"
+	"MessagePushService/interfaces"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+const KeyProviderLocal = "local"
+
+// NewKeyProvider 根据配置创建主密钥提供方, 未配置加密时返回 nil
+func NewKeyProvider(config *common.Config) interfaces.IDrivenKeyProvider {
+	cfg := config.Encryption
+	if cfg == nil || cfg.KeyFile == "" {
+		return nil
+	}
+
+	switch cfg.Provider {
+	case "", KeyProviderLocal:
+		return NewLocalKeyProvider(cfg)
+	default:
+		log.Fatalf("invalid encryption provider %q", cfg.Provider)
+	}
+	return nil
+}
+
+var (
+	localKeyProviderOnce     sync.Once
+	localKeyProviderInstance *localKeyProvider
+)
+
+// localKeyProvider 主密钥保存在本地密钥文件中, 使用 AES-256-GCM 加密数据密钥
+// 轮换主密钥时在文件中追加新密钥并修改 masterKeyID, 旧密钥在全部内容重新加密前不能删除
+type localKeyProvider struct {
+	currentKeyID string
+	keys         map[string]cipher.AEAD
+}
+
+func NewLocalKeyProvider(cfg *common.EncryptionConfig) interfaces.IDrivenKeyProvider {
+	localKeyProviderOnce.Do(func() {
+		keys, err := loadKeyFile(cfg.KeyFile)
+		if err != nil {
+			log.Fatalf("Failed to load key file: %v", err)
+		}
+		if _, ok := keys[cfg.MasterKeyID]; !ok {
+			log.Fatalf("master key %q not found in key file %s", cfg.MasterKeyID, cfg.KeyFile)
+		}
+		localKeyProviderInstance = &localKeyProvider{
+			currentKeyID: cfg.MasterKeyID,
+			keys:         keys,
+		}
+	})
+
+	return localKeyProviderInstance
+}
+
+func (p *localKeyProvider) GenerateDataKey(ctx context.Context) (masterKeyID string, plaintext, wrapped []byte, err error) {
+	plaintext = make([]byte, 32)
+	_, err = rand.Read(plaintext)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	aead := p.keys[p.currentKeyID]
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	wrapped = aead.Seal(nonce, nonce, plaintext, []byte(p.currentKeyID))
+	return p.currentKeyID, plaintext, wrapped, nil
+}
+
+func (p *localKeyProvider) DecryptDataKey(ctx context.Context, masterKeyID string, wrapped []byte) ([]byte, error) {
+	aead, ok := p.keys[masterKeyID]
+	if !ok {
+		return nil, fmt.Errorf("master key %q not found", masterKeyID)
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errors.New("wrapped data key is too short")
+	}
+	nonce, ciphertext := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, []byte(masterKeyID))
+}
+
+func (p *localKeyProvider) CurrentKeyID() string {
+	return p.currentKeyID
+}
+
+// loadKeyFile 每行 "<主密钥ID>:<base64 编码的32字节密钥>", 忽略空行与 # 开头的注释
+func loadKeyFile(path string) (map[string]cipher.AEAD, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]cipher.AEAD)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		id, encoded, ok := strings.Cut(text, ":")
+		id = strings.TrimSpace(id)
+		if !ok || id == "" {
+			return nil, fmt.Errorf("invalid key at line %d", line)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("key %q must be 32 bytes encoded in base64", id)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		keys[id] = aead
+	}
+	return keys, scanner.Err()
+}
@@ -0,0 +1,49 @@
+package drivenadapters
+
+import (
+	"MessagePushService/common"
+	"MessagePushService/interfaces"
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	mqsdk "github.com/yyboo586/MQSDK"
+)
+
+var (
+	mqProducerOnce     sync.Once
+	mqProducerInstance *mqProducer
+)
+
+type mqProducer struct {
+	producer mqsdk.Producer
+}
+
+func NewMQProducer(config *common.Config) interfaces.IDrivenMQProducer {
+	mqConfig := &mqsdk.NSQConfig{
+		Type:      config.MQ.Type,
+		NSQDAddr:  config.MQ.NSQDAddr,
+		NSQLookup: []string{},
+	}
+	mqProducerOnce.Do(func() {
+		producer, err := mqsdk.NewFactory().NewProducer(mqConfig)
+		if err != nil {
+			log.Fatalf("Failed to create producer: %v", err)
+		}
+		mqProducerInstance = &mqProducer{
+			producer: producer,
+		}
+	})
+
+	return mqProducerInstance
+}
+
+func (p *mqProducer) Publish(ctx context.Context, topic string, body interface{}) error {
+	msg := &mqsdk.Message{
+		ID:        common.NewID(),
+		Timestamp: time.Now().Unix(),
+		Body:      body,
+	}
+	return p.producer.Publish(ctx, topic, msg)
+}
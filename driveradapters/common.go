@@ -1 +1,124 @@
 package driveradapters
+
+import (
+	"MessagePushService/common"
+	"MessagePushService/interfaces"
+	"fmt"
+	"net/http"
+)
+
+// parseMessageBody 解析 MQ 消息体与 HTTP 发布接口共用的消息格式, 消息ID、时间戳与 topic 由调用方填充
+func parseMessageBody(body map[string]interface{}) (message *interfaces.LogicsMessage, userIDs []string, err error) {
+	// audience 缺省为 users, 即推送给 user_ids 指定的用户集合
+	audience, _ := body["audience"].(string)
+	audienceType, ok := interfaces.ParseAudienceType(audience)
+	if !ok {
+		return nil, nil, fmt.Errorf("body.audience is invalid: %s", audience)
+	}
+
+	message = &interfaces.LogicsMessage{
+		Type:         interfaces.MessageTypeToUsers,
+		AudienceType: audienceType,
+	}
+	// org_id 可选, 启用多租户时为消息所属组织, audience 为 org 时同时为受众组织
+	message.OrgID, _ = body["org_id"].(string)
+	// callback_url 可选, 指定后该消息的投递状态事件回调到此地址, 否则使用 topic 的默认回调地址
+	message.CallbackURL, _ = body["callback_url"].(string)
+
+	// priority 可选(high/normal/low), 缺省使用 topic 配置的优先级
+	priority, _ := body["priority"].(string)
+	message.Priority, ok = interfaces.ParseMessagePriority(priority)
+	if !ok {
+		return nil, nil, fmt.Errorf("body.priority is invalid: %s", priority)
+	}
+
+	// deliver_at/expires_at 可选, unix秒
+	if message.DeliverAt, err = parseUnixTime(body, "deliver_at"); err != nil {
+		return nil, nil, err
+	}
+	if message.ExpiresAt, err = parseUnixTime(body, "expires_at"); err != nil {
+		return nil, nil, err
+	}
+
+	switch audienceType {
+	case interfaces.AudienceTypeUsers:
+		userIDs, err = parseUserIDs(body)
+		if err != nil {
+			return nil, nil, err
+		}
+	case interfaces.AudienceTypeOrg:
+		orgID, ok := body["org_id"].(string)
+		if !ok || orgID == "" {
+			return nil, nil, fmt.Errorf("body.org_id is required when audience is org")
+		}
+		message.Type = interfaces.MessageTypeBroadcast
+		message.AudienceID = orgID
+	case interfaces.AudienceTypeChannel:
+		channel, ok := body["channel"].(string)
+		if !ok || channel == "" {
+			return nil, nil, fmt.Errorf("body.channel is required when audience is channel")
+		}
+		message.Type = interfaces.MessageTypeChannel
+		message.AudienceID = channel
+	default:
+		message.Type = interfaces.MessageTypeBroadcast
+	}
+
+	contentInterface, ok := body["content"]
+	if !ok {
+		return nil, nil, fmt.Errorf("body.content is required")
+	}
+
+	content, ok := contentInterface.(map[string]interface{})
+	if !ok {
+		return nil, nil, fmt.Errorf("body.content is not a map[string]interface{}")
+	}
+	message.Content = content
+
+	return message, userIDs, nil
+}
+
+// parseTenant 内部接口通过 org_id 参数指定用户所属组织, 启用多租户时必填
+func parseTenant(tenancy interfaces.ILogicsTenancy, orgID string) (string, error) {
+	tenantID := tenancy.TenantOf(orgID)
+	if tenancy.Enabled() && tenantID == "" {
+		return "", common.NewHTTPError(http.StatusBadRequest, "org_id is required", nil)
+	}
+	return tenantID, nil
+}
+
+func parseUnixTime(body map[string]interface{}, key string) (int64, error) {
+	v, ok := body[key]
+	if !ok || v == nil {
+		return 0, nil
+	}
+	f, ok := v.(float64)
+	if !ok || f < 0 {
+		return 0, fmt.Errorf("body.%s is not a valid unix timestamp", key)
+	}
+	return int64(f), nil
+}
+
+func parseUserIDs(body map[string]interface{}) ([]string, error) {
+	userIDsInterface, ok := body["user_ids"]
+	if !ok {
+		return nil, fmt.Errorf("body.user_ids is required")
+	}
+
+	userIDs, ok := userIDsInterface.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("body.user_ids is not a []interface{}")
+	}
+	if len(userIDs) == 0 {
+		return nil, fmt.Errorf("user_ids is empty")
+	}
+
+	userIDsStr := make([]string, len(userIDs))
+	for i, userID := range userIDs {
+		userIDsStr[i], ok = userID.(string)
+		if !ok {
+			return nil, fmt.Errorf("user_ids is not a []string")
+		}
+	}
+	return userIDsStr, nil
+}
@@ -0,0 +1,157 @@
+package driveradapters
+
+import (
+	"MessagePushService/common"
+	"MessagePushService/interfaces"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	connAdminHandlerOnce     sync.Once
+	connAdminHandlerInstance *connAdminHandler
+)
+
+// 查询连接的默认与最大返回数
+const (
+	connListDefaultLimit = 100
+	connListMaxLimit     = 1000
+)
+
+type connAdminHandler struct {
+	connAdmin interfaces.ILogicsConnAdmin
+	tenancy   interfaces.ILogicsTenancy
+}
+
+func NewConnAdminHandler(connAdmin interfaces.ILogicsConnAdmin, tenancy interfaces.ILogicsTenancy) interfaces.RESTHandler {
+	connAdminHandlerOnce.Do(func() {
+		connAdminHandlerInstance = &connAdminHandler{
+			connAdmin: connAdmin,
+			tenancy:   tenancy,
+		}
+	})
+
+	return connAdminHandlerInstance
+}
+
+func (handler *connAdminHandler) RegisterPublic(engine *gin.Engine) {
+}
+
+func (handler *connAdminHandler) RegisterPrivate(engine *gin.Engine) {
+	engine.GET("/api/v1/message-push/connections", handler.list)
+	engine.GET("/api/v1/message-push/connections/count", handler.count)
+	engine.POST("/api/v1/message-push/connections/:id/disconnect", handler.disconnect)
+	engine.POST("/api/v1/message-push/connections/:id/diagnostic", handler.sendDiagnostic)
+	engine.POST("/api/v1/message-push/users/:user_id/disconnect", handler.disconnectUser)
+}
+
+// list 按 org_id、user_id 过滤本实例的连接, 按建连时间升序最多返回 limit 个
+func (handler *connAdminHandler) list(c *gin.Context) {
+	filter := &interfaces.ConnFilter{
+		OrgID:  c.Query("org_id"),
+		UserID: c.Query("user_id"),
+		Limit:  connListDefaultLimit,
+	}
+	if s := c.Query("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit <= 0 {
+			common.ReplyError(c, common.NewHTTPError(http.StatusBadRequest, "limit must be a positive integer", nil))
+			return
+		}
+		filter.Limit = min(limit, connListMaxLimit)
+	}
+
+	total, outs := handler.connAdmin.List(c, filter)
+	if outs == nil {
+		outs = []*interfaces.ConnInfo{}
+	}
+	common.ReplyOK(c, http.StatusOK, map[string]interface{}{
+		"total":       total,
+		"connections": outs,
+	})
+}
+
+func (handler *connAdminHandler) count(c *gin.Context) {
+	common.ReplyOK(c, http.StatusOK, handler.connAdmin.Count(c))
+}
+
+type disconnectReq struct {
+	OrgID  string `json:"org_id"`
+	Reason string `json:"reason"`
+}
+
+// disconnect 请求体可选, reason 作为关闭原因发送给客户端
+func (handler *connAdminHandler) disconnect(c *gin.Context) {
+	var req disconnectReq
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			common.ReplyError(c, common.NewHTTPError(http.StatusBadRequest, "invalid request body", map[string]interface{}{"error": err.Error()}))
+			return
+		}
+	}
+
+	err := handler.connAdmin.Disconnect(c, c.Param("id"), req.Reason)
+	if err != nil {
+		common.ReplyError(c, connAdminHTTPError(err))
+		return
+	}
+
+	common.ReplyOK(c, http.StatusOK, map[string]interface{}{"id": c.Param("id")})
+}
+
+// disconnectUser 断开用户在本实例上的所有连接, 启用多租户时通过 org_id 指定用户所属组织
+func (handler *connAdminHandler) disconnectUser(c *gin.Context) {
+	var req disconnectReq
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			common.ReplyError(c, common.NewHTTPError(http.StatusBadRequest, "invalid request body", map[string]interface{}{"error": err.Error()}))
+			return
+		}
+	}
+	tenantID, err := parseTenant(handler.tenancy, req.OrgID)
+	if err != nil {
+		common.ReplyError(c, err)
+		return
+	}
+
+	n := handler.connAdmin.DisconnectUser(c, tenantID, c.Param("user_id"), req.Reason)
+	common.ReplyOK(c, http.StatusOK, map[string]interface{}{"disconnected": n})
+}
+
+type diagnosticReq struct {
+	Content interface{} `json:"content"`
+}
+
+// sendDiagnostic 向连接推送一条诊断消息, type 为 17
+func (handler *connAdminHandler) sendDiagnostic(c *gin.Context) {
+	var req diagnosticReq
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			common.ReplyError(c, common.NewHTTPError(http.StatusBadRequest, "invalid request body", map[string]interface{}{"error": err.Error()}))
+			return
+		}
+	}
+
+	id, err := handler.connAdmin.SendDiagnostic(c, c.Param("id"), req.Content)
+	if err != nil {
+		common.ReplyError(c, connAdminHTTPError(err))
+		return
+	}
+
+	common.ReplyOK(c, http.StatusAccepted, map[string]interface{}{"id": id})
+}
+
+func connAdminHTTPError(err error) error {
+	switch {
+	case errors.Is(err, interfaces.ErrRecordNotFound), errors.Is(err, interfaces.ErrConnClosed):
+		return common.NewHTTPError(http.StatusNotFound, "connection not found", nil)
+	case errors.Is(err, interfaces.ErrSlowConsumer):
+		return common.NewHTTPError(http.StatusServiceUnavailable, err.Error(), nil)
+	default:
+		return err
+	}
+}
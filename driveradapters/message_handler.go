@@ -0,0 +1,223 @@
+package driveradapters
+
+import (
+	"MessagePushService/common"
+	"MessagePushService/interfaces"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	messageHandlerOnce     sync.Once
+	messageHandlerInstance *messageHandler
+)
+
+type messageHandler struct {
+	logicsMessage   interfaces.ILogicsMessage
+	messagePush     interfaces.ILogicsMessagePush
+	messageRevision interfaces.ILogicsMessageRevision
+	identifyService interfaces.IDrivenIdentifyService
+	tenancy         interfaces.ILogicsTenancy
+}
+
+func NewMessageHandler(logicsMessage interfaces.ILogicsMessage, messagePush interfaces.ILogicsMessagePush, messageRevision interfaces.ILogicsMessageRevision, identifyService interfaces.IDrivenIdentifyService, tenancy interfaces.ILogicsTenancy) interfaces.RESTHandler {
+	messageHandlerOnce.Do(func() {
+		messageHandlerInstance = &messageHandler{
+			logicsMessage:   logicsMessage,
+			messagePush:     messagePush,
+			messageRevision: messageRevision,
+			identifyService: identifyService,
+			tenancy:         tenancy,
+		}
+	})
+
+	return messageHandlerInstance
+}
+
+func (handler *messageHandler) RegisterPublic(engine *gin.Engine) {
+	engine.GET("/api/v1/message-push/unread", handler.getUnreadPublic)
+}
+
+func (handler *messageHandler) RegisterPrivate(engine *gin.Engine) {
+	engine.GET("/api/v1/message-push/users/:user_id/unread", handler.getUnreadPrivate)
+	engine.POST("/api/v1/message-push/messages", handler.publish)
+	engine.GET("/api/v1/message-push/messages/:id/status", handler.getStatus)
+	engine.POST("/api/v1/message-push/messages/:id/recall", handler.recall)
+	engine.PUT("/api/v1/message-push/messages/:id", handler.edit)
+	engine.GET("/api/v1/message-push/messages/:id/edits", handler.getEdits)
+	engine.GET("/api/v1/message-push/metrics", handler.getMetrics)
+}
+
+func (handler *messageHandler) getUnreadPublic(c *gin.Context) {
+	userInfo, err := handler.authenticate(c)
+	if err != nil {
+		common.ReplyError(c, err)
+		return
+	}
+
+	handler.getUnread(c, userInfo.TenantID, userInfo.ID)
+}
+
+// getUnreadPrivate 启用多租户时通过 org_id 参数指定用户所属组织
+func (handler *messageHandler) getUnreadPrivate(c *gin.Context) {
+	tenantID, err := parseTenant(handler.tenancy, c.Query("org_id"))
+	if err != nil {
+		common.ReplyError(c, err)
+		return
+	}
+
+	handler.getUnread(c, tenantID, c.Param("user_id"))
+}
+
+func (handler *messageHandler) getUnread(c *gin.Context, tenantID, userID string) {
+	out, err := handler.logicsMessage.GetUnreadCount(c, tenantID, userID)
+	if err != nil {
+		common.ReplyError(c, err)
+		return
+	}
+
+	common.ReplyOK(c, http.StatusOK, out)
+}
+
+// publish 与 MQ 消息体格式相同, 另可通过 id 指定消息ID(用于幂等重试)、topic 指定回调与降级通知按 topic 的配置
+func (handler *messageHandler) publish(c *gin.Context) {
+	var body map[string]interface{}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		common.ReplyError(c, common.NewHTTPError(http.StatusBadRequest, "invalid request body", map[string]interface{}{"error": err.Error()}))
+		return
+	}
+
+	message, userIDs, err := parseMessageBody(body)
+	if err != nil {
+		common.ReplyError(c, common.NewHTTPError(http.StatusBadRequest, err.Error(), nil))
+		return
+	}
+	message.ID, _ = body["id"].(string)
+	if message.ID == "" {
+		message.ID = common.NewID()
+	}
+	message.Topic, _ = body["topic"].(string)
+	message.Timestamp = time.Now().Unix()
+
+	err = handler.logicsMessage.Add(c, message, userIDs)
+	if err != nil {
+		common.ReplyError(c, publishHTTPError(err))
+		return
+	}
+	err = handler.messagePush.NotifyByNewMessage(message.ID, message.Priority)
+	if err != nil {
+		// 消息已保存, 调用方使用相同的 id 重试即可
+		common.ReplyError(c, common.NewHTTPError(http.StatusServiceUnavailable, err.Error(), map[string]interface{}{"id": message.ID}))
+		return
+	}
+
+	common.ReplyOK(c, http.StatusCreated, map[string]interface{}{"id": message.ID})
+}
+
+func (handler *messageHandler) getStatus(c *gin.Context) {
+	out, err := handler.logicsMessage.GetStatus(c, c.Param("id"))
+	if err != nil {
+		if errors.Is(err, interfaces.ErrRecordNotFound) {
+			err = common.NewHTTPError(http.StatusNotFound, "message not found", nil)
+		}
+		common.ReplyError(c, err)
+		return
+	}
+
+	common.ReplyOK(c, http.StatusOK, out)
+}
+
+// recall 由消息生产者撤回消息, 不受聊天消息撤回时限的限制
+func (handler *messageHandler) recall(c *gin.Context) {
+	err := handler.messageRevision.Recall(c, nil, c.Param("id"))
+	if err != nil {
+		common.ReplyError(c, revisionHTTPError(err))
+		return
+	}
+
+	common.ReplyOK(c, http.StatusOK, map[string]interface{}{"id": c.Param("id")})
+}
+
+// edit 替换聊天消息的 content 字段
+func (handler *messageHandler) edit(c *gin.Context) {
+	var body map[string]interface{}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		common.ReplyError(c, common.NewHTTPError(http.StatusBadRequest, "invalid request body", map[string]interface{}{"error": err.Error()}))
+		return
+	}
+	content, ok := body["content"]
+	if !ok {
+		common.ReplyError(c, common.NewHTTPError(http.StatusBadRequest, "body.content is required", nil))
+		return
+	}
+
+	err := handler.messageRevision.Edit(c, nil, c.Param("id"), content)
+	if err != nil {
+		common.ReplyError(c, revisionHTTPError(err))
+		return
+	}
+
+	common.ReplyOK(c, http.StatusOK, map[string]interface{}{"id": c.Param("id")})
+}
+
+// getEdits 按编辑顺序返回编辑前的各版本内容
+func (handler *messageHandler) getEdits(c *gin.Context) {
+	out, err := handler.logicsMessage.GetEdits(c, c.Param("id"))
+	if err != nil {
+		common.ReplyError(c, err)
+		return
+	}
+
+	common.ReplyOK(c, http.StatusOK, out)
+}
+
+func publishHTTPError(err error) error {
+	switch {
+	case errors.Is(err, interfaces.ErrQuotaExceeded):
+		return common.NewHTTPError(http.StatusTooManyRequests, err.Error(), nil)
+	case errors.Is(err, interfaces.ErrCrossOrg):
+		return common.NewHTTPError(http.StatusForbidden, err.Error(), nil)
+	case errors.Is(err, interfaces.ErrDuplicateID):
+		return common.NewHTTPError(http.StatusConflict, err.Error(), nil)
+	default:
+		return common.NewHTTPError(http.StatusBadRequest, err.Error(), nil)
+	}
+}
+
+func revisionHTTPError(err error) error {
+	switch {
+	case errors.Is(err, interfaces.ErrRecordNotFound):
+		return common.NewHTTPError(http.StatusNotFound, "message not found", nil)
+	case errors.Is(err, interfaces.ErrForbidden):
+		return common.NewHTTPError(http.StatusForbidden, err.Error(), nil)
+	case errors.Is(err, interfaces.ErrMessageRecalled):
+		return common.NewHTTPError(http.StatusConflict, err.Error(), nil)
+	default:
+		return err
+	}
+}
+
+func (handler *messageHandler) getMetrics(c *gin.Context) {
+	common.ReplyOK(c, http.StatusOK, common.Counters())
+}
+
+// authenticate 公共接口通过访问令牌识别用户
+func (handler *messageHandler) authenticate(c *gin.Context) (*interfaces.UserInfo, error) {
+	if c.GetHeader("Authorization") == "" {
+		return nil, common.NewHTTPError(http.StatusUnauthorized, "Authorization is required", nil)
+	}
+
+	userInfo, err := handler.identifyService.Instrospect(c)
+	if err != nil {
+		return nil, err
+	}
+	if userInfo == nil {
+		return nil, common.NewHTTPError(http.StatusUnauthorized, "用户未登录", nil)
+	}
+	userInfo.TenantID = handler.tenancy.TenantOf(userInfo.OrgID)
+	return userInfo, nil
+}
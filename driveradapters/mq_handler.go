@@ -4,7 +4,7 @@ import (
 	"MessagePushService/common"
 	"MessagePushService/interfaces"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"sync"
@@ -22,12 +22,13 @@ var (
 )
 
 type MQHandler struct {
-	consumer      mqsdk.Consumer
-	logicsMessage interfaces.ILogicsMessage
-	messagePush   interfaces.ILogicsMessagePush
+	consumer        mqsdk.Consumer
+	logicsMessage   interfaces.ILogicsMessage
+	messagePush     interfaces.ILogicsMessagePush
+	messageRevision interfaces.ILogicsMessageRevision
 }
 
-func NewMQHandler(config *common.Config, logicsMessage interfaces.ILogicsMessage, messagePush interfaces.ILogicsMessagePush) *MQHandler {
+func NewMQHandler(config *common.Config, logicsMessage interfaces.ILogicsMessage, messagePush interfaces.ILogicsMessagePush, messageRevision interfaces.ILogicsMessageRevision) *MQHandler {
 	mqConfig := &mqsdk.NSQConfig{
 		Type:      config.MQ.Type,
 		NSQDAddr:  config.MQ.NSQDAddr,
@@ -39,9 +40,10 @@ func NewMQHandler(config *common.Config, logicsMessage interfaces.ILogicsMessage
 			log.Fatalf("Failed to create consumer: %v", err)
 		}
 		mqHandler = &MQHandler{
-			consumer:      consumer,
-			logicsMessage: logicsMessage,
-			messagePush:   messagePush,
+			consumer:        consumer,
+			logicsMessage:   logicsMessage,
+			messagePush:     messagePush,
+			messageRevision: messageRevision,
 		}
 	})
 
@@ -52,7 +54,7 @@ func NewMQHandler(config *common.Config, logicsMessage interfaces.ILogicsMessage
 
 func (mqHandler *MQHandler) Start(config *common.Config) {
 	for _, topic := range config.Event.Topics {
-		mqHandler.Register(topic, mqHandler.handleToUsers)
+		mqHandler.Register(topic, mqHandler.newToUsersHandler(topic))
 	}
 }
 
@@ -63,50 +65,81 @@ func (mqHandler *MQHandler) Register(topic string, handler func(msg *mqsdk.Messa
 	}
 }
 
-func (mqHandler *MQHandler) handleToUsers(msg *mqsdk.Message) (err error) {
-	log.Printf("handleToUsers msg: %v", msg)
-	userIDsInterface, ok := msg.Body.(map[string]interface{})["user_ids"]
-	if !ok {
-		return fmt.Errorf("body.user_ids is required")
+// newToUsersHandler 记录消息来源的 topic, 降级通知等按 topic 配置的功能依赖它
+func (mqHandler *MQHandler) newToUsersHandler(topic string) func(msg *mqsdk.Message) error {
+	return func(msg *mqsdk.Message) error {
+		return mqHandler.handleToUsers(topic, msg)
 	}
+}
 
-	userIDs, ok := userIDsInterface.([]interface{})
+func (mqHandler *MQHandler) handleToUsers(topic string, msg *mqsdk.Message) (err error) {
+	// 消息体可能包含敏感内容, 只记录消息ID与 topic
+	log.Printf("[DEBUG] handleToUsers messageID: %s, topic: %s", msg.ID, topic)
+	body, ok := msg.Body.(map[string]interface{})
 	if !ok {
-		return fmt.Errorf("body.user_ids is not a []interface{}")
-	}
-	if len(userIDs) == 0 {
-		return fmt.Errorf("user_ids is empty")
+		return fmt.Errorf("body is not a map[string]interface{}")
 	}
 
-	userIDsStr := make([]string, len(userIDs))
-	for i, userID := range userIDs {
-		userIDsStr[i], ok = userID.(string)
-		if !ok {
-			return fmt.Errorf("user_ids is not a []string")
-		}
+	// action 缺省为发布新消息, recall/edit 撤回或编辑 message_id 对应的消息
+	action, _ := body["action"].(string)
+	switch action {
+	case "", "publish":
+	case "recall", "edit":
+		return mqHandler.handleRevision(action, body)
+	default:
+		return fmt.Errorf("body.action is invalid: %s", action)
 	}
 
-	contentInterface, ok := msg.Body.(map[string]interface{})["content"]
-	if !ok {
-		return fmt.Errorf("body.content is required")
+	message, userIDs, err := parseMessageBody(body)
+	if err != nil {
+		return err
 	}
-
-	content, ok := contentInterface.(map[string]interface{})
-	if !ok {
-		return fmt.Errorf("body.content is not a map[string]interface{}")
+	message.ID = msg.ID
+	message.Timestamp = msg.Timestamp
+	message.Topic = topic
+
+	err = mqHandler.logicsMessage.Add(context.Background(), message, userIDs)
+	// 超过组织配额、跨组织投递或消息ID已被其它消息使用时重新投递也不会成功, 丢弃
+	if errors.Is(err, interfaces.ErrQuotaExceeded) || errors.Is(err, interfaces.ErrCrossOrg) || errors.Is(err, interfaces.ErrDuplicateID) {
+		log.Printf("[WARN] drop message: %v, messageID: %s", err, msg.ID)
+		return nil
 	}
-
-	contentBytes, err := json.Marshal(content)
 	if err != nil {
-		return fmt.Errorf("failed to marshal content: %v", err)
+		log.Printf("[ERROR] save message error: %v", err)
+		return
 	}
 
-	err = mqHandler.logicsMessage.Add(context.Background(), interfaces.MessageTypeToUsers, userIDsStr, msg.ID, string(contentBytes), msg.Timestamp)
+	// 推送队列已满时返回错误, 由MQ稍后重新投递, 消息已存在时 Add 不会重复保存
+	err = mqHandler.messagePush.NotifyByNewMessage(msg.ID, message.Priority)
 	if err != nil {
-		log.Printf("[ERROR] save message error: %v", err)
+		log.Printf("[WARN] notify new message error: %v, messageID: %s", err, msg.ID)
 		return
 	}
-
-	mqHandler.messagePush.NotifyByNewMessage(msg.ID)
 	return
 }
+
+func (mqHandler *MQHandler) handleRevision(action string, body map[string]interface{}) (err error) {
+	messageID, _ := body["message_id"].(string)
+	if messageID == "" {
+		return fmt.Errorf("body.message_id is required")
+	}
+
+	if action == "recall" {
+		err = mqHandler.messageRevision.Recall(context.Background(), nil, messageID)
+	} else {
+		content, ok := body["content"]
+		if !ok {
+			return fmt.Errorf("body.content is required")
+		}
+		err = mqHandler.messageRevision.Edit(context.Background(), nil, messageID, content)
+	}
+	// 消息不存在、已撤回或不允许编辑时重试无意义, 不再重新投递
+	if errors.Is(err, interfaces.ErrRecordNotFound) || errors.Is(err, interfaces.ErrMessageRecalled) || errors.Is(err, interfaces.ErrForbidden) {
+		log.Printf("[WARN] %s message error: %v, messageID: %s", action, err, messageID)
+		return nil
+	}
+	if err != nil {
+		log.Printf("[ERROR] %s message error: %v, messageID: %s", action, err, messageID)
+	}
+	return err
+}
@@ -0,0 +1,76 @@
+package driveradapters
+
+import (
+	"MessagePushService/common"
+	"MessagePushService/interfaces"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	presenceHandlerOnce     sync.Once
+	presenceHandlerInstance *presenceHandler
+)
+
+// 单次查询的最大用户数
+const presenceQueryLimit = 500
+
+type presenceHandler struct {
+	presence interfaces.ILogicsPresence
+	tenancy  interfaces.ILogicsTenancy
+}
+
+func NewPresenceHandler(presence interfaces.ILogicsPresence, tenancy interfaces.ILogicsTenancy) interfaces.RESTHandler {
+	presenceHandlerOnce.Do(func() {
+		presenceHandlerInstance = &presenceHandler{
+			presence: presence,
+			tenancy:  tenancy,
+		}
+	})
+
+	return presenceHandlerInstance
+}
+
+func (handler *presenceHandler) RegisterPublic(engine *gin.Engine) {
+}
+
+func (handler *presenceHandler) RegisterPrivate(engine *gin.Engine) {
+	engine.POST("/api/v1/message-push/presence/query", handler.query)
+}
+
+type presenceQueryReq struct {
+	OrgID   string   `json:"org_id"`
+	UserIDs []string `json:"user_ids"`
+}
+
+func (handler *presenceHandler) query(c *gin.Context) {
+	var req presenceQueryReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		common.ReplyError(c, common.NewHTTPError(http.StatusBadRequest, "invalid request body", map[string]interface{}{"error": err.Error()}))
+		return
+	}
+	if len(req.UserIDs) == 0 {
+		common.ReplyError(c, common.NewHTTPError(http.StatusBadRequest, "user_ids is required", nil))
+		return
+	}
+	if len(req.UserIDs) > presenceQueryLimit {
+		common.ReplyError(c, common.NewHTTPError(http.StatusBadRequest, "too many user_ids", map[string]interface{}{"limit": presenceQueryLimit}))
+		return
+	}
+
+	tenantID, err := parseTenant(handler.tenancy, req.OrgID)
+	if err != nil {
+		common.ReplyError(c, err)
+		return
+	}
+
+	outs, err := handler.presence.Get(c, tenantID, req.UserIDs)
+	if err != nil {
+		common.ReplyError(c, err)
+		return
+	}
+
+	common.ReplyOK(c, http.StatusOK, outs)
+}
@@ -0,0 +1,69 @@
+package driveradapters
+
+import (
+	"MessagePushService/common"
+	"MessagePushService/interfaces"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	retentionHandlerOnce     sync.Once
+	retentionHandlerInstance *retentionHandler
+)
+
+type retentionHandler struct {
+	retention interfaces.ILogicsRetention
+}
+
+func NewRetentionHandler(retention interfaces.ILogicsRetention) interfaces.RESTHandler {
+	retentionHandlerOnce.Do(func() {
+		retentionHandlerInstance = &retentionHandler{
+			retention: retention,
+		}
+	})
+
+	return retentionHandlerInstance
+}
+
+func (handler *retentionHandler) RegisterPublic(engine *gin.Engine) {
+}
+
+func (handler *retentionHandler) RegisterPrivate(engine *gin.Engine) {
+	engine.POST("/api/v1/message-push/retention/runs", handler.trigger)
+	engine.GET("/api/v1/message-push/retention/runs", handler.getRuns)
+}
+
+type retentionTriggerReq struct {
+	DryRun bool `json:"dry_run"`
+}
+
+// trigger 异步执行一次清理, 通过 getRuns 查看进度与结果
+func (handler *retentionHandler) trigger(c *gin.Context) {
+	var req retentionTriggerReq
+	// 请求体可选, 缺省执行实际删除
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			common.ReplyError(c, common.NewHTTPError(http.StatusBadRequest, "invalid request body", map[string]interface{}{"error": err.Error()}))
+			return
+		}
+	}
+
+	run, err := handler.retention.Trigger(req.DryRun)
+	if err != nil {
+		if errors.Is(err, interfaces.ErrRunInProgress) {
+			err = common.NewHTTPError(http.StatusConflict, err.Error(), nil)
+		}
+		common.ReplyError(c, err)
+		return
+	}
+
+	common.ReplyOK(c, http.StatusAccepted, run)
+}
+
+func (handler *retentionHandler) getRuns(c *gin.Context) {
+	common.ReplyOK(c, http.StatusOK, handler.retention.GetRuns())
+}
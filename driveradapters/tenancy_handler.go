@@ -0,0 +1,52 @@
+package driveradapters
+
+import (
+	"MessagePushService/common"
+	"MessagePushService/interfaces"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	tenancyHandlerOnce     sync.Once
+	tenancyHandlerInstance *tenancyHandler
+)
+
+type tenancyHandler struct {
+	tenancy interfaces.ILogicsTenancy
+}
+
+func NewTenancyHandler(tenancy interfaces.ILogicsTenancy) interfaces.RESTHandler {
+	tenancyHandlerOnce.Do(func() {
+		tenancyHandlerInstance = &tenancyHandler{
+			tenancy: tenancy,
+		}
+	})
+
+	return tenancyHandlerInstance
+}
+
+func (handler *tenancyHandler) RegisterPublic(engine *gin.Engine) {
+}
+
+func (handler *tenancyHandler) RegisterPrivate(engine *gin.Engine) {
+	engine.GET("/api/v1/message-push/orgs/:org_id/usage", handler.getUsage)
+	engine.GET("/api/v1/message-push/metrics/tenants", handler.getMetrics)
+}
+
+// getUsage 连接数与计数器为本实例的数据, 每日消息数为所有实例的合计
+func (handler *tenancyHandler) getUsage(c *gin.Context) {
+	out, err := handler.tenancy.GetUsage(c, c.Param("org_id"))
+	if err != nil {
+		common.ReplyError(c, err)
+		return
+	}
+
+	common.ReplyOK(c, http.StatusOK, out)
+}
+
+func (handler *tenancyHandler) getMetrics(c *gin.Context) {
+	common.ReplyOK(c, http.StatusOK, common.TenantCounters())
+}
@@ -0,0 +1,127 @@
+package driveradapters
+
+import (
+	"MessagePushService/common"
+	"MessagePushService/interfaces"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	userDataHandlerOnce     sync.Once
+	userDataHandlerInstance *userDataHandler
+)
+
+type userDataHandler struct {
+	userData interfaces.ILogicsUserData
+	tenancy  interfaces.ILogicsTenancy
+}
+
+func NewUserDataHandler(userData interfaces.ILogicsUserData, tenancy interfaces.ILogicsTenancy) interfaces.RESTHandler {
+	userDataHandlerOnce.Do(func() {
+		userDataHandlerInstance = &userDataHandler{
+			userData: userData,
+			tenancy:  tenancy,
+		}
+	})
+
+	return userDataHandlerInstance
+}
+
+func (handler *userDataHandler) RegisterPublic(engine *gin.Engine) {
+}
+
+func (handler *userDataHandler) RegisterPrivate(engine *gin.Engine) {
+	engine.GET("/api/v1/message-push/users/:user_id/export", handler.export)
+	engine.POST("/api/v1/message-push/users/:user_id/erase", handler.erase)
+	engine.GET("/api/v1/message-push/users/:user_id/audit", handler.getAuditLogs)
+}
+
+type userDataReq struct {
+	OrgID    string `json:"org_id"`
+	Operator string `json:"operator"`
+	Reason   string `json:"reason"`
+}
+
+// export 以附件形式返回用户的全部消息, 操作人通过 query 参数传入
+func (handler *userDataHandler) export(c *gin.Context) {
+	req := &interfaces.DataRequest{
+		UserID:   c.Param("user_id"),
+		Operator: c.Query("operator"),
+		Reason:   c.Query("reason"),
+	}
+	if req.Operator == "" {
+		common.ReplyError(c, common.NewHTTPError(http.StatusBadRequest, "operator is required", nil))
+		return
+	}
+	orgID, err := parseTenant(handler.tenancy, c.Query("org_id"))
+	if err != nil {
+		common.ReplyError(c, err)
+		return
+	}
+	req.OrgID = orgID
+
+	c.Writer.Header().Set("Content-Type", "application/json")
+	c.Writer.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=user-%s-export.json", req.UserID))
+	err = handler.userData.Export(c.Request.Context(), req, c.Writer)
+	if err != nil {
+		// 已开始写入时无法再返回错误码, 失败记录在审计日志中
+		if c.Writer.Written() {
+			log.Printf("[ERROR] export user data error: %v, userID: %s", err, req.UserID)
+			return
+		}
+		c.Writer.Header().Del("Content-Disposition")
+		common.ReplyError(c, err)
+	}
+}
+
+// erase 删除用户的收件箱与状态数据, 用户发送的聊天消息按 userData.authoredChat 处理
+func (handler *userDataHandler) erase(c *gin.Context) {
+	var body userDataReq
+	if err := c.ShouldBindJSON(&body); err != nil {
+		common.ReplyError(c, common.NewHTTPError(http.StatusBadRequest, "invalid request body", map[string]interface{}{"error": err.Error()}))
+		return
+	}
+	if body.Operator == "" {
+		common.ReplyError(c, common.NewHTTPError(http.StatusBadRequest, "operator is required", nil))
+		return
+	}
+	orgID, err := parseTenant(handler.tenancy, body.OrgID)
+	if err != nil {
+		common.ReplyError(c, err)
+		return
+	}
+
+	result, err := handler.userData.Erase(c.Request.Context(), &interfaces.DataRequest{
+		OrgID:    orgID,
+		UserID:   c.Param("user_id"),
+		Operator: body.Operator,
+		Reason:   body.Reason,
+	})
+	if err != nil {
+		common.ReplyError(c, err)
+		return
+	}
+
+	common.ReplyOK(c, http.StatusOK, result)
+}
+
+func (handler *userDataHandler) getAuditLogs(c *gin.Context) {
+	orgID, err := parseTenant(handler.tenancy, c.Query("org_id"))
+	if err != nil {
+		common.ReplyError(c, err)
+		return
+	}
+
+	logs, err := handler.userData.GetAuditLogs(c.Request.Context(), orgID, c.Param("user_id"))
+	if err != nil {
+		common.ReplyError(c, err)
+		return
+	}
+
+	common.ReplyOK(c, http.StatusOK, logs)
+}
@@ -21,14 +21,18 @@ type websocketHandler struct {
 	wsConnManager   interfaces.ILogicsWsConnManager
 	messagePush     interfaces.ILogicsMessagePush
 	identifyService interfaces.IDrivenIdentifyService
+	tenancy         interfaces.ILogicsTenancy
+	upgradeLimiter  *common.KeyedLimiter // 公共端口按客户端IP限制建连频率
+	payloads        map[string]bool      // 允许客户端选择的消息体压缩算法
 }
 
-func NewWebsocketHandler(wsConnManager interfaces.ILogicsWsConnManager, messagePush interfaces.ILogicsMessagePush, identifyService interfaces.IDrivenIdentifyService) interfaces.RESTHandler {
+func NewWebsocketHandler(config *common.Config, wsConnManager interfaces.ILogicsWsConnManager, messagePush interfaces.ILogicsMessagePush, identifyService interfaces.IDrivenIdentifyService, tenancy interfaces.ILogicsTenancy) interfaces.RESTHandler {
 	websocketHandlerOnce.Do(func() {
 		websocketHandlerInstance = &websocketHandler{
 			upgrader: &websocket.Upgrader{
 				ReadBufferSize:  1024,
 				WriteBufferSize: 1024,
+				Subprotocols:    interfaces.Subprotocols, // 客户端未携带或不支持时不回复子协议, 使用 v0
 				CheckOrigin: func(r *http.Request) bool {
 					return true // 在生产环境中应该进行更严格的跨域检查
 				},
@@ -36,7 +40,26 @@ func NewWebsocketHandler(wsConnManager interfaces.ILogicsWsConnManager, messageP
 			wsConnManager:   wsConnManager,
 			messagePush:     messagePush,
 			identifyService: identifyService,
+			tenancy:         tenancy,
+			payloads:        make(map[string]bool),
 		}
+		if cfg := config.Compression; cfg != nil {
+			websocketHandlerInstance.upgrader.EnableCompression = cfg.Enabled
+			for _, payload := range cfg.Payloads {
+				websocketHandlerInstance.payloads[payload] = true
+			}
+		}
+
+		r, burst := 1.0, 10
+		if cfg := config.Inbound; cfg != nil {
+			if cfg.UpgradeRate > 0 {
+				r = cfg.UpgradeRate
+			}
+			if cfg.UpgradeBurst > 0 {
+				burst = cfg.UpgradeBurst
+			}
+		}
+		websocketHandlerInstance.upgradeLimiter = common.NewKeyedLimiter(r, burst)
 	})
 
 	return websocketHandlerInstance
@@ -57,14 +80,22 @@ func (handler *websocketHandler) upgradePrivate(ctx *gin.Context) {
 		return
 	}
 
+	// 内部服务通过 org_id 参数指定用户所属组织
 	userInfo := &interfaces.UserInfo{
-		ID:   userID,
-		Name: fmt.Sprintf("private-%s", userID),
+		ID:    userID,
+		Name:  fmt.Sprintf("private-%s", userID),
+		OrgID: ctx.Query("org_id"),
 	}
 	handler.upgrade(ctx, userInfo)
 }
 
 func (handler *websocketHandler) upgradePublic(c *gin.Context) {
+	if !handler.upgradeLimiter.Allow(c.ClientIP()) {
+		common.IncCounter(common.MetricUpgradeRateLimited)
+		common.ReplyError(c, common.NewHTTPError(http.StatusTooManyRequests, "too many connection attempts", nil))
+		return
+	}
+
 	authorization := c.GetHeader("Authorization")
 	if authorization == "" {
 		common.ReplyError(c, common.NewHTTPError(http.StatusUnauthorized, "Authorization is required", nil))
@@ -84,13 +115,38 @@ func (handler *websocketHandler) upgradePublic(c *gin.Context) {
 	handler.upgrade(c, userInfo)
 }
 
+// upgrade 客户端可通过 compression 参数选择消息体压缩算法; 启用多租户时连接属于用户所在组织, 并占用组织的连接数配额
 func (handler *websocketHandler) upgrade(c *gin.Context, userInfo *interfaces.UserInfo) {
+	options := &interfaces.ConnOptions{
+		PayloadEncoding: c.Query("compression"),
+		RemoteAddr:      c.ClientIP(),
+		UserAgent:       c.Request.UserAgent(),
+	}
+	if options.PayloadEncoding != "" && !handler.payloads[options.PayloadEncoding] {
+		common.ReplyError(c, common.NewHTTPError(http.StatusBadRequest, "unsupported compression", map[string]interface{}{"compression": options.PayloadEncoding}))
+		return
+	}
+
+	tenantID, err := parseTenant(handler.tenancy, userInfo.OrgID)
+	if err != nil {
+		common.ReplyError(c, err)
+		return
+	}
+	userInfo.TenantID = tenantID
+	err = handler.tenancy.AcquireConn(userInfo.TenantID)
+	if err != nil {
+		common.IncTenantCounter(userInfo.TenantID, common.MetricQuotaConnectionsRejected)
+		common.ReplyError(c, common.NewHTTPError(http.StatusTooManyRequests, err.Error(), nil))
+		return
+	}
+
 	conn, err := handler.upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
+		handler.tenancy.ReleaseConn(userInfo.TenantID)
 		common.ReplyError(c, err)
 		return
 	}
 
-	handler.wsConnManager.Add(conn, userInfo)
-	handler.messagePush.NotifyByUserLogin(userInfo.ID)
+	handler.wsConnManager.Add(conn, userInfo, options)
+	handler.messagePush.NotifyByUserLogin(userInfo)
 }
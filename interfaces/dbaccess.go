@@ -9,7 +9,8 @@ import (
 )
 
 var (
-	ErrRecordNotFound = errors.New("record not found")
+	ErrRecordNotFound  = errors.New("record not found")
+	ErrMessageRecalled = errors.New("message is recalled")
 )
 
 type IDBMessage interface {
@@ -17,36 +18,329 @@ type IDBMessage interface {
 	Add(ctx context.Context, userIDs []string, message *DBMessage) error
 	// 根据消息ID获取消息
 	GetByID(ctx context.Context, messageID string) (out *DBMessage, userIDs []string, err error)
-	// 根据消息状态获取消息（仅限一条，因为不同的消息推送的人群可能不一样）
-	GetByPushStatus(ctx context.Context, status MessagePushStatus) (out *DBMessage, userIDs []string, err error)
 	// 批量获取特定用户指定状态的消息
-	GetByUserID(ctx context.Context, userID string, status MessagePushStatus, limit int) (out []*DBMessage, err error)
+	// 按收件箱序号升序返回 since 之后创建的推送记录对应的消息
+	GetByUserID(ctx context.Context, tenantID, userID string, status MessagePushStatus, since time.Time, limit int) (out []*DBMessage, err error)
+	// 统计 before 之前创建的推送记录数
+	CountByUserID(ctx context.Context, tenantID, userID string, status MessagePushStatus, before time.Time) (int, error)
+	// 按收件箱序号升序返回序号大于 afterSeq 且已到投递时间、未过期的消息
+	GetAfterSeq(ctx context.Context, tenantID, userID string, afterSeq int64, limit int) (out []*DBMessage, err error)
+	// 用户收件箱当前最大序号
+	GetLatestSeq(ctx context.Context, tenantID, userID string) (int64, error)
+	// 批量获取用户尚未生成推送记录的组织/全员广播消息(仅限 since 之后创建、属于该租户或不属于任何组织的消息)
+	GetPendingBroadcasts(ctx context.Context, tenantID, userID, orgID string, since time.Time, limit int) (out []*DBMessage, err error)
 	// 更新消息状态
-	UpdateStatus(ctx context.Context, userID, msgID string, status MessagePushStatus) error
+	UpdateStatus(ctx context.Context, tenantID, userID, msgID string, status MessagePushStatus) error
+	// 更新消息状态(客户端确认), 推送记录不存在时为非指定用户的消息创建; 不会覆盖已撤回的状态
+	UpsertStatus(ctx context.Context, tenantID, userID, msgID string, status MessagePushStatus) error
+	// 批量更新消息状态, 推送记录不存在时创建; 不会覆盖客户端已确认的状态
+	BatchUpsertStatus(ctx context.Context, items []*DBPushStatus) error
+	// 标记消息已读, upTo 为 true 时标记该消息及之前的所有消息, 返回本次新标记为已读的消息
+	MarkRead(ctx context.Context, tenantID, userID, msgID string, upTo bool) (out []*DBReadMessage, err error)
+	// 按消息类型与聊天室统计用户的未读消息数
+	CountUnread(ctx context.Context, tenantID, userID string) (out []*DBUnreadCount, err error)
+	// 获取定时投递时间(unix秒)不晚于 before、尚未分派推送且未撤回的定时消息
+	GetDueScheduled(ctx context.Context, before int64, limit int) (out []*DBMessage, err error)
+	// 抢占已到投递时间的定时消息的推送, 已被其它实例抢占或尚未到期时返回 false
+	ClaimScheduled(ctx context.Context, messageID string) (bool, error)
+	// 获取消息的所有推送记录
+	GetRecipientStatus(ctx context.Context, messageID string) (out []*DBRecipientStatus, err error)
+	// 获取租户内指定用户中创建于 [since, before) 内、处于 statuses 状态、补偿次数小于 maxAttempts 且租约已过期的推送记录
+	GetRedeliverable(ctx context.Context, tenantID string, userIDs []string, statuses []MessagePushStatus, since, before time.Time, maxAttempts, limit int) (out []*DBUserMessage, err error)
+	// 租用推送记录: 租约已过期时设置新的租约、状态改为推送中并增加补偿次数
+	ClaimRedelivery(ctx context.Context, id int64, leaseUntil time.Time) (bool, error)
+	// 将租户内指定用户中处于 statuses 状态、补偿次数达到 maxAttempts 且租约已过期的推送记录标记为已放弃, 返回本次标记的记录
+	AbandonExhausted(ctx context.Context, tenantID string, userIDs []string, statuses []MessagePushStatus, maxAttempts, limit int) (out []*DBUserMessage, err error)
+	// 撤回消息: 未推送的记录标记为已撤回, 并将撤回事件 event 保存给可能已收到消息的用户(广播类事件只保存消息), 返回这些用户
+	// 指定用户的消息没有用户收到时不保存事件; 消息已撤回时返回 ErrMessageRecalled
+	Recall(ctx context.Context, messageID string, event *DBMessage) (userIDs []string, err error)
+	// 编辑消息内容: 保存编辑前的内容到编辑历史, 并将编辑事件 event 保存给可能已收到消息的用户, 返回这些用户
+	Edit(ctx context.Context, messageID, editorID, content string, event *DBMessage) (userIDs []string, err error)
+	// 按编辑顺序获取消息的编辑历史
+	GetEdits(ctx context.Context, messageID string) (out []*DBMessageEdit, err error)
+	// 租户内两个用户之间是否有一方向另一方发送过聊天消息
+	HasChatted(ctx context.Context, tenantID, userID, peerID string) (bool, error)
 }
 
-type DBMessage struct {
+type IDBRetention interface {
+	// 按创建时间升序获取 before 之前创建、已到投递时间并已分派、且没有处于 pending 状态的推送记录的指定类型消息的ID
+	GetMessageIDsBefore(ctx context.Context, messageType int, before time.Time, pending []MessagePushStatus, limit int) ([]string, error)
+	// 统计 GetMessageIDsBefore 将删除的消息数及其推送记录数
+	CountMessagesBefore(ctx context.Context, messageType int, before time.Time, pending []MessagePushStatus) (messages, records int64, err error)
+	// 删除消息的推送记录, 最多删除 limit 行
+	DeleteUserMessages(ctx context.Context, messageIDs []string, limit int) (int64, error)
+	// 删除消息及其编辑历史, 需先删除推送记录
+	DeleteMessages(ctx context.Context, messageIDs []string) (int64, error)
+	// 删除 before 之前创建、已到投递时间且处于 statuses 状态的推送记录, 最多删除 limit 行
+	DeleteUserMessagesByStatus(ctx context.Context, statuses []MessagePushStatus, before time.Time, limit int) (int64, error)
+	// 统计 DeleteUserMessagesByStatus 将删除的推送记录数
+	CountUserMessagesByStatus(ctx context.Context, statuses []MessagePushStatus, before time.Time) (int64, error)
+}
+
+// IDBUserData 用户数据按 (租户, 用户ID) 读取与删除, 未启用多租户时租户ID为空
+type IDBUserData interface {
+	// 按推送记录主键升序获取用户收件箱中主键大于 afterID 的推送记录及其消息
+	GetInbox(ctx context.Context, tenantID, userID string, afterID int64, limit int) (out []*DBInboxRecord, err error)
+	// 按消息ID升序获取用户发送的、消息ID大于 afterID 的聊天消息及撤回/编辑事件
+	GetAuthored(ctx context.Context, tenantID, userID, afterID string, limit int) (out []*DBMessage, err error)
+	// 获取用户的所有编辑记录
+	GetEditsByEditor(ctx context.Context, tenantID, userID string) (out []*DBMessageEdit, err error)
+	// 删除用户的一批推送记录, 并删除因此没有任何推送记录的指定用户消息; 返回删除的推送记录数与消息数
+	DeleteInbox(ctx context.Context, tenantID, userID string, limit int) (records, messages int64, err error)
+	// 将用户发送的一批聊天消息及撤回/编辑事件的内容替换为 content 并清除发送者, 同时删除其编辑历史; 返回处理的消息数
+	ScrubAuthored(ctx context.Context, tenantID, userID, content string, limit int) (int64, error)
+	// 删除用户发送的一批聊天消息及撤回/编辑事件, 连同其推送记录与编辑历史; 返回删除的消息数与推送记录数
+	DeleteAuthored(ctx context.Context, tenantID, userID string, limit int) (messages, records int64, err error)
+	// 删除用户的编辑记录、收件箱序号、在线状态、降级通知与回调记录, 返回删除的行数
+	DeleteUserState(ctx context.Context, tenantID, userID string) (int64, error)
+}
+
+type IDBAudit interface {
+	// 添加审计日志, 返回日志ID
+	Add(ctx context.Context, log *DBAuditLog) (int64, error)
+	// 更新审计日志的执行结果
+	Finish(ctx context.Context, id int64, status, details string) error
+	// 按时间倒序获取数据主体的审计日志
+	GetBySubject(ctx context.Context, orgID, userID string, limit int) (out []*DBAuditLog, err error)
+}
+
+type DBAuditLog struct {
+	ID            int64
+	Action        string
+	SubjectOrgID  string
+	SubjectUserID string
+	Operator      string
+	Reason        string
+	Status        string
+	Details       string
+	CreatedAt     time.Time
+	FinishedAt    *time.Time
+}
+
+type DBInboxRecord struct {
+	ID         int64
+	Message    *DBMessage
+	PushStatus int
+	Read       bool
+	CreatedAt  time.Time
+}
+
+type IDBDataKey interface {
+	// 添加数据密钥
+	Add(ctx context.Context, key *DBDataKey) error
+	// 根据ID获取数据密钥
+	GetByID(ctx context.Context, id string) (*DBDataKey, error)
+	// 获取指定主密钥最新的数据密钥, 不存在时返回 nil
+	GetLatest(ctx context.Context, masterKeyID string) (*DBDataKey, error)
+	// 按主键顺序获取 afterID 之后数据密钥不是 keyID 的一批内容
+	GetStaleContents(ctx context.Context, table ContentTable, keyID, afterID string, limit int) (out []*DBContent, err error)
+	// 更新重新加密的内容; 读取后被修改的行跳过, 由下一批处理
+	UpdateContents(ctx context.Context, table ContentTable, contents []*DBContent) (int64, error)
+}
+
+// ContentTable 保存消息内容的表
+type ContentTable string
+
+const (
+	ContentTableMessage ContentTable = "t_message"
+	ContentTableEdit    ContentTable = "t_message_edit"
+)
+
+type DBDataKey struct {
+	ID          string
+	MasterKeyID string
+	WrappedKey  []byte
+	CreatedAt   time.Time
+}
+
+// DBContent 一行消息内容, Previous 为读取时的密文
+type DBContent struct {
 	ID        string
-	Type      int
+	MessageID string // 内容所属的消息ID, 加密时作为附加认证数据
+	Content   string
+	KeyID     string
+	Previous  string
+}
+
+type IDBPresence interface {
+	// 更新用户最后活跃时间
+	UpsertLastSeen(ctx context.Context, tenantID, userID string, lastSeen time.Time) error
+	// 批量获取租户内用户最后活跃时间
+	GetLastSeen(ctx context.Context, tenantID string, userIDs []string) (out map[string]time.Time, err error)
+}
+
+type IDBOrgUsage interface {
+	// 组织在 day 的消息数加 delta, 加上后超过 limit(大于0时) 则不增加并返回 false
+	AddMessages(ctx context.Context, orgID string, day time.Time, delta, limit int64) (bool, error)
+	// 获取组织在 day 的消息数
+	GetMessages(ctx context.Context, orgID string, day time.Time) (int64, error)
+}
+
+type IDBFallback interface {
+	// 获取需要降级通知的推送记录: 消息来自 topic, 投递时间(定时消息为 deliver_at, 其余为创建时间)在 [after, before] 之间, 已到投递时间且未过期, 客户端未确认, 且仍有通道未投递成功也未达到重试上限
+	// 组织/全员广播按 t_user_presence 中的用户展开, 包括尚未生成推送记录的离线用户
+	GetCandidates(ctx context.Context, topic string, channels []string, after, before time.Time, maxAttempts, limit int) (out []*DBFallbackCandidate, err error)
+	// 获取某条推送记录在各通道的投递记录
+	GetAttempts(ctx context.Context, orgID, userID, msgID string) (out []*DBFallbackAttempt, err error)
+	// 记录一次投递尝试, 已存在时累加尝试次数
+	AddAttempt(ctx context.Context, attempt *DBFallbackAttempt) error
+}
+
+type DBFallbackCandidate struct {
+	OrgID     string
+	UserID    string
+	MessageID string
+}
+
+type DBFallbackAttempt struct {
+	OrgID     string
+	UserID    string
+	MessageID string
+	Channel   string
+	Status    int
+	Attempts  int
+	Error     string
+}
+
+// CallbackOutboxStatus 回调发件箱状态
+type CallbackOutboxStatus int
+
+const (
+	CallbackOutboxStatusPending CallbackOutboxStatus = iota // 待发送
+	CallbackOutboxStatusSent                                // 已发送
+	CallbackOutboxStatusDead                                // 超过重试次数, 放弃
+)
+
+type IDBCallbackOutbox interface {
+	// 添加待发送的回调
+	Add(ctx context.Context, outbox *DBCallbackOutbox) error
+	// 获取到期待发送的回调
+	GetDue(ctx context.Context, limit int) (out []*DBCallbackOutbox, err error)
+	// 抢占回调的发送权, 将下次尝试时间推迟到 leaseUntil, 避免多个实例重复发送
+	Claim(ctx context.Context, id int64, leaseUntil time.Time) (ok bool, err error)
+	// 标记发送成功
+	MarkSent(ctx context.Context, id int64) error
+	// 标记发送失败, dead 为 true 时不再重试
+	MarkFailed(ctx context.Context, id int64, nextAttemptAt time.Time, dead bool, lastError string) error
+}
+
+type DBCallbackOutbox struct {
+	ID            int64
+	EventID       string
+	MessageID     string
+	OrgID         string
+	UserID        string
+	Event         string
+	URL           string
+	Payload       string
+	Status        int
+	Attempts      int
+	NextAttemptAt time.Time
+}
+
+type DBMessage struct {
+	ID           string
+	OrgID        string // 所属租户, 为空表示不属于任何组织
+	Type         int
+	Content      string
+	KeyID        string // 加密内容的数据密钥ID, 为空表示明文
+	Timestamp    int64
+	AudienceType int
+	AudienceID   string
+	SenderID     string
+	RoomID       string
+	Topic        string
+	CallbackURL  string
+	DeliverAt    int64
+	ExpiresAt    int64
+	Priority     int
+	RecalledAt   int64
+	EditedAt     int64
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+
+	Seq             int64             // 接收用户收件箱中的序号, 仅按用户查询时返回
+	RecipientSeqs   map[string]int64  // 接收用户ID -> 收件箱序号, 仅 GetByID 返回
+	RecipientOrgIDs map[string]string // 接收用户ID -> 推送记录所属租户, 仅 GetByID 返回, 只记录与消息租户不同的用户
+}
+
+type DBMessageEdit struct {
+	MessageID string
 	Content   string
-	Timestamp int64
+	KeyID     string
+	EditorID  string
 	CreatedAt time.Time
-	UpdatedAt time.Time
 }
 
-func ConvertDBMessageToModel(message *DBMessage) *LogicsMessage {
+type DBUserMessage struct {
+	ID         int64
+	UserID     string
+	MessageID  string
+	PushStatus int
+	Attempts   int
+}
+
+type DBPushStatus struct {
+	OrgID      string
+	UserID     string
+	MessageID  string
+	PushStatus int
+}
+
+type DBRecipientStatus struct {
+	OrgID      string
+	UserID     string
+	PushStatus int
+	Read       bool
+}
+
+type DBReadMessage struct {
+	MessageID string
+	Type      int
+	SenderID  string
+}
+
+type DBUnreadCount struct {
+	Type   int
+	RoomID string
+	Count  int
+}
+
+// ConvertDBMessageToModel 使用 contentCipher 解密消息内容, 内容无法解密或解析时返回 nil
+func ConvertDBMessageToModel(message *DBMessage, contentCipher ILogicsContentCipher) *LogicsMessage {
+	content, err := contentCipher.Decrypt(message.Content, message.KeyID, message.ID)
+	if err != nil {
+		log.Printf("[ERROR] decrypt message content error: %v, messageID: %s", err, message.ID)
+		return nil
+	}
 	var i interface{}
-	err := json.Unmarshal([]byte(message.Content), &i)
+	err = json.Unmarshal([]byte(content), &i)
 	if err != nil {
 		log.Printf("[ERROR] unmarshal message content error: %v", err)
 		return nil
 	}
 	return &LogicsMessage{
-		ID:        message.ID,
-		Type:      MessageType(message.Type),
-		Content:   i,
-		Timestamp: message.Timestamp,
-		CreatedAt: message.CreatedAt,
-		UpdatedAt: message.UpdatedAt,
+		ID:           message.ID,
+		OrgID:        message.OrgID,
+		Type:         MessageType(message.Type),
+		Content:      i,
+		Timestamp:    message.Timestamp,
+		AudienceType: AudienceType(message.AudienceType),
+		AudienceID:   message.AudienceID,
+		SenderID:     message.SenderID,
+		RoomID:       message.RoomID,
+		Topic:        message.Topic,
+		CallbackURL:  message.CallbackURL,
+		DeliverAt:    message.DeliverAt,
+		ExpiresAt:    message.ExpiresAt,
+		Priority:     MessagePriority(message.Priority),
+		RecalledAt:   message.RecalledAt,
+		EditedAt:     message.EditedAt,
+		CreatedAt:    message.CreatedAt,
+		UpdatedAt:    message.UpdatedAt,
+
+		Seq:             message.Seq,
+		RecipientSeqs:   message.RecipientSeqs,
+		RecipientOrgIDs: message.RecipientOrgIDs,
 	}
 }
@@ -1,8 +1,47 @@
 package interfaces
 
-import "github.com/gin-gonic/gin"
+import (
+	"context"
+
+	"github.com/gin-gonic/gin"
+)
 
 type IDrivenIdentifyService interface {
 	// 令牌内省
 	Instrospect(ctx *gin.Context) (*UserInfo, error)
 }
+
+type IDrivenMQProducer interface {
+	// 发布消息到指定 topic
+	Publish(ctx context.Context, topic string, body interface{}) error
+}
+
+type UserContact struct {
+	UserID       string
+	Email        string
+	Phone        string
+	DeviceTokens []string // 移动端推送令牌
+}
+
+type IDrivenUserContact interface {
+	// 获取用户联系方式
+	GetContact(ctx context.Context, userID string) (*UserContact, error)
+}
+
+// IDrivenFallbackChannel 用户离线或未确认时的降级通知通道
+type IDrivenFallbackChannel interface {
+	// 通道名称, 与配置中的通道名一致
+	Name() string
+	// 发送降级通知
+	Send(ctx context.Context, contact *UserContact, message *LogicsMessage) error
+}
+
+// IDrivenKeyProvider 主密钥提供方, 生成并解密数据密钥; 主密钥不离开提供方(本地密钥文件或 KMS)
+type IDrivenKeyProvider interface {
+	// 使用当前主密钥生成数据密钥, 返回主密钥ID、数据密钥明文与密文
+	GenerateDataKey(ctx context.Context) (masterKeyID string, plaintext, wrapped []byte, err error)
+	// 使用指定主密钥解密数据密钥
+	DecryptDataKey(ctx context.Context, masterKeyID string, wrapped []byte) ([]byte, error)
+	// 当前主密钥ID
+	CurrentKeyID() string
+}
@@ -2,27 +2,171 @@ package interfaces
 
 import (
 	"context"
+	"errors"
+	"io"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+var (
+	ErrRateLimited   = errors.New("rate limited")
+	ErrPushQueueFull = errors.New("push queue is full")
+	ErrSlowConsumer  = errors.New("connection send buffer is full")
+	ErrConnClosed    = errors.New("connection is closed")
+	ErrForbidden     = errors.New("operation is not permitted")
+	ErrRunInProgress = errors.New("a run is already in progress")
+	ErrQuotaExceeded = errors.New("tenant quota exceeded")
+	ErrCrossOrg      = errors.New("cross-org delivery is not allowed")
+	ErrDuplicateID   = errors.New("message id is used by another message")
+)
+
 //go:generate mockgen -source=./logics.go -destination=mock/logics_mock.go -package=mock
 
 // MQMessageType 消息类型, 和 topic 对应，方便后续解析消息
 type MessageType int
 
 const (
-	_                   MessageType = iota
-	MessageTypeACK                  // 消息确认
-	MessageTypeChatRoom             // 聊天室消息
-	MessageTypeToUsers              // 推送给指定用户集合
+	_                      MessageType = iota
+	MessageTypeACK                     // 消息确认
+	MessageTypeChatRoom                // 聊天室消息
+	MessageTypeToUsers                 // 推送给指定用户集合
+	MessageTypeBroadcast               // 广播消息(组织/在线用户/全部用户)
+	MessageTypeChannel                 // 频道消息, 推送给频道的当前订阅者
+	MessageTypeSubscribe               // 客户端订阅频道
+	MessageTypeUnsubscribe             // 客户端取消订阅频道
+	MessageTypePresence                // 在线状态: 客户端上报状态/服务端推送状态变更
+	MessageTypeEphemeral               // 临时消息(正在输入等), 只转发给在线接收者, 不持久化
+	MessageTypeRead                    // 客户端标记消息已读
+	MessageTypeReadReceipt             // 已读回执, 推送给聊天消息的发送者
+	MessageTypeError                   // 错误, 服务端拒绝处理客户端消息时回复
+	MessageTypeSync                    // 客户端按收件箱序号同步消息
+	MessageTypeBacklog                 // 用户上线补推结束, 服务端通知客户端是否还有未补推的消息
+	MessageTypeRecall                  // 撤回消息: 客户端撤回自己发送的聊天消息/服务端推送撤回事件
+	MessageTypeEdit                    // 编辑消息: 客户端编辑自己发送的聊天消息/服务端推送编辑事件
+	MessageTypeDiagnostic              // 诊断消息, 运维通过管理接口推送给指定连接, 不持久化, 客户端无需确认
+)
+
+// ErrorCode 错误帧中的错误码
+type ErrorCode string
+
+const (
+	ErrorCodeInvalidJSON    ErrorCode = "invalid_json"    // 消息不是合法的JSON
+	ErrorCodeInvalidMessage ErrorCode = "invalid_message" // 缺少 id/type/timestamp
+	ErrorCodeUnknownType    ErrorCode = "unknown_type"    // 不支持的消息类型
+	ErrorCodeInvalidBody    ErrorCode = "invalid_body"    // 消息体字段缺失或格式错误
+	ErrorCodeNotEnabled     ErrorCode = "not_enabled"     // 服务端未启用该功能
+	ErrorCodeNotFound       ErrorCode = "not_found"       // 消息不存在
+	ErrorCodeRateLimited    ErrorCode = "rate_limited"    // 超过发送频率限制
+	ErrorCodeForbidden      ErrorCode = "forbidden"       // 无权操作, 如撤回他人的消息、超过撤回时限或向无关用户发送临时消息
+	ErrorCodeRecalled       ErrorCode = "recalled"        // 消息已撤回
+	ErrorCodeQuotaExceeded  ErrorCode = "quota_exceeded"  // 超过组织的每日消息数配额
+	ErrorCodeDuplicateID    ErrorCode = "duplicate_id"    // 消息ID已被其它发送者或组织的消息使用
+	ErrorCodeInternal       ErrorCode = "internal_error"  // 服务端内部错误, 可重试
+)
+
+// 客户端通过 Sec-WebSocket-Protocol 协商协议版本与编码, 未携带或不支持时使用 v0
+const (
+	ProtocolV0        = ""               // v0: {"id", "type", "timestamp", "body"}, 频道消息另带 channel
+	ProtocolV1        = "mps.v1"         // v1: Envelope, JSON 文本帧
+	ProtocolV1MsgPack = "mps.v1.msgpack" // v1: Envelope, MessagePack 二进制帧
+	ProtocolV1Proto   = "mps.v1.proto"   // v1: Envelope, Protobuf 二进制帧
 )
 
+// Subprotocols 服务端支持的子协议, 客户端同时提供多个时按此顺序选择
+var Subprotocols = []string{ProtocolV1Proto, ProtocolV1MsgPack, ProtocolV1}
+
+// Envelope 收发双向的消息信封, 按连接协商的协议版本编码
+type Envelope struct {
+	Version   int               `json:"v"`
+	Type      MessageType       `json:"type"`
+	ID        string            `json:"id"`
+	Seq       int64             `json:"seq,omitempty"`      // 按用户递增的序号, 仅推送消息
+	Timestamp int64             `json:"timestamp"`          // unix 秒
+	Sender    string            `json:"sender,omitempty"`   // 发送者用户ID, 仅聊天消息
+	Payload   interface{}       `json:"payload"`            // 消息体, 对应 v0 的 body
+	Metadata  map[string]string `json:"metadata,omitempty"` // 附加信息, 如频道消息的 channel
+	Encoding  string            `json:"encoding,omitempty"` // 消息体压缩算法, 不为空时 payload 为压缩后的 JSON
+}
+
+// 消息体压缩算法, 客户端建连时通过 compression 参数选择, 仅 v1 信封支持
+const (
+	PayloadEncodingGzip   = "gzip"
+	PayloadEncodingSnappy = "snappy"
+)
+
+// ConnOptions 客户端建连时选择的连接选项
+type ConnOptions struct {
+	PayloadEncoding string // 消息体压缩算法, 为空表示不压缩
+	RemoteAddr      string // 客户端地址
+	UserAgent       string // 客户端 User-Agent
+}
+
 const (
-	MessageTypeToUsersTopic = "core.push.users"
+	MessageTypeToUsersTopic   = "core.push.users"
+	MessageTypeBroadcastTopic = "core.push.broadcast"
 )
 
+// AudienceType 消息受众类型
+type AudienceType int
+
+const (
+	AudienceTypeUsers   AudienceType = iota // 指定用户集合, 每个用户一条推送记录
+	AudienceTypeOrg                         // 组织内所有用户, 消息只存储一份, 推送记录在投递时生成
+	AudienceTypeOnline                      // 当前所有在线用户, 不做离线补推
+	AudienceTypeAll                         // 所有用户, 消息只存储一份, 推送记录在投递时生成
+	AudienceTypeChannel                     // 频道的当前订阅者, 不做离线补推
+)
+
+// ParseAudienceType 将MQ消息中的受众类型字符串转换为AudienceType, 空字符串视为指定用户集合
+func ParseAudienceType(s string) (AudienceType, bool) {
+	switch s {
+	case "", "users":
+		return AudienceTypeUsers, true
+	case "org":
+		return AudienceTypeOrg, true
+	case "online":
+		return AudienceTypeOnline, true
+	case "all":
+		return AudienceTypeAll, true
+	case "channel":
+		return AudienceTypeChannel, true
+	default:
+		return 0, false
+	}
+}
+
+// IsBroadcast 是否为只存储一份、按需生成推送记录的广播类受众
+func (t AudienceType) IsBroadcast() bool {
+	return t != AudienceTypeUsers
+}
+
+// MessagePriority 消息优先级, 推送队列中高优先级消息先于已排队的低优先级消息推送
+type MessagePriority int
+
+const (
+	MessagePriorityDefault MessagePriority = iota // 未指定, 使用 topic 配置的优先级, 缺省为普通
+	MessagePriorityLow                            // 低, 如营销推送
+	MessagePriorityNormal                         // 普通
+	MessagePriorityHigh                           // 高, 如安全通知
+)
+
+// ParseMessagePriority 将优先级字符串转换为MessagePriority, 空字符串视为未指定
+func ParseMessagePriority(s string) (MessagePriority, bool) {
+	switch s {
+	case "":
+		return MessagePriorityDefault, true
+	case "low":
+		return MessagePriorityLow, true
+	case "normal":
+		return MessagePriorityNormal, true
+	case "high":
+		return MessagePriorityHigh, true
+	default:
+		return 0, false
+	}
+}
+
 type MessagePushStatus int
 
 const (
@@ -30,48 +174,521 @@ const (
 	MessagePushStatusSending                            // 推送中
 	MessagePushStatusSuccess                            // 推送成功
 	MessagePushStatusFailed                             // 推送失败
+	MessagePushStatusAcked                              // 客户端已确认
+	MessagePushStatusExpired                            // 消息已过期, 不再推送
+	MessagePushStatusRecalled                           // 消息已撤回, 不再推送
+	MessagePushStatusAbandoned                          // 补偿次数用完仍未推送成功, 不再推送
 )
 
+func (s MessagePushStatus) String() string {
+	switch s {
+	case MessagePushStatusUnhandled:
+		return "unhandled"
+	case MessagePushStatusSending:
+		return "sending"
+	case MessagePushStatusSuccess:
+		return "success"
+	case MessagePushStatusFailed:
+		return "failed"
+	case MessagePushStatusAcked:
+		return "acked"
+	case MessagePushStatusExpired:
+		return "expired"
+	case MessagePushStatusRecalled:
+		return "recalled"
+	case MessagePushStatusAbandoned:
+		return "abandoned"
+	default:
+		return "unknown"
+	}
+}
+
 type UserInfo struct {
-	ID    string // 用户ID
-	OrgID string // 组织ID
-	Name  string // 用户名
+	ID       string // 用户ID
+	OrgID    string // 组织ID
+	Name     string // 用户名
+	TenantID string // 所属租户, 启用多租户时为组织ID, 否则为空; 连接、推送记录与收件箱按 (租户, 用户ID) 隔离
+}
+
+// ILogicsFrameCodec 按连接协商的子协议编解码消息信封
+type ILogicsFrameCodec interface {
+	Encode(envelope *Envelope) ([]byte, error)
+	Decode(data []byte) (*Envelope, error)
+	// websocket.TextMessage 或 websocket.BinaryMessage
+	FrameType() int
 }
 
 type ILogicsWsConn interface {
 	SafeClose()
-	Send(ctx context.Context, data []byte)
+	// 以普通优先级发送控制类数据(回复、在线状态等), 发送缓冲区已满时按慢连接策略处理
+	Send(ctx context.Context, envelope *Envelope)
+	// 按优先级发送推送消息, 高优先级的数据先于已排队的低优先级数据写入连接; 不会阻塞
+	// 返回错误表示消息未进入发送缓冲区(ErrSlowConsumer/ErrConnClosed); 已进入缓冲区但最终未写入连接的消息, 推送记录会被标记为推送失败以便补偿
+	// 信封在写入连接时按该连接协商的协议版本编码, 调用方不能再修改已发送的信封
+	SendMessage(ctx context.Context, envelope *Envelope, priority MessagePriority) error
+	// 按优先级发送控制类数据, 不生成推送记录; 返回错误表示未进入发送缓冲区
+	TrySend(ctx context.Context, envelope *Envelope, priority MessagePriority) error
+	// 向客户端发送关闭码与原因后关闭连接
+	Disconnect(reason string)
+	GetID() string
+	GetUserInfo() *UserInfo
+	GetInfo() *ConnInfo
+}
+
+// ConnInfo 连接信息, 用于管理接口
+type ConnInfo struct {
+	ID           string `json:"id"`
+	UserID       string `json:"user_id"`
+	OrgID        string `json:"org_id"`
+	RemoteAddr   string `json:"remote_addr"`
+	UserAgent    string `json:"user_agent"`
+	Protocol     string `json:"protocol"`       // 协商的子协议
+	ConnectedAt  int64  `json:"connected_at"`   // 建连时间(unix秒)
+	LastActiveAt int64  `json:"last_active_at"` // 最后收到客户端数据(含 pong)的时间(unix秒)
+	Buffered     int    `json:"buffered"`       // 发送缓冲区中待写入的数据条数
+	BufferSize   int    `json:"buffer_size"`    // 每个优先级的发送缓冲区容量
 }
 
 type ILogicsWsConnManager interface {
-	Add(conn *websocket.Conn, userInfo *UserInfo)
-	Get(ctx context.Context, userID string) ILogicsWsConn
-	Remove(userID string)
+	Add(conn *websocket.Conn, userInfo *UserInfo, options *ConnOptions)
+	// 获取租户内用户的所有连接(同一用户可在多个设备上登录)
+	Get(ctx context.Context, tenantID, userID string) []ILogicsWsConn
+	// 按连接ID获取连接, 不存在时返回 nil
+	GetByID(ctx context.Context, connID string) ILogicsWsConn
+	// 获取组织内所有在线用户的连接
+	GetByOrgID(ctx context.Context, orgID string) []ILogicsWsConn
+	// 获取所有在线用户的连接
+	GetAll(ctx context.Context) []ILogicsWsConn
+	// 获取本实例所有在线用户的ID: 租户ID -> 用户ID
+	GetUsers(ctx context.Context) map[string][]string
+	// 移除连接并释放所属租户的连接配额
+	Remove(conn ILogicsWsConn)
+}
+
+// PresenceStatus 用户在线状态
+type PresenceStatus string
+
+const (
+	PresenceStatusOnline  PresenceStatus = "online"  // 至少一个连接处于活跃状态
+	PresenceStatusAway    PresenceStatus = "away"    // 所有连接均处于离开状态
+	PresenceStatusOffline PresenceStatus = "offline" // 没有连接
+)
+
+type UserPresence struct {
+	OrgID       string         `json:"org_id,omitempty"` // 用户所属租户, 未启用多租户时为空
+	UserID      string         `json:"user_id"`
+	Status      PresenceStatus `json:"status"`
+	LastSeen    int64          `json:"last_seen"` // 最后活跃时间(unix秒), 从未上线为0
+	DeviceCount int            `json:"device_count"`
+}
+
+type ILogicsPresence interface {
+	// 连接建立
+	OnConnect(conn ILogicsWsConn)
+	// 连接断开
+	OnDisconnect(conn ILogicsWsConn)
+	// 客户端上报连接状态(online/away)
+	SetStatus(conn ILogicsWsConn, status PresenceStatus) error
+	// 收到客户端消息时更新最后活跃时间
+	Touch(conn ILogicsWsConn)
+	// 批量查询租户内用户的在线状态
+	Get(ctx context.Context, tenantID string, userIDs []string) ([]*UserPresence, error)
 }
 
 type LogicsMessage struct {
-	ID        string
-	Type      MessageType
-	Content   interface{}
-	Timestamp int64
-	CreatedAt time.Time
-	UpdatedAt time.Time
+	ID           string
+	OrgID        string // 消息所属租户, 启用多租户时只推送给该组织的用户; 为空表示不属于任何组织
+	Type         MessageType
+	Content      interface{}
+	Timestamp    int64
+	AudienceType AudienceType // 受众类型
+	AudienceID   string       // 受众标识, 受众类型为组织时为组织ID, 为频道时为频道名
+	SenderID     string       // 发送者用户ID, 仅聊天消息
+	RoomID       string       // 聊天室ID, 仅聊天消息
+	Topic        string       // 消息来源的MQ topic
+	CallbackURL  string       // 投递状态回调地址, 为空时使用 topic 配置的回调地址
+	DeliverAt    int64        // 定时投递时间(unix秒), 0 表示立即投递
+	ExpiresAt    int64        // 过期时间(unix秒), 0 表示永不过期
+	Priority     MessagePriority
+	RecalledAt   int64 // 撤回时间(unix秒), 0 表示未撤回
+	EditedAt     int64 // 最后编辑时间(unix秒), 0 表示未编辑
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+
+	Seq             int64             // 接收用户收件箱中的序号, 仅按用户查询时返回; 广播类消息在推送记录落库时分配序号
+	RecipientSeqs   map[string]int64  // 接收用户ID -> 收件箱序号, 仅 GetByID 返回
+	RecipientOrgIDs map[string]string // 接收用户ID -> 推送记录所属租户, 仅 GetByID 返回, 只记录与消息租户不同的用户(如全员广播的撤回事件)
+}
+
+// RecipientTenant 接收用户的推送记录所属租户, 缺省为消息所属租户
+func (m *LogicsMessage) RecipientTenant(userID string) string {
+	if tenantID, ok := m.RecipientOrgIDs[userID]; ok {
+		return tenantID
+	}
+	return m.OrgID
+}
+
+// RecipientSeq 消息在接收用户收件箱中的序号, 按用户查询时为 Seq, 否则从 RecipientSeqs 中查找
+func (m *LogicsMessage) RecipientSeq(userID string) int64 {
+	if m.Seq > 0 {
+		return m.Seq
+	}
+	return m.RecipientSeqs[userID]
+}
+
+// IsExpired 消息是否已过期, 过期消息不再推送
+func (m *LogicsMessage) IsExpired(now time.Time) bool {
+	return m.ExpiresAt > 0 && m.ExpiresAt <= now.Unix()
+}
+
+// IsRecalled 消息是否已撤回, 已撤回的消息不再推送
+func (m *LogicsMessage) IsRecalled() bool {
+	return m.RecalledAt > 0
+}
+
+// IsScheduled 消息是否尚未到定时投递时间
+func (m *LogicsMessage) IsScheduled(now time.Time) bool {
+	return m.DeliverAt > now.Unix()
 }
 
 type ILogicsMessage interface {
-	// 添加消息
-	Add(ctx context.Context, messageType MessageType, userIDs []string, messageID string, content string, timestamp int64) error
+	// 添加消息, 受众类型为指定用户集合时 userIDs 不能为空, 其余受众类型忽略 userIDs
+	// 启用多租户时校验消息所属组织并计入每日消息数配额, 超过配额返回 ErrQuotaExceeded, 跨组织投递返回 ErrCrossOrg
+	Add(ctx context.Context, message *LogicsMessage, userIDs []string) error
 	// 根据消息ID获取消息
 	GetByID(ctx context.Context, messageID string) (out *LogicsMessage, userIDs []string, err error)
-	// 根据用户ID获取待推送的消息
-	GetByUserID(ctx context.Context, userID string) (outs []*LogicsMessage, err error)
+	// 根据用户ID按收件箱序号获取 since 之后保存的待推送消息
+	GetByUserID(ctx context.Context, tenantID, userID string, since time.Time, limit int) (outs []*LogicsMessage, err error)
+	// 统计用户 before 之前保存的待推送消息数
+	CountPending(ctx context.Context, tenantID, userID string, before time.Time) (int, error)
+	// 按收件箱序号升序返回序号大于 afterSeq 的消息, 以及收件箱当前最大序号
+	Sync(ctx context.Context, tenantID, userID string, afterSeq int64, limit int) (outs []*LogicsMessage, latestSeq int64, err error)
+	// 获取用户尚未投递的组织/全员广播消息
+	GetPendingBroadcasts(ctx context.Context, userInfo *UserInfo, limit int) (outs []*LogicsMessage, err error)
 	// 更新消息状态
-	UpdateStatus(ctx context.Context, userID, msgID string, status MessagePushStatus) error
+	UpdateStatus(ctx context.Context, tenantID, userID, msgID string, status MessagePushStatus) error
+	// 更新消息状态(客户端确认), 推送记录不存在时创建(广播、在线用户、频道消息在投递后才异步生成推送记录); 不会覆盖已撤回的状态
+	UpsertStatus(ctx context.Context, tenantID, userID, msgID string, status MessagePushStatus) error
+	// 批量更新消息状态, 推送记录不存在时创建; 不会覆盖客户端已确认的状态
+	BatchUpsertStatus(ctx context.Context, items []*PushStatusUpdate) error
+	// 标记消息已读, upTo 为 true 时标记该消息及之前的所有消息, 返回本次新标记为已读的消息
+	MarkRead(ctx context.Context, tenantID, userID, msgID string, upTo bool) ([]*ReadMessage, error)
+	// 获取用户的未读消息数
+	GetUnreadCount(ctx context.Context, tenantID, userID string) (*UnreadCount, error)
+	// 获取定时投递时间不晚于 before、尚未分派推送的定时消息
+	GetDueScheduled(ctx context.Context, before time.Time, limit int) ([]*LogicsMessage, error)
+	// 抢占定时消息的推送, 多个实例或多次通知之间只有一次抢占成功
+	ClaimScheduled(ctx context.Context, messageID string) (bool, error)
+	// 获取消息的投递状态
+	GetStatus(ctx context.Context, messageID string) (*MessageStatus, error)
+	// 获取租户内指定用户中创建于 [since, before) 内、仍未推送成功且未被其它实例租用的推送记录
+	GetRedeliverable(ctx context.Context, tenantID string, userIDs []string, since, before time.Time, maxAttempts, limit int) ([]*UserMessage, error)
+	// 租用推送记录用于补偿推送, 返回 false 表示已被其它实例租用
+	ClaimRedelivery(ctx context.Context, id int64, leaseUntil time.Time) (bool, error)
+	// 将租户内指定用户中补偿次数用完仍未推送成功的推送记录标记为已放弃, 返回本次标记的记录
+	AbandonExhausted(ctx context.Context, tenantID string, userIDs []string, maxAttempts, limit int) ([]*UserMessage, error)
+	// 撤回消息并保存撤回事件 event, 返回撤回事件的接收用户; 指定用户的消息没有用户收到时不保存事件
+	Recall(ctx context.Context, messageID string, event *LogicsMessage) (userIDs []string, err error)
+	// 更新消息内容并保存编辑历史与编辑事件 event, 返回编辑事件的接收用户
+	Edit(ctx context.Context, messageID, editorID string, content interface{}, event *LogicsMessage) (userIDs []string, err error)
+	// 获取消息的编辑历史
+	GetEdits(ctx context.Context, messageID string) ([]*MessageEdit, error)
+}
+
+// MessageEdit 消息的一次编辑, Content 为编辑前的内容
+type MessageEdit struct {
+	Content  interface{} `json:"content"`
+	EditorID string      `json:"editor_id"`
+	EditedAt int64       `json:"edited_at"`
+}
+
+// UserMessage 用户的推送记录
+type UserMessage struct {
+	ID        int64
+	UserID    string
+	MessageID string
+	Status    MessagePushStatus
+	Attempts  int
+}
+
+// MessageState 消息整体状态
+type MessageState string
+
+const (
+	MessageStateScheduled MessageState = "scheduled" // 等待定时投递
+	MessageStateActive    MessageState = "active"    // 可投递
+	MessageStateExpired   MessageState = "expired"   // 已过期, 不再投递
+	MessageStateRecalled  MessageState = "recalled"  // 已撤回, 不再投递
+)
+
+type MessageStatus struct {
+	ID         string             `json:"id"`
+	State      MessageState       `json:"state"`
+	DeliverAt  int64              `json:"deliver_at"`
+	ExpiresAt  int64              `json:"expires_at"`
+	Total      int                `json:"total"`     // 推送记录数, 广播消息只统计已投递的用户
+	ByStatus   map[string]int     `json:"by_status"` // 按推送状态统计, 消息过期后未投递的记录计为 expired
+	Recipients []*RecipientStatus `json:"recipients"`
+}
+
+type RecipientStatus struct {
+	OrgID  string `json:"org_id,omitempty"`
+	UserID string `json:"user_id"`
+	Status string `json:"status"`
+	Read   bool   `json:"read"`
+}
+
+type PushStatusUpdate struct {
+	OrgID     string // 接收用户所属租户
+	UserID    string
+	MessageID string
+	Status    MessagePushStatus
+}
+
+type ReadMessage struct {
+	MessageID string
+	Type      MessageType
+	SenderID  string
+}
+
+type UnreadCount struct {
+	Total  int                 `json:"total"`
+	ByType map[MessageType]int `json:"by_type"`
+	ByRoom map[string]int      `json:"by_room"`
+}
+
+type ILogicsReadReceipt interface {
+	// 标记消息已读, 并按配置向聊天消息的发送者推送已读回执
+	MarkRead(ctx context.Context, reader *UserInfo, msgID string, upTo bool) error
+}
+
+// IChannelPolicy 频道订阅鉴权策略
+type IChannelPolicy interface {
+	// 判断用户是否有权订阅该频道
+	Authorize(ctx context.Context, userInfo *UserInfo, channel string) bool
+	// 判断用户是否有权获取另一用户的实时信息(如在线状态)
+	AuthorizePeer(ctx context.Context, userInfo *UserInfo, peerID string) bool
+}
+
+type ILogicsSubscription interface {
+	// 订阅频道, 返回订阅成功与被拒绝的频道
+	Subscribe(ctx context.Context, conn ILogicsWsConn, channels []string) (accepted, rejected []string)
+	// 取消订阅频道
+	Unsubscribe(ctx context.Context, conn ILogicsWsConn, channels []string)
+	// 连接断开时清理该连接的所有订阅
+	RemoveConn(conn ILogicsWsConn)
+	// 获取频道中属于租户的当前订阅者, 频道按租户隔离, tenantID 为空时只返回不属于任何租户的订阅者
+	GetSubscribers(ctx context.Context, tenantID, channel string) []ILogicsWsConn
+	// 连接是否已订阅该频道
+	IsSubscribed(conn ILogicsWsConn, channel string) bool
+}
+
+type ILogicsEphemeral interface {
+	// 转发临时消息, body.to 为接收用户ID 或 body.channel 为频道(发送者需已订阅), 超过发送频率限制时返回 ErrRateLimited
+	Relay(ctx context.Context, sender ILogicsWsConn, messageID string, body map[string]interface{}) error
+}
+
+// FallbackStatus 降级通知投递状态
+type FallbackStatus int
+
+const (
+	_                     FallbackStatus = iota
+	FallbackStatusSuccess                // 投递成功
+	FallbackStatusFailed                 // 投递失败
+)
+
+type ILogicsFallback interface {
+	// 启动降级通知扫描
+	Start()
+}
+
+// CallbackEvent 投递状态回调事件
+type CallbackEvent string
+
+const (
+	CallbackEventDelivered CallbackEvent = "delivered" // 已推送到客户端连接
+	CallbackEventAcked     CallbackEvent = "acked"     // 客户端已确认
+	CallbackEventFailed    CallbackEvent = "failed"    // 补偿次数用完仍未推送成功, 不再推送
+	CallbackEventExpired   CallbackEvent = "expired"   // 消息过期, 不再推送
+)
+
+type ILogicsCallback interface {
+	// 记录投递状态事件, 消息未配置回调地址时忽略
+	Emit(ctx context.Context, message *LogicsMessage, tenantID, userID string, event CallbackEvent)
+	// 同 Emit, 按消息ID加载消息
+	EmitByID(ctx context.Context, messageID, tenantID, userID string, event CallbackEvent)
+	// 启动发件箱投递
+	Start()
+}
+
+// ILogicsMessageRevision 撤回与编辑已发送的消息, 并向可能已收到消息的用户推送撤回/编辑事件
+// operator 为空表示由消息生产者(MQ/HTTP)操作, 不限制消息类型与时限; 否则为聊天消息的发送者
+type ILogicsMessageRevision interface {
+	// 撤回消息, 聊天消息的发送者只能在撤回时限内撤回自己发送的消息, 否则返回 ErrForbidden
+	Recall(ctx context.Context, operator *UserInfo, messageID string) error
+	// 编辑聊天消息的 content 字段, 发送者只能在编辑时限内编辑自己发送的消息, 否则返回 ErrForbidden
+	Edit(ctx context.Context, operator *UserInfo, messageID string, content interface{}) error
+}
+
+// RetentionRunState 清理任务状态
+type RetentionRunState string
+
+const (
+	RetentionRunStateRunning   RetentionRunState = "running"
+	RetentionRunStateSucceeded RetentionRunState = "succeeded"
+	RetentionRunStateFailed    RetentionRunState = "failed"
+)
+
+// RetentionRun 一次清理的执行记录, dry-run 时 Messages/Records 为将要删除的数量
+type RetentionRun struct {
+	ID         string             `json:"id"`
+	Trigger    string             `json:"trigger"` // schedule: 定时执行; manual: 通过接口触发
+	DryRun     bool               `json:"dry_run"`
+	State      RetentionRunState  `json:"state"`
+	StartedAt  int64              `json:"started_at"`
+	FinishedAt int64              `json:"finished_at,omitempty"`
+	Error      string             `json:"error,omitempty"`
+	Results    []*RetentionResult `json:"results"`
+}
+
+// RetentionResult 一条保留规则的清理结果
+type RetentionResult struct {
+	Rule     string `json:"rule"` // 消息类型名, 未推送成功的推送记录为 undelivered
+	MaxAge   string `json:"max_age"`
+	Messages int64  `json:"messages"`
+	Records  int64  `json:"records"`
+}
+
+type ILogicsRetention interface {
+	// 启动定期清理
+	Start()
+	// 立即执行一次清理, 已有清理在执行时返回 ErrRunInProgress
+	Trigger(dryRun bool) (*RetentionRun, error)
+	// 最近的清理记录, 按开始时间倒序
+	GetRuns() []*RetentionRun
+}
+
+// DataRequest 数据主体请求(导出/删除用户数据)
+type DataRequest struct {
+	OrgID    string // 数据主体所属租户, 未启用多租户时为空
+	UserID   string // 数据主体用户ID
+	Operator string // 发起请求的操作人
+	Reason   string // 请求原因, 如工单号
+}
+
+// ErasureResult 删除用户数据的结果
+type ErasureResult struct {
+	InboxRecords     int64  `json:"inbox_records"`     // 删除的推送记录数
+	OrphanMessages   int64  `json:"orphan_messages"`   // 因没有其它接收者而删除的消息数
+	AuthoredPolicy   string `json:"authored_policy"`   // 用户发送的聊天消息的处理方式: scrub/delete/keep
+	AuthoredMessages int64  `json:"authored_messages"` // 清除内容或删除的聊天消息数
+	AuthoredRecords  int64  `json:"authored_records"`  // 删除聊天消息时一并删除的其它接收者的推送记录数
+	OtherRows        int64  `json:"other_rows"`        // 删除的编辑记录、收件箱序号、在线状态、降级通知与回调记录数
+}
+
+// AuditLog 用户数据请求的审计日志
+type AuditLog struct {
+	ID            int64  `json:"id"`
+	Action        string `json:"action"` // export/erase
+	SubjectOrgID  string `json:"subject_org_id,omitempty"`
+	SubjectUserID string `json:"subject_user_id"`
+	Operator      string `json:"operator"`
+	Reason        string `json:"reason"`
+	Status        string `json:"status"`  // pending/succeeded/failed
+	Details       string `json:"details"` // 执行结果(JSON)
+	CreatedAt     int64  `json:"created_at"`
+	FinishedAt    int64  `json:"finished_at,omitempty"`
+}
+
+type ILogicsUserData interface {
+	// 将用户的收件箱、发送的聊天消息与编辑记录以 JSON 写入 w; 写入数据前先记录审计日志, 记录失败时不导出
+	Export(ctx context.Context, req *DataRequest, w io.Writer) error
+	// 删除用户的收件箱与个人状态, 并按配置处理用户发送的聊天消息; 可重复执行
+	Erase(ctx context.Context, req *DataRequest) (*ErasureResult, error)
+	// 按时间倒序获取用户数据请求的审计日志
+	GetAuditLogs(ctx context.Context, orgID, userID string) ([]*AuditLog, error)
+}
+
+// ILogicsContentCipher 消息内容的信封加密: 内容由数据密钥加密, 数据密钥由主密钥加密后保存
+type ILogicsContentCipher interface {
+	// 启动定期重新加载当前数据密钥
+	Start()
+	// 使用当前数据密钥加密, 密文绑定所属消息ID; 返回密文与数据密钥ID; 未启用加密时返回明文, 数据密钥ID为空
+	Encrypt(plaintext, messageID string) (content, keyID string, err error)
+	// 使用指定数据密钥解密, messageID 需与加密时相同
+	Decrypt(content, keyID, messageID string) (string, error)
+	// 将全部消息内容重新加密为当前数据密钥; newDataKey 为 true 时先生成新的数据密钥; 未启用加密时解密为明文
+	Rotate(ctx context.Context, newDataKey bool) (*RotationResult, error)
+}
+
+// RotationResult 重新加密的行数
+type RotationResult struct {
+	KeyID    string `json:"key_id"`
+	Messages int64  `json:"messages"`
+	Edits    int64  `json:"edits"`
+}
+
+// TenantUsage 组织的配额与用量
+type TenantUsage struct {
+	OrgID                     string           `json:"org_id"`
+	Connections               int              `json:"connections"`                  // 本实例上的连接数
+	MaxConnectionsPerInstance int              `json:"max_connections_per_instance"` // 单个实例上的连接数上限, 0 表示不限制
+	MessagesToday             int64            `json:"messages_today"`               // 今天(UTC)已发布的消息数
+	MaxMessagesPerDay         int64            `json:"max_messages_per_day"`         // 0 表示不限制
+	Counters                  map[string]int64 `json:"counters"`                     // 本实例上该组织的计数器
+}
+
+// ILogicsTenancy 多租户: 按组织隔离消息与连接, 并限制每个组织的连接数与每日消息数
+type ILogicsTenancy interface {
+	// 是否启用多租户
+	Enabled() bool
+	// 组织对应的租户ID, 未启用多租户时为空
+	TenantOf(orgID string) string
+	// 校验并设置消息所属租户: 未启用多租户时清空; 启用时指定用户的消息必须属于某个组织, 不属于任何组织的广播需配置 allowCrossOrg, 否则返回 ErrCrossOrg
+	CheckMessage(message *LogicsMessage) error
+	// 占用一个连接配额, 超过配额返回 ErrQuotaExceeded
+	AcquireConn(tenantID string) error
+	// 释放连接配额
+	ReleaseConn(tenantID string)
+	// 计入一条 at 当天发布的消息, 超过配额返回 ErrQuotaExceeded
+	ConsumeMessage(ctx context.Context, tenantID string, at time.Time) error
+	// 撤销 ConsumeMessage 计入的消息, 消息未保存时调用
+	RefundMessage(ctx context.Context, tenantID string, at time.Time)
+	// 获取组织的配额与用量
+	GetUsage(ctx context.Context, orgID string) (*TenantUsage, error)
+}
+
+// ConnFilter 查询连接的条件, 为空的字段不过滤
+type ConnFilter struct {
+	OrgID  string
+	UserID string
+	Limit  int // 最多返回的连接数, 按建连时间升序
+}
+
+// ConnCount 本实例的连接数
+type ConnCount struct {
+	Total int            `json:"total"`
+	ByOrg map[string]int `json:"by_org"`
+}
+
+// ILogicsConnAdmin 管理本实例的在线连接
+type ILogicsConnAdmin interface {
+	// 查询连接, 返回满足条件的连接总数与按建连时间升序的前 Limit 个连接
+	List(ctx context.Context, filter *ConnFilter) (total int, outs []*ConnInfo)
+	// 按组织统计连接数
+	Count(ctx context.Context) *ConnCount
+	// 断开单个连接, 连接不存在时返回 ErrRecordNotFound
+	Disconnect(ctx context.Context, connID, reason string) error
+	// 断开租户内用户的所有连接, 返回断开的连接数
+	DisconnectUser(ctx context.Context, tenantID, userID, reason string) int
+	// 向单个连接推送一条诊断消息, 返回消息ID; 连接不存在时返回 ErrRecordNotFound, 未进入发送缓冲区时返回 ErrSlowConsumer/ErrConnClosed
+	SendDiagnostic(ctx context.Context, connID string, content interface{}) (string, error)
 }
 
 type ILogicsMessagePush interface {
-	NotifyByNewMessage(messageID string)
-	NotifyByUserLogin(userID string)
+	// 通知推送新消息, 推送队列已满时不阻塞, 返回 ErrPushQueueFull, 调用方应稍后重试
+	NotifyByNewMessage(messageID string, priority MessagePriority) error
+	NotifyByUserLogin(userInfo *UserInfo)
 }
 
 type MessageHandler interface {
@@ -0,0 +1,213 @@
+package logics
+
+import (
+	"MessagePushService/common"
+	"MessagePushService/interfaces"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	callbackOnce     sync.Once
+	callbackInstance *callback
+)
+
+// callback 将投递状态事件写入发件箱, 再由后台任务带签名POST到生产者注册的回调地址, 失败按指数退避重试
+type callback struct {
+	logicsMessage    interfaces.ILogicsMessage
+	dbCallbackOutbox interfaces.IDBCallbackOutbox
+	httpClient       common.HTTPClient
+
+	enabled      bool
+	secret       string
+	topics       map[string]string // topic -> 回调地址
+	maxAttempts  int
+	pollInterval time.Duration
+	leaseTime    time.Duration // 抢占后其它实例在该时间内不会重复发送
+	batchLimit   int
+
+	ctx context.Context
+}
+
+func NewCallback(config *common.Config, logicsMessage interfaces.ILogicsMessage, dbCallbackOutbox interfaces.IDBCallbackOutbox, httpClient common.HTTPClient) interfaces.ILogicsCallback {
+	callbackOnce.Do(func() {
+		callbackInstance = &callback{
+			logicsMessage:    logicsMessage,
+			dbCallbackOutbox: dbCallbackOutbox,
+			httpClient:       httpClient,
+			topics:           make(map[string]string),
+			maxAttempts:      8,
+			pollInterval:     time.Second * 2,
+			leaseTime:        time.Second * 30,
+			batchLimit:       100,
+			ctx:              context.Background(),
+		}
+
+		cfg := config.Callback
+		if cfg == nil {
+			return
+		}
+		// 未配置密钥时签名形同虚设, 接收方无法校验请求来源
+		if cfg.Enabled && cfg.Secret == "" {
+			log.Fatalf("callback is enabled but callback.secret is not configured")
+		}
+		callbackInstance.enabled = cfg.Enabled
+		callbackInstance.secret = cfg.Secret
+		if cfg.Topics != nil {
+			callbackInstance.topics = cfg.Topics
+		}
+		if cfg.MaxAttempts > 0 {
+			callbackInstance.maxAttempts = cfg.MaxAttempts
+		}
+		if cfg.PollInterval > 0 {
+			callbackInstance.pollInterval = cfg.PollInterval
+		}
+	})
+
+	return callbackInstance
+}
+
+func (c *callback) Emit(ctx context.Context, message *interfaces.LogicsMessage, tenantID, userID string, event interfaces.CallbackEvent) {
+	if !c.enabled {
+		return
+	}
+	url := message.CallbackURL
+	if url == "" {
+		url = c.topics[message.Topic]
+	}
+	if url == "" {
+		return
+	}
+
+	eventID := common.NewID()
+	payload, err := json.Marshal(map[string]interface{}{
+		"event_id":    eventID,
+		"event":       event,
+		"message_id":  message.ID,
+		"org_id":      tenantID,
+		"user_id":     userID,
+		"topic":       message.Topic,
+		"occurred_at": time.Now().Unix(),
+	})
+	if err != nil {
+		log.Printf("[ERROR] marshal callback payload error: %v", err)
+		return
+	}
+
+	err = c.dbCallbackOutbox.Add(ctx, &interfaces.DBCallbackOutbox{
+		EventID:   eventID,
+		MessageID: message.ID,
+		OrgID:     tenantID,
+		UserID:    userID,
+		Event:     string(event),
+		URL:       url,
+		Payload:   string(payload),
+	})
+	if err != nil {
+		log.Printf("[ERROR] add callback outbox error: %v", err)
+	}
+}
+
+func (c *callback) EmitByID(ctx context.Context, messageID, tenantID, userID string, event interfaces.CallbackEvent) {
+	if !c.enabled {
+		return
+	}
+	message, _, err := c.logicsMessage.GetByID(ctx, messageID)
+	if err != nil || message == nil {
+		return
+	}
+	c.Emit(ctx, message, tenantID, userID, event)
+}
+
+func (c *callback) Start() {
+	if !c.enabled {
+		return
+	}
+	go c.deliveryWorker()
+}
+
+func (c *callback) deliveryWorker() {
+	ticker := time.NewTicker(c.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			log.Printf("[DEBUG] callback deliveryWorker receive close signal")
+			return
+		case <-ticker.C:
+			outboxes, err := c.dbCallbackOutbox.GetDue(c.ctx, c.batchLimit)
+			if err != nil {
+				log.Printf("[ERROR] get due callback outbox error: %v", err)
+				continue
+			}
+			for _, outbox := range outboxes {
+				ok, err := c.dbCallbackOutbox.Claim(c.ctx, outbox.ID, time.Now().Add(c.leaseTime))
+				if err != nil {
+					log.Printf("[ERROR] claim callback outbox error: %v", err)
+					continue
+				}
+				if !ok {
+					continue
+				}
+				c.deliver(outbox)
+			}
+		}
+	}
+}
+
+func (c *callback) deliver(outbox *interfaces.DBCallbackOutbox) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	header := map[string]interface{}{
+		"X-Callback-Event":     outbox.Event,
+		"X-Callback-Event-ID":  outbox.EventID,
+		"X-Callback-Timestamp": timestamp,
+		"X-Callback-Signature": "sha256=" + c.sign(timestamp, outbox.Payload),
+	}
+
+	ctx, cancel := context.WithTimeout(c.ctx, time.Second*10)
+	defer cancel()
+
+	_, _, err := c.httpClient.POSTRaw(ctx, outbox.URL, header, []byte(outbox.Payload))
+	if err == nil {
+		if err = c.dbCallbackOutbox.MarkSent(c.ctx, outbox.ID); err != nil {
+			log.Printf("[ERROR] mark callback outbox sent error: %v", err)
+		}
+		return
+	}
+
+	attempts := outbox.Attempts + 1
+	dead := attempts >= c.maxAttempts
+	log.Printf("[WARN] deliver callback error, eventID: %s, attempts: %d, dead: %v, error: %v", outbox.EventID, attempts, dead, err)
+	err = c.dbCallbackOutbox.MarkFailed(c.ctx, outbox.ID, time.Now().Add(backoff(attempts)), dead, truncate(err.Error(), 512))
+	if err != nil {
+		log.Printf("[ERROR] mark callback outbox failed error: %v", err)
+	}
+}
+
+// sign 签名内容为 "{timestamp}.{payload}", 接收方用同一密钥校验并拒绝时间戳过旧的请求以防重放
+func (c *callback) sign(timestamp, payload string) string {
+	mac := hmac.New(sha256.New, []byte(c.secret))
+	mac.Write([]byte(fmt.Sprintf("%s.%s", timestamp, payload)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// backoff 第 n 次失败后的重试间隔: 2^n 秒, 最长10分钟
+func backoff(attempts int) time.Duration {
+	if attempts > 10 {
+		return time.Minute * 10
+	}
+	d := time.Second << uint(attempts)
+	if d > time.Minute*10 {
+		d = time.Minute * 10
+	}
+	return d
+}
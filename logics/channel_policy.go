@@ -0,0 +1,73 @@
+package logics
+
+import (
+	"MessagePushService/common"
+	"MessagePushService/interfaces"
+	"context"
+	"log"
+	"regexp"
+	"strings"
+)
+
+var channelNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_\-.:]{1,128}$`)
+
+// channelPolicy 默认的频道订阅鉴权策略
+//   - user:{userID}:* 仅用户本人可订阅
+//   - org:{orgID}:* 仅组织内用户可订阅
+//   - presence:{userID} 用户本人及同一租户内与其互发过聊天消息的用户可订阅
+//   - 配置中 publicPrefixes 指定前缀的频道所有已登录用户均可订阅
+//   - 其余频道(包括 device:{deviceID}:*)一律拒绝
+//
+// 需要更细粒度的鉴权(比如校验设备归属)时, 实现 interfaces.IChannelPolicy 替换即可。
+type channelPolicy struct {
+	dbMessage      interfaces.IDBMessage
+	publicPrefixes []string
+}
+
+func NewChannelPolicy(config *common.Config, dbMessage interfaces.IDBMessage) interfaces.IChannelPolicy {
+	policy := &channelPolicy{dbMessage: dbMessage}
+	if config.Subscription != nil {
+		policy.publicPrefixes = config.Subscription.PublicPrefixes
+	}
+	return policy
+}
+
+func (p *channelPolicy) Authorize(ctx context.Context, userInfo *interfaces.UserInfo, channel string) bool {
+	if !channelNameRegexp.MatchString(channel) {
+		return false
+	}
+
+	if strings.HasPrefix(channel, "user:") {
+		return strings.HasPrefix(channel, "user:"+userInfo.ID+":")
+	}
+	if strings.HasPrefix(channel, "org:") {
+		return userInfo.OrgID != "" && strings.HasPrefix(channel, "org:"+userInfo.OrgID+":")
+	}
+	if strings.HasPrefix(channel, presenceChannelPrefix) {
+		return p.AuthorizePeer(ctx, userInfo, strings.TrimPrefix(channel, presenceChannelPrefix))
+	}
+
+	for _, prefix := range p.publicPrefixes {
+		if strings.HasPrefix(channel, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthorizePeer 用户本人, 或同一租户内与其互发过聊天消息的用户
+func (p *channelPolicy) AuthorizePeer(ctx context.Context, userInfo *interfaces.UserInfo, peerID string) bool {
+	if peerID == "" {
+		return false
+	}
+	if peerID == userInfo.ID {
+		return true
+	}
+
+	ok, err := p.dbMessage.HasChatted(ctx, userInfo.TenantID, userInfo.ID, peerID)
+	if err != nil {
+		log.Printf("[ERROR] check chat relation error, %v, userID: %s, peerID: %s", err, userInfo.ID, peerID)
+		return false
+	}
+	return ok
+}
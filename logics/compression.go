@@ -0,0 +1,131 @@
+package logics
+
+import (
+	"MessagePushService/common"
+	"MessagePushService/interfaces"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/golang/snappy"
+)
+
+// compressionPolicy 下行消息的压缩级别与阈值
+type compressionPolicy struct {
+	level     int
+	threshold int
+}
+
+func newCompressionPolicy(config *common.Config) *compressionPolicy {
+	p := &compressionPolicy{
+		level:     flate.BestSpeed,
+		threshold: 1024,
+	}
+	if cfg := config.Compression; cfg != nil {
+		if cfg.Level >= flate.BestSpeed && cfg.Level <= flate.BestCompression {
+			p.level = cfg.Level
+		}
+		if cfg.Threshold > 0 {
+			p.threshold = cfg.Threshold
+		}
+	}
+	return p
+}
+
+// compressEnvelope 压缩消息体, 消息体编码后小于阈值时返回原信封
+func compressEnvelope(envelope *interfaces.Envelope, encoding string, threshold int) (*interfaces.Envelope, error) {
+	data, err := json.Marshal(envelope.Payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < threshold {
+		return envelope, nil
+	}
+
+	var compressed []byte
+	switch encoding {
+	case interfaces.PayloadEncodingGzip:
+		var buf bytes.Buffer
+		w, _ := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+		w.Write(data)
+		err = w.Close()
+		if err != nil {
+			return nil, err
+		}
+		compressed = buf.Bytes()
+	case interfaces.PayloadEncodingSnappy:
+		compressed = snappy.Encode(nil, data)
+	default:
+		return nil, fmt.Errorf("unsupported payload encoding %s", encoding)
+	}
+
+	out := *envelope
+	out.Payload = compressed
+	out.Encoding = encoding
+	return &out, nil
+}
+
+// maxDecompressRatio 上行消息体解压后的大小上限为单条上行消息大小限制的倍数, 避免解压小体积的恶意数据耗尽内存
+const maxDecompressRatio = 16
+
+// decompressEnvelope 解压客户端发送的压缩消息体, JSON 与 Protobuf 编码时 payload 为 base64 字符串; 解压后超过 maxSize 字节时返回 invalid_body
+func decompressEnvelope(envelope *interfaces.Envelope, maxSize int64) error {
+	if envelope.Encoding == "" {
+		return nil
+	}
+
+	var data []byte
+	switch v := envelope.Payload.(type) {
+	case []byte:
+		data = v
+	case string:
+		var err error
+		data, err = base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return newFrameError(interfaces.ErrorCodeInvalidBody, "compressed payload is not base64")
+		}
+	default:
+		return newFrameError(interfaces.ErrorCodeInvalidBody, "compressed payload is not bytes")
+	}
+
+	var err error
+	switch envelope.Encoding {
+	case interfaces.PayloadEncodingGzip:
+		var r *gzip.Reader
+		r, err = gzip.NewReader(bytes.NewReader(data))
+		if err == nil {
+			data, err = io.ReadAll(io.LimitReader(r, maxSize+1))
+		}
+		if err == nil && int64(len(data)) > maxSize {
+			return newFrameError(interfaces.ErrorCodeInvalidBody, "decompressed payload too large")
+		}
+	case interfaces.PayloadEncodingSnappy:
+		// 解压前按头部记录的长度检查, 不分配超过上限的内存
+		var n int
+		n, err = snappy.DecodedLen(data)
+		if err == nil && int64(n) > maxSize {
+			return newFrameError(interfaces.ErrorCodeInvalidBody, "decompressed payload too large")
+		}
+		if err == nil {
+			data, err = snappy.Decode(nil, data)
+		}
+	default:
+		return newFrameError(interfaces.ErrorCodeInvalidMessage, fmt.Sprintf("unsupported payload encoding %s", envelope.Encoding))
+	}
+	if err != nil {
+		return newFrameError(interfaces.ErrorCodeInvalidBody, "decompress payload error")
+	}
+
+	var payload interface{}
+	err = json.Unmarshal(data, &payload)
+	if err != nil {
+		return newFrameError(interfaces.ErrorCodeInvalidBody, "decompressed payload is not a valid json")
+	}
+	envelope.Payload = payload
+	envelope.Encoding = ""
+	return nil
+}
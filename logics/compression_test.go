@@ -0,0 +1,148 @@
+package logics
+
+import (
+	"MessagePushService/interfaces"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/golang/snappy"
+)
+
+func TestDecompressEnvelopeLimit(t *testing.T) {
+	payload := map[string]interface{}{"content": strings.Repeat("a", 4096)}
+	for _, encoding := range []string{interfaces.PayloadEncodingGzip, interfaces.PayloadEncodingSnappy} {
+		compressed, err := compressEnvelope(&interfaces.Envelope{Payload: payload}, encoding, 0)
+		if err != nil {
+			t.Fatalf("%s compress error: %v", encoding, err)
+		}
+
+		envelope := *compressed
+		err = decompressEnvelope(&envelope, 1024)
+		var frameErr *frameError
+		if !errors.As(err, &frameErr) || frameErr.code != interfaces.ErrorCodeInvalidBody {
+			t.Fatalf("%s decompress over limit, expect invalid_body, got %v", encoding, err)
+		}
+
+		envelope = *compressed
+		err = decompressEnvelope(&envelope, 8192)
+		if err != nil {
+			t.Fatalf("%s decompress error: %v", encoding, err)
+		}
+		if envelope.Encoding != "" || envelope.Payload.(map[string]interface{})["content"] != payload["content"] {
+			t.Fatalf("%s decompress mismatch: %+v", encoding, envelope)
+		}
+	}
+}
+
+// BenchmarkPayloadCompression 比较典型消息体在各压缩算法下的大小与耗时, 用于确定 compression.threshold 与 compression.level
+//
+//	go test -bench PayloadCompression ./logics
+func BenchmarkPayloadCompression(b *testing.B) {
+	payloads := []struct {
+		name string
+		data []byte
+	}{
+		{"notification", mustMarshal(b, notification())},
+		{"chat", mustMarshal(b, chat())},
+		{"order-list", mustMarshal(b, orderList(50))},
+		{"rich-text", mustMarshal(b, richText())},
+	}
+
+	algorithms := []struct {
+		name     string
+		compress func([]byte) []byte
+	}{
+		{"deflate-1", deflate(flate.BestSpeed)},
+		{"deflate-6", deflate(flate.DefaultCompression)},
+		{"gzip", gzipCompress},
+		{"snappy", func(data []byte) []byte { return snappy.Encode(nil, data) }},
+	}
+
+	for _, payload := range payloads {
+		for _, algorithm := range algorithms {
+			b.Run(payload.name+"/"+algorithm.name, func(b *testing.B) {
+				var out []byte
+				for i := 0; i < b.N; i++ {
+					out = algorithm.compress(payload.data)
+				}
+				b.ReportMetric(float64(len(payload.data)), "bytes")
+				b.ReportMetric(float64(len(out))*100/float64(len(payload.data)), "ratio%")
+			})
+		}
+	}
+}
+
+func deflate(level int) func([]byte) []byte {
+	return func(data []byte) []byte {
+		var buf bytes.Buffer
+		w, _ := flate.NewWriter(&buf, level)
+		w.Write(data)
+		w.Close()
+		return buf.Bytes()
+	}
+}
+
+func gzipCompress(data []byte) []byte {
+	var buf bytes.Buffer
+	w, _ := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+func mustMarshal(b *testing.B, v interface{}) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return data
+}
+
+func notification() map[string]interface{} {
+	return map[string]interface{}{
+		"title":   "订单已发货",
+		"content": "您的订单 202311150001 已发货",
+		"link":    "https://example.com/orders/202311150001",
+	}
+}
+
+func chat() map[string]interface{} {
+	return map[string]interface{}{
+		"from":    "10001",
+		"to":      "10002",
+		"room_id": "room-42",
+		"content": strings.Repeat("明天下午三点在会议室讨论发布计划, 请提前准备好测试报告。", 8),
+	}
+}
+
+func orderList(n int) map[string]interface{} {
+	orders := make([]interface{}, 0, n)
+	for i := 0; i < n; i++ {
+		orders = append(orders, map[string]interface{}{
+			"id":       fmt.Sprintf("2023111500%04d", i),
+			"status":   "shipped",
+			"amount":   199.5 + float64(i),
+			"currency": "CNY",
+			"items": []interface{}{
+				map[string]interface{}{"sku": fmt.Sprintf("sku-%d", i), "name": "无线蓝牙耳机", "quantity": 1},
+				map[string]interface{}{"sku": fmt.Sprintf("sku-%d", i+1), "name": "充电数据线", "quantity": 2},
+			},
+			"address": "上海市浦东新区世纪大道 100 号",
+		})
+	}
+	return map[string]interface{}{"title": "今日订单汇总", "orders": orders}
+}
+
+func richText() map[string]interface{} {
+	var b strings.Builder
+	for i := 0; i < 40; i++ {
+		fmt.Fprintf(&b, "<p>第 %d 段: 系统将于本周六凌晨进行例行维护, 维护期间部分功能不可用, 给您带来的不便敬请谅解。</p>", i)
+	}
+	return map[string]interface{}{"title": "系统维护公告", "html": b.String()}
+}
@@ -0,0 +1,123 @@
+package logics
+
+import (
+	"MessagePushService/common"
+	"MessagePushService/interfaces"
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	connAdminOnce     sync.Once
+	connAdminInstance *connAdmin
+)
+
+// closeCodeAdminDisconnect 运维通过管理接口断开连接时发送给客户端的关闭码
+const closeCodeAdminDisconnect = 4009
+
+// closeReasonMaxLen 关闭帧的原因最长 123 字节
+const closeReasonMaxLen = 123
+
+type connAdmin struct {
+	wsConnManager interfaces.ILogicsWsConnManager
+}
+
+func NewConnAdmin(wsConnManager interfaces.ILogicsWsConnManager) interfaces.ILogicsConnAdmin {
+	connAdminOnce.Do(func() {
+		connAdminInstance = &connAdmin{
+			wsConnManager: wsConnManager,
+		}
+	})
+
+	return connAdminInstance
+}
+
+func (a *connAdmin) List(ctx context.Context, filter *interfaces.ConnFilter) (total int, outs []*interfaces.ConnInfo) {
+	for _, conn := range a.wsConnManager.GetAll(ctx) {
+		userInfo := conn.GetUserInfo()
+		if filter.OrgID != "" && userInfo.OrgID != filter.OrgID {
+			continue
+		}
+		if filter.UserID != "" && userInfo.ID != filter.UserID {
+			continue
+		}
+		outs = append(outs, conn.GetInfo())
+	}
+
+	sort.Slice(outs, func(i, j int) bool {
+		if outs[i].ConnectedAt != outs[j].ConnectedAt {
+			return outs[i].ConnectedAt < outs[j].ConnectedAt
+		}
+		return outs[i].ID < outs[j].ID
+	})
+	total = len(outs)
+	if filter.Limit > 0 && len(outs) > filter.Limit {
+		outs = outs[:filter.Limit]
+	}
+	return total, outs
+}
+
+func (a *connAdmin) Count(ctx context.Context) *interfaces.ConnCount {
+	out := &interfaces.ConnCount{ByOrg: make(map[string]int)}
+	for _, conn := range a.wsConnManager.GetAll(ctx) {
+		out.Total++
+		out.ByOrg[conn.GetUserInfo().OrgID]++
+	}
+	return out
+}
+
+func (a *connAdmin) Disconnect(ctx context.Context, connID, reason string) error {
+	conn := a.wsConnManager.GetByID(ctx, connID)
+	if conn == nil {
+		return fmt.Errorf("%w, connID: %s", interfaces.ErrRecordNotFound, connID)
+	}
+
+	a.disconnect(conn, reason)
+	return nil
+}
+
+// DisconnectUser 关闭连接需要等待写协程发送关闭帧后退出, 各连接在后台并行关闭, 不阻塞请求
+func (a *connAdmin) DisconnectUser(ctx context.Context, tenantID, userID, reason string) int {
+	conns := a.wsConnManager.Get(ctx, tenantID, userID)
+	for _, conn := range conns {
+		a.logDisconnect(conn, reason)
+		go conn.Disconnect(reason)
+	}
+	return len(conns)
+}
+
+func (a *connAdmin) disconnect(conn interfaces.ILogicsWsConn, reason string) {
+	a.logDisconnect(conn, reason)
+	conn.Disconnect(reason)
+}
+
+func (a *connAdmin) logDisconnect(conn interfaces.ILogicsWsConn, reason string) {
+	log.Printf("[INFO] disconnect connection by admin, connID: %s, userID: %s, reason: %s", conn.GetID(), conn.GetUserInfo().ID, reason)
+	common.IncCounter(common.MetricAdminDisconnect)
+}
+
+// SendDiagnostic 诊断消息以高优先级发送, 越过已排队的推送消息, 可用于确认连接的写通路是否正常
+func (a *connAdmin) SendDiagnostic(ctx context.Context, connID string, content interface{}) (string, error) {
+	conn := a.wsConnManager.GetByID(ctx, connID)
+	if conn == nil {
+		return "", fmt.Errorf("%w, connID: %s", interfaces.ErrRecordNotFound, connID)
+	}
+
+	now := time.Now().Unix()
+	id := common.NewID()
+	envelope := newEnvelope(id, interfaces.MessageTypeDiagnostic, map[string]interface{}{
+		"content": content,
+		"sent_at": now,
+	}, now)
+	err := conn.TrySend(ctx, envelope, interfaces.MessagePriorityHigh)
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("[INFO] send diagnostic message, connID: %s, userID: %s, messageID: %s", connID, conn.GetUserInfo().ID, id)
+	return id, nil
+}
@@ -0,0 +1,339 @@
+package logics
+
+import (
+	"MessagePushService/common"
+	"MessagePushService/interfaces"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	contentCipherOnce     sync.Once
+	contentCipherInstance *contentCipher
+)
+
+var errNoKeyProvider = errors.New("encryption key provider is not configured")
+
+// cipherPrefix 密文格式的版本前缀
+const cipherPrefix = "v2:"
+
+type dataKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// contentCipher 信封加密: 消息内容使用 AES-256-GCM 数据密钥加密, 以所属消息ID作为附加认证数据, 保存为 "v2:" + base64(nonce + 密文) 与数据密钥ID;
+// 密文被复制到其它消息的行时解密失败, 不是该格式的密文拒绝解密
+// 数据密钥由主密钥提供方加密后保存在 t_data_key, 使用时解密并缓存在内存中
+type contentCipher struct {
+	keyProvider interfaces.IDrivenKeyProvider
+	dbDataKey   interfaces.IDBDataKey
+
+	enabled         bool
+	refreshInterval time.Duration
+	batchSize       int
+
+	mu      sync.RWMutex
+	current *dataKey            // 新内容使用的数据密钥, 未启用加密时为 nil
+	keys    map[string]*dataKey // 数据密钥ID -> 已解密的数据密钥
+
+	ctx context.Context
+}
+
+func NewContentCipher(config *common.Config, keyProvider interfaces.IDrivenKeyProvider, dbDataKey interfaces.IDBDataKey) interfaces.ILogicsContentCipher {
+	contentCipherOnce.Do(func() {
+		contentCipherInstance = &contentCipher{
+			keyProvider:     keyProvider,
+			dbDataKey:       dbDataKey,
+			refreshInterval: time.Minute,
+			batchSize:       500,
+			keys:            make(map[string]*dataKey),
+			ctx:             context.Background(),
+		}
+
+		cfg := config.Encryption
+		if cfg == nil {
+			return
+		}
+		contentCipherInstance.enabled = cfg.Enabled
+		if cfg.RefreshInterval > 0 {
+			contentCipherInstance.refreshInterval = cfg.RefreshInterval
+		}
+		if cfg.BatchSize > 0 {
+			contentCipherInstance.batchSize = cfg.BatchSize
+		}
+		if !cfg.Enabled {
+			return
+		}
+		if keyProvider == nil {
+			log.Fatalf("encryption is enabled but encryption.keyFile is not configured")
+		}
+		err := contentCipherInstance.loadCurrent()
+		if err != nil {
+			log.Fatalf("Failed to load data key: %v", err)
+		}
+	})
+
+	return contentCipherInstance
+}
+
+// Start 定期重新加载当前数据密钥, 其它实例轮换数据密钥后本实例随之使用新密钥
+func (c *contentCipher) Start() {
+	if !c.enabled {
+		return
+	}
+	go c.refreshWorker()
+}
+
+func (c *contentCipher) refreshWorker() {
+	ticker := time.NewTicker(c.refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			log.Printf("[DEBUG] contentCipher refreshWorker receive close signal")
+			return
+		case <-ticker.C:
+			err := c.loadCurrent()
+			if err != nil {
+				log.Printf("[ERROR] refresh data key error: %v", err)
+			}
+		}
+	}
+}
+
+func (c *contentCipher) Encrypt(plaintext, messageID string) (content, keyID string, err error) {
+	c.mu.RLock()
+	key := c.current
+	c.mu.RUnlock()
+
+	if key == nil {
+		return plaintext, "", nil
+	}
+	content, err = seal(key, plaintext, messageID)
+	if err != nil {
+		return "", "", err
+	}
+	return content, key.id, nil
+}
+
+func (c *contentCipher) Decrypt(content, keyID, messageID string) (string, error) {
+	if keyID == "" {
+		return content, nil
+	}
+	key, err := c.getKey(keyID)
+	if err != nil {
+		return "", err
+	}
+
+	if !strings.HasPrefix(content, cipherPrefix) {
+		return "", fmt.Errorf("unsupported encrypted content format, dataKeyID: %s, messageID: %s", keyID, messageID)
+	}
+	data, err := base64.StdEncoding.DecodeString(content[len(cipherPrefix):])
+	if err != nil {
+		return "", fmt.Errorf("decode encrypted content error, %w", err)
+	}
+	if len(data) < key.aead.NonceSize() {
+		return "", errors.New("encrypted content is too short")
+	}
+	nonce, ciphertext := data[:key.aead.NonceSize()], data[key.aead.NonceSize():]
+	plaintext, err := key.aead.Open(nil, nonce, ciphertext, []byte(messageID))
+	if err != nil {
+		return "", fmt.Errorf("decrypt content error, %w, dataKeyID: %s, messageID: %s", err, keyID, messageID)
+	}
+	return string(plaintext), nil
+}
+
+// Rotate 按主键顺序分批读取数据密钥不是当前数据密钥的内容, 解密后使用当前数据密钥重新加密;
+// 轮换期间其它实例仍可能使用旧数据密钥保存新内容, 在 refreshInterval 之后再执行一次即可
+func (c *contentCipher) Rotate(ctx context.Context, newDataKey bool) (*interfaces.RotationResult, error) {
+	if newDataKey {
+		if !c.enabled {
+			return nil, errors.New("encryption is not enabled")
+		}
+		err := c.createDataKey(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c.mu.RLock()
+	target := c.current
+	c.mu.RUnlock()
+
+	result := &interfaces.RotationResult{}
+	if target != nil {
+		result.KeyID = target.id
+	}
+	var err error
+	result.Messages, err = c.rotateTable(ctx, interfaces.ContentTableMessage, target)
+	if err != nil {
+		return result, err
+	}
+	result.Edits, err = c.rotateTable(ctx, interfaces.ContentTableEdit, target)
+	if err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// rotateTable target 为 nil 时解密为明文
+func (c *contentCipher) rotateTable(ctx context.Context, table interfaces.ContentTable, target *dataKey) (int64, error) {
+	var targetID string
+	if target != nil {
+		targetID = target.id
+	}
+
+	var total int64
+	var afterID string
+	for {
+		contents, err := c.dbDataKey.GetStaleContents(ctx, table, targetID, afterID, c.batchSize)
+		if err != nil {
+			return total, err
+		}
+		if len(contents) == 0 {
+			return total, nil
+		}
+
+		for _, v := range contents {
+			plaintext, err := c.Decrypt(v.Content, v.KeyID, v.MessageID)
+			if err != nil {
+				return total, fmt.Errorf("%w, table: %s, id: %s", err, table, v.ID)
+			}
+			v.Content, v.KeyID = plaintext, targetID
+			if target != nil {
+				v.Content, err = seal(target, plaintext, v.MessageID)
+				if err != nil {
+					return total, err
+				}
+			}
+		}
+
+		n, err := c.dbDataKey.UpdateContents(ctx, table, contents)
+		if err != nil {
+			return total, err
+		}
+		total += n
+		afterID = contents[len(contents)-1].ID
+		log.Printf("[INFO] re-encrypted %d rows of %s, total: %d", n, table, total)
+		if len(contents) < c.batchSize {
+			return total, nil
+		}
+	}
+}
+
+// loadCurrent 使用当前主密钥最新的数据密钥, 不存在时生成
+func (c *contentCipher) loadCurrent() error {
+	ctx, cancel := context.WithTimeout(c.ctx, time.Second*5)
+	defer cancel()
+
+	latest, err := c.dbDataKey.GetLatest(ctx, c.keyProvider.CurrentKeyID())
+	if err != nil {
+		return err
+	}
+	if latest == nil {
+		return c.createDataKey(ctx)
+	}
+
+	key, err := c.unwrap(ctx, latest)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.current = key
+	return nil
+}
+
+func (c *contentCipher) createDataKey(ctx context.Context) error {
+	masterKeyID, plaintext, wrapped, err := c.keyProvider.GenerateDataKey(ctx)
+	if err != nil {
+		return fmt.Errorf("generate data key error, %w", err)
+	}
+	key, err := newDataKey(common.NewID(), plaintext)
+	if err != nil {
+		return err
+	}
+	err = c.dbDataKey.Add(ctx, &interfaces.DBDataKey{
+		ID:          key.id,
+		MasterKeyID: masterKeyID,
+		WrappedKey:  wrapped,
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[INFO] data key created, id: %s, masterKeyID: %s", key.id, masterKeyID)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.keys[key.id] = key
+	c.current = key
+	return nil
+}
+
+func (c *contentCipher) getKey(keyID string) (*dataKey, error) {
+	c.mu.RLock()
+	key, ok := c.keys[keyID]
+	c.mu.RUnlock()
+	if ok {
+		return key, nil
+	}
+	if c.keyProvider == nil {
+		return nil, errNoKeyProvider
+	}
+
+	ctx, cancel := context.WithTimeout(c.ctx, time.Second*5)
+	defer cancel()
+	dbKey, err := c.dbDataKey.GetByID(ctx, keyID)
+	if err != nil {
+		return nil, err
+	}
+	return c.unwrap(ctx, dbKey)
+}
+
+func (c *contentCipher) unwrap(ctx context.Context, dbKey *interfaces.DBDataKey) (*dataKey, error) {
+	plaintext, err := c.keyProvider.DecryptDataKey(ctx, dbKey.MasterKeyID, dbKey.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt data key error, %w, dataKeyID: %s", err, dbKey.ID)
+	}
+	key, err := newDataKey(dbKey.ID, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.keys[key.id] = key
+	return key, nil
+}
+
+func newDataKey(id string, plaintext []byte) (*dataKey, error) {
+	block, err := aes.NewCipher(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &dataKey{id: id, aead: aead}, nil
+}
+
+func seal(key *dataKey, plaintext, messageID string) (string, error) {
+	nonce := make([]byte, key.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	return cipherPrefix + base64.StdEncoding.EncodeToString(key.aead.Seal(nonce, nonce, []byte(plaintext), []byte(messageID))), nil
+}
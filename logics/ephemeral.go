@@ -0,0 +1,82 @@
+package logics
+
+import (
+	"MessagePushService/common"
+	"MessagePushService/interfaces"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	ephemeralOnce     sync.Once
+	ephemeralInstance *ephemeral
+)
+
+// ephemeral 临时消息(正在输入/实时光标/正在查看等)直接转发给在线接收者, 不写入数据库
+type ephemeral struct {
+	wsConnManager interfaces.ILogicsWsConnManager
+	subscription  interfaces.ILogicsSubscription
+	policy        interfaces.IChannelPolicy
+	limiter       *common.KeyedLimiter // 按发送者限流
+}
+
+func NewEphemeral(config *common.Config, wsConnManager interfaces.ILogicsWsConnManager, subscription interfaces.ILogicsSubscription, policy interfaces.IChannelPolicy) interfaces.ILogicsEphemeral {
+	ephemeralOnce.Do(func() {
+		r, burst := 5.0, 10
+		if config.Ephemeral != nil {
+			if config.Ephemeral.Rate > 0 {
+				r = config.Ephemeral.Rate
+			}
+			if config.Ephemeral.Burst > 0 {
+				burst = config.Ephemeral.Burst
+			}
+		}
+		ephemeralInstance = &ephemeral{
+			wsConnManager: wsConnManager,
+			subscription:  subscription,
+			policy:        policy,
+			limiter:       common.NewKeyedLimiter(r, burst),
+		}
+	})
+
+	return ephemeralInstance
+}
+
+func (e *ephemeral) Relay(ctx context.Context, sender interfaces.ILogicsWsConn, messageID string, body map[string]interface{}) (err error) {
+	senderInfo := sender.GetUserInfo()
+	senderID := senderInfo.ID
+	if !e.limiter.Allow(senderInfo.TenantID + "/" + senderID) {
+		return interfaces.ErrRateLimited
+	}
+
+	var recipients []interfaces.ILogicsWsConn
+	if to, ok := body["to"].(string); ok && to != "" {
+		// 只能发送给同一租户内、与发送者有关系的用户, 与订阅其在线状态的鉴权一致
+		if !e.policy.AuthorizePeer(ctx, senderInfo, to) {
+			return fmt.Errorf("%w, not allowed to send to user %s", interfaces.ErrForbidden, to)
+		}
+		recipients = e.wsConnManager.Get(ctx, senderInfo.TenantID, to)
+	} else if channel, ok := body["channel"].(string); ok && channel != "" {
+		if !e.subscription.IsSubscribed(sender, channel) {
+			return fmt.Errorf("sender is not subscribed to channel %s", channel)
+		}
+		recipients = e.subscription.GetSubscribers(ctx, senderInfo.TenantID, channel)
+	} else {
+		return fmt.Errorf("body.to or body.channel is required")
+	}
+
+	// 发送者身份以服务端为准, 不信任客户端上报的 from
+	body["from"] = senderID
+	envelope := newEnvelope(messageID, interfaces.MessageTypeEphemeral, body, time.Now().Unix())
+	envelope.Sender = senderID
+
+	for _, conn := range recipients {
+		if conn == sender {
+			continue
+		}
+		conn.Send(ctx, envelope)
+	}
+	return nil
+}
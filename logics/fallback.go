@@ -0,0 +1,192 @@
+package logics
+
+import (
+	"MessagePushService/common"
+	"MessagePushService/interfaces"
+	"context"
+	"log"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	fallbackOnce     sync.Once
+	fallbackInstance *fallback
+)
+
+// fallback 消息在规则指定的延迟后仍未被客户端确认(用户离线或未回复ACK), 通过 webhook/邮件/移动推送等通道降级通知
+type fallback struct {
+	logicsMessage interfaces.ILogicsMessage
+	dbFallback    interfaces.IDBFallback
+	userContact   interfaces.IDrivenUserContact
+	channels      map[string]interfaces.IDrivenFallbackChannel
+
+	rules        []*common.FallbackRule
+	scanInterval time.Duration
+	maxAge       time.Duration
+	maxAttempts  int
+	batchLimit   int
+
+	ctx context.Context
+}
+
+func NewFallback(config *common.Config, logicsMessage interfaces.ILogicsMessage, dbFallback interfaces.IDBFallback, userContact interfaces.IDrivenUserContact, channels []interfaces.IDrivenFallbackChannel) interfaces.ILogicsFallback {
+	fallbackOnce.Do(func() {
+		fallbackInstance = &fallback{
+			logicsMessage: logicsMessage,
+			dbFallback:    dbFallback,
+			userContact:   userContact,
+			channels:      make(map[string]interfaces.IDrivenFallbackChannel, len(channels)),
+			scanInterval:  time.Second * 30,
+			maxAge:        time.Hour * 24,
+			maxAttempts:   3,
+			batchLimit:    100,
+			ctx:           context.Background(),
+		}
+		for _, channel := range channels {
+			fallbackInstance.channels[channel.Name()] = channel
+		}
+
+		cfg := config.Fallback
+		if cfg == nil {
+			return
+		}
+		if cfg.ScanInterval > 0 {
+			fallbackInstance.scanInterval = cfg.ScanInterval
+		}
+		if cfg.MaxAge > 0 {
+			fallbackInstance.maxAge = cfg.MaxAge
+		}
+		if cfg.MaxAttempts > 0 {
+			fallbackInstance.maxAttempts = cfg.MaxAttempts
+		}
+		// 只保留已配置的通道, 否则未配置通道的记录永远无法完成, 会反复被扫描出来
+		for _, rule := range cfg.Rules {
+			enabled := make([]string, 0, len(rule.Channels))
+			for _, name := range rule.Channels {
+				if _, ok := fallbackInstance.channels[name]; ok {
+					enabled = append(enabled, name)
+				} else {
+					log.Printf("[WARN] fallback channel %s is not configured, topic: %s", name, rule.Topic)
+				}
+			}
+			if len(enabled) == 0 {
+				continue
+			}
+			fallbackInstance.rules = append(fallbackInstance.rules, &common.FallbackRule{
+				Topic:    rule.Topic,
+				Delay:    rule.Delay,
+				Channels: enabled,
+			})
+		}
+	})
+
+	return fallbackInstance
+}
+
+func (f *fallback) Start() {
+	if len(f.rules) == 0 {
+		return
+	}
+	go f.scanWorker()
+}
+
+func (f *fallback) scanWorker() {
+	ticker := time.NewTicker(f.scanInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.ctx.Done():
+			log.Printf("[DEBUG] fallback scanWorker receive close signal")
+			return
+		case <-ticker.C:
+			for _, rule := range f.rules {
+				f.scan(rule)
+			}
+		}
+	}
+}
+
+func (f *fallback) scan(rule *common.FallbackRule) {
+	now := time.Now()
+	candidates, err := f.dbFallback.GetCandidates(f.ctx, rule.Topic, rule.Channels, now.Add(-f.maxAge), now.Add(-rule.Delay), f.maxAttempts, f.batchLimit)
+	if err != nil {
+		log.Printf("[ERROR] get fallback candidates error: %v", err)
+		return
+	}
+
+	messages := make(map[string]*interfaces.LogicsMessage)
+	for _, candidate := range candidates {
+		message, ok := messages[candidate.MessageID]
+		if !ok {
+			message, _, err = f.logicsMessage.GetByID(f.ctx, candidate.MessageID)
+			if err != nil {
+				log.Printf("[ERROR] get fallback message error: %v", err)
+				continue
+			}
+			messages[candidate.MessageID] = message
+		}
+		if message == nil {
+			continue
+		}
+
+		f.notify(rule, candidate.OrgID, candidate.UserID, message)
+	}
+}
+
+func (f *fallback) notify(rule *common.FallbackRule, orgID, userID string, message *interfaces.LogicsMessage) {
+	attempts, err := f.dbFallback.GetAttempts(f.ctx, orgID, userID, message.ID)
+	if err != nil {
+		log.Printf("[ERROR] get fallback attempts error: %v", err)
+		return
+	}
+	done := make(map[string]bool, len(attempts))
+	for _, attempt := range attempts {
+		done[attempt.Channel] = attempt.Status == int(interfaces.FallbackStatusSuccess) || attempt.Attempts >= f.maxAttempts
+	}
+
+	// 获取联系方式失败时仍然尝试不依赖联系方式的通道(如webhook), 其余通道会记录失败
+	contact, err := f.userContact.GetContact(f.ctx, userID)
+	if err != nil {
+		log.Printf("[ERROR] get user contact error, userID: %s, error: %v", userID, err)
+		contact = &interfaces.UserContact{UserID: userID}
+	}
+
+	for _, name := range rule.Channels {
+		if done[name] {
+			continue
+		}
+
+		attempt := &interfaces.DBFallbackAttempt{
+			OrgID:     orgID,
+			UserID:    userID,
+			MessageID: message.ID,
+			Channel:   name,
+			Status:    int(interfaces.FallbackStatusSuccess),
+		}
+		err = f.channels[name].Send(f.ctx, contact, message)
+		if err != nil {
+			log.Printf("[ERROR] fallback notify error, channel: %s, userID: %s, messageID: %s, error: %v", name, userID, message.ID, err)
+			attempt.Status = int(interfaces.FallbackStatusFailed)
+			attempt.Error = truncate(err.Error(), 512)
+		}
+
+		err = f.dbFallback.AddAttempt(f.ctx, attempt)
+		if err != nil {
+			log.Printf("[ERROR] add fallback attempt error: %v", err)
+		}
+	}
+}
+
+// truncate 截断为最多 n 字节, 按字符边界截断, 避免写入非法的 UTF-8
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,55 @@
+package logics
+
+import (
+	"MessagePushService/common"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// inboundPolicy 客户端上行消息的大小与频率限制
+type inboundPolicy struct {
+	maxFrameSize    int64
+	connRate        rate.Limit
+	connBurst       int
+	userLimiter     *common.KeyedLimiter // 同一用户的所有连接共享
+	maxViolations   int
+	violationWindow time.Duration
+}
+
+func newInboundPolicy(config *common.Config) *inboundPolicy {
+	p := &inboundPolicy{
+		maxFrameSize:    64 * 1024,
+		connRate:        20,
+		connBurst:       40,
+		maxViolations:   5,
+		violationWindow: time.Minute,
+	}
+	userRate, userBurst := 50.0, 100
+
+	if cfg := config.Inbound; cfg != nil {
+		if cfg.MaxFrameSize > 0 {
+			p.maxFrameSize = cfg.MaxFrameSize
+		}
+		if cfg.ConnRate > 0 {
+			p.connRate = rate.Limit(cfg.ConnRate)
+		}
+		if cfg.ConnBurst > 0 {
+			p.connBurst = cfg.ConnBurst
+		}
+		if cfg.UserRate > 0 {
+			userRate = cfg.UserRate
+		}
+		if cfg.UserBurst > 0 {
+			userBurst = cfg.UserBurst
+		}
+		if cfg.MaxViolations > 0 {
+			p.maxViolations = cfg.MaxViolations
+		}
+		if cfg.ViolationWindow > 0 {
+			p.violationWindow = cfg.ViolationWindow
+		}
+	}
+	p.userLimiter = common.NewKeyedLimiter(userRate, userBurst)
+	return p
+}
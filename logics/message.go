@@ -1,11 +1,15 @@
 package logics
 
 import (
+	"MessagePushService/common"
 	"MessagePushService/interfaces"
 	"context"
+	"encoding/json"
+	"fmt"
 	"log"
 	"strings"
 	"sync"
+	"time"
 )
 
 var (
@@ -13,63 +17,476 @@ var (
 	logicsMessageInstance *logicsMessage
 )
 
+// redeliverableStatuses 需要补偿推送的状态: 推送中的记录可能是推送过程中实例退出遗留的, 与待处理、推送失败的记录一起补偿
+var redeliverableStatuses = []interfaces.MessagePushStatus{
+	interfaces.MessagePushStatusUnhandled,
+	interfaces.MessagePushStatusSending,
+	interfaces.MessagePushStatusFailed,
+}
+
 type logicsMessage struct {
-	userloginBatchLimit int
-	dbMessage           interfaces.IDBMessage
+	broadcastReplayWindow time.Duration                         // 用户上线时只补推该时间窗口内的组织/全员广播
+	topicPriorities       map[string]interfaces.MessagePriority // 消息未指定优先级时按 topic 配置
+	dbMessage             interfaces.IDBMessage
+	tenancy               interfaces.ILogicsTenancy
+	contentCipher         interfaces.ILogicsContentCipher
 }
 
-func NewMessage(dbMessage interfaces.IDBMessage) interfaces.ILogicsMessage {
+func NewMessage(config *common.Config, dbMessage interfaces.IDBMessage, tenancy interfaces.ILogicsTenancy, contentCipher interfaces.ILogicsContentCipher) interfaces.ILogicsMessage {
 	logicsMessageOnce.Do(func() {
 		logicsMessageInstance = &logicsMessage{
-			userloginBatchLimit: 5,
-			dbMessage:           dbMessage,
+			broadcastReplayWindow: time.Hour * 24 * 7,
+			topicPriorities:       make(map[string]interfaces.MessagePriority),
+			dbMessage:             dbMessage,
+			tenancy:               tenancy,
+			contentCipher:         contentCipher,
+		}
+
+		if config.Priority == nil {
+			return
+		}
+		for topic, s := range config.Priority.Topics {
+			priority, ok := interfaces.ParseMessagePriority(s)
+			if !ok {
+				log.Fatalf("invalid priority %q for topic %s", s, topic)
+			}
+			logicsMessageInstance.topicPriorities[topic] = priority
 		}
 	})
 
 	return logicsMessageInstance
 }
 
-func (l *logicsMessage) Add(ctx context.Context, messageType interfaces.MessageType, userIDs []string, messageID string, content string, timestamp int64) (err error) {
-	message := &interfaces.DBMessage{
-		ID:        messageID,
-		Type:      int(messageType),
-		Content:   content,
-		Timestamp: timestamp,
+func (l *logicsMessage) Add(ctx context.Context, message *interfaces.LogicsMessage, userIDs []string) (err error) {
+	switch message.AudienceType {
+	case interfaces.AudienceTypeUsers:
+		if len(userIDs) == 0 {
+			return fmt.Errorf("user_ids is empty")
+		}
+		// 重复的用户(如发给自己的聊天消息)只保存一条推送记录
+		userIDs = uniqueUserIDs(userIDs)
+	case interfaces.AudienceTypeOrg:
+		if message.AudienceID == "" {
+			return fmt.Errorf("org_id is required when audience is org")
+		}
+		userIDs = nil
+	case interfaces.AudienceTypeChannel:
+		if message.AudienceID == "" {
+			return fmt.Errorf("channel is required when audience is channel")
+		}
+		userIDs = nil
+	default:
+		userIDs = nil
+	}
+
+	if message.ExpiresAt > 0 && message.ExpiresAt <= message.DeliverAt {
+		return fmt.Errorf("expires_at must be later than deliver_at")
+	}
+	err = l.tenancy.CheckMessage(message)
+	if err != nil {
+		return err
+	}
+
+	dbMessage, err := l.convertToDBMessage(message)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	err = l.tenancy.ConsumeMessage(ctx, message.OrgID, now)
+	if err != nil {
+		return err
 	}
-	err = l.dbMessage.Add(ctx, userIDs, message)
+	err = l.dbMessage.Add(ctx, userIDs, dbMessage)
 	if err != nil {
+		// 消息未保存(含重复消息)时撤销计入的配额
+		l.tenancy.RefundMessage(ctx, message.OrgID, now)
 		if strings.Contains(err.Error(), "Duplicate entry") {
-			log.Printf("[DEBUG] message %s already exists", messageID)
-			return nil
+			return l.checkDuplicate(ctx, message)
 		}
 		log.Println(err)
 		return err
 	}
+
+	common.IncTenantCounter(message.OrgID, common.MetricMessagesPublished)
+	if message.DeliverAt > 0 {
+		common.IncCounter(common.MetricMessagesScheduled)
+	}
 	return
 }
 
+// checkDuplicate 同一来源重复发送(MQ 重新投递、客户端重发)时视为成功; 消息ID已被其它发送者或组织的消息使用时返回 ErrDuplicateID,
+// 否则调用方会确认并重新推送那条消息
+func (l *logicsMessage) checkDuplicate(ctx context.Context, message *interfaces.LogicsMessage) error {
+	existing, _, err := l.dbMessage.GetByID(ctx, message.ID)
+	if err != nil {
+		return err
+	}
+	if existing.OrgID != message.OrgID || existing.SenderID != message.SenderID {
+		log.Printf("[WARN] message id conflicts with another message, messageID: %s", message.ID)
+		return fmt.Errorf("%w, messageID: %s", interfaces.ErrDuplicateID, message.ID)
+	}
+	log.Printf("[DEBUG] message %s already exists", message.ID)
+	return nil
+}
+
+func uniqueUserIDs(userIDs []string) []string {
+	seen := make(map[string]bool, len(userIDs))
+	out := make([]string, 0, len(userIDs))
+	for _, userID := range userIDs {
+		if seen[userID] {
+			continue
+		}
+		seen[userID] = true
+		out = append(out, userID)
+	}
+	return out
+}
+
+// convertToDBMessage 未指定优先级时按 topic 配置, 缺省为普通
+func (l *logicsMessage) convertToDBMessage(message *interfaces.LogicsMessage) (*interfaces.DBMessage, error) {
+	if message.Priority == interfaces.MessagePriorityDefault {
+		message.Priority = l.topicPriorities[message.Topic]
+	}
+	if message.Priority == interfaces.MessagePriorityDefault {
+		message.Priority = interfaces.MessagePriorityNormal
+	}
+
+	content, err := json.Marshal(message.Content)
+	if err != nil {
+		return nil, fmt.Errorf("marshal content error, %v", err)
+	}
+
+	return &interfaces.DBMessage{
+		ID:           message.ID,
+		OrgID:        message.OrgID,
+		Type:         int(message.Type),
+		Content:      string(content),
+		Timestamp:    message.Timestamp,
+		AudienceType: int(message.AudienceType),
+		AudienceID:   message.AudienceID,
+		SenderID:     message.SenderID,
+		RoomID:       message.RoomID,
+		Topic:        message.Topic,
+		CallbackURL:  message.CallbackURL,
+		DeliverAt:    message.DeliverAt,
+		ExpiresAt:    message.ExpiresAt,
+		Priority:     int(message.Priority),
+	}, nil
+}
+
 func (l *logicsMessage) GetByID(ctx context.Context, messageID string) (out *interfaces.LogicsMessage, userIDs []string, err error) {
 	message, userIDs, err := l.dbMessage.GetByID(ctx, messageID)
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	return interfaces.ConvertDBMessageToModel(message), userIDs, nil
+	return interfaces.ConvertDBMessageToModel(message, l.contentCipher), userIDs, nil
+}
+
+func (l *logicsMessage) GetByUserID(ctx context.Context, tenantID, userID string, since time.Time, limit int) (outs []*interfaces.LogicsMessage, err error) {
+	// 整批都无法推送时继续读取下一批, 返回空表示没有待推送的消息
+	for {
+		messages, err := l.dbMessage.GetByUserID(ctx, tenantID, userID, interfaces.MessagePushStatusUnhandled, since, limit)
+		if err != nil {
+			log.Println(err)
+			return nil, err
+		}
+
+		for _, v := range messages {
+			message := interfaces.ConvertDBMessageToModel(v, l.contentCipher)
+			if message != nil {
+				outs = append(outs, message)
+				continue
+			}
+			// 内容无法解密或解析的消息永远无法推送, 标记为已放弃, 避免每次上线都重新读取
+			err = l.dbMessage.UpdateStatus(ctx, tenantID, userID, v.ID, interfaces.MessagePushStatusAbandoned)
+			if err != nil {
+				log.Printf("[ERROR] abandon undecodable message error: %v, messageID: %s, userID: %s", err, v.ID, userID)
+				return nil, err
+			}
+			log.Printf("[WARN] abandon undecodable message, messageID: %s, userID: %s", v.ID, userID)
+		}
+		if len(outs) > 0 || len(messages) == 0 {
+			return outs, nil
+		}
+	}
+}
+
+func (l *logicsMessage) Sync(ctx context.Context, tenantID, userID string, afterSeq int64, limit int) (outs []*interfaces.LogicsMessage, latestSeq int64, err error) {
+	// 先读取最大序号, 之后新增的消息序号更大, 客户端下次同步时获取
+	latestSeq, err = l.dbMessage.GetLatestSeq(ctx, tenantID, userID)
+	if err != nil {
+		return nil, 0, err
+	}
+	if afterSeq >= latestSeq {
+		return nil, latestSeq, nil
+	}
+
+	messages, err := l.dbMessage.GetAfterSeq(ctx, tenantID, userID, afterSeq, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, v := range messages {
+		if message := interfaces.ConvertDBMessageToModel(v, l.contentCipher); message != nil {
+			outs = append(outs, message)
+		}
+	}
+	return outs, latestSeq, nil
+}
+
+func (l *logicsMessage) CountPending(ctx context.Context, tenantID, userID string, before time.Time) (int, error) {
+	return l.dbMessage.CountByUserID(ctx, tenantID, userID, interfaces.MessagePushStatusUnhandled, before)
+}
+
+func (l *logicsMessage) GetPendingBroadcasts(ctx context.Context, userInfo *interfaces.UserInfo, limit int) (outs []*interfaces.LogicsMessage, err error) {
+	since := time.Now().Add(-l.broadcastReplayWindow)
+	messages, err := l.dbMessage.GetPendingBroadcasts(ctx, userInfo.TenantID, userInfo.ID, userInfo.OrgID, since, limit)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for _, v := range messages {
+		// 内容无法解析的消息不返回, 否则该消息永远不会生成推送记录
+		if message := interfaces.ConvertDBMessageToModel(v, l.contentCipher); message != nil {
+			outs = append(outs, message)
+		}
+	}
+	return
+}
+
+func (logicsMessage *logicsMessage) UpdateStatus(ctx context.Context, tenantID, userID, msgID string, status interfaces.MessagePushStatus) error {
+	return logicsMessage.dbMessage.UpdateStatus(ctx, tenantID, userID, msgID, status)
+}
+
+func (logicsMessage *logicsMessage) UpsertStatus(ctx context.Context, tenantID, userID, msgID string, status interfaces.MessagePushStatus) error {
+	return logicsMessage.dbMessage.UpsertStatus(ctx, tenantID, userID, msgID, status)
+}
+
+func (l *logicsMessage) BatchUpsertStatus(ctx context.Context, items []*interfaces.PushStatusUpdate) error {
+	dbItems := make([]*interfaces.DBPushStatus, 0, len(items))
+	for _, item := range items {
+		dbItems = append(dbItems, &interfaces.DBPushStatus{
+			OrgID:      item.OrgID,
+			UserID:     item.UserID,
+			MessageID:  item.MessageID,
+			PushStatus: int(item.Status),
+		})
+	}
+	return l.dbMessage.BatchUpsertStatus(ctx, dbItems)
+}
+
+func (l *logicsMessage) MarkRead(ctx context.Context, tenantID, userID, msgID string, upTo bool) (outs []*interfaces.ReadMessage, err error) {
+	messages, err := l.dbMessage.MarkRead(ctx, tenantID, userID, msgID, upTo)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for _, v := range messages {
+		outs = append(outs, &interfaces.ReadMessage{
+			MessageID: v.MessageID,
+			Type:      interfaces.MessageType(v.Type),
+			SenderID:  v.SenderID,
+		})
+	}
+	return
 }
 
-func (l *logicsMessage) GetByUserID(ctx context.Context, userID string) (outs []*interfaces.LogicsMessage, err error) {
-	messages, err := l.dbMessage.GetByUserID(ctx, userID, interfaces.MessagePushStatusUnhandled, l.userloginBatchLimit)
+func (l *logicsMessage) GetUnreadCount(ctx context.Context, tenantID, userID string) (out *interfaces.UnreadCount, err error) {
+	counts, err := l.dbMessage.CountUnread(ctx, tenantID, userID)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
+	out = &interfaces.UnreadCount{
+		ByType: make(map[interfaces.MessageType]int),
+		ByRoom: make(map[string]int),
+	}
+	for _, v := range counts {
+		out.Total += v.Count
+		out.ByType[interfaces.MessageType(v.Type)] += v.Count
+		if v.RoomID != "" {
+			out.ByRoom[v.RoomID] += v.Count
+		}
+	}
+	return
+}
+
+func (l *logicsMessage) GetDueScheduled(ctx context.Context, before time.Time, limit int) (outs []*interfaces.LogicsMessage, err error) {
+	messages, err := l.dbMessage.GetDueScheduled(ctx, before.Unix(), limit)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
 	for _, v := range messages {
-		outs = append(outs, interfaces.ConvertDBMessageToModel(v))
+		if message := interfaces.ConvertDBMessageToModel(v, l.contentCipher); message != nil {
+			outs = append(outs, message)
+		}
 	}
 	return
 }
 
-func (logicsMessage *logicsMessage) UpdateStatus(ctx context.Context, userID, msgID string, status interfaces.MessagePushStatus) error {
-	return logicsMessage.dbMessage.UpdateStatus(ctx, userID, msgID, status)
+func (l *logicsMessage) ClaimScheduled(ctx context.Context, messageID string) (bool, error) {
+	claimed, err := l.dbMessage.ClaimScheduled(ctx, messageID)
+	if err != nil {
+		log.Println(err)
+		return false, err
+	}
+	return claimed, nil
+}
+
+func (l *logicsMessage) GetStatus(ctx context.Context, messageID string) (*interfaces.MessageStatus, error) {
+	message, _, err := l.GetByID(ctx, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if message == nil {
+		return nil, fmt.Errorf("message content is invalid, messageID: %s", messageID)
+	}
+	recipients, err := l.dbMessage.GetRecipientStatus(ctx, messageID)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	now := time.Now()
+	out := &interfaces.MessageStatus{
+		ID:         message.ID,
+		State:      interfaces.MessageStateActive,
+		DeliverAt:  message.DeliverAt,
+		ExpiresAt:  message.ExpiresAt,
+		Total:      len(recipients),
+		ByStatus:   make(map[string]int),
+		Recipients: make([]*interfaces.RecipientStatus, 0, len(recipients)),
+	}
+	switch {
+	case message.IsRecalled():
+		out.State = interfaces.MessageStateRecalled
+	case message.IsExpired(now):
+		out.State = interfaces.MessageStateExpired
+	case message.IsScheduled(now):
+		out.State = interfaces.MessageStateScheduled
+	}
+
+	for _, v := range recipients {
+		status := interfaces.MessagePushStatus(v.PushStatus)
+		// 过期时尚未推送的记录不会再推送, 用户上线前仍为待处理状态
+		if out.State == interfaces.MessageStateExpired && status == interfaces.MessagePushStatusUnhandled {
+			status = interfaces.MessagePushStatusExpired
+		}
+		out.ByStatus[status.String()]++
+		out.Recipients = append(out.Recipients, &interfaces.RecipientStatus{
+			OrgID:  v.OrgID,
+			UserID: v.UserID,
+			Status: status.String(),
+			Read:   v.Read,
+		})
+	}
+	return out, nil
+}
+
+func (l *logicsMessage) GetRedeliverable(ctx context.Context, tenantID string, userIDs []string, since, before time.Time, maxAttempts, limit int) (outs []*interfaces.UserMessage, err error) {
+	rows, err := l.dbMessage.GetRedeliverable(ctx, tenantID, userIDs, redeliverableStatuses, since, before, maxAttempts, limit)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	for _, v := range rows {
+		outs = append(outs, &interfaces.UserMessage{
+			ID:        v.ID,
+			UserID:    v.UserID,
+			MessageID: v.MessageID,
+			Status:    interfaces.MessagePushStatus(v.PushStatus),
+			Attempts:  v.Attempts,
+		})
+	}
+	return
+}
+
+func (l *logicsMessage) AbandonExhausted(ctx context.Context, tenantID string, userIDs []string, maxAttempts, limit int) (outs []*interfaces.UserMessage, err error) {
+	rows, err := l.dbMessage.AbandonExhausted(ctx, tenantID, userIDs, redeliverableStatuses, maxAttempts, limit)
+	if err != nil {
+		log.Println(err)
+	}
+
+	// 部分记录标记成功后出错时仍返回这些记录, 调用方需为其发出事件
+	for _, v := range rows {
+		outs = append(outs, &interfaces.UserMessage{
+			ID:        v.ID,
+			UserID:    v.UserID,
+			MessageID: v.MessageID,
+			Status:    interfaces.MessagePushStatusAbandoned,
+			Attempts:  v.Attempts,
+		})
+	}
+	return outs, err
+}
+
+func (l *logicsMessage) ClaimRedelivery(ctx context.Context, id int64, leaseUntil time.Time) (bool, error) {
+	return l.dbMessage.ClaimRedelivery(ctx, id, leaseUntil)
+}
+
+func (l *logicsMessage) Recall(ctx context.Context, messageID string, event *interfaces.LogicsMessage) (userIDs []string, err error) {
+	dbEvent, err := l.convertToDBMessage(event)
+	if err != nil {
+		return nil, err
+	}
+	userIDs, err = l.dbMessage.Recall(ctx, messageID, dbEvent)
+	if err != nil {
+		return nil, err
+	}
+
+	common.IncCounter(common.MetricMessagesRecalled)
+	return userIDs, nil
+}
+
+func (l *logicsMessage) Edit(ctx context.Context, messageID, editorID string, content interface{}, event *interfaces.LogicsMessage) (userIDs []string, err error) {
+	data, err := json.Marshal(content)
+	if err != nil {
+		return nil, fmt.Errorf("marshal content error, %v", err)
+	}
+	dbEvent, err := l.convertToDBMessage(event)
+	if err != nil {
+		return nil, err
+	}
+	userIDs, err = l.dbMessage.Edit(ctx, messageID, editorID, string(data), dbEvent)
+	if err != nil {
+		return nil, err
+	}
+
+	common.IncCounter(common.MetricMessagesEdited)
+	return userIDs, nil
+}
+
+func (l *logicsMessage) GetEdits(ctx context.Context, messageID string) (outs []*interfaces.MessageEdit, err error) {
+	edits, err := l.dbMessage.GetEdits(ctx, messageID)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	outs = make([]*interfaces.MessageEdit, 0, len(edits))
+	for _, v := range edits {
+		plaintext, err := l.contentCipher.Decrypt(v.Content, v.KeyID, v.MessageID)
+		if err != nil {
+			log.Printf("[ERROR] decrypt message edit content error: %v, messageID: %s", err, messageID)
+			continue
+		}
+		var content interface{}
+		err = json.Unmarshal([]byte(plaintext), &content)
+		if err != nil {
+			log.Printf("[ERROR] unmarshal message edit content error: %v", err)
+			continue
+		}
+		outs = append(outs, &interfaces.MessageEdit{
+			Content:  content,
+			EditorID: v.EditorID,
+			EditedAt: v.CreatedAt.Unix(),
+		})
+	}
+	return outs, nil
 }
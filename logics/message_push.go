@@ -1,12 +1,14 @@
 package logics
 
 import (
+	"MessagePushService/common"
 	"MessagePushService/interfaces"
 	"context"
-	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"log"
 	"sync"
+	"time"
 )
 
 var (
@@ -14,44 +16,133 @@ var (
 	messagePushInstance *messagePush
 )
 
+// pushTask 分派给推送协程的任务, 两类任务互斥
+type pushTask struct {
+	message  *interfaces.LogicsMessage
+	envelope *interfaces.Envelope       // 推送消息信封, 写入连接时按连接的协议版本编码
+	tenantID string                     // 指定用户消息: 接收用户所属租户
+	userIDs  []string                   // 指定用户消息: 分片内的接收用户
+	conns    []interfaces.ILogicsWsConn // 广播消息: 分片内的在线连接
+}
+
 type messagePush struct {
 	wsConnManager interfaces.ILogicsWsConnManager
 	logicsMessage interfaces.ILogicsMessage
+	subscription  interfaces.ILogicsSubscription
+	callback      interfaces.ILogicsCallback
+
+	scheduleScanInterval time.Duration
+	scheduleBatchSize    int // 每次扫描的定时消息数
+	sweepInterval        time.Duration
+	sweepMinAge          time.Duration
+	sweepLease           time.Duration
+	sweepMaxAttempts     int
+	sweepBatchSize       int // 每批补偿的推送记录数
+	sweepUserChunk       int // 每次查询的在线用户数
 
 	ctx context.Context
 
-	newMessageSignal chan string
-	userLoginSignal  chan string
+	newMessageQueue *priorityQueue[string]
+	shards          []*priorityQueue[*pushTask] // 按用户ID分片, 保证同一用户的推送顺序
+	statusBatcher   *statusBatcher
+	replayer        *replayer
 }
 
-func NewMessagePush(wsConnManager interfaces.ILogicsWsConnManager, logicsMessage interfaces.ILogicsMessage) interfaces.ILogicsMessagePush {
+func NewMessagePush(config *common.Config, wsConnManager interfaces.ILogicsWsConnManager, logicsMessage interfaces.ILogicsMessage, subscription interfaces.ILogicsSubscription, callback interfaces.ILogicsCallback) interfaces.ILogicsMessagePush {
 	messagePushOnce.Do(func() {
+		workers, queueSize, batchSize, flushInterval := 8, 1000, 500, time.Millisecond*200
+		sweepInterval, sweepMinAge, sweepLease, sweepMaxAttempts := time.Second*30, time.Second*30, time.Minute, 5
+		if cfg := config.Push; cfg != nil {
+			if cfg.Workers > 0 {
+				workers = cfg.Workers
+			}
+			if cfg.QueueSize > 0 {
+				queueSize = cfg.QueueSize
+			}
+			if cfg.StatusBatchSize > 0 {
+				batchSize = cfg.StatusBatchSize
+			}
+			if cfg.StatusFlushInterval > 0 {
+				flushInterval = cfg.StatusFlushInterval
+			}
+			if cfg.SweepInterval > 0 {
+				sweepInterval = cfg.SweepInterval
+			}
+			if cfg.SweepMinAge > 0 {
+				sweepMinAge = cfg.SweepMinAge
+			}
+			if cfg.SweepLease > 0 {
+				sweepLease = cfg.SweepLease
+			}
+			if cfg.SweepMaxAttempts > 0 {
+				sweepMaxAttempts = cfg.SweepMaxAttempts
+			}
+		}
+
+		ctx := context.Background()
 		messagePushInstance = &messagePush{
-			wsConnManager:    wsConnManager,
-			logicsMessage:    logicsMessage,
-			ctx:              context.Background(),
-			newMessageSignal: make(chan string, 1000),
-			userLoginSignal:  make(chan string, 10),
+			wsConnManager:        wsConnManager,
+			logicsMessage:        logicsMessage,
+			subscription:         subscription,
+			callback:             callback,
+			scheduleScanInterval: time.Second,
+			scheduleBatchSize:    200,
+			sweepInterval:        sweepInterval,
+			sweepMinAge:          sweepMinAge,
+			sweepLease:           sweepLease,
+			sweepMaxAttempts:     sweepMaxAttempts,
+			sweepBatchSize:       200,
+			sweepUserChunk:       500,
+			ctx:                  ctx,
+			newMessageQueue:      newPriorityQueue[string](queueSize),
+			shards:               make([]*priorityQueue[*pushTask], workers),
+			statusBatcher:        newStatusBatcher(ctx, logicsMessage, batchSize, flushInterval),
 		}
 
+		messagePushInstance.replayer = newReplayer(config, messagePushInstance)
+
+		for i := range messagePushInstance.shards {
+			messagePushInstance.shards[i] = newPriorityQueue[*pushTask](queueSize)
+			go messagePushInstance.pushWorker(messagePushInstance.shards[i])
+		}
 		go messagePushInstance.newMessageWorker()
-		go messagePushInstance.userLoginWorker()
+		go messagePushInstance.scheduleWorker()
+		go messagePushInstance.sweepWorker()
 	})
 
 	return messagePushInstance
 }
 
-func (messagePush *messagePush) NotifyByNewMessage(messageID string) {
-	messagePush.newMessageSignal <- messageID
+func (messagePush *messagePush) NotifyByNewMessage(messageID string, priority interfaces.MessagePriority) error {
+	if !messagePush.newMessageQueue.TryPush(priority, messageID) {
+		return interfaces.ErrPushQueueFull
+	}
+	return nil
+}
+
+func (messagePush *messagePush) NotifyByUserLogin(userInfo *interfaces.UserInfo) {
+	messagePush.replayer.Start(messagePush.ctx, userInfo)
+}
+
+// onAck 客户端确认收到消息, 补推等待整批确认后继续
+func (messagePush *messagePush) onAck(tenantID, userID, messageID string) {
+	messagePush.replayer.Ack(tenantID, userID, messageID)
 }
 
-func (messagePush *messagePush) NotifyByUserLogin(userID string) {
-	messagePush.userLoginSignal <- userID
+func (messagePush *messagePush) shard(userID string) *priorityQueue[*pushTask] {
+	h := fnv.New32a()
+	h.Write([]byte(userID))
+	return messagePush.shards[h.Sum32()%uint32(len(messagePush.shards))]
 }
 
+// newMessageWorker 加载新消息并按接收用户分片分派给推送协程, 推送协程队列已满时阻塞, 进而使新消息队列积压并拒绝新的通知
 func (messagePush *messagePush) newMessageWorker() {
 	for {
-		messageID := <-messagePush.newMessageSignal
+		messageID, ok := messagePush.newMessageQueue.Pop(messagePush.ctx)
+		if !ok {
+			log.Printf("[DEBUG] newMessageWorker receive close signal")
+			return
+		}
 		message, userIDs, err := messagePush.logicsMessage.GetByID(messagePush.ctx, messageID)
 		if err != nil {
 			log.Printf("[ERROR] get message error: %v", err)
@@ -62,95 +153,342 @@ func (messagePush *messagePush) newMessageWorker() {
 			continue
 		}
 
-		err = messagePush.pushMessageToUsers(messagePush.ctx, message, userIDs)
-		if err != nil {
-			log.Printf("[ERROR] push message to users error: %v", err)
+		now := time.Now()
+		// 撤回时尚未推送的记录已标记为已撤回
+		if message.IsRecalled() {
 			continue
 		}
+		// 定时消息到期后由 scheduleWorker 再次通知
+		if message.IsScheduled(now) {
+			continue
+		}
+		// 定时消息可能同时由发布通知与多个实例的扫描触发, 只有抢占成功的一方推送
+		if message.DeliverAt > 0 {
+			claimed, err := messagePush.logicsMessage.ClaimScheduled(messagePush.ctx, message.ID)
+			if err != nil || !claimed {
+				continue
+			}
+		}
+		if message.IsExpired(now) {
+			messagePush.expireMessage(messagePush.ctx, message, message.OrgID, userIDs)
+			continue
+		}
+
+		envelope := newMessageEnvelope(message)
+		if message.AudienceType.IsBroadcast() {
+			messagePush.dispatchConns(message, envelope, messagePush.getAudienceConns(messagePush.ctx, message))
+		} else {
+			messagePush.dispatchUsers(message, envelope, userIDs)
+		}
 	}
 }
 
-// 这里的逻辑有问题: 可能会阻塞在第一个登录的用户那里
-func (messagePush *messagePush) userLoginWorker() {
+func (messagePush *messagePush) dispatchUsers(message *interfaces.LogicsMessage, envelope *interfaces.Envelope, userIDs []string) {
+	type taskKey struct {
+		shard    *priorityQueue[*pushTask]
+		tenantID string
+	}
+	tasks := make(map[taskKey]*pushTask)
+	for _, userID := range userIDs {
+		key := taskKey{shard: messagePush.shard(userID), tenantID: message.RecipientTenant(userID)}
+		task, ok := tasks[key]
+		if !ok {
+			task = &pushTask{message: message, envelope: envelope, tenantID: key.tenantID}
+			tasks[key] = task
+		}
+		task.userIDs = append(task.userIDs, userID)
+	}
+	for key, task := range tasks {
+		key.shard.Push(message.Priority, task)
+	}
+}
+
+func (messagePush *messagePush) dispatchConns(message *interfaces.LogicsMessage, envelope *interfaces.Envelope, wsConns []interfaces.ILogicsWsConn) {
+	tasks := make(map[*priorityQueue[*pushTask]]*pushTask)
+	for _, wsConn := range wsConns {
+		shard := messagePush.shard(wsConn.GetUserInfo().ID)
+		task, ok := tasks[shard]
+		if !ok {
+			task = &pushTask{message: message, envelope: envelope}
+			tasks[shard] = task
+		}
+		task.conns = append(task.conns, wsConn)
+	}
+	for shard, task := range tasks {
+		shard.Push(message.Priority, task)
+	}
+}
+
+func (messagePush *messagePush) pushWorker(queue *priorityQueue[*pushTask]) {
+	for {
+		task, ok := queue.Pop(messagePush.ctx)
+		if !ok {
+			log.Printf("[DEBUG] pushWorker receive close signal")
+			return
+		}
+
+		switch {
+		case task.conns != nil:
+			messagePush.pushMessageToConns(messagePush.ctx, task.message, task.envelope, task.conns)
+		default:
+			messagePush.pushMessageToUsers(messagePush.ctx, task.message, task.envelope, task.tenantID, task.userIDs)
+		}
+	}
+}
+
+// scheduleWorker 定时扫描已到投递时间且尚未分派推送的消息, 按新消息通知推送
+// 是否已分派保存在消息记录中, 服务停止期间到期的消息在启动后补扫; 推送前由 newMessageWorker 抢占, 多个实例不会重复推送
+func (messagePush *messagePush) scheduleWorker() {
+	ticker := time.NewTicker(messagePush.scheduleScanInterval)
+	defer ticker.Stop()
+
 	for {
 		select {
 		case <-messagePush.ctx.Done():
-			log.Printf("[DEBUG] userLoginWorker receive close signal")
+			log.Printf("[DEBUG] scheduleWorker receive close signal")
 			return
-		case userID := <-messagePush.userLoginSignal:
-			for {
-				messages, err := messagePush.logicsMessage.GetByUserID(messagePush.ctx, userID)
-				if err != nil {
-					log.Printf("[ERROR] get pending message by user id error: %v", err)
-					break
-				}
-				if len(messages) == 0 {
-					break
-				}
+		case <-ticker.C:
+			messages, err := messagePush.logicsMessage.GetDueScheduled(messagePush.ctx, time.Now(), messagePush.scheduleBatchSize)
+			if err != nil {
+				log.Printf("[ERROR] get due scheduled message error: %v", err)
+				continue
+			}
+			for _, message := range messages {
+				// 内部调度不丢弃通知, 队列已满时等待
+				messagePush.newMessageQueue.Push(message.Priority, message.ID)
+			}
+		}
+	}
+}
+
+// sweepWorker 启动时及定期补偿推送: 新消息通知只保存在内存中, 实例在保存消息后、推送前退出时, 在线用户的推送记录会一直处于待处理状态
+// 只补偿本实例在线用户的推送记录, 补偿前先租用记录, 避免多个实例重复推送
+func (messagePush *messagePush) sweepWorker() {
+	ticker := time.NewTicker(messagePush.sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		messagePush.sweep(messagePush.ctx)
 
-				err = messagePush.pushMessagesToUser(messagePush.ctx, messages, userID)
+		select {
+		case <-messagePush.ctx.Done():
+			log.Printf("[DEBUG] sweepWorker receive close signal")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (messagePush *messagePush) sweep(ctx context.Context) {
+	for tenantID, userIDs := range messagePush.wsConnManager.GetUsers(ctx) {
+		if !messagePush.sweepTenant(ctx, tenantID, userIDs) {
+			return
+		}
+	}
+}
+
+// sweepTenant 补偿租户内在线用户的推送记录, 查询失败返回 false
+// 与上线补推的范围一致: 超过补推时间范围的记录只能通过同步获取; 正在补推的用户由补推按序投递, 不补偿
+func (messagePush *messagePush) sweepTenant(ctx context.Context, tenantID string, userIDs []string) bool {
+	idle := make([]string, 0, len(userIDs))
+	for _, userID := range userIDs {
+		if !messagePush.replayer.Active(tenantID, userID) {
+			idle = append(idle, userID)
+		}
+	}
+	userIDs = idle
+	for start := 0; start < len(userIDs); start += messagePush.sweepUserChunk {
+		end := min(start+messagePush.sweepUserChunk, len(userIDs))
+		now := time.Now()
+		rows, err := messagePush.logicsMessage.GetRedeliverable(ctx, tenantID, userIDs[start:end], now.Add(-messagePush.replayer.maxAge), now.Add(-messagePush.sweepMinAge), messagePush.sweepMaxAttempts, messagePush.sweepBatchSize)
+		if err != nil {
+			log.Printf("[ERROR] get redeliverable message error: %v", err)
+			return false
+		}
+
+		messages := make(map[string]*interfaces.LogicsMessage)
+		for _, row := range rows {
+			ok, err := messagePush.logicsMessage.ClaimRedelivery(ctx, row.ID, time.Now().Add(messagePush.sweepLease))
+			if err != nil {
+				log.Printf("[ERROR] claim redelivery error: %v", err)
+				continue
+			}
+			if !ok {
+				continue
+			}
+
+			message, ok := messages[row.MessageID]
+			if !ok {
+				message, _, err = messagePush.logicsMessage.GetByID(ctx, row.MessageID)
 				if err != nil {
-					log.Printf("[ERROR] push messages to user error: %v", err)
-					break
+					continue
 				}
+				messages[row.MessageID] = message
 			}
+			messagePush.redeliver(ctx, row.MessageID, message, tenantID, row.UserID)
+		}
+
+		// 补偿次数用完仍未推送成功的记录不再推送, 回调 failed 事件
+		abandoned, err := messagePush.logicsMessage.AbandonExhausted(ctx, tenantID, userIDs[start:end], messagePush.sweepMaxAttempts, messagePush.sweepBatchSize)
+		if err != nil {
+			log.Printf("[ERROR] abandon exhausted message error: %v", err)
 		}
+		for _, row := range abandoned {
+			log.Printf("[WARN] give up pushing message, messageID: %s, userID: %s, attempts: %d", row.MessageID, row.UserID, row.Attempts)
+			common.IncTenantCounter(tenantID, common.MetricMessagesAbandoned)
+			messagePush.callback.EmitByID(ctx, row.MessageID, tenantID, row.UserID, interfaces.CallbackEventFailed)
+		}
+	}
+	return true
+}
+
+func (messagePush *messagePush) redeliver(ctx context.Context, messageID string, message *interfaces.LogicsMessage, tenantID, userID string) {
+	if message == nil {
+		// 内容无法解析, 补偿次数用完后不再补偿
+		messagePush.statusBatcher.Add(tenantID, userID, messageID, interfaces.MessagePushStatusFailed)
+		return
 	}
+	// 撤回时正在推送的记录
+	if message.IsRecalled() {
+		messagePush.statusBatcher.Add(tenantID, userID, messageID, interfaces.MessagePushStatusRecalled)
+		return
+	}
+	if message.IsExpired(time.Now()) {
+		messagePush.expireMessage(ctx, message, tenantID, []string{userID})
+		return
+	}
+
+	log.Printf("[INFO] redeliver message, messageID: %s, userID: %s", message.ID, userID)
+	messagePush.shard(userID).Push(message.Priority, &pushTask{message: message, envelope: newMessageEnvelope(message), tenantID: tenantID, userIDs: []string{userID}})
 }
 
-func (messagePush *messagePush) pushMessageToUsers(ctx context.Context, message *interfaces.LogicsMessage, userIDs []string) (err error) {
+// expireMessage 丢弃已过期的消息, 指定用户的消息将推送记录标记为已过期
+func (messagePush *messagePush) expireMessage(ctx context.Context, message *interfaces.LogicsMessage, tenantID string, userIDs []string) {
+	if message.AudienceType.IsBroadcast() {
+		log.Printf("[WARN] broadcast message expired, messageID: %s", message.ID)
+		common.IncCounter(common.MetricMessagesExpired)
+		return
+	}
+
 	for _, userID := range userIDs {
-		wsConn := messagePush.wsConnManager.Get(ctx, userID)
-		if wsConn == nil {
-			log.Printf("[WARN] 用户未上线, ws conn is nil, userID: %s", userID)
-			continue
+		messagePush.statusBatcher.Add(tenantID, userID, message.ID, interfaces.MessagePushStatusExpired)
+		common.IncTenantCounter(tenantID, common.MetricMessagesExpired)
+		messagePush.callback.Emit(ctx, message, tenantID, userID, interfaces.CallbackEventExpired)
+	}
+}
+
+// getAudienceConns 获取广播类消息当前在线的受众连接
+func (messagePush *messagePush) getAudienceConns(ctx context.Context, message *interfaces.LogicsMessage) []interfaces.ILogicsWsConn {
+	switch message.AudienceType {
+	case interfaces.AudienceTypeOrg:
+		return messagePush.wsConnManager.GetByOrgID(ctx, message.AudienceID)
+	case interfaces.AudienceTypeOnline, interfaces.AudienceTypeAll:
+		// 不属于任何组织的广播推送给所有租户
+		if message.OrgID == "" {
+			return messagePush.wsConnManager.GetAll(ctx)
 		}
+		return messagePush.wsConnManager.GetByOrgID(ctx, message.OrgID)
+	case interfaces.AudienceTypeChannel:
+		return messagePush.subscription.GetSubscribers(ctx, message.OrgID, message.AudienceID)
+	default:
+		return nil
+	}
+}
 
-		var i map[string]interface{}
-		i = make(map[string]interface{})
-		i["id"] = message.ID
-		i["body"] = message.Content
-		i["timestamp"] = message.Timestamp
-		jsonData, err := json.Marshal(i)
-		if err != nil {
-			log.Printf("[ERROR] marshal message error: %v", err)
+func (messagePush *messagePush) pushMessageToUsers(ctx context.Context, message *interfaces.LogicsMessage, envelope *interfaces.Envelope, tenantID string, userIDs []string) {
+	for _, userID := range userIDs {
+		wsConns := messagePush.wsConnManager.Get(ctx, tenantID, userID)
+		if len(wsConns) == 0 {
 			continue
 		}
-		wsConn.Send(ctx, jsonData)
-		err = messagePush.logicsMessage.UpdateStatus(ctx, userID, message.ID, interfaces.MessagePushStatusSuccess)
-		if err != nil {
-			log.Printf("[ERROR] update message status error: %v", err)
-			return err
+		messagePush.recordSend(ctx, message, tenantID, userID, sendToConns(ctx, wsConns, message, withSeq(envelope, message.RecipientSeq(userID))))
+	}
+}
+
+// pushMessageToConns 向在线连接推送广播类消息, 推送记录在投递时生成
+func (messagePush *messagePush) pushMessageToConns(ctx context.Context, message *interfaces.LogicsMessage, envelope *interfaces.Envelope, wsConns []interfaces.ILogicsWsConn) {
+	// 同一用户的多个连接只记录一次推送, 任一连接发送成功即为推送成功
+	sent := make(map[tenantUser]bool, len(wsConns))
+	for _, wsConn := range wsConns {
+		userInfo := wsConn.GetUserInfo()
+		key := tenantUser{tenantID: userInfo.TenantID, userID: userInfo.ID}
+		ok := sendToConns(ctx, []interfaces.ILogicsWsConn{wsConn}, message, envelope)
+		sent[key] = sent[key] || ok
+	}
+	for key, ok := range sent {
+		messagePush.recordSend(ctx, message, key.tenantID, key.userID, ok)
+	}
+}
+
+// sendToConns 向用户的连接发送消息, 任一连接发送成功返回 true
+func sendToConns(ctx context.Context, wsConns []interfaces.ILogicsWsConn, message *interfaces.LogicsMessage, envelope *interfaces.Envelope) bool {
+	sent := false
+	for _, wsConn := range wsConns {
+		if wsConn.SendMessage(ctx, envelope, message.Priority) == nil {
+			sent = true
 		}
 	}
-	return nil
+	return sent
+}
+
+// recordSend 记录推送结果, 未能进入任何连接发送缓冲区的记录标记为推送失败, 由补偿推送重新投递
+func (messagePush *messagePush) recordSend(ctx context.Context, message *interfaces.LogicsMessage, tenantID, userID string, sent bool) {
+	if !sent {
+		messagePush.statusBatcher.Add(tenantID, userID, message.ID, interfaces.MessagePushStatusFailed)
+		return
+	}
+	messagePush.statusBatcher.Add(tenantID, userID, message.ID, interfaces.MessagePushStatusSuccess)
+	common.IncTenantCounter(tenantID, common.MetricMessagesDelivered)
+	messagePush.callback.Emit(ctx, message, tenantID, userID, interfaces.CallbackEventDelivered)
+}
+
+// markUndelivered 已进入连接发送缓冲区的消息最终未写入连接(被丢弃或连接断开)
+func (messagePush *messagePush) markUndelivered(tenantID, userID, messageID string) {
+	messagePush.statusBatcher.Add(tenantID, userID, messageID, interfaces.MessagePushStatusFailed)
 }
 
-func (messagePush *messagePush) pushMessagesToUser(ctx context.Context, messages []*interfaces.LogicsMessage, userID string) (err error) {
-	wsConn := messagePush.wsConnManager.Get(ctx, userID)
-	if wsConn == nil {
+// pushMessagesToUser 补推一批消息, 推送状态同步写入, 下一批查询时不再返回本批消息; 返回已过期或未能发送的消息ID
+func (messagePush *messagePush) pushMessagesToUser(ctx context.Context, messages []*interfaces.LogicsMessage, tenantID, userID string) (undelivered []string, err error) {
+	wsConns := messagePush.wsConnManager.Get(ctx, tenantID, userID)
+	if len(wsConns) == 0 {
 		err = fmt.Errorf("用户未上线, ws conn is nil, userID: %s", userID)
-		return err
+		return nil, err
 	}
 
+	now := time.Now()
+	updates := make([]*interfaces.PushStatusUpdate, 0, len(messages))
+	events := make([]interfaces.CallbackEvent, 0, len(messages))
 	for _, message := range messages {
-		var i map[string]interface{}
-		i = make(map[string]interface{})
-		i["id"] = message.ID
-		i["body"] = message.Content
-		i["timestamp"] = message.Timestamp
-		jsonData, err := json.Marshal(i)
-		if err != nil {
-			log.Printf("[ERROR] marshal message error: %v", err)
-			continue
+		status, event := interfaces.MessagePushStatusSuccess, interfaces.CallbackEventDelivered
+		if message.IsExpired(now) {
+			status, event = interfaces.MessagePushStatusExpired, interfaces.CallbackEventExpired
+		} else if !sendToConns(ctx, wsConns, message, newMessageEnvelope(message)) {
+			// 发送缓冲区已满, 推送失败的记录由补偿推送重新投递, 不回调
+			status, event = interfaces.MessagePushStatusFailed, ""
 		}
-		wsConn.Send(ctx, jsonData)
-		err = messagePush.logicsMessage.UpdateStatus(ctx, userID, message.ID, interfaces.MessagePushStatusSuccess)
-		if err != nil {
-			log.Printf("[ERROR] update message status error: %v", err)
-			return err
+		if status != interfaces.MessagePushStatusSuccess {
+			undelivered = append(undelivered, message.ID)
 		}
+		updates = append(updates, &interfaces.PushStatusUpdate{OrgID: tenantID, UserID: userID, MessageID: message.ID, Status: status})
+		events = append(events, event)
 	}
 
-	return nil
+	err = messagePush.logicsMessage.BatchUpsertStatus(ctx, updates)
+	if err != nil {
+		log.Printf("[ERROR] batch upsert message status error: %v", err)
+		return nil, err
+	}
+
+	for i, message := range messages {
+		switch events[i] {
+		case "":
+			continue
+		case interfaces.CallbackEventDelivered:
+			common.IncTenantCounter(tenantID, common.MetricMessagesDelivered)
+		case interfaces.CallbackEventExpired:
+			common.IncTenantCounter(tenantID, common.MetricMessagesExpired)
+		}
+		messagePush.callback.Emit(ctx, message, tenantID, userID, events[i])
+	}
+	return undelivered, nil
 }
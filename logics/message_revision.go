@@ -0,0 +1,176 @@
+package logics
+
+import (
+	"MessagePushService/common"
+	"MessagePushService/interfaces"
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	messageRevisionOnce     sync.Once
+	messageRevisionInstance *messageRevision
+)
+
+// messageRevision 撤回/编辑事件作为消息保存到接收用户的收件箱, 与普通消息一样推送、补推与同步
+type messageRevision struct {
+	logicsMessage interfaces.ILogicsMessage
+	messagePush   interfaces.ILogicsMessagePush
+	recallWindow  time.Duration // 聊天消息的发送者可撤回的时限
+	editWindow    time.Duration // 聊天消息的发送者可编辑的时限
+}
+
+func NewMessageRevision(config *common.Config, logicsMessage interfaces.ILogicsMessage, messagePush interfaces.ILogicsMessagePush) interfaces.ILogicsMessageRevision {
+	messageRevisionOnce.Do(func() {
+		messageRevisionInstance = &messageRevision{
+			logicsMessage: logicsMessage,
+			messagePush:   messagePush,
+			recallWindow:  time.Minute * 2,
+			editWindow:    time.Hour * 24,
+		}
+		if cfg := config.Revision; cfg != nil {
+			if cfg.RecallWindow > 0 {
+				messageRevisionInstance.recallWindow = cfg.RecallWindow
+			}
+			if cfg.EditWindow > 0 {
+				messageRevisionInstance.editWindow = cfg.EditWindow
+			}
+		}
+	})
+
+	return messageRevisionInstance
+}
+
+func (r *messageRevision) Recall(ctx context.Context, operator *interfaces.UserInfo, messageID string) error {
+	message, err := r.load(ctx, messageID)
+	if err != nil {
+		return err
+	}
+	if operator != nil {
+		err = authorizeSender(message, operator, r.recallWindow)
+		if err != nil {
+			return err
+		}
+	}
+
+	now := time.Now().Unix()
+	event := newRevisionEvent(message, interfaces.MessageTypeRecall, operator, now, map[string]interface{}{
+		"message_id":  message.ID,
+		"recalled_at": now,
+	})
+	userIDs, err := r.logicsMessage.Recall(ctx, message.ID, event)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[INFO] message recalled, messageID: %s, operator: %s", message.ID, event.SenderID)
+	r.notify(event, userIDs)
+	return nil
+}
+
+func (r *messageRevision) Edit(ctx context.Context, operator *interfaces.UserInfo, messageID string, content interface{}) error {
+	message, err := r.load(ctx, messageID)
+	if err != nil {
+		return err
+	}
+	if message.Type != interfaces.MessageTypeChatRoom {
+		return fmt.Errorf("%w, only chat messages can be edited", interfaces.ErrForbidden)
+	}
+	if operator != nil {
+		err = authorizeSender(message, operator, r.editWindow)
+		if err != nil {
+			return err
+		}
+	}
+	body, ok := message.Content.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("message content is not an object, messageID: %s", messageID)
+	}
+
+	// 只替换 content 字段, from/to/room_id 等路由字段保持不变
+	edited := make(map[string]interface{}, len(body))
+	for k, v := range body {
+		edited[k] = v
+	}
+	edited["content"] = content
+
+	now := time.Now().Unix()
+	event := newRevisionEvent(message, interfaces.MessageTypeEdit, operator, now, map[string]interface{}{
+		"message_id": message.ID,
+		"content":    content,
+		"edited_at":  now,
+	})
+	userIDs, err := r.logicsMessage.Edit(ctx, message.ID, event.SenderID, edited, event)
+	if err != nil {
+		return err
+	}
+
+	r.notify(event, userIDs)
+	return nil
+}
+
+func (r *messageRevision) load(ctx context.Context, messageID string) (*interfaces.LogicsMessage, error) {
+	message, _, err := r.logicsMessage.GetByID(ctx, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if message == nil {
+		return nil, fmt.Errorf("message content is invalid, messageID: %s", messageID)
+	}
+	if message.IsRecalled() {
+		return nil, interfaces.ErrMessageRecalled
+	}
+	// 撤回/编辑事件本身不能再被撤回或编辑
+	if message.Type == interfaces.MessageTypeRecall || message.Type == interfaces.MessageTypeEdit {
+		return nil, fmt.Errorf("%w, revision events cannot be revised", interfaces.ErrForbidden)
+	}
+	return message, nil
+}
+
+// authorizeSender 客户端只能撤回/编辑自己在时限内发送的聊天消息
+func authorizeSender(message *interfaces.LogicsMessage, operator *interfaces.UserInfo, window time.Duration) error {
+	if message.Type != interfaces.MessageTypeChatRoom || message.SenderID != operator.ID || message.OrgID != operator.TenantID {
+		return fmt.Errorf("%w, not the sender of the message", interfaces.ErrForbidden)
+	}
+	if time.Since(message.CreatedAt) > window {
+		return fmt.Errorf("%w, exceeded the time limit of %s", interfaces.ErrForbidden, window)
+	}
+	return nil
+}
+
+// newRevisionEvent 撤回/编辑事件发给已收到原消息的用户, 以高优先级推送; 不设置 topic, 不回调也不降级通知
+// 广播类消息的事件按指定用户保存, 不作为广播补推给未收到原消息的用户
+func newRevisionEvent(message *interfaces.LogicsMessage, typ interfaces.MessageType, operator *interfaces.UserInfo, now int64, content map[string]interface{}) *interfaces.LogicsMessage {
+	event := &interfaces.LogicsMessage{
+		ID:           common.NewID(),
+		OrgID:        message.OrgID,
+		Type:         typ,
+		Content:      content,
+		Timestamp:    now,
+		AudienceType: message.AudienceType,
+		AudienceID:   message.AudienceID,
+		RoomID:       message.RoomID,
+		Priority:     interfaces.MessagePriorityHigh,
+	}
+	if message.AudienceType.IsBroadcast() {
+		event.AudienceType, event.AudienceID = interfaces.AudienceTypeUsers, ""
+	}
+	if operator != nil {
+		event.SenderID = operator.ID
+	}
+	return event
+}
+
+func (r *messageRevision) notify(event *interfaces.LogicsMessage, userIDs []string) {
+	if len(userIDs) == 0 {
+		return
+	}
+	// 推送队列已满时事件已保存, 在线用户由补偿推送、离线用户上线时补推
+	err := r.messagePush.NotifyByNewMessage(event.ID, event.Priority)
+	if err != nil {
+		log.Printf("[WARN] notify revision event error, %v, messageID: %s", err, event.ID)
+	}
+}
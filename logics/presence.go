@@ -0,0 +1,232 @@
+package logics
+
+import (
+	"MessagePushService/common"
+	"MessagePushService/interfaces"
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	presenceOnce     sync.Once
+	presenceInstance *presence
+)
+
+// presenceChannelPrefix 在线状态变更事件推送到 presence:{userID} 频道的订阅者
+const presenceChannelPrefix = "presence:"
+
+type presenceState struct {
+	conns    map[interfaces.ILogicsWsConn]interfaces.PresenceStatus // 连接 -> 连接状态(online/away)
+	status   interfaces.PresenceStatus                              // 聚合后的用户状态
+	lastSeen time.Time
+}
+
+type presence struct {
+	dbPresence   interfaces.IDBPresence
+	subscription interfaces.ILogicsSubscription
+	producer     interfaces.IDrivenMQProducer
+	topic        string // 状态变更事件发布的 topic, 为空则不发布
+
+	users map[tenantUser]*presenceState // 租户内用户 -> 在线状态, 仅包含当前有连接的用户
+	mu    sync.RWMutex
+
+	ctx       context.Context
+	eventChan chan *interfaces.UserPresence
+}
+
+func NewPresence(config *common.Config, dbPresence interfaces.IDBPresence, subscription interfaces.ILogicsSubscription, producer interfaces.IDrivenMQProducer) interfaces.ILogicsPresence {
+	presenceOnce.Do(func() {
+		presenceInstance = &presence{
+			dbPresence:   dbPresence,
+			subscription: subscription,
+			producer:     producer,
+			users:        make(map[tenantUser]*presenceState, 10000),
+			ctx:          context.Background(),
+			eventChan:    make(chan *interfaces.UserPresence, 1000),
+		}
+		if config.Presence != nil {
+			presenceInstance.topic = config.Presence.Topic
+		}
+
+		go presenceInstance.eventWorker()
+	})
+
+	return presenceInstance
+}
+
+func (p *presence) OnConnect(conn interfaces.ILogicsWsConn) {
+	key := presenceKey(conn)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	state, ok := p.users[key]
+	if !ok {
+		state = &presenceState{
+			conns:  make(map[interfaces.ILogicsWsConn]interfaces.PresenceStatus),
+			status: interfaces.PresenceStatusOffline,
+		}
+		p.users[key] = state
+	}
+	state.conns[conn] = interfaces.PresenceStatusOnline
+	state.lastSeen = time.Now()
+	p.refresh(key, state)
+}
+
+func (p *presence) OnDisconnect(conn interfaces.ILogicsWsConn) {
+	key := presenceKey(conn)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	state, ok := p.users[key]
+	if !ok {
+		return
+	}
+	if _, ok := state.conns[conn]; !ok {
+		return
+	}
+	delete(state.conns, conn)
+	state.lastSeen = time.Now()
+	p.refresh(key, state)
+	if len(state.conns) == 0 {
+		delete(p.users, key)
+	}
+}
+
+func (p *presence) SetStatus(conn interfaces.ILogicsWsConn, status interfaces.PresenceStatus) error {
+	if status != interfaces.PresenceStatusOnline && status != interfaces.PresenceStatusAway {
+		return fmt.Errorf("invalid presence status: %s", status)
+	}
+	key := presenceKey(conn)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	state, ok := p.users[key]
+	if !ok {
+		return nil
+	}
+	if _, ok := state.conns[conn]; !ok {
+		return nil
+	}
+	state.conns[conn] = status
+	state.lastSeen = time.Now()
+	p.refresh(key, state)
+	return nil
+}
+
+func (p *presence) Touch(conn interfaces.ILogicsWsConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if state, ok := p.users[presenceKey(conn)]; ok {
+		state.lastSeen = time.Now()
+	}
+}
+
+func (p *presence) Get(ctx context.Context, tenantID string, userIDs []string) (outs []*interfaces.UserPresence, err error) {
+	offline := make([]string, 0, len(userIDs))
+	p.mu.RLock()
+	for _, userID := range userIDs {
+		state, ok := p.users[tenantUser{tenantID: tenantID, userID: userID}]
+		if !ok {
+			offline = append(offline, userID)
+			continue
+		}
+		outs = append(outs, &interfaces.UserPresence{
+			OrgID:       tenantID,
+			UserID:      userID,
+			Status:      state.status,
+			LastSeen:    state.lastSeen.Unix(),
+			DeviceCount: len(state.conns),
+		})
+	}
+	p.mu.RUnlock()
+
+	// 离线用户的最后活跃时间从数据库中获取
+	lastSeen, err := p.dbPresence.GetLastSeen(ctx, tenantID, offline)
+	if err != nil {
+		log.Printf("[ERROR] get last seen error: %v", err)
+		return nil, err
+	}
+	for _, userID := range offline {
+		out := &interfaces.UserPresence{
+			OrgID:  tenantID,
+			UserID: userID,
+			Status: interfaces.PresenceStatusOffline,
+		}
+		if t, ok := lastSeen[userID]; ok {
+			out.LastSeen = t.Unix()
+		}
+		outs = append(outs, out)
+	}
+	return outs, nil
+}
+
+func presenceKey(conn interfaces.ILogicsWsConn) tenantUser {
+	userInfo := conn.GetUserInfo()
+	return tenantUser{tenantID: userInfo.TenantID, userID: userInfo.ID}
+}
+
+// refresh 重新计算用户的聚合状态, 状态变化时发出事件, 调用方需持有写锁
+func (p *presence) refresh(key tenantUser, state *presenceState) {
+	status := interfaces.PresenceStatusOffline
+	for _, connStatus := range state.conns {
+		if connStatus == interfaces.PresenceStatusOnline {
+			status = interfaces.PresenceStatusOnline
+			break
+		}
+		status = interfaces.PresenceStatusAway
+	}
+	if status == state.status {
+		return
+	}
+	state.status = status
+
+	event := &interfaces.UserPresence{
+		OrgID:       key.tenantID,
+		UserID:      key.userID,
+		Status:      status,
+		LastSeen:    state.lastSeen.Unix(),
+		DeviceCount: len(state.conns),
+	}
+	select {
+	case p.eventChan <- event:
+	default:
+		log.Printf("[WARN] presence event channel is full, drop event, userID: %s, status: %s", key.userID, status)
+	}
+}
+
+// eventWorker 异步处理状态变更事件: 持久化最后活跃时间, 推送给订阅者, 发布到MQ
+func (p *presence) eventWorker() {
+	for {
+		select {
+		case <-p.ctx.Done():
+			log.Printf("[DEBUG] presence eventWorker receive close signal")
+			return
+		case event := <-p.eventChan:
+			if event.Status == interfaces.PresenceStatusOffline {
+				err := p.dbPresence.UpsertLastSeen(p.ctx, event.OrgID, event.UserID, time.Unix(event.LastSeen, 0))
+				if err != nil {
+					log.Printf("[ERROR] upsert last seen error: %v", err)
+				}
+			}
+
+			envelope := newEnvelope(common.NewID(), interfaces.MessageTypePresence, event, time.Now().Unix())
+			for _, conn := range p.subscription.GetSubscribers(p.ctx, event.OrgID, presenceChannelPrefix+event.UserID) {
+				conn.Send(p.ctx, envelope)
+			}
+
+			if p.topic != "" && p.producer != nil {
+				err := p.producer.Publish(p.ctx, p.topic, event)
+				if err != nil {
+					log.Printf("[ERROR] publish presence event error: %v", err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package logics
+
+import (
+	"MessagePushService/interfaces"
+	"context"
+)
+
+// priorityQueue 按消息优先级分通道的有界队列, 高优先级的元素可越过已排队的低优先级元素
+// 为避免持续的高优先级流量饿死低优先级, 每 normalTurn 次出队优先取一次普通优先级, 每 lowTurn 次出队优先取一次低优先级
+// 队列容量为各优先级通道的元素总数, 入队前先占用一个空位, 出队或丢弃后释放; 队列只支持单个消费者
+type priorityQueue[T any] struct {
+	lanes [3]chan T     // 下标: 0-低 1-普通 2-高
+	slots chan struct{} // 已占用的空位, 容量为队列容量
+	ready chan struct{} // 入队后通知消费者, 容量为1
+	popN  uint64
+}
+
+const (
+	priorityQueueNormalTurn = 4
+	priorityQueueLowTurn    = 16
+)
+
+// newPriorityQueue size 为所有优先级合计的容量; 每个通道的容量同为 size, 占用空位后写入通道不会阻塞
+func newPriorityQueue[T any](size int) *priorityQueue[T] {
+	q := &priorityQueue[T]{slots: make(chan struct{}, size), ready: make(chan struct{}, 1)}
+	for i := range q.lanes {
+		q.lanes[i] = make(chan T, size)
+	}
+	return q
+}
+
+func laneIndex(priority interfaces.MessagePriority) int {
+	switch priority {
+	case interfaces.MessagePriorityLow:
+		return 0
+	case interfaces.MessagePriorityHigh:
+		return 2
+	default:
+		return 1
+	}
+}
+
+// Len 各优先级通道中的元素总数
+func (q *priorityQueue[T]) Len() int {
+	n := 0
+	for i := range q.lanes {
+		n += len(q.lanes[i])
+	}
+	return n
+}
+
+// Push 入队, 队列已满时阻塞
+func (q *priorityQueue[T]) Push(priority interfaces.MessagePriority, v T) {
+	q.slots <- struct{}{}
+	q.lanes[laneIndex(priority)] <- v
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// TryPush 非阻塞入队, 队列已满时返回 false
+func (q *priorityQueue[T]) TryPush(priority interfaces.MessagePriority, v T) bool {
+	select {
+	case q.slots <- struct{}{}:
+	default:
+		return false
+	}
+	q.lanes[laneIndex(priority)] <- v
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// DropOldest 非阻塞地丢弃优先级不高于 priority 的元素中最早的一个, 从最低优先级的通道开始; 没有可丢弃的元素时返回 false
+func (q *priorityQueue[T]) DropOldest(priority interfaces.MessagePriority) (v T, ok bool) {
+	for i := 0; i <= laneIndex(priority); i++ {
+		select {
+		case v = <-q.lanes[i]:
+			<-q.slots
+			return v, true
+		default:
+		}
+	}
+	return v, false
+}
+
+// Ready 有新元素入队时可读, 读到后应调用 TryPop 直到返回 false
+func (q *priorityQueue[T]) Ready() <-chan struct{} {
+	return q.ready
+}
+
+// Close 关闭队列, 消费者从 Ready 读到关闭信号后退出; 调用方需保证关闭后不再入队
+func (q *priorityQueue[T]) Close() {
+	close(q.ready)
+}
+
+// TryPop 非阻塞出队, 队列为空时返回 false
+func (q *priorityQueue[T]) TryPop() (v T, ok bool) {
+	q.popN++
+	order := [3]int{2, 1, 0}
+	switch {
+	case q.popN%priorityQueueLowTurn == 0:
+		order = [3]int{0, 2, 1}
+	case q.popN%priorityQueueNormalTurn == 0:
+		order = [3]int{1, 2, 0}
+	}
+
+	for _, i := range order {
+		select {
+		case v = <-q.lanes[i]:
+			<-q.slots
+			return v, true
+		default:
+		}
+	}
+	q.popN--
+	return v, false
+}
+
+// Pop 阻塞出队, ctx 结束或队列关闭时返回 false
+func (q *priorityQueue[T]) Pop(ctx context.Context) (v T, ok bool) {
+	for {
+		if v, ok = q.TryPop(); ok {
+			return v, true
+		}
+		select {
+		case <-ctx.Done():
+			return v, false
+		case _, ok = <-q.ready:
+			if !ok {
+				return v, false
+			}
+		}
+	}
+}
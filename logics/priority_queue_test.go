@@ -0,0 +1,36 @@
+package logics
+
+import (
+	"MessagePushService/interfaces"
+	"testing"
+)
+
+func TestPriorityQueueCapacity(t *testing.T) {
+	q := newPriorityQueue[int](3)
+	q.TryPush(interfaces.MessagePriorityLow, 1)
+	q.TryPush(interfaces.MessagePriorityNormal, 2)
+	q.TryPush(interfaces.MessagePriorityHigh, 3)
+	if q.TryPush(interfaces.MessagePriorityHigh, 4) {
+		t.Fatal("push into a full queue should fail whatever the priority")
+	}
+
+	// 只丢弃优先级不高于新元素的元素, 从最低优先级开始
+	if v, ok := q.DropOldest(interfaces.MessagePriorityHigh); !ok || v != 1 {
+		t.Fatalf("drop oldest, expect 1, got %d, %v", v, ok)
+	}
+	if !q.TryPush(interfaces.MessagePriorityHigh, 4) {
+		t.Fatal("push after drop should succeed")
+	}
+	if _, ok := q.DropOldest(interfaces.MessagePriorityLow); ok {
+		t.Fatal("low priority push should not drop higher priority elements")
+	}
+
+	for _, expect := range []int{3, 4, 2} {
+		if v, ok := q.TryPop(); !ok || v != expect {
+			t.Fatalf("pop, expect %d, got %d, %v", expect, v, ok)
+		}
+	}
+	if q.Len() != 0 || !q.TryPush(interfaces.MessagePriorityLow, 5) {
+		t.Fatal("popped elements should free their slots")
+	}
+}
@@ -0,0 +1,350 @@
+package logics
+
+import (
+	"MessagePushService/interfaces"
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// NewFrameCodec 根据连接协商的子协议选择编解码器, 未协商时使用 v0
+func NewFrameCodec(subprotocol string) interfaces.ILogicsFrameCodec {
+	switch subprotocol {
+	case interfaces.ProtocolV1:
+		return v1Codec{}
+	case interfaces.ProtocolV1MsgPack:
+		return msgpackCodec{}
+	case interfaces.ProtocolV1Proto:
+		return protoCodec{}
+	default:
+		return v0Codec{}
+	}
+}
+
+// v0Frame 未协商子协议时的消息格式
+type v0Frame struct {
+	ID        string                 `json:"id"`
+	Type      interfaces.MessageType `json:"type"`
+	Seq       int64                  `json:"seq,omitempty"`
+	Timestamp int64                  `json:"timestamp"`
+	Body      interface{}            `json:"body"`
+	Channel   string                 `json:"channel,omitempty"`
+}
+
+type v0Codec struct{}
+
+func (v0Codec) Encode(envelope *interfaces.Envelope) ([]byte, error) {
+	return json.Marshal(&v0Frame{
+		ID:        envelope.ID,
+		Type:      envelope.Type,
+		Seq:       envelope.Seq,
+		Timestamp: envelope.Timestamp,
+		Body:      envelope.Payload,
+		Channel:   envelope.Metadata["channel"],
+	})
+}
+
+func (v0Codec) Decode(data []byte) (*interfaces.Envelope, error) {
+	var frame v0Frame
+	err := json.Unmarshal(data, &frame)
+	if err != nil {
+		return nil, err
+	}
+	return &interfaces.Envelope{
+		ID:        frame.ID,
+		Type:      frame.Type,
+		Timestamp: frame.Timestamp,
+		Payload:   frame.Body,
+	}, nil
+}
+
+func (v0Codec) FrameType() int {
+	return websocket.TextMessage
+}
+
+type v1Codec struct{}
+
+func (v1Codec) Encode(envelope *interfaces.Envelope) ([]byte, error) {
+	out := *envelope
+	out.Version = 1
+	return json.Marshal(&out)
+}
+
+func (v1Codec) Decode(data []byte) (*interfaces.Envelope, error) {
+	var envelope interfaces.Envelope
+	err := json.Unmarshal(data, &envelope)
+	if err != nil {
+		return nil, err
+	}
+	return checkVersion(&envelope)
+}
+
+func (v1Codec) FrameType() int {
+	return websocket.TextMessage
+}
+
+// msgpackCodec 字段名与 JSON 编码相同
+type msgpackCodec struct{}
+
+func (msgpackCodec) Encode(envelope *interfaces.Envelope) ([]byte, error) {
+	out := *envelope
+	out.Version = 1
+
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.SetOmitEmpty(true)
+	enc.UseCompactInts(true)
+	err := enc.Encode(&out)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Decode(data []byte) (*interfaces.Envelope, error) {
+	var envelope interfaces.Envelope
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	err := dec.Decode(&envelope)
+	if err != nil {
+		return nil, err
+	}
+	return checkVersion(&envelope)
+}
+
+func (msgpackCodec) FrameType() int {
+	return websocket.BinaryMessage
+}
+
+// protoCodec 按 proto/envelope.proto 中的 Envelope 编码, payload 为 google.protobuf.Value; 修改字段时需同步 .proto 文件
+type protoCodec struct{}
+
+const (
+	protoFieldVersion protowire.Number = iota + 1
+	protoFieldType
+	protoFieldID
+	protoFieldSeq
+	protoFieldTimestamp
+	protoFieldSender
+	protoFieldPayload
+	protoFieldMetadata
+	protoFieldEncoding
+)
+
+func (protoCodec) Encode(envelope *interfaces.Envelope) ([]byte, error) {
+	payload, err := toProtoValue(envelope.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("encode payload error, %w", err)
+	}
+	payloadData, err := proto.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("encode payload error, %w", err)
+	}
+
+	b := make([]byte, 0, 32+len(envelope.ID)+len(envelope.Sender)+len(payloadData))
+	b = appendProtoVarint(b, protoFieldVersion, 1)
+	b = appendProtoVarint(b, protoFieldType, uint64(envelope.Type))
+	b = appendProtoString(b, protoFieldID, envelope.ID)
+	b = appendProtoVarint(b, protoFieldSeq, uint64(envelope.Seq))
+	b = appendProtoVarint(b, protoFieldTimestamp, uint64(envelope.Timestamp))
+	b = appendProtoString(b, protoFieldSender, envelope.Sender)
+	b = protowire.AppendTag(b, protoFieldPayload, protowire.BytesType)
+	b = protowire.AppendBytes(b, payloadData)
+	for k, v := range envelope.Metadata {
+		var entry []byte
+		entry = appendProtoString(entry, 1, k)
+		entry = appendProtoString(entry, 2, v)
+		b = protowire.AppendTag(b, protoFieldMetadata, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	b = appendProtoString(b, protoFieldEncoding, envelope.Encoding)
+	return b, nil
+}
+
+func (protoCodec) Decode(data []byte) (*interfaces.Envelope, error) {
+	envelope := &interfaces.Envelope{}
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		switch typ {
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			data = data[n:]
+			switch num {
+			case protoFieldVersion:
+				envelope.Version = int(int32(v))
+			case protoFieldType:
+				envelope.Type = interfaces.MessageType(int32(v))
+			case protoFieldSeq:
+				envelope.Seq = int64(v)
+			case protoFieldTimestamp:
+				envelope.Timestamp = int64(v)
+			}
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			data = data[n:]
+			switch num {
+			case protoFieldID:
+				envelope.ID = string(v)
+			case protoFieldSender:
+				envelope.Sender = string(v)
+			case protoFieldEncoding:
+				envelope.Encoding = string(v)
+			case protoFieldPayload:
+				payload := &structpb.Value{}
+				err := proto.Unmarshal(v, payload)
+				if err != nil {
+					return nil, fmt.Errorf("decode payload error, %w", err)
+				}
+				envelope.Payload = payload.AsInterface()
+			case protoFieldMetadata:
+				key, value, err := consumeProtoMapEntry(v)
+				if err != nil {
+					return nil, err
+				}
+				if envelope.Metadata == nil {
+					envelope.Metadata = make(map[string]string)
+				}
+				envelope.Metadata[key] = value
+			}
+		default:
+			// 跳过未知字段, 兼容后续新增的字段
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			data = data[n:]
+		}
+	}
+	return checkVersion(envelope)
+}
+
+func (protoCodec) FrameType() int {
+	return websocket.BinaryMessage
+}
+
+func appendProtoVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendProtoString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// consumeProtoMapEntry 解析 map<string, string> 的一项
+func consumeProtoMapEntry(data []byte) (key, value string, err error) {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return "", "", protowire.ParseError(n)
+		}
+		data = data[n:]
+		if typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return "", "", protowire.ParseError(n)
+			}
+			data = data[n:]
+			continue
+		}
+		v, n := protowire.ConsumeString(data)
+		if n < 0 {
+			return "", "", protowire.ParseError(n)
+		}
+		data = data[n:]
+		switch num {
+		case 1:
+			key = v
+		case 2:
+			value = v
+		}
+	}
+	return key, value, nil
+}
+
+// toProtoValue 消息体转换为 google.protobuf.Value, 结构体等无法直接转换的值先经过 JSON 转换
+func toProtoValue(payload interface{}) (*structpb.Value, error) {
+	value, err := structpb.NewValue(payload)
+	if err == nil {
+		return value, nil
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	var generic interface{}
+	err = json.Unmarshal(data, &generic)
+	if err != nil {
+		return nil, err
+	}
+	return structpb.NewValue(generic)
+}
+
+func checkVersion(envelope *interfaces.Envelope) (*interfaces.Envelope, error) {
+	if envelope.Version != 1 {
+		return nil, newFrameError(interfaces.ErrorCodeInvalidMessage, fmt.Sprintf("unsupported version %d", envelope.Version))
+	}
+	return envelope, nil
+}
+
+// newEnvelope 构造服务端发出的控制类消息(回复、在线状态等)
+func newEnvelope(id string, typ interfaces.MessageType, payload interface{}, timestamp int64) *interfaces.Envelope {
+	return &interfaces.Envelope{
+		ID:        id,
+		Type:      typ,
+		Timestamp: timestamp,
+		Payload:   payload,
+	}
+}
+
+// newMessageEnvelope 构造推送消息, 按用户查询的消息带有该用户的收件箱序号
+func newMessageEnvelope(message *interfaces.LogicsMessage) *interfaces.Envelope {
+	envelope := &interfaces.Envelope{
+		ID:        message.ID,
+		Type:      message.Type,
+		Timestamp: message.Timestamp,
+		Seq:       message.Seq,
+		Sender:    message.SenderID,
+		Payload:   message.Content,
+	}
+	if message.AudienceType == interfaces.AudienceTypeChannel {
+		envelope.Metadata = map[string]string{"channel": message.AudienceID}
+	}
+	return envelope
+}
+
+// withSeq 同一消息推送给多个用户时, 每个用户的信封带有各自的收件箱序号
+func withSeq(envelope *interfaces.Envelope, seq int64) *interfaces.Envelope {
+	if seq == 0 || envelope.Seq == seq {
+		return envelope
+	}
+	out := *envelope
+	out.Seq = seq
+	return &out
+}
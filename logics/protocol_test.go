@@ -0,0 +1,120 @@
+package logics
+
+import (
+	"MessagePushService/interfaces"
+	"reflect"
+	"testing"
+)
+
+// benchEnvelope 典型的推送消息
+func benchEnvelope() *interfaces.Envelope {
+	return &interfaces.Envelope{
+		Version:   1,
+		Type:      interfaces.MessageTypeToUsers,
+		ID:        "0c4f8f5e-6a3b-4f61-9d7e-2f3c1b8a9e10",
+		Seq:       1024,
+		Timestamp: 1700000000,
+		Sender:    "10001",
+		Payload: map[string]interface{}{
+			"title":   "订单已发货",
+			"content": "您的订单 202311150001 已发货, 预计 2 天内送达",
+			"order": map[string]interface{}{
+				"id":     "202311150001",
+				"amount": 199.5,
+				"items":  []interface{}{"sku-1", "sku-2", "sku-3"},
+			},
+			"read": false,
+		},
+		Metadata: map[string]string{"channel": "order:10001"},
+	}
+}
+
+var benchProtocols = []string{interfaces.ProtocolV1, interfaces.ProtocolV1MsgPack, interfaces.ProtocolV1Proto}
+
+func TestFrameCodecRoundTrip(t *testing.T) {
+	envelope := benchEnvelope()
+	for _, protocol := range benchProtocols {
+		codec := NewFrameCodec(protocol)
+		data, err := codec.Encode(envelope)
+		if err != nil {
+			t.Fatalf("%s encode error: %v", protocol, err)
+		}
+		decoded, err := codec.Decode(data)
+		if err != nil {
+			t.Fatalf("%s decode error: %v", protocol, err)
+		}
+		if decoded.ID != envelope.ID || decoded.Seq != envelope.Seq || decoded.Sender != envelope.Sender || !reflect.DeepEqual(decoded.Metadata, envelope.Metadata) {
+			t.Fatalf("%s round trip mismatch: %+v", protocol, decoded)
+		}
+	}
+}
+
+func TestPayloadIntAcrossCodecs(t *testing.T) {
+	envelope := &interfaces.Envelope{
+		Version:   1,
+		Type:      interfaces.MessageTypeSync,
+		ID:        "s1",
+		Timestamp: 1700000000,
+		Payload:   map[string]interface{}{"after_seq": 5, "limit": 300},
+	}
+	for _, protocol := range benchProtocols {
+		codec := NewFrameCodec(protocol)
+		data, err := codec.Encode(envelope)
+		if err != nil {
+			t.Fatalf("%s encode error: %v", protocol, err)
+		}
+		decoded, err := codec.Decode(data)
+		if err != nil {
+			t.Fatalf("%s decode error: %v", protocol, err)
+		}
+		body := decoded.Payload.(map[string]interface{})
+		if v, ok := payloadInt(body["after_seq"]); !ok || v != 5 {
+			t.Fatalf("%s after_seq: %v(%T), got %d, %v", protocol, body["after_seq"], body["after_seq"], v, ok)
+		}
+		if v, ok := payloadInt(body["limit"]); !ok || v != 300 {
+			t.Fatalf("%s limit: %v(%T), got %d, %v", protocol, body["limit"], body["limit"], v, ok)
+		}
+	}
+
+	if _, ok := payloadInt("5"); ok {
+		t.Fatal("string should not be parsed as a number")
+	}
+	if _, ok := payloadInt(1.5); ok {
+		t.Fatal("fraction should not be parsed as an integer")
+	}
+}
+
+// BenchmarkFrameCodecEncode 比较各子协议编码同一条推送消息的耗时, bytes 为编码后大小
+//
+//	go test -bench FrameCodec -benchmem ./logics
+func BenchmarkFrameCodecEncode(b *testing.B) {
+	envelope := benchEnvelope()
+	for _, protocol := range benchProtocols {
+		codec := NewFrameCodec(protocol)
+		b.Run(protocol, func(b *testing.B) {
+			var data []byte
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				data, _ = codec.Encode(envelope)
+			}
+			b.ReportMetric(float64(len(data)), "bytes")
+		})
+	}
+}
+
+func BenchmarkFrameCodecDecode(b *testing.B) {
+	envelope := benchEnvelope()
+	for _, protocol := range benchProtocols {
+		codec := NewFrameCodec(protocol)
+		data, err := codec.Encode(envelope)
+		if err != nil {
+			b.Fatalf("%s encode error: %v", protocol, err)
+		}
+		b.Run(protocol, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				codec.Decode(data)
+			}
+		})
+	}
+}
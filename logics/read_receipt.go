@@ -0,0 +1,71 @@
+package logics
+
+import (
+	"MessagePushService/common"
+	"MessagePushService/interfaces"
+	"context"
+	"sync"
+	"time"
+)
+
+var (
+	readReceiptOnce     sync.Once
+	readReceiptInstance *readReceipt
+)
+
+type readReceipt struct {
+	logicsMessage interfaces.ILogicsMessage
+	wsConnManager interfaces.ILogicsWsConnManager
+	notifySender  bool // 是否向聊天消息的发送者推送已读回执
+}
+
+func NewReadReceipt(config *common.Config, logicsMessage interfaces.ILogicsMessage, wsConnManager interfaces.ILogicsWsConnManager) interfaces.ILogicsReadReceipt {
+	readReceiptOnce.Do(func() {
+		readReceiptInstance = &readReceipt{
+			logicsMessage: logicsMessage,
+			wsConnManager: wsConnManager,
+		}
+		if config.ReadReceipt != nil {
+			readReceiptInstance.notifySender = config.ReadReceipt.NotifySender
+		}
+	})
+
+	return readReceiptInstance
+}
+
+func (r *readReceipt) MarkRead(ctx context.Context, reader *interfaces.UserInfo, msgID string, upTo bool) error {
+	messages, err := r.logicsMessage.MarkRead(ctx, reader.TenantID, reader.ID, msgID, upTo)
+	if err != nil {
+		return err
+	}
+	if !r.notifySender {
+		return nil
+	}
+
+	// 按发送者聚合, 每个发送者只推送一条回执
+	bySender := make(map[string][]string)
+	for _, message := range messages {
+		if message.Type != interfaces.MessageTypeChatRoom || message.SenderID == "" || message.SenderID == reader.ID {
+			continue
+		}
+		bySender[message.SenderID] = append(bySender[message.SenderID], message.MessageID)
+	}
+
+	now := time.Now().Unix()
+	for senderID, messageIDs := range bySender {
+		wsConns := r.wsConnManager.Get(ctx, reader.TenantID, senderID)
+		if len(wsConns) == 0 {
+			continue
+		}
+
+		envelope := newEnvelope(common.NewID(), interfaces.MessageTypeReadReceipt, map[string]interface{}{
+			"message_ids": messageIDs,
+			"reader":      reader.ID,
+			"read_at":     now,
+		}, now)
+		for _, wsConn := range wsConns {
+			wsConn.Send(ctx, envelope)
+		}
+	}
+	return nil
+}
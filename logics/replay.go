@@ -0,0 +1,215 @@
+package logics
+
+import (
+	"MessagePushService/common"
+	"MessagePushService/interfaces"
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// replaySession 一个用户的补推过程, 记录已发送、等待客户端确认的消息
+type replaySession struct {
+	mu      sync.Mutex
+	pending map[string]struct{}
+	done    chan struct{} // pending 清空时关闭
+}
+
+// expect 开始等待一批消息的确认, 需在发送前调用, 避免确认先于登记到达
+func (s *replaySession) expect(messageIDs []string) <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pending = make(map[string]struct{}, len(messageIDs))
+	for _, id := range messageIDs {
+		s.pending[id] = struct{}{}
+	}
+	s.done = make(chan struct{})
+	if len(s.pending) == 0 {
+		close(s.done)
+	}
+	return s.done
+}
+
+func (s *replaySession) ack(messageID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.pending[messageID]; !ok {
+		return
+	}
+	delete(s.pending, messageID)
+	if len(s.pending) == 0 {
+		close(s.done)
+	}
+}
+
+// replayer 用户上线时按收件箱序号分批补推离线消息, 客户端确认整批后再补推下一批; 不同用户的补推并发执行
+type replayer struct {
+	messagePush *messagePush
+	batchSize   int
+	ackTimeout  time.Duration
+	maxAge      time.Duration
+	maxCount    int
+	sem         chan struct{}
+
+	mu       sync.Mutex
+	sessions map[tenantUser]*replaySession // 租户内用户 -> 补推过程
+}
+
+func newReplayer(config *common.Config, messagePush *messagePush) *replayer {
+	r := &replayer{
+		messagePush: messagePush,
+		batchSize:   50,
+		ackTimeout:  time.Second * 10,
+		maxAge:      time.Hour * 24 * 7,
+		maxCount:    1000,
+		sessions:    make(map[tenantUser]*replaySession),
+	}
+	concurrency := 64
+	if cfg := config.Replay; cfg != nil {
+		if cfg.BatchSize > 0 {
+			r.batchSize = cfg.BatchSize
+		}
+		if cfg.AckTimeout > 0 {
+			r.ackTimeout = cfg.AckTimeout
+		}
+		if cfg.MaxAge > 0 {
+			r.maxAge = cfg.MaxAge
+		}
+		if cfg.MaxCount > 0 {
+			r.maxCount = cfg.MaxCount
+		}
+		if cfg.Concurrency > 0 {
+			concurrency = cfg.Concurrency
+		}
+	}
+	r.sem = make(chan struct{}, concurrency)
+	return r
+}
+
+// Start 同一用户已在补推时不重复补推, 新连接从下一批开始接收, 之前的消息可通过同步请求获取
+func (r *replayer) Start(ctx context.Context, userInfo *interfaces.UserInfo) {
+	key := tenantUser{tenantID: userInfo.TenantID, userID: userInfo.ID}
+	r.mu.Lock()
+	if _, ok := r.sessions[key]; ok {
+		r.mu.Unlock()
+		return
+	}
+	session := &replaySession{}
+	r.sessions[key] = session
+	r.mu.Unlock()
+
+	go func() {
+		defer func() {
+			r.mu.Lock()
+			delete(r.sessions, key)
+			r.mu.Unlock()
+		}()
+
+		select {
+		case r.sem <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		defer func() { <-r.sem }()
+
+		r.replay(ctx, userInfo, session)
+	}()
+}
+
+// Active 用户是否正在补推
+func (r *replayer) Active(tenantID, userID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, ok := r.sessions[tenantUser{tenantID: tenantID, userID: userID}]
+	return ok
+}
+
+// Ack 客户端确认收到消息
+func (r *replayer) Ack(tenantID, userID, messageID string) {
+	r.mu.Lock()
+	session, ok := r.sessions[tenantUser{tenantID: tenantID, userID: userID}]
+	r.mu.Unlock()
+	if ok {
+		session.ack(messageID)
+	}
+}
+
+func (r *replayer) replay(ctx context.Context, userInfo *interfaces.UserInfo, session *replaySession) {
+	since := time.Now().Add(-r.maxAge)
+	budget := r.maxCount
+
+	more, ok := r.replayBatches(ctx, userInfo, session, &budget, func(limit int) ([]*interfaces.LogicsMessage, error) {
+		return r.messagePush.logicsMessage.GetByUserID(ctx, userInfo.TenantID, userInfo.ID, since, limit)
+	})
+	// 组织/全员广播只存储一份, 用户上线时补推尚未投递的部分
+	if ok && !more {
+		more, ok = r.replayBatches(ctx, userInfo, session, &budget, func(limit int) ([]*interfaces.LogicsMessage, error) {
+			return r.messagePush.logicsMessage.GetPendingBroadcasts(ctx, userInfo, limit)
+		})
+	}
+	// 确认超时等原因未补推完时, 通知客户端通过同步请求获取剩余消息
+	more = more || !ok
+	// 超过补推时间范围的消息不补推, 同样通知客户端通过同步请求获取
+	if !more {
+		older, err := r.messagePush.logicsMessage.CountPending(ctx, userInfo.TenantID, userInfo.ID, since)
+		if err != nil {
+			log.Printf("[ERROR] count pending message error: %v", err)
+		}
+		more = older > 0
+	}
+	for _, wsConn := range r.messagePush.wsConnManager.Get(ctx, userInfo.TenantID, userInfo.ID) {
+		wsConn.Send(ctx, newEnvelope(common.NewID(), interfaces.MessageTypeBacklog, map[string]interface{}{
+			"more": more,
+		}, time.Now().Unix()))
+	}
+}
+
+// replayBatches 分批补推 fetch 返回的消息, 返回是否因达到补推上限而仍有未补推的消息, 以及是否正常结束(用户下线或确认超时时为 false)
+func (r *replayer) replayBatches(ctx context.Context, userInfo *interfaces.UserInfo, session *replaySession, budget *int, fetch func(limit int) ([]*interfaces.LogicsMessage, error)) (more bool, ok bool) {
+	for {
+		messages, err := fetch(r.batchSize)
+		if err != nil {
+			log.Printf("[ERROR] get pending message error: %v, userID: %s", err, userInfo.ID)
+			return false, false
+		}
+		if len(messages) == 0 {
+			return false, true
+		}
+		if *budget <= 0 {
+			return true, true
+		}
+		if len(messages) > *budget {
+			messages = messages[:*budget]
+		}
+		*budget -= len(messages)
+
+		messageIDs := make([]string, 0, len(messages))
+		for _, message := range messages {
+			messageIDs = append(messageIDs, message.ID)
+		}
+		done := session.expect(messageIDs)
+
+		undelivered, err := r.messagePush.pushMessagesToUser(ctx, messages, userInfo.TenantID, userInfo.ID)
+		if err != nil {
+			log.Printf("[ERROR] push messages to user error: %v", err)
+			return false, false
+		}
+		// 已过期或未能发送的消息不需要等待确认
+		for _, id := range undelivered {
+			session.ack(id)
+		}
+
+		select {
+		case <-done:
+		case <-time.After(r.ackTimeout):
+			log.Printf("[WARN] replay ack timeout, userID: %s", userInfo.ID)
+			return false, false
+		case <-ctx.Done():
+			return false, false
+		}
+	}
+}
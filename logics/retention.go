@@ -0,0 +1,315 @@
+package logics
+
+import (
+	"MessagePushService/common"
+	"MessagePushService/interfaces"
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	retentionOnce     sync.Once
+	retentionInstance *retention
+)
+
+// 保留的最近清理记录数
+const retentionRunHistory = 20
+
+// retentionTypes 保留规则中的类型名 -> 消息类型
+var retentionTypes = map[string][]interfaces.MessageType{
+	"notification": {interfaces.MessageTypeToUsers},
+	"chat":         {interfaces.MessageTypeChatRoom},
+	"broadcast":    {interfaces.MessageTypeBroadcast},
+	"channel":      {interfaces.MessageTypeChannel},
+	"revision":     {interfaces.MessageTypeRecall, interfaces.MessageTypeEdit},
+}
+
+// undeliveredStatuses 未推送成功的推送记录, 超过保留时间后不再推送
+var undeliveredStatuses = []interfaces.MessagePushStatus{
+	interfaces.MessagePushStatusUnhandled,
+	interfaces.MessagePushStatusSending,
+	interfaces.MessagePushStatusFailed,
+	interfaces.MessagePushStatusExpired,
+	interfaces.MessagePushStatusRecalled,
+}
+
+// retention 按消息类型删除超过保留时间的消息及其推送记录, 并删除超过保留时间仍未推送成功的推送记录
+// 每批最多删除 batchSize 行, 批次之间暂停 batchPause, 避免长事务与长时间锁表; 多个实例同时执行时删除是幂等的
+type retention struct {
+	dbRetention interfaces.IDBRetention
+
+	enabled     bool
+	dryRun      bool
+	interval    time.Duration
+	batchSize   int
+	batchPause  time.Duration
+	undelivered time.Duration
+	rules       []*common.RetentionRule
+
+	mu      sync.Mutex
+	running bool
+	runs    []*interfaces.RetentionRun // 最近的清理记录, 按开始时间倒序
+
+	ctx context.Context
+}
+
+func NewRetention(config *common.Config, dbRetention interfaces.IDBRetention) interfaces.ILogicsRetention {
+	retentionOnce.Do(func() {
+		retentionInstance = &retention{
+			dbRetention: dbRetention,
+			interval:    time.Hour,
+			batchSize:   500,
+			batchPause:  time.Millisecond * 100,
+			ctx:         context.Background(),
+		}
+
+		cfg := config.Retention
+		if cfg == nil {
+			return
+		}
+		retentionInstance.enabled = cfg.Enabled
+		retentionInstance.dryRun = cfg.DryRun
+		retentionInstance.undelivered = cfg.Undelivered
+		if cfg.Interval > 0 {
+			retentionInstance.interval = cfg.Interval
+		}
+		if cfg.BatchSize > 0 {
+			retentionInstance.batchSize = cfg.BatchSize
+		}
+		if cfg.BatchPause > 0 {
+			retentionInstance.batchPause = cfg.BatchPause
+		}
+		for _, rule := range cfg.Rules {
+			if _, ok := retentionTypes[rule.Type]; !ok {
+				log.Fatalf("invalid retention type %q", rule.Type)
+			}
+			if rule.MaxAge <= 0 {
+				log.Fatalf("retention maxAge of %s must be positive", rule.Type)
+			}
+			retentionInstance.rules = append(retentionInstance.rules, rule)
+		}
+	})
+
+	return retentionInstance
+}
+
+func (r *retention) Start() {
+	if !r.enabled {
+		return
+	}
+	go r.scheduleWorker()
+}
+
+func (r *retention) scheduleWorker() {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			log.Printf("[DEBUG] retention scheduleWorker receive close signal")
+			return
+		case <-ticker.C:
+			run, err := r.begin("schedule", r.dryRun)
+			if err != nil {
+				log.Printf("[WARN] skip scheduled retention run, %v", err)
+				continue
+			}
+			r.execute(run)
+		}
+	}
+}
+
+func (r *retention) Trigger(dryRun bool) (*interfaces.RetentionRun, error) {
+	run, err := r.begin("manual", dryRun)
+	if err != nil {
+		return nil, err
+	}
+	go r.execute(run)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return copyRetentionRun(run), nil
+}
+
+func (r *retention) GetRuns() []*interfaces.RetentionRun {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	out := make([]*interfaces.RetentionRun, 0, len(r.runs))
+	for _, run := range r.runs {
+		out = append(out, copyRetentionRun(run))
+	}
+	return out
+}
+
+// begin 同一实例同时只执行一次清理
+func (r *retention) begin(trigger string, dryRun bool) (*interfaces.RetentionRun, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.running {
+		return nil, interfaces.ErrRunInProgress
+	}
+	r.running = true
+
+	run := &interfaces.RetentionRun{
+		ID:        common.NewID(),
+		Trigger:   trigger,
+		DryRun:    dryRun,
+		State:     interfaces.RetentionRunStateRunning,
+		StartedAt: time.Now().Unix(),
+		Results:   make([]*interfaces.RetentionResult, 0, len(r.rules)+1),
+	}
+	r.runs = append([]*interfaces.RetentionRun{run}, r.runs...)
+	if len(r.runs) > retentionRunHistory {
+		r.runs = r.runs[:retentionRunHistory]
+	}
+	return run, nil
+}
+
+func (r *retention) execute(run *interfaces.RetentionRun) {
+	common.IncCounter(common.MetricRetentionRuns)
+	log.Printf("[INFO] retention run started, id: %s, trigger: %s, dryRun: %v", run.ID, run.Trigger, run.DryRun)
+
+	err := r.purge(run)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.running = false
+	run.FinishedAt = time.Now().Unix()
+	run.State = interfaces.RetentionRunStateSucceeded
+	if err != nil {
+		run.State = interfaces.RetentionRunStateFailed
+		run.Error = err.Error()
+		log.Printf("[ERROR] retention run failed, id: %s, %v", run.ID, err)
+		return
+	}
+	log.Printf("[INFO] retention run finished, id: %s", run.ID)
+}
+
+func (r *retention) purge(run *interfaces.RetentionRun) error {
+	now := time.Now()
+	for _, rule := range r.rules {
+		result := r.addResult(run, rule.Type, rule.MaxAge)
+		for _, typ := range retentionTypes[rule.Type] {
+			err := r.purgeMessages(run.DryRun, typ, now.Add(-rule.MaxAge), result)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if r.undelivered > 0 {
+		result := r.addResult(run, "undelivered", r.undelivered)
+		err := r.purgeUndelivered(run.DryRun, now.Add(-r.undelivered), result)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// purgeMessages 每批先删除消息的推送记录(广播消息的推送记录可能很多, 同样分批), 再删除消息; 仍有待推送记录的消息不删除
+func (r *retention) purgeMessages(dryRun bool, typ interfaces.MessageType, before time.Time, result *interfaces.RetentionResult) error {
+	if dryRun {
+		messages, records, err := r.dbRetention.CountMessagesBefore(r.ctx, int(typ), before, redeliverableStatuses)
+		if err != nil {
+			return err
+		}
+		r.addCounts(result, messages, records)
+		return nil
+	}
+
+	for {
+		messageIDs, err := r.dbRetention.GetMessageIDsBefore(r.ctx, int(typ), before, redeliverableStatuses, r.batchSize)
+		if err != nil {
+			return err
+		}
+		if len(messageIDs) == 0 {
+			return nil
+		}
+
+		for {
+			records, err := r.dbRetention.DeleteUserMessages(r.ctx, messageIDs, r.batchSize)
+			if err != nil {
+				return err
+			}
+			r.addCounts(result, 0, records)
+			common.AddCounter(common.MetricRetentionRecordsPurged, records)
+			r.pause()
+			if records < int64(r.batchSize) {
+				break
+			}
+		}
+
+		messages, err := r.dbRetention.DeleteMessages(r.ctx, messageIDs)
+		if err != nil {
+			return err
+		}
+		r.addCounts(result, messages, 0)
+		common.AddCounter(common.MetricRetentionMessagesPurged, messages)
+		r.pause()
+	}
+}
+
+func (r *retention) purgeUndelivered(dryRun bool, before time.Time, result *interfaces.RetentionResult) error {
+	if dryRun {
+		records, err := r.dbRetention.CountUserMessagesByStatus(r.ctx, undeliveredStatuses, before)
+		if err != nil {
+			return err
+		}
+		r.addCounts(result, 0, records)
+		return nil
+	}
+
+	for {
+		records, err := r.dbRetention.DeleteUserMessagesByStatus(r.ctx, undeliveredStatuses, before, r.batchSize)
+		if err != nil {
+			return err
+		}
+		if records == 0 {
+			return nil
+		}
+		r.addCounts(result, 0, records)
+		common.AddCounter(common.MetricRetentionRecordsPurged, records)
+		r.pause()
+	}
+}
+
+func (r *retention) pause() {
+	select {
+	case <-time.After(r.batchPause):
+	case <-r.ctx.Done():
+	}
+}
+
+// addResult/addCounts 清理记录可能同时被 GetRuns 读取, 修改需加锁
+func (r *retention) addResult(run *interfaces.RetentionRun, rule string, maxAge time.Duration) *interfaces.RetentionResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := &interfaces.RetentionResult{Rule: rule, MaxAge: maxAge.String()}
+	run.Results = append(run.Results, result)
+	return result
+}
+
+func (r *retention) addCounts(result *interfaces.RetentionResult, messages, records int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result.Messages += messages
+	result.Records += records
+}
+
+func copyRetentionRun(run *interfaces.RetentionRun) *interfaces.RetentionRun {
+	out := *run
+	out.Results = make([]*interfaces.RetentionResult, 0, len(run.Results))
+	for _, result := range run.Results {
+		tmp := *result
+		out.Results = append(out.Results, &tmp)
+	}
+	return &out
+}
@@ -0,0 +1,57 @@
+package logics
+
+import (
+	"MessagePushService/common"
+	"MessagePushService/interfaces"
+	"log"
+	"time"
+)
+
+// 慢连接策略: 连接发送缓冲区已满时的处理方式
+const (
+	slowConsumerDropOldest = "drop-oldest"
+	slowConsumerDropNewest = "drop-newest"
+	slowConsumerDisconnect = "disconnect"
+)
+
+// closeCodeSlowConsumer 因慢连接断开时发送给客户端的关闭码
+const closeCodeSlowConsumer = 4008
+
+// outboundFrame 待写入连接的消息, 推送消息带有消息ID, 未写入连接时用于标记推送失败
+type outboundFrame struct {
+	messageID string
+	envelope  *interfaces.Envelope
+}
+
+type sendPolicy struct {
+	policy          string
+	bufferSize      int
+	disconnectAfter time.Duration
+}
+
+func newSendPolicy(config *common.Config) *sendPolicy {
+	p := &sendPolicy{
+		policy:          slowConsumerDisconnect,
+		bufferSize:      1000,
+		disconnectAfter: time.Second * 5,
+	}
+
+	cfg := config.SlowConsumer
+	if cfg == nil {
+		return p
+	}
+	switch cfg.Policy {
+	case "":
+	case slowConsumerDropOldest, slowConsumerDropNewest, slowConsumerDisconnect:
+		p.policy = cfg.Policy
+	default:
+		log.Fatalf("invalid slowConsumer.policy: %s", cfg.Policy)
+	}
+	if cfg.BufferSize > 0 {
+		p.bufferSize = cfg.BufferSize
+	}
+	if cfg.DisconnectAfter > 0 {
+		p.disconnectAfter = cfg.DisconnectAfter
+	}
+	return p
+}
@@ -0,0 +1,76 @@
+package logics
+
+import (
+	"MessagePushService/interfaces"
+	"context"
+	"log"
+	"time"
+)
+
+// statusBatcher 合并推送状态更新, 达到批量条数或间隔后一次写入, 避免大批量推送时每个用户一次数据库更新
+type statusBatcher struct {
+	logicsMessage interfaces.ILogicsMessage
+	batchSize     int
+	flushInterval time.Duration
+	updates       chan *interfaces.PushStatusUpdate
+
+	ctx context.Context
+}
+
+func newStatusBatcher(ctx context.Context, logicsMessage interfaces.ILogicsMessage, batchSize int, flushInterval time.Duration) *statusBatcher {
+	b := &statusBatcher{
+		logicsMessage: logicsMessage,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		updates:       make(chan *interfaces.PushStatusUpdate, batchSize*4),
+		ctx:           ctx,
+	}
+	go b.worker()
+	return b
+}
+
+// Add 缓冲区已满时阻塞, 推送速度受限于状态写入速度
+func (b *statusBatcher) Add(tenantID, userID, messageID string, status interfaces.MessagePushStatus) {
+	b.updates <- &interfaces.PushStatusUpdate{
+		OrgID:     tenantID,
+		UserID:    userID,
+		MessageID: messageID,
+		Status:    status,
+	}
+}
+
+func (b *statusBatcher) worker() {
+	ticker := time.NewTicker(b.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*interfaces.PushStatusUpdate, 0, b.batchSize)
+	for {
+		select {
+		case <-b.ctx.Done():
+			b.flush(batch)
+			log.Printf("[DEBUG] statusBatcher receive close signal")
+			return
+		case update := <-b.updates:
+			batch = append(batch, update)
+			if len(batch) >= b.batchSize {
+				b.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				b.flush(batch)
+				batch = batch[:0]
+			}
+		}
+	}
+}
+
+func (b *statusBatcher) flush(batch []*interfaces.PushStatusUpdate) {
+	if len(batch) == 0 {
+		return
+	}
+	err := b.logicsMessage.BatchUpsertStatus(context.Background(), batch)
+	if err != nil {
+		log.Printf("[ERROR] batch upsert message status error, count: %d, error: %v", len(batch), err)
+	}
+}
@@ -0,0 +1,131 @@
+package logics
+
+import (
+	"MessagePushService/common"
+	"MessagePushService/interfaces"
+	"context"
+	"log"
+	"sync"
+)
+
+var (
+	subscriptionOnce     sync.Once
+	subscriptionInstance *subscription
+)
+
+type subscription struct {
+	policy     interfaces.IChannelPolicy
+	maxPerConn int // 单个连接最多订阅的频道数
+
+	channels map[string]map[interfaces.ILogicsWsConn]struct{} // 频道 -> 订阅者
+	conns    map[interfaces.ILogicsWsConn]map[string]struct{} // 连接 -> 已订阅频道
+	mu       sync.RWMutex
+}
+
+func NewSubscription(config *common.Config, policy interfaces.IChannelPolicy) interfaces.ILogicsSubscription {
+	subscriptionOnce.Do(func() {
+		subscriptionInstance = &subscription{
+			policy:     policy,
+			maxPerConn: 100,
+			channels:   make(map[string]map[interfaces.ILogicsWsConn]struct{}),
+			conns:      make(map[interfaces.ILogicsWsConn]map[string]struct{}),
+		}
+		if config.Subscription != nil && config.Subscription.MaxPerConn > 0 {
+			subscriptionInstance.maxPerConn = config.Subscription.MaxPerConn
+		}
+	})
+
+	return subscriptionInstance
+}
+
+func (s *subscription) Subscribe(ctx context.Context, conn interfaces.ILogicsWsConn, channels []string) (accepted, rejected []string) {
+	// 鉴权可能涉及外部调用, 不在锁内进行
+	allowed := make([]string, 0, len(channels))
+	for _, channel := range channels {
+		if s.policy.Authorize(ctx, conn.GetUserInfo(), channel) {
+			allowed = append(allowed, channel)
+		} else {
+			log.Printf("[WARN] subscribe channel denied, userID: %s, channel: %s", conn.GetUserInfo().ID, channel)
+			rejected = append(rejected, channel)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	subscribed, ok := s.conns[conn]
+	if !ok {
+		subscribed = make(map[string]struct{})
+		s.conns[conn] = subscribed
+	}
+	for _, channel := range allowed {
+		if _, ok := subscribed[channel]; !ok && len(subscribed) >= s.maxPerConn {
+			rejected = append(rejected, channel)
+			continue
+		}
+		subscribed[channel] = struct{}{}
+
+		subscribers, ok := s.channels[channel]
+		if !ok {
+			subscribers = make(map[interfaces.ILogicsWsConn]struct{})
+			s.channels[channel] = subscribers
+		}
+		subscribers[conn] = struct{}{}
+		accepted = append(accepted, channel)
+	}
+	return
+}
+
+func (s *subscription) Unsubscribe(ctx context.Context, conn interfaces.ILogicsWsConn, channels []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, channel := range channels {
+		s.unsubscribe(conn, channel)
+	}
+}
+
+func (s *subscription) RemoveConn(conn interfaces.ILogicsWsConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for channel := range s.conns[conn] {
+		s.unsubscribe(conn, channel)
+	}
+	delete(s.conns, conn)
+}
+
+func (s *subscription) GetSubscribers(ctx context.Context, tenantID, channel string) (conns []interfaces.ILogicsWsConn) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	conns = make([]interfaces.ILogicsWsConn, 0, len(s.channels[channel]))
+	for conn := range s.channels[channel] {
+		if conn.GetUserInfo().TenantID != tenantID {
+			continue
+		}
+		conns = append(conns, conn)
+	}
+	return
+}
+
+func (s *subscription) IsSubscribed(conn interfaces.ILogicsWsConn, channel string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.conns[conn][channel]
+	return ok
+}
+
+// unsubscribe 调用方需持有写锁
+func (s *subscription) unsubscribe(conn interfaces.ILogicsWsConn, channel string) {
+	if subscribers, ok := s.channels[channel]; ok {
+		delete(subscribers, conn)
+		if len(subscribers) == 0 {
+			delete(s.channels, channel)
+		}
+	}
+	if subscribed, ok := s.conns[conn]; ok {
+		delete(subscribed, channel)
+	}
+}
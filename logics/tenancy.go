@@ -0,0 +1,191 @@
+package logics
+
+import (
+	"MessagePushService/common"
+	"MessagePushService/interfaces"
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	tenancyOnce     sync.Once
+	tenancyInstance *tenancy
+)
+
+// tenantUser 租户内的用户, 同一用户ID在不同租户下为不同用户
+type tenantUser struct {
+	tenantID string
+	userID   string
+}
+
+type tenancy struct {
+	dbOrgUsage interfaces.IDBOrgUsage
+
+	enabled       bool
+	allowCrossOrg bool
+	defaultQuota  common.TenantQuota
+	quotas        map[string]*common.TenantQuota // 组织ID -> 配额, 未配置的组织使用 defaultQuota
+
+	conns map[string]int // 租户ID -> 本实例上的连接数, 连接配额按实例计数
+	mu    sync.Mutex
+}
+
+func NewTenancy(config *common.Config, dbOrgUsage interfaces.IDBOrgUsage) interfaces.ILogicsTenancy {
+	tenancyOnce.Do(func() {
+		tenancyInstance = &tenancy{
+			dbOrgUsage: dbOrgUsage,
+			quotas:     make(map[string]*common.TenantQuota),
+			conns:      make(map[string]int),
+		}
+		if config.Tenancy != nil {
+			// 未启用时所有组织共用一个租户, 按组织配置的配额不会生效, 视为配置错误
+			if !config.Tenancy.Enabled && (len(config.Tenancy.Quotas) > 0 || config.Tenancy.DefaultQuota != nil && *config.Tenancy.DefaultQuota != (common.TenantQuota{})) {
+				log.Fatalf("tenancy.quotas or tenancy.defaultQuota is configured but tenancy.enabled is false")
+			}
+			tenancyInstance.enabled = config.Tenancy.Enabled
+			tenancyInstance.allowCrossOrg = config.Tenancy.AllowCrossOrg
+			if config.Tenancy.DefaultQuota != nil {
+				tenancyInstance.defaultQuota = *config.Tenancy.DefaultQuota
+			}
+			for orgID, quota := range config.Tenancy.Quotas {
+				if quota != nil {
+					tenancyInstance.quotas[orgID] = quota
+				}
+			}
+		}
+	})
+
+	return tenancyInstance
+}
+
+func (t *tenancy) Enabled() bool {
+	return t.enabled
+}
+
+func (t *tenancy) TenantOf(orgID string) string {
+	if !t.enabled {
+		return ""
+	}
+	return orgID
+}
+
+func (t *tenancy) quotaOf(tenantID string) common.TenantQuota {
+	if quota, ok := t.quotas[tenantID]; ok {
+		return *quota
+	}
+	return t.defaultQuota
+}
+
+func (t *tenancy) CheckMessage(message *interfaces.LogicsMessage) error {
+	if !t.enabled {
+		message.OrgID = ""
+		return nil
+	}
+
+	if message.AudienceType == interfaces.AudienceTypeOrg {
+		if message.OrgID != "" && message.OrgID != message.AudienceID {
+			common.IncCounter(common.MetricCrossOrgRejected)
+			return fmt.Errorf("%w: org_id %s, audience org %s", interfaces.ErrCrossOrg, message.OrgID, message.AudienceID)
+		}
+		message.OrgID = message.AudienceID
+		return nil
+	}
+	if message.OrgID != "" {
+		return nil
+	}
+
+	// 不属于任何组织的消息; 频道名只在组织内唯一, 频道消息必须指定组织, 否则会推送给所有组织中同名频道的订阅者
+	if message.AudienceType == interfaces.AudienceTypeUsers {
+		return fmt.Errorf("org_id is required")
+	}
+	if message.AudienceType == interfaces.AudienceTypeChannel {
+		common.IncCounter(common.MetricCrossOrgRejected)
+		return fmt.Errorf("%w: org_id is required for channel messages", interfaces.ErrCrossOrg)
+	}
+	if !t.allowCrossOrg {
+		common.IncCounter(common.MetricCrossOrgRejected)
+		return fmt.Errorf("%w: org_id is required", interfaces.ErrCrossOrg)
+	}
+	return nil
+}
+
+func (t *tenancy) AcquireConn(tenantID string) error {
+	if tenantID == "" {
+		return nil
+	}
+
+	max := t.quotaOf(tenantID).MaxConnectionsPerInstance
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if max > 0 && t.conns[tenantID] >= max {
+		return fmt.Errorf("%w: org %s connections %d", interfaces.ErrQuotaExceeded, tenantID, max)
+	}
+	t.conns[tenantID]++
+	return nil
+}
+
+func (t *tenancy) ReleaseConn(tenantID string) {
+	if tenantID == "" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conns[tenantID] <= 1 {
+		delete(t.conns, tenantID)
+		return
+	}
+	t.conns[tenantID]--
+}
+
+func (t *tenancy) ConsumeMessage(ctx context.Context, tenantID string, at time.Time) error {
+	if tenantID == "" {
+		return nil
+	}
+
+	max := t.quotaOf(tenantID).MaxMessagesPerDay
+	ok, err := t.dbOrgUsage.AddMessages(ctx, tenantID, at, 1, max)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		common.IncTenantCounter(tenantID, common.MetricQuotaMessagesRejected)
+		return fmt.Errorf("%w: org %s messages per day %d", interfaces.ErrQuotaExceeded, tenantID, max)
+	}
+	return nil
+}
+
+func (t *tenancy) RefundMessage(ctx context.Context, tenantID string, at time.Time) {
+	if tenantID == "" {
+		return
+	}
+
+	_, err := t.dbOrgUsage.AddMessages(ctx, tenantID, at, -1, 0)
+	if err != nil {
+		log.Printf("[ERROR] refund message quota failed, org: %s, err: %v", tenantID, err)
+	}
+}
+
+func (t *tenancy) GetUsage(ctx context.Context, orgID string) (*interfaces.TenantUsage, error) {
+	quota := t.quotaOf(orgID)
+	messages, err := t.dbOrgUsage.GetMessages(ctx, orgID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	conns := t.conns[orgID]
+	t.mu.Unlock()
+
+	return &interfaces.TenantUsage{
+		OrgID:                     orgID,
+		Connections:               conns,
+		MaxConnectionsPerInstance: quota.MaxConnectionsPerInstance,
+		MessagesToday:             messages,
+		MaxMessagesPerDay:         quota.MaxMessagesPerDay,
+		Counters:                  common.TenantCountersOf(orgID),
+	}, nil
+}
@@ -0,0 +1,407 @@
+package logics
+
+import (
+	"MessagePushService/common"
+	"MessagePushService/interfaces"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	userDataOnce     sync.Once
+	userDataInstance *userData
+)
+
+// 用户发送的聊天消息在删除用户数据时的处理方式
+const (
+	authoredChatScrub  = "scrub"  // 清除内容与发送者, 其它接收者保留消息记录
+	authoredChatDelete = "delete" // 删除消息, 其它接收者也不再可见
+	authoredChatKeep   = "keep"   // 保留
+)
+
+// 审计日志的操作与状态
+const (
+	auditActionExport = "export"
+	auditActionErase  = "erase"
+
+	auditStatusPending   = "pending"
+	auditStatusSucceeded = "succeeded"
+	auditStatusFailed    = "failed"
+)
+
+// 单个用户返回的审计日志数
+const auditLogLimit = 100
+
+// erasedContent 清除后的聊天消息内容
+var erasedContent = map[string]interface{}{"erased": true}
+
+type userData struct {
+	dbUserData    interfaces.IDBUserData
+	dbAudit       interfaces.IDBAudit
+	dbPresence    interfaces.IDBPresence
+	contentCipher interfaces.ILogicsContentCipher
+	authoredChat  string
+	batchSize     int
+}
+
+func NewUserData(config *common.Config, dbUserData interfaces.IDBUserData, dbAudit interfaces.IDBAudit, dbPresence interfaces.IDBPresence, contentCipher interfaces.ILogicsContentCipher) interfaces.ILogicsUserData {
+	userDataOnce.Do(func() {
+		userDataInstance = &userData{
+			dbUserData:    dbUserData,
+			dbAudit:       dbAudit,
+			dbPresence:    dbPresence,
+			contentCipher: contentCipher,
+			authoredChat:  authoredChatScrub,
+			batchSize:     500,
+		}
+
+		cfg := config.UserData
+		if cfg == nil {
+			return
+		}
+		switch cfg.AuthoredChat {
+		case "":
+		case authoredChatScrub, authoredChatDelete, authoredChatKeep:
+			userDataInstance.authoredChat = cfg.AuthoredChat
+		default:
+			log.Fatalf("invalid userData.authoredChat %q", cfg.AuthoredChat)
+		}
+		if cfg.BatchSize > 0 {
+			userDataInstance.batchSize = cfg.BatchSize
+		}
+	})
+
+	return userDataInstance
+}
+
+// exportInboxItem 收件箱中的一条消息
+type exportInboxItem struct {
+	MessageID  string      `json:"message_id"`
+	Type       int         `json:"type"`
+	Seq        int64       `json:"seq,omitempty"`
+	PushStatus string      `json:"push_status"`
+	Read       bool        `json:"read"`
+	ReceivedAt int64       `json:"received_at"`
+	SenderID   string      `json:"sender_id,omitempty"`
+	RoomID     string      `json:"room_id,omitempty"`
+	Timestamp  int64       `json:"timestamp"`
+	RecalledAt int64       `json:"recalled_at,omitempty"`
+	Content    interface{} `json:"content"`
+}
+
+// exportAuthoredItem 用户发送的一条聊天消息或撤回/编辑事件
+type exportAuthoredItem struct {
+	MessageID  string                 `json:"message_id"`
+	Type       interfaces.MessageType `json:"type"`
+	RoomID     string                 `json:"room_id,omitempty"`
+	Timestamp  int64                  `json:"timestamp"`
+	EditedAt   int64                  `json:"edited_at,omitempty"`
+	RecalledAt int64                  `json:"recalled_at,omitempty"`
+	Content    interface{}            `json:"content"`
+}
+
+// exportEditItem 用户的一次编辑, content 为编辑前的内容
+type exportEditItem struct {
+	MessageID string      `json:"message_id"`
+	Content   interface{} `json:"content"`
+	EditedAt  int64       `json:"edited_at"`
+}
+
+// exportCounts 导出的条数, 记录在审计日志中
+type exportCounts struct {
+	Inbox    int    `json:"inbox"`
+	Authored int    `json:"authored"`
+	Edits    int    `json:"edits"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Export 按批读取并逐条写入, 不在内存中保存全部消息:
+//
+//	{"user_id": "", "exported_at": 0, "last_seen": 0, "inbox": [...], "authored": [...], "edits": [...]}
+func (u *userData) Export(ctx context.Context, req *interfaces.DataRequest, w io.Writer) (err error) {
+	auditID, err := u.audit(ctx, auditActionExport, req)
+	if err != nil {
+		return err
+	}
+
+	counts := &exportCounts{}
+	defer func() {
+		u.finishAudit(ctx, auditID, counts, err, func(msg string) { counts.Error = msg })
+	}()
+
+	lastSeen, err := u.dbPresence.GetLastSeen(ctx, req.OrgID, []string{req.UserID})
+	if err != nil {
+		return err
+	}
+
+	out := &jsonStreamWriter{w: w}
+	userID, _ := json.Marshal(req.UserID)
+	out.raw(fmt.Sprintf(`{"user_id":%s,"exported_at":%d,"last_seen":%d,"inbox":[`, userID, time.Now().Unix(), unixOrZero(lastSeen[req.UserID])))
+
+	var afterID int64
+	for out.err == nil {
+		records, err := u.dbUserData.GetInbox(ctx, req.OrgID, req.UserID, afterID, u.batchSize)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			m := record.Message
+			content, err := u.decryptedContent(m.Content, m.KeyID, m.ID)
+			if err != nil {
+				return err
+			}
+			out.item(&exportInboxItem{
+				MessageID:  m.ID,
+				Type:       m.Type,
+				Seq:        m.Seq,
+				PushStatus: interfaces.MessagePushStatus(record.PushStatus).String(),
+				Read:       record.Read,
+				ReceivedAt: record.CreatedAt.Unix(),
+				SenderID:   m.SenderID,
+				RoomID:     m.RoomID,
+				Timestamp:  m.Timestamp,
+				RecalledAt: m.RecalledAt,
+				Content:    content,
+			})
+			afterID = record.ID
+		}
+		counts.Inbox += len(records)
+		if len(records) < u.batchSize {
+			break
+		}
+	}
+
+	out.raw(`],"authored":[`)
+	out.first = true
+	var afterMessageID string
+	for out.err == nil {
+		messages, err := u.dbUserData.GetAuthored(ctx, req.OrgID, req.UserID, afterMessageID, u.batchSize)
+		if err != nil {
+			return err
+		}
+		for _, m := range messages {
+			content, err := u.decryptedContent(m.Content, m.KeyID, m.ID)
+			if err != nil {
+				return err
+			}
+			out.item(&exportAuthoredItem{
+				MessageID:  m.ID,
+				Type:       interfaces.MessageType(m.Type),
+				RoomID:     m.RoomID,
+				Timestamp:  m.Timestamp,
+				EditedAt:   m.EditedAt,
+				RecalledAt: m.RecalledAt,
+				Content:    content,
+			})
+			afterMessageID = m.ID
+		}
+		counts.Authored += len(messages)
+		if len(messages) < u.batchSize {
+			break
+		}
+	}
+
+	out.raw(`],"edits":[`)
+	out.first = true
+	edits, err := u.dbUserData.GetEditsByEditor(ctx, req.OrgID, req.UserID)
+	if err != nil {
+		return err
+	}
+	for _, edit := range edits {
+		content, err := u.decryptedContent(edit.Content, edit.KeyID, edit.MessageID)
+		if err != nil {
+			return err
+		}
+		out.item(&exportEditItem{
+			MessageID: edit.MessageID,
+			Content:   content,
+			EditedAt:  edit.CreatedAt.Unix(),
+		})
+	}
+	counts.Edits = len(edits)
+	out.raw(`]}`)
+
+	return out.err
+}
+
+func (u *userData) Erase(ctx context.Context, req *interfaces.DataRequest) (result *interfaces.ErasureResult, err error) {
+	auditID, err := u.audit(ctx, auditActionErase, req)
+	if err != nil {
+		return nil, err
+	}
+
+	result = &interfaces.ErasureResult{AuthoredPolicy: u.authoredChat}
+	details := &struct {
+		*interfaces.ErasureResult
+		Error string `json:"error,omitempty"`
+	}{ErasureResult: result}
+	defer func() {
+		u.finishAudit(ctx, auditID, details, err, func(msg string) { details.Error = msg })
+	}()
+
+	// 分批删除, 避免长事务; 中途失败时已删除的部分不回滚, 重新执行即可
+	for {
+		records, messages, err := u.dbUserData.DeleteInbox(ctx, req.OrgID, req.UserID, u.batchSize)
+		if err != nil {
+			return nil, err
+		}
+		result.InboxRecords += records
+		result.OrphanMessages += messages
+		if records == 0 {
+			break
+		}
+	}
+
+	switch u.authoredChat {
+	case authoredChatScrub:
+		content, _ := json.Marshal(erasedContent)
+		for {
+			n, err := u.dbUserData.ScrubAuthored(ctx, req.OrgID, req.UserID, string(content), u.batchSize)
+			if err != nil {
+				return nil, err
+			}
+			result.AuthoredMessages += n
+			if n == 0 {
+				break
+			}
+		}
+	case authoredChatDelete:
+		for {
+			messages, records, err := u.dbUserData.DeleteAuthored(ctx, req.OrgID, req.UserID, u.batchSize)
+			if err != nil {
+				return nil, err
+			}
+			result.AuthoredMessages += messages
+			result.AuthoredRecords += records
+			if messages == 0 {
+				break
+			}
+		}
+	}
+
+	result.OtherRows, err = u.dbUserData.DeleteUserState(ctx, req.OrgID, req.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("[INFO] user data erased, orgID: %s, userID: %s, operator: %s, result: %+v", req.OrgID, req.UserID, req.Operator, *result)
+	return result, nil
+}
+
+func (u *userData) GetAuditLogs(ctx context.Context, orgID, userID string) ([]*interfaces.AuditLog, error) {
+	logs, err := u.dbAudit.GetBySubject(ctx, orgID, userID, auditLogLimit)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	outs := make([]*interfaces.AuditLog, 0, len(logs))
+	for _, v := range logs {
+		out := &interfaces.AuditLog{
+			ID:            v.ID,
+			Action:        v.Action,
+			SubjectOrgID:  v.SubjectOrgID,
+			SubjectUserID: v.SubjectUserID,
+			Operator:      v.Operator,
+			Reason:        v.Reason,
+			Status:        v.Status,
+			Details:       v.Details,
+			CreatedAt:     v.CreatedAt.Unix(),
+		}
+		if v.FinishedAt != nil {
+			out.FinishedAt = v.FinishedAt.Unix()
+		}
+		outs = append(outs, out)
+	}
+	return outs, nil
+}
+
+// audit 执行前记录审计日志, 确保每个请求都有记录
+func (u *userData) audit(ctx context.Context, action string, req *interfaces.DataRequest) (int64, error) {
+	id, err := u.dbAudit.Add(ctx, &interfaces.DBAuditLog{
+		Action:        action,
+		SubjectOrgID:  req.OrgID,
+		SubjectUserID: req.UserID,
+		Operator:      req.Operator,
+		Reason:        req.Reason,
+		Status:        auditStatusPending,
+		Details:       "{}",
+	})
+	if err != nil {
+		return 0, fmt.Errorf("add audit log error, %w", err)
+	}
+	return id, nil
+}
+
+// finishAudit 记录执行结果, 失败时通过 setError 将原因写入 details
+func (u *userData) finishAudit(ctx context.Context, id int64, details interface{}, err error, setError func(string)) {
+	status := auditStatusSucceeded
+	if err != nil {
+		status = auditStatusFailed
+		setError(err.Error())
+	}
+	data, _ := json.Marshal(details)
+	// 请求的 ctx 可能已取消, 审计日志仍需更新
+	fErr := u.dbAudit.Finish(context.WithoutCancel(ctx), id, status, string(data))
+	if fErr != nil {
+		log.Printf("[ERROR] finish audit log error: %v, id: %d", fErr, id)
+	}
+}
+
+// decryptedContent 解密后原样输出消息内容, 不是合法 JSON 时按字符串输出
+func (u *userData) decryptedContent(content, keyID, messageID string) (interface{}, error) {
+	plaintext, err := u.contentCipher.Decrypt(content, keyID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if json.Valid([]byte(plaintext)) {
+		return json.RawMessage(plaintext), nil
+	}
+	return plaintext, nil
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// jsonStreamWriter 逐条写入 JSON 数组元素, 出错后忽略之后的写入
+type jsonStreamWriter struct {
+	w     io.Writer
+	first bool
+	err   error
+}
+
+func (s *jsonStreamWriter) raw(str string) {
+	if s.err != nil {
+		return
+	}
+	_, s.err = io.WriteString(s.w, str)
+	s.first = true
+}
+
+func (s *jsonStreamWriter) item(v interface{}) {
+	if s.err != nil {
+		return
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		s.err = err
+		return
+	}
+	if !s.first {
+		_, s.err = io.WriteString(s.w, ",")
+		if s.err != nil {
+			return
+		}
+	}
+	_, s.err = s.w.Write(data)
+	s.first = false
+}
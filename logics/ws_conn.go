@@ -1,15 +1,20 @@
 package logics
 
 import (
+	"MessagePushService/common"
 	"MessagePushService/interfaces"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gorilla/websocket"
+	"golang.org/x/time/rate"
 )
 
 type WsConn struct {
@@ -17,40 +22,80 @@ type WsConn struct {
 	logicsMessage interfaces.ILogicsMessage
 	conn          *websocket.Conn
 	UserInfo      *interfaces.UserInfo
+	codec         interfaces.ILogicsFrameCodec // 按协商的子协议编解码消息
+
+	id          string       // 连接ID, 用于管理接口
+	remoteAddr  string       // 客户端地址
+	userAgent   string       // 客户端 User-Agent
+	connectedAt time.Time    // 建连时间
+	lastActive  atomic.Int64 // 最后收到客户端数据(含 pong)的时间(unix纳秒)
 
 	writeTimeout      time.Duration // time allowed to write a message to the peer
 	readTimeout       time.Duration // time allowed to read the next pong message from the peer
 	heartBeatInterval time.Duration // send pings to peer with this period. Must be less than pongWait
 
-	bufferChan chan []byte // 发送消息缓冲区
-	isAlive    bool        // 连接是否存活
-	mu         sync.RWMutex
-	closeOnce  sync.Once
-	wg         sync.WaitGroup // 等待所有goroutine完成, 避免泄露
+	sendQueue   *priorityQueue[*outboundFrame] // 发送消息缓冲区, 按优先级出队
+	sendPolicy  *sendPolicy
+	inbound     *inboundPolicy
+	compression *compressionPolicy
+	payloadEnc  string        // 客户端选择的消息体压缩算法, 仅 v1 信封支持
+	connLimiter *rate.Limiter // 按连接限流上行消息
+	violations  int           // 当前计数窗口内超过上行限流的次数, 仅在 readPump 中访问
+	violationAt time.Time     // 当前计数窗口的开始时间
+	fullSince   atomic.Int64  // 发送缓冲区开始持续已满的时间(unix纳秒), 0 表示未满
+	slowClosing atomic.Bool   // 是否已因慢连接而断开
+	closeCode   atomic.Int32  // 服务端主动关闭时发送的关闭码, 0 表示正常关闭
+	closeReason atomic.Value  // 运维断开连接时发送的关闭原因(string)
+	isAlive     bool          // 连接是否存活
+	mu          sync.RWMutex
+	closeOnce   sync.Once
+	wg          sync.WaitGroup // 等待所有goroutine完成, 避免泄露
 
 	ctx    context.Context
 	cancel context.CancelFunc
 }
 
-func NewWsConn(manager interfaces.ILogicsWsConnManager, conn *websocket.Conn, userInfo *interfaces.UserInfo, logicsMessage interfaces.ILogicsMessage) interfaces.ILogicsWsConn {
+func NewWsConn(manager interfaces.ILogicsWsConnManager, conn *websocket.Conn, userInfo *interfaces.UserInfo, logicsMessage interfaces.ILogicsMessage, policy *sendPolicy, inbound *inboundPolicy, compression *compressionPolicy, options *interfaces.ConnOptions) interfaces.ILogicsWsConn {
 	ctx, cancel := context.WithCancel(context.Background())
 	wsConn := &WsConn{
 		manager:       manager,
 		logicsMessage: logicsMessage,
 		conn:          conn,
 		UserInfo:      userInfo,
+		codec:         NewFrameCodec(conn.Subprotocol()),
+
+		id:          common.NewID(),
+		remoteAddr:  conn.RemoteAddr().String(),
+		connectedAt: time.Now(),
 
 		writeTimeout:      time.Second * 10,
 		readTimeout:       time.Second * 6,
 		heartBeatInterval: (time.Second * 6 * 9) / 10,
 
-		bufferChan: make(chan []byte, 1000),
-		isAlive:    true,
+		sendQueue:   newPriorityQueue[*outboundFrame](policy.bufferSize),
+		sendPolicy:  policy,
+		inbound:     inbound,
+		compression: compression,
+		connLimiter: rate.NewLimiter(inbound.connRate, inbound.connBurst),
+		isAlive:     true,
 
 		ctx:    ctx,
 		cancel: cancel,
 	}
 
+	if options != nil && conn.Subprotocol() != interfaces.ProtocolV0 {
+		wsConn.payloadEnc = options.PayloadEncoding
+	}
+	if options != nil {
+		if options.RemoteAddr != "" {
+			wsConn.remoteAddr = options.RemoteAddr
+		}
+		wsConn.userAgent = options.UserAgent
+	}
+	wsConn.lastActive.Store(wsConn.connectedAt.UnixNano())
+	// 未协商 permessage-deflate 时不生效
+	conn.SetCompressionLevel(compression.level)
+
 	wsConn.SetPongHandler()
 	wsConn.SetCloseHandler()
 
@@ -68,13 +113,26 @@ func (wsConn *WsConn) SafeClose() {
 		wsConn.mu.Unlock()
 
 		wsConn.cancel()
-		close(wsConn.bufferChan)
+		wsConn.sendQueue.Close()
 
-		wsConn.manager.Remove(wsConn.UserInfo.ID)
+		wsConn.manager.Remove(wsConn)
 
 		wsConn.wg.Wait()
 		// 等待所有goroutine退出后，再关闭连接
 		wsConn.conn.Close()
+		// readPump 退出后不会再有新的订阅, 此时清理订阅才不会遗漏
+		if subscriptionInstance != nil {
+			subscriptionInstance.RemoveConn(wsConn)
+		}
+
+		// 缓冲区中未写入连接的消息标记为推送失败, 由补偿推送重新投递
+		for {
+			frame, ok := wsConn.sendQueue.TryPop()
+			if !ok {
+				break
+			}
+			wsConn.reportUndelivered(frame)
+		}
 	})
 }
 
@@ -83,6 +141,7 @@ func (wsConn *WsConn) readPump() {
 	defer wsConn.wg.Done()
 
 	wsConn.conn.SetReadDeadline(time.Now().Add(wsConn.readTimeout))
+	wsConn.conn.SetReadLimit(wsConn.inbound.maxFrameSize)
 	for {
 		select {
 		case <-wsConn.ctx.Done():
@@ -91,6 +150,12 @@ func (wsConn *WsConn) readPump() {
 		}
 		messageType, message, err := wsConn.conn.ReadMessage()
 		if err != nil {
+			// 超过大小限制时 websocket 库已回复关闭码 1009
+			if errors.Is(err, websocket.ErrReadLimit) {
+				log.Printf("[WARN] inbound message too large, userID: %s", wsConn.UserInfo.ID)
+				common.IncCounter(common.MetricInboundTooLarge)
+				return
+			}
 			// 非正常关闭连接
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
 				log.Printf("[ERROR] read message error, %v", err)
@@ -98,22 +163,54 @@ func (wsConn *WsConn) readPump() {
 			// 正常关闭连接
 			return
 		}
-		log.Println("receive message from user: ", wsConn.UserInfo.ID, string(message))
-		if messageType != websocket.TextMessage {
-			log.Printf("[ERROR] receive unexpected message type, %d, %s", messageType, string(message))
+		wsConn.lastActive.Store(time.Now().UnixNano())
+		log.Printf("[DEBUG] receive message from user: %s, size: %d", wsConn.UserInfo.ID, len(message))
+		// 帧类型与协商的编码不一致属于协议层面的违规, 直接断开连接
+		if messageType != wsConn.codec.FrameType() {
+			log.Printf("[ERROR] receive unexpected message type, %d, userID: %s", messageType, wsConn.UserInfo.ID)
+			wsConn.closeCode.Store(websocket.CloseUnsupportedData)
 			return
 		}
-		var i map[string]interface{}
-		err = json.Unmarshal(message, &i)
-		if err != nil {
-			log.Printf("[ERROR] unmarshal message error, %v", err)
-			return
+		if !wsConn.allowInbound() {
+			continue
 		}
-		err = wsConn.handleMessage(i)
-		if err != nil {
-			log.Printf("[ERROR] handle message error, %v", err)
+		if wsConn.violations >= wsConn.inbound.maxViolations {
 			return
 		}
+		if presenceInstance != nil {
+			presenceInstance.Touch(wsConn)
+		}
+		wsConn.dispatch(message)
+	}
+}
+
+// dispatch 处理一条客户端消息, 处理失败时回复错误帧(id 与客户端消息的 id 一致), 不断开连接
+func (wsConn *WsConn) dispatch(message []byte) {
+	envelope, err := wsConn.codec.Decode(message)
+	if err != nil {
+		var fe *frameError
+		if !errors.As(err, &fe) {
+			fe = newFrameError(interfaces.ErrorCodeInvalidJSON, "message is not a valid json object")
+		}
+		wsConn.replyError("", fe)
+		return
+	}
+
+	if envelope.ID == "" || envelope.Type == 0 {
+		wsConn.replyError(envelope.ID, newFrameError(interfaces.ErrorCodeInvalidMessage, "id and type are required"))
+		return
+	}
+	if envelope.Timestamp == 0 {
+		wsConn.replyError(envelope.ID, newFrameError(interfaces.ErrorCodeInvalidMessage, "timestamp is required"))
+		return
+	}
+
+	err = decompressEnvelope(envelope, wsConn.inbound.maxFrameSize*maxDecompressRatio)
+	if err == nil {
+		err = wsConn.handleMessage(envelope)
+	}
+	if err != nil {
+		wsConn.replyError(envelope.ID, err)
 	}
 }
 
@@ -134,76 +231,367 @@ func (wsConn *WsConn) writePump() {
 				return
 			}
 		case <-wsConn.ctx.Done():
-			err := wsConn.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "server close"))
+			code, reason := websocket.CloseNormalClosure, "server close"
+			switch c := int(wsConn.closeCode.Load()); c {
+			case closeCodeSlowConsumer:
+				code, reason = c, "slow consumer"
+			case websocket.CloseUnsupportedData:
+				code, reason = c, "unexpected frame type"
+			case websocket.ClosePolicyViolation:
+				code, reason = c, "rate limit exceeded"
+				// 先发送缓冲区中的错误帧, 客户端可据此得知断开原因
+				wsConn.flush()
+			case closeCodeAdminDisconnect:
+				code, reason = c, "disconnected by admin"
+				if v, _ := wsConn.closeReason.Load().(string); v != "" {
+					reason = v
+				}
+			}
+			wsConn.conn.SetWriteDeadline(time.Now().Add(wsConn.writeTimeout))
+			err := wsConn.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason))
 			if err != nil {
 				log.Printf("[ERROR] write close message error, %v", err)
 				return
 			}
 			return
-		case data, ok := <-wsConn.bufferChan:
+		case _, ok := <-wsConn.sendQueue.Ready():
 			if !ok {
 				return
 			}
-			err := wsConn.conn.WriteMessage(websocket.TextMessage, data)
-			if err != nil {
-				log.Printf("[ERROR] write message error, %v", err)
-				return
+			for {
+				frame, ok := wsConn.sendQueue.TryPop()
+				if !ok {
+					break
+				}
+				err := wsConn.write(frame)
+				if err != nil {
+					log.Printf("[ERROR] write message error, %v", err)
+					wsConn.reportUndelivered(frame)
+					return
+				}
 			}
 		}
 	}
 }
 
-func (wsConn *WsConn) handleMessage(msg map[string]interface{}) (err error) {
-	id, ok := msg["id"].(string)
-	if !ok {
-		log.Printf("[ERROR] id is not a string")
-		return
-	}
-	typ, ok := msg["type"].(float64)
-	if !ok {
-		log.Printf("[ERROR] type is not a float64")
-		return
-	}
-	timestamp, ok := msg["timestamp"].(float64)
-	if !ok {
-		log.Printf("[ERROR] timestamp is not a float64")
-		return
-	}
-	switch interfaces.MessageType(typ) {
+// handleMessage 处理客户端消息, 需要确认的消息(聊天、已读、在线状态、撤回、编辑)处理成功后回复 ACK, type 为 1, id 与客户端消息的 id 一致
+func (wsConn *WsConn) handleMessage(envelope *interfaces.Envelope) (err error) {
+	id, typ := envelope.ID, envelope.Type
+	switch typ {
 	case interfaces.MessageTypeACK:
+		// 客户端确认收到 id 对应的消息; 广播类消息的推送记录异步写入, 确认可能先到达, 需要创建推送记录
+		err = wsConn.logicsMessage.UpsertStatus(wsConn.ctx, wsConn.UserInfo.TenantID, wsConn.UserInfo.ID, id, interfaces.MessagePushStatusAcked)
+		if err != nil {
+			return err
+		}
+		if callbackInstance != nil {
+			callbackInstance.EmitByID(wsConn.ctx, id, wsConn.UserInfo.TenantID, wsConn.UserInfo.ID, interfaces.CallbackEventAcked)
+		}
+		if messagePushInstance != nil {
+			messagePushInstance.onAck(wsConn.UserInfo.TenantID, wsConn.UserInfo.ID, id)
+		}
+		return nil
 	case interfaces.MessageTypeChatRoom:
-		body, ok := msg["body"].(map[string]interface{})
+		body, ok := envelope.Payload.(map[string]interface{})
 		if !ok {
-			return fmt.Errorf("body is not a map[string]interface{}")
+			return newFrameError(interfaces.ErrorCodeInvalidBody, "body is required")
 		}
-		from, ok := body["from"].(string)
-		if !ok {
-			return fmt.Errorf("from is not a string")
+		// 发送者身份以服务端为准, 客户端上报的 from 与连接的用户不一致时拒绝
+		from := wsConn.UserInfo.ID
+		if v, ok := body["from"]; ok && v != from {
+			return newFrameError(interfaces.ErrorCodeForbidden, "body.from does not match the connected user")
 		}
+		body["from"] = from
 		to, ok := body["to"].(string)
 		if !ok {
-			return fmt.Errorf("to is not a string")
+			return newFrameError(interfaces.ErrorCodeInvalidBody, "body.to is not a string")
 		}
 
-		bodyStr, err := json.Marshal(body)
+		roomID, _ := body["room_id"].(string)
+
+		// 聊天消息属于发送者所在租户, 只能发送给同一租户内的用户
+		message := &interfaces.LogicsMessage{
+			ID:           id,
+			OrgID:        wsConn.UserInfo.TenantID,
+			Type:         interfaces.MessageTypeChatRoom,
+			Content:      body,
+			Timestamp:    envelope.Timestamp,
+			AudienceType: interfaces.AudienceTypeUsers,
+			SenderID:     from,
+			RoomID:       roomID,
+		}
+		err = wsConn.logicsMessage.Add(wsConn.ctx, message, []string{from, to})
+		if errors.Is(err, interfaces.ErrQuotaExceeded) {
+			return newFrameError(interfaces.ErrorCodeQuotaExceeded, err.Error())
+		}
+		if errors.Is(err, interfaces.ErrDuplicateID) {
+			return newFrameError(interfaces.ErrorCodeDuplicateID, "message id is already used, retry with a new id")
+		}
+		if err != nil {
+			return fmt.Errorf("add message error, %w", err)
+		}
+		// 发送者自己的那份推送记录直接标记为已读, 避免计入未读数
+		_, err = wsConn.logicsMessage.MarkRead(wsConn.ctx, wsConn.UserInfo.TenantID, from, id, false)
 		if err != nil {
-			return fmt.Errorf("marshal body error, %v", err)
+			log.Printf("[ERROR] mark sender message read error, %v", err)
+		}
+		// 推送队列已满时不影响发送者, 消息已保存, 接收者上线或补偿推送时投递
+		err = messagePushInstance.NotifyByNewMessage(id, message.Priority)
+		if err != nil {
+			log.Printf("[WARN] notify new message error, %v, messageID: %s", err, id)
+		}
+	case interfaces.MessageTypeSubscribe, interfaces.MessageTypeUnsubscribe:
+		channels, err := parseChannels(envelope.Payload)
+		if err != nil {
+			return newFrameError(interfaces.ErrorCodeInvalidBody, err.Error())
+		}
+		if subscriptionInstance == nil {
+			return newFrameError(interfaces.ErrorCodeNotEnabled, "subscription is not enabled")
 		}
 
-		err = wsConn.logicsMessage.Add(wsConn.ctx, interfaces.MessageTypeChatRoom, []string{from, to}, id, string(bodyStr), int64(timestamp))
+		reply := map[string]interface{}{"channels": channels}
+		if typ == interfaces.MessageTypeSubscribe {
+			accepted, rejected := subscriptionInstance.Subscribe(wsConn.ctx, wsConn, channels)
+			reply = map[string]interface{}{"accepted": accepted, "rejected": rejected}
+		} else {
+			subscriptionInstance.Unsubscribe(wsConn.ctx, wsConn, channels)
+		}
+		wsConn.reply(id, typ, reply)
+		return nil
+	case interfaces.MessageTypePresence:
+		body, ok := envelope.Payload.(map[string]interface{})
+		if !ok {
+			return newFrameError(interfaces.ErrorCodeInvalidBody, "body is required")
+		}
+		status, ok := body["status"].(string)
+		if !ok {
+			return newFrameError(interfaces.ErrorCodeInvalidBody, "body.status is not a string")
+		}
+		if presenceInstance == nil {
+			return newFrameError(interfaces.ErrorCodeNotEnabled, "presence is not enabled")
+		}
+		err = presenceInstance.SetStatus(wsConn, interfaces.PresenceStatus(status))
 		if err != nil {
-			return fmt.Errorf("add message error, %v", err)
+			return newFrameError(interfaces.ErrorCodeInvalidBody, err.Error())
+		}
+	case interfaces.MessageTypeRead:
+		body, ok := envelope.Payload.(map[string]interface{})
+		if !ok {
+			return newFrameError(interfaces.ErrorCodeInvalidBody, "body is required")
+		}
+		// message_id 标记单条消息已读, up_to 标记该消息及之前的所有消息已读
+		msgID, upTo := body["message_id"].(string), false
+		if upToID, ok := body["up_to"].(string); ok && upToID != "" {
+			msgID, upTo = upToID, true
+		}
+		if msgID == "" {
+			return newFrameError(interfaces.ErrorCodeInvalidBody, "body.message_id or body.up_to is required")
+		}
+		if readReceiptInstance == nil {
+			return newFrameError(interfaces.ErrorCodeNotEnabled, "read receipt is not enabled")
+		}
+		err = readReceiptInstance.MarkRead(wsConn.ctx, wsConn.UserInfo, msgID, upTo)
+		if errors.Is(err, interfaces.ErrRecordNotFound) {
+			return newFrameError(interfaces.ErrorCodeNotFound, "message not found")
+		}
+		if err != nil {
+			return err
+		}
+	case interfaces.MessageTypeEphemeral:
+		body, ok := envelope.Payload.(map[string]interface{})
+		if !ok {
+			return newFrameError(interfaces.ErrorCodeInvalidBody, "body is required")
+		}
+		if ephemeralInstance == nil {
+			return newFrameError(interfaces.ErrorCodeNotEnabled, "ephemeral is not enabled")
+		}
+		err = ephemeralInstance.Relay(wsConn.ctx, wsConn, id, body)
+		if errors.Is(err, interfaces.ErrRateLimited) {
+			return newFrameError(interfaces.ErrorCodeRateLimited, "ephemeral message rate limited")
+		}
+		if errors.Is(err, interfaces.ErrForbidden) {
+			return newFrameError(interfaces.ErrorCodeForbidden, err.Error())
+		}
+		if err != nil {
+			return newFrameError(interfaces.ErrorCodeInvalidBody, err.Error())
+		}
+		// 临时消息不回复 ACK
+		return nil
+	case interfaces.MessageTypeSync:
+		return wsConn.sync(id, envelope.Payload)
+	case interfaces.MessageTypeRecall, interfaces.MessageTypeEdit:
+		body, ok := envelope.Payload.(map[string]interface{})
+		if !ok {
+			return newFrameError(interfaces.ErrorCodeInvalidBody, "body is required")
+		}
+		msgID, _ := body["message_id"].(string)
+		if msgID == "" {
+			return newFrameError(interfaces.ErrorCodeInvalidBody, "body.message_id is required")
+		}
+		if messageRevisionInstance == nil {
+			return newFrameError(interfaces.ErrorCodeNotEnabled, "message revision is not enabled")
+		}
+		if typ == interfaces.MessageTypeRecall {
+			err = messageRevisionInstance.Recall(wsConn.ctx, wsConn.UserInfo, msgID)
+		} else {
+			content, ok := body["content"]
+			if !ok {
+				return newFrameError(interfaces.ErrorCodeInvalidBody, "body.content is required")
+			}
+			err = messageRevisionInstance.Edit(wsConn.ctx, wsConn.UserInfo, msgID, content)
+		}
+		if err != nil {
+			return revisionFrameError(err)
 		}
-		messagePushInstance.NotifyByNewMessage(id)
 	default:
-		return fmt.Errorf("receive unexpected message type, %v, %v", typ, msg)
+		return newFrameError(interfaces.ErrorCodeUnknownType, fmt.Sprintf("unknown message type %d", typ))
 	}
 
+	wsConn.reply(id, interfaces.MessageTypeACK, nil)
 	return nil
 }
 
+// 同步请求每次返回的消息数
+const (
+	syncDefaultLimit = 100
+	syncMaxLimit     = 500
+)
+
+// sync 按收件箱序号返回 after_seq 之后的消息, 回复的 type 与 id 与请求一致
+// 消息内嵌在回复中而不是逐条推送, 避免占满发送缓冲区并保证顺序; 客户端仍需对收到的消息回复 ACK
+func (wsConn *WsConn) sync(id string, payload interface{}) error {
+	body, ok := payload.(map[string]interface{})
+	if !ok {
+		return newFrameError(interfaces.ErrorCodeInvalidBody, "body is required")
+	}
+	afterSeq, ok := payloadInt(body["after_seq"])
+	if !ok || afterSeq < 0 {
+		return newFrameError(interfaces.ErrorCodeInvalidBody, "body.after_seq is not a non-negative number")
+	}
+	limit := syncDefaultLimit
+	if v, ok := payloadInt(body["limit"]); ok && v > 0 {
+		limit = int(min(v, syncMaxLimit))
+	}
+
+	messages, latestSeq, err := wsConn.logicsMessage.Sync(wsConn.ctx, wsConn.UserInfo.TenantID, wsConn.UserInfo.ID, afterSeq, limit)
+	if err != nil {
+		return err
+	}
+	envelopes := make([]*interfaces.Envelope, 0, len(messages))
+	for _, message := range messages {
+		envelope := newMessageEnvelope(message)
+		envelope.Version = 1
+		envelopes = append(envelopes, envelope)
+	}
+	wsConn.reply(id, interfaces.MessageTypeSync, map[string]interface{}{
+		"messages":   envelopes,
+		"latest_seq": latestSeq,
+		"has_more":   len(messages) == limit,
+	})
+	return nil
+}
+
+// payloadInt 读取消息体中的整数: JSON 与 protobuf 解码为 float64, MessagePack 按数值大小解码为不同宽度的整数
+func payloadInt(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return int64(n), n == float64(int64(n))
+	case float32:
+		return int64(n), n == float32(int64(n))
+	case int:
+		return int64(n), true
+	case int8:
+		return int64(n), true
+	case int16:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case uint:
+		return int64(n), n <= math.MaxInt64
+	case uint8:
+		return int64(n), true
+	case uint16:
+		return int64(n), true
+	case uint32:
+		return int64(n), true
+	case uint64:
+		return int64(n), n <= math.MaxInt64
+	}
+	return 0, false
+}
+
+// revisionFrameError 撤回/编辑失败的原因转换为错误帧
+func revisionFrameError(err error) error {
+	switch {
+	case errors.Is(err, interfaces.ErrRecordNotFound):
+		return newFrameError(interfaces.ErrorCodeNotFound, "message not found")
+	case errors.Is(err, interfaces.ErrForbidden):
+		return newFrameError(interfaces.ErrorCodeForbidden, err.Error())
+	case errors.Is(err, interfaces.ErrMessageRecalled):
+		return newFrameError(interfaces.ErrorCodeRecalled, "message is recalled")
+	default:
+		return err
+	}
+}
+
+// frameError 回复给客户端的错误, 其它错误按内部错误回复, 不向客户端暴露细节
+type frameError struct {
+	code    interfaces.ErrorCode
+	message string
+}
+
+func newFrameError(code interfaces.ErrorCode, message string) *frameError {
+	return &frameError{code: code, message: message}
+}
+
+func (e *frameError) Error() string {
+	return fmt.Sprintf("%s: %s", e.code, e.message)
+}
+
+// replyError 回复错误帧(NACK), id 为出错的客户端消息的 id
+func (wsConn *WsConn) replyError(id string, err error) {
+	var fe *frameError
+	if !errors.As(err, &fe) {
+		log.Printf("[ERROR] handle message error, userID: %s, id: %s, %v", wsConn.UserInfo.ID, id, err)
+		fe = newFrameError(interfaces.ErrorCodeInternal, "internal error")
+	}
+	wsConn.reply(id, interfaces.MessageTypeError, map[string]interface{}{
+		"code":    fe.code,
+		"message": fe.message,
+	})
+}
+
+// reply 回复客户端发起的请求(如订阅), id 与请求的 id 一致
+func (wsConn *WsConn) reply(id string, typ interfaces.MessageType, body interface{}) {
+	wsConn.Send(wsConn.ctx, newEnvelope(id, typ, body, time.Now().Unix()))
+}
+
+func parseChannels(payload interface{}) ([]string, error) {
+	body, ok := payload.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("body is not a map[string]interface{}")
+	}
+	channelsInterface, ok := body["channels"].([]interface{})
+	if !ok || len(channelsInterface) == 0 {
+		return nil, fmt.Errorf("body.channels is required")
+	}
+
+	channels := make([]string, 0, len(channelsInterface))
+	for _, v := range channelsInterface {
+		channel, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("body.channels is not a []string")
+		}
+		channels = append(channels, channel)
+	}
+	return channels, nil
+}
+
 func (wsConn *WsConn) SetPongHandler() {
 	wsConn.conn.SetPongHandler(func(appData string) error {
+		wsConn.lastActive.Store(time.Now().UnixNano())
 		wsConn.conn.SetReadDeadline(time.Now().Add(wsConn.readTimeout))
 		return nil
 	})
@@ -215,22 +603,174 @@ func (wsConn *WsConn) SetCloseHandler() {
 	})
 }
 
-func (wsConn *WsConn) Send(ctx context.Context, data []byte) {
+func (wsConn *WsConn) GetID() string {
+	return wsConn.id
+}
+
+func (wsConn *WsConn) GetUserInfo() *interfaces.UserInfo {
+	return wsConn.UserInfo
+}
+
+func (wsConn *WsConn) GetInfo() *interfaces.ConnInfo {
+	return &interfaces.ConnInfo{
+		ID:           wsConn.id,
+		UserID:       wsConn.UserInfo.ID,
+		OrgID:        wsConn.UserInfo.OrgID,
+		RemoteAddr:   wsConn.remoteAddr,
+		UserAgent:    wsConn.userAgent,
+		Protocol:     wsConn.conn.Subprotocol(),
+		ConnectedAt:  wsConn.connectedAt.Unix(),
+		LastActiveAt: time.Unix(0, wsConn.lastActive.Load()).Unix(),
+		Buffered:     wsConn.sendQueue.Len(),
+		BufferSize:   wsConn.sendPolicy.bufferSize,
+	}
+}
+
+// Disconnect 关闭原因超过关闭帧的长度限制时按字符边界截断, 避免发送非法的 UTF-8
+func (wsConn *WsConn) Disconnect(reason string) {
+	if len(reason) > closeReasonMaxLen {
+		n := closeReasonMaxLen
+		for n > 0 && !utf8.RuneStart(reason[n]) {
+			n--
+		}
+		reason = reason[:n]
+	}
+	wsConn.closeReason.Store(reason)
+	wsConn.closeCode.Store(closeCodeAdminDisconnect)
+	wsConn.SafeClose()
+}
+
+func (wsConn *WsConn) Send(ctx context.Context, envelope *interfaces.Envelope) {
+	wsConn.enqueue(ctx, &outboundFrame{envelope: envelope}, interfaces.MessagePriorityNormal)
+}
+
+func (wsConn *WsConn) SendMessage(ctx context.Context, envelope *interfaces.Envelope, priority interfaces.MessagePriority) error {
+	return wsConn.enqueue(ctx, &outboundFrame{messageID: envelope.ID, envelope: envelope}, priority)
+}
+
+func (wsConn *WsConn) TrySend(ctx context.Context, envelope *interfaces.Envelope, priority interfaces.MessagePriority) error {
+	return wsConn.enqueue(ctx, &outboundFrame{envelope: envelope}, priority)
+}
+
+func (wsConn *WsConn) enqueue(ctx context.Context, frame *outboundFrame, priority interfaces.MessagePriority) error {
 	select {
 	case <-wsConn.ctx.Done():
-		return
+		return interfaces.ErrConnClosed
 	case <-ctx.Done():
-		return
+		return ctx.Err()
 	default:
 	}
 
 	wsConn.mu.RLock()
 	defer wsConn.mu.RUnlock()
 
-	// 当 wsConn.isAlive 为 false 时，bufferChan 可能已经被关闭。
+	// 当 wsConn.isAlive 为 false 时，sendQueue 可能已经被关闭。
 	if !wsConn.isAlive {
-		return
+		return interfaces.ErrConnClosed
+	}
+
+	if wsConn.sendQueue.TryPush(priority, frame) {
+		wsConn.fullSince.Store(0)
+		return nil
+	}
+
+	switch wsConn.sendPolicy.policy {
+	case slowConsumerDropOldest:
+		for !wsConn.sendQueue.TryPush(priority, frame) {
+			dropped, ok := wsConn.sendQueue.DropOldest(priority)
+			if !ok {
+				// 缓冲区中都是优先级更高的消息, 丢弃新消息
+				common.IncCounter(common.MetricSlowConsumerDropNewest)
+				return interfaces.ErrSlowConsumer
+			}
+			common.IncCounter(common.MetricSlowConsumerDropOldest)
+			wsConn.reportUndelivered(dropped)
+		}
+		return nil
+	case slowConsumerDropNewest:
+		common.IncCounter(common.MetricSlowConsumerDropNewest)
+		return interfaces.ErrSlowConsumer
+	default:
+		now := time.Now().UnixNano()
+		wsConn.fullSince.CompareAndSwap(0, now)
+		if time.Duration(now-wsConn.fullSince.Load()) < wsConn.sendPolicy.disconnectAfter {
+			common.IncCounter(common.MetricSlowConsumerDropNewest)
+			return interfaces.ErrSlowConsumer
+		}
+		if wsConn.slowClosing.CompareAndSwap(false, true) {
+			log.Printf("[WARN] disconnect slow consumer, userID: %s", wsConn.UserInfo.ID)
+			common.IncCounter(common.MetricSlowConsumerDisconnect)
+			wsConn.closeCode.Store(closeCodeSlowConsumer)
+			// 持有读锁, SafeClose 需要写锁, 异步关闭
+			go wsConn.SafeClose()
+		}
+		return interfaces.ErrSlowConsumer
 	}
+}
 
-	wsConn.bufferChan <- data
+// allowInbound 上行消息是否在连接与用户的限流范围内, 超过时回复错误帧; 一个计数窗口内累计超过次数后标记以策略违规关闭连接, 调用方应退出读循环
+func (wsConn *WsConn) allowInbound() bool {
+	if wsConn.connLimiter.Allow() && wsConn.inbound.userLimiter.Allow(wsConn.UserInfo.ID) {
+		return true
+	}
+
+	// 偶发的超限不累计到长连接的整个生命周期
+	if now := time.Now(); now.Sub(wsConn.violationAt) > wsConn.inbound.violationWindow {
+		wsConn.violations = 0
+		wsConn.violationAt = now
+	}
+	wsConn.violations++
+	common.IncCounter(common.MetricInboundRateLimited)
+	wsConn.replyError("", newFrameError(interfaces.ErrorCodeRateLimited, "too many messages"))
+	if wsConn.violations >= wsConn.inbound.maxViolations {
+		log.Printf("[WARN] disconnect client exceeding inbound rate limit, userID: %s", wsConn.UserInfo.ID)
+		common.IncCounter(common.MetricInboundDisconnect)
+		wsConn.closeCode.Store(websocket.ClosePolicyViolation)
+		return true
+	}
+	return false
+}
+
+// flush 将发送缓冲区中的数据写入连接, 仅在关闭连接前调用
+func (wsConn *WsConn) flush() {
+	for {
+		frame, ok := wsConn.sendQueue.TryPop()
+		if !ok {
+			return
+		}
+		if err := wsConn.write(frame); err != nil {
+			wsConn.reportUndelivered(frame)
+			return
+		}
+	}
+}
+
+// write 按连接协商的协议版本编码后写入连接, 编码失败的消息被丢弃, 不影响后续消息
+func (wsConn *WsConn) write(frame *outboundFrame) error {
+	envelope := frame.envelope
+	if wsConn.payloadEnc != "" {
+		compressed, err := compressEnvelope(envelope, wsConn.payloadEnc, wsConn.compression.threshold)
+		if err != nil {
+			log.Printf("[ERROR] compress message error, %v, id: %s", err, envelope.ID)
+		} else {
+			envelope = compressed
+		}
+	}
+	data, err := wsConn.codec.Encode(envelope)
+	if err != nil {
+		log.Printf("[ERROR] encode message error, %v, id: %s", err, frame.envelope.ID)
+		wsConn.reportUndelivered(frame)
+		return nil
+	}
+	wsConn.conn.SetWriteDeadline(time.Now().Add(wsConn.writeTimeout))
+	wsConn.conn.EnableWriteCompression(len(data) >= wsConn.compression.threshold)
+	return wsConn.conn.WriteMessage(wsConn.codec.FrameType(), data)
+}
+
+// reportUndelivered 推送消息未写入连接时, 将推送记录标记为推送失败
+func (wsConn *WsConn) reportUndelivered(frame *outboundFrame) {
+	if frame.messageID == "" || messagePushInstance == nil {
+		return
+	}
+	messagePushInstance.markUndelivered(wsConn.UserInfo.TenantID, wsConn.UserInfo.ID, frame.messageID)
 }
@@ -1,6 +1,7 @@
 package logics
 
 import (
+	"MessagePushService/common"
 	"MessagePushService/interfaces"
 	"context"
 	"sync"
@@ -14,41 +15,137 @@ var (
 )
 
 type wsConnManager struct {
-	wsConns       map[string]interfaces.ILogicsWsConn // 用户ID -> 连接
+	wsConns       map[string]map[string]map[interfaces.ILogicsWsConn]struct{} // 租户ID -> 用户ID -> 连接集合(同一用户可在多个设备上登录)
+	byID          map[string]interfaces.ILogicsWsConn                         // 连接ID -> 连接
 	mu            sync.RWMutex
 	logicsMessage interfaces.ILogicsMessage
+	presence      interfaces.ILogicsPresence
+	tenancy       interfaces.ILogicsTenancy
+	sendPolicy    *sendPolicy
+	inboundPolicy *inboundPolicy
+	compression   *compressionPolicy
 }
 
-func NewWsConnManager(logicsMessage interfaces.ILogicsMessage) interfaces.ILogicsWsConnManager {
+func NewWsConnManager(config *common.Config, logicsMessage interfaces.ILogicsMessage, presence interfaces.ILogicsPresence, tenancy interfaces.ILogicsTenancy) interfaces.ILogicsWsConnManager {
 	wsConnManagerOnce.Do(func() {
 		wsConnManagerInstance = &wsConnManager{
-			wsConns:       make(map[string]interfaces.ILogicsWsConn, 10000),
+			wsConns:       make(map[string]map[string]map[interfaces.ILogicsWsConn]struct{}),
+			byID:          make(map[string]interfaces.ILogicsWsConn, 10000),
 			logicsMessage: logicsMessage,
+			presence:      presence,
+			tenancy:       tenancy,
+			sendPolicy:    newSendPolicy(config),
+			inboundPolicy: newInboundPolicy(config),
+			compression:   newCompressionPolicy(config),
 		}
 	})
 
 	return wsConnManagerInstance
 }
 
-func (manager *wsConnManager) Add(conn *websocket.Conn, userInfo *interfaces.UserInfo) {
+func (manager *wsConnManager) Add(conn *websocket.Conn, userInfo *interfaces.UserInfo, options *interfaces.ConnOptions) {
 	manager.mu.Lock()
-	defer manager.mu.Unlock()
+	newConn := NewWsConn(manager, conn, userInfo, manager.logicsMessage, manager.sendPolicy, manager.inboundPolicy, manager.compression, options)
+	users, ok := manager.wsConns[userInfo.TenantID]
+	if !ok {
+		users = make(map[string]map[interfaces.ILogicsWsConn]struct{}, 10000)
+		manager.wsConns[userInfo.TenantID] = users
+	}
+	conns, ok := users[userInfo.ID]
+	if !ok {
+		conns = make(map[interfaces.ILogicsWsConn]struct{})
+		users[userInfo.ID] = conns
+	}
+	conns[newConn] = struct{}{}
+	manager.byID[newConn.GetID()] = newConn
+	// 在锁内更新在线状态, 保证同一连接的 OnConnect 先于 OnDisconnect
+	manager.presence.OnConnect(newConn)
+	manager.mu.Unlock()
+}
+
+func (manager *wsConnManager) Get(ctx context.Context, tenantID, userID string) (conns []interfaces.ILogicsWsConn) {
+	manager.mu.RLock()
+	defer manager.mu.RUnlock()
+
+	for conn := range manager.wsConns[tenantID][userID] {
+		conns = append(conns, conn)
+	}
+	return
+}
+
+func (manager *wsConnManager) GetByID(ctx context.Context, connID string) interfaces.ILogicsWsConn {
+	manager.mu.RLock()
+	defer manager.mu.RUnlock()
+
+	return manager.byID[connID]
+}
+
+func (manager *wsConnManager) GetByOrgID(ctx context.Context, orgID string) (conns []interfaces.ILogicsWsConn) {
+	manager.mu.RLock()
+	defer manager.mu.RUnlock()
+
+	for _, users := range manager.wsConns {
+		for _, userConns := range users {
+			for conn := range userConns {
+				if conn.GetUserInfo().OrgID == orgID {
+					conns = append(conns, conn)
+				}
+			}
+		}
+	}
+	return
+}
+
+func (manager *wsConnManager) GetAll(ctx context.Context) (conns []interfaces.ILogicsWsConn) {
+	manager.mu.RLock()
+	defer manager.mu.RUnlock()
 
-	newConn := NewWsConn(manager, conn, userInfo, manager.logicsMessage)
-	manager.wsConns[userInfo.ID] = newConn
+	for _, users := range manager.wsConns {
+		for _, userConns := range users {
+			for conn := range userConns {
+				conns = append(conns, conn)
+			}
+		}
+	}
+	return
 }
 
-func (manager *wsConnManager) Get(ctx context.Context, userID string) (conn interfaces.ILogicsWsConn) {
+func (manager *wsConnManager) GetUsers(ctx context.Context) (out map[string][]string) {
 	manager.mu.RLock()
 	defer manager.mu.RUnlock()
 
-	conn = manager.wsConns[userID]
+	out = make(map[string][]string, len(manager.wsConns))
+	for tenantID, users := range manager.wsConns {
+		userIDs := make([]string, 0, len(users))
+		for userID := range users {
+			userIDs = append(userIDs, userID)
+		}
+		out[tenantID] = userIDs
+	}
 	return
 }
 
-func (manager *wsConnManager) Remove(userID string) {
+func (manager *wsConnManager) Remove(conn interfaces.ILogicsWsConn) {
+	userInfo := conn.GetUserInfo()
+
 	manager.mu.Lock()
-	defer manager.mu.Unlock()
+	users := manager.wsConns[userInfo.TenantID]
+	conns := users[userInfo.ID]
+	_, ok := conns[conn]
+	if ok {
+		delete(manager.byID, conn.GetID())
+		delete(conns, conn)
+		if len(conns) == 0 {
+			delete(users, userInfo.ID)
+		}
+		if len(users) == 0 {
+			delete(manager.wsConns, userInfo.TenantID)
+		}
+	}
+	manager.mu.Unlock()
 
-	delete(manager.wsConns, userID)
+	if ok {
+		manager.tenancy.ReleaseConn(userInfo.TenantID)
+		manager.presence.OnDisconnect(conn)
+	}
 }
@@ -7,7 +7,11 @@ import (
 	"MessagePushService/driveradapters"
 	"MessagePushService/interfaces"
 	"MessagePushService/logics"
+	"context"
+	"encoding/json"
+	"flag"
 	"log"
+	"os"
 	"runtime"
 	"time"
 
@@ -15,9 +19,9 @@ import (
 )
 
 type Server struct {
-	config        *common.Config
-	mqHandler     *driveradapters.MQHandler
-	wsConnHandler interfaces.RESTHandler
+	config       *common.Config
+	mqHandler    *driveradapters.MQHandler
+	restHandlers []interfaces.RESTHandler
 }
 
 func (s *Server) Start() {
@@ -27,8 +31,14 @@ func (s *Server) Start() {
 		server := gin.New()
 		server.Use(gin.Recovery())
 		server.Use(gin.Logger())
+		// 未配置信任的代理时, 客户端IP取连接的对端地址, 不采信客户端可伪造的 X-Forwarded-For
+		if err := server.SetTrustedProxies(s.config.Server.TrustedProxies); err != nil {
+			log.Fatalf("Failed to set trusted proxies: %v", err)
+		}
 
-		s.wsConnHandler.RegisterPublic(server)
+		for _, handler := range s.restHandlers {
+			handler.RegisterPublic(server)
+		}
 
 		if err := server.Run(s.config.Server.PublicAddr); err != nil {
 			log.Fatalf("Failed to start server: %v", err)
@@ -38,8 +48,14 @@ func (s *Server) Start() {
 		server := gin.New()
 		server.Use(gin.Recovery())
 		server.Use(gin.Logger())
+		// 未配置信任的代理时, 客户端IP取连接的对端地址, 不采信客户端可伪造的 X-Forwarded-For
+		if err := server.SetTrustedProxies(s.config.Server.TrustedProxies); err != nil {
+			log.Fatalf("Failed to set trusted proxies: %v", err)
+		}
 
-		s.wsConnHandler.RegisterPrivate(server)
+		for _, handler := range s.restHandlers {
+			handler.RegisterPrivate(server)
+		}
 
 		if err := server.Run(s.config.Server.PrivateAddr); err != nil {
 			log.Fatalf("Failed to start server: %v", err)
@@ -64,20 +80,77 @@ func main() {
 	}
 	httpClient := common.NewHTTPClient()
 
-	drivenIdentifyService := drivenadapters.NewIdentifyService(config, httpClient)
+	// 读写消息内容的模块都依赖消息内容的加解密
+	logicsContentCipher := logics.NewContentCipher(config, drivenadapters.NewKeyProvider(config), dbaccess.NewDBDataKey(dbPool))
+	if len(os.Args) > 1 && os.Args[1] == "rotate-keys" {
+		rotateKeys(logicsContentCipher, os.Args[2:])
+		return
+	}
+	logicsContentCipher.Start()
 
-	dbMessage := dbaccess.NewDBMessage(dbPool)
+	drivenIdentifyService := drivenadapters.NewIdentifyService(config, httpClient)
 
-	logicsMessage := logics.NewMessage(dbMessage)
-	logicsWsConnManager := logics.NewWsConnManager(logicsMessage)
-	logicsMessagePush := logics.NewMessagePush(logicsWsConnManager, logicsMessage)
+	drivenMQProducer := drivenadapters.NewMQProducer(config)
+	drivenUserContact := drivenadapters.NewUserContact(config, httpClient)
+	drivenFallbackChannels := drivenadapters.NewFallbackChannels(config, httpClient)
+
+	dbMessage := dbaccess.NewDBMessage(dbPool, logicsContentCipher)
+	dbPresence := dbaccess.NewDBPresence(dbPool)
+	dbFallback := dbaccess.NewDBFallback(dbPool)
+	dbCallbackOutbox := dbaccess.NewDBCallbackOutbox(dbPool)
+	dbRetention := dbaccess.NewDBRetention(dbPool)
+	dbUserData := dbaccess.NewDBUserData(dbPool, logicsContentCipher)
+	dbAudit := dbaccess.NewDBAudit(dbPool)
+	dbOrgUsage := dbaccess.NewDBOrgUsage(dbPool)
+
+	logicsTenancy := logics.NewTenancy(config, dbOrgUsage)
+	logicsMessage := logics.NewMessage(config, dbMessage, logicsTenancy, logicsContentCipher)
+	logicsCallback := logics.NewCallback(config, logicsMessage, dbCallbackOutbox, httpClient)
+	logicsChannelPolicy := logics.NewChannelPolicy(config, dbMessage)
+	logicsSubscription := logics.NewSubscription(config, logicsChannelPolicy)
+	logicsPresence := logics.NewPresence(config, dbPresence, logicsSubscription, drivenMQProducer)
+	logicsWsConnManager := logics.NewWsConnManager(config, logicsMessage, logicsPresence, logicsTenancy)
+	logicsMessagePush := logics.NewMessagePush(config, logicsWsConnManager, logicsMessage, logicsSubscription, logicsCallback)
+	logicsMessageRevision := logics.NewMessageRevision(config, logicsMessage, logicsMessagePush)
+	logics.NewEphemeral(config, logicsWsConnManager, logicsSubscription, logicsChannelPolicy)
+	logics.NewReadReceipt(config, logicsMessage, logicsWsConnManager)
+	logics.NewFallback(config, logicsMessage, dbFallback, drivenUserContact, drivenFallbackChannels).Start()
+	logicsCallback.Start()
+	logicsRetention := logics.NewRetention(config, dbRetention)
+	logicsRetention.Start()
+	logicsUserData := logics.NewUserData(config, dbUserData, dbAudit, dbPresence, logicsContentCipher)
+	logicsConnAdmin := logics.NewConnAdmin(logicsWsConnManager)
 
 	server := &Server{
-		config:        config,
-		mqHandler:     driveradapters.NewMQHandler(config, logicsMessage, logicsMessagePush),
-		wsConnHandler: driveradapters.NewWebsocketHandler(logicsWsConnManager, logicsMessagePush, drivenIdentifyService),
+		config:    config,
+		mqHandler: driveradapters.NewMQHandler(config, logicsMessage, logicsMessagePush, logicsMessageRevision),
+		restHandlers: []interfaces.RESTHandler{
+			driveradapters.NewWebsocketHandler(config, logicsWsConnManager, logicsMessagePush, drivenIdentifyService, logicsTenancy),
+			driveradapters.NewPresenceHandler(logicsPresence, logicsTenancy),
+			driveradapters.NewMessageHandler(logicsMessage, logicsMessagePush, logicsMessageRevision, drivenIdentifyService, logicsTenancy),
+			driveradapters.NewRetentionHandler(logicsRetention),
+			driveradapters.NewUserDataHandler(logicsUserData, logicsTenancy),
+			driveradapters.NewTenancyHandler(logicsTenancy),
+			driveradapters.NewConnAdminHandler(logicsConnAdmin, logicsTenancy),
+		},
 	}
 	server.Start()
 
 	select {}
 }
+
+// rotateKeys 将全部消息内容重新加密为当前数据密钥后退出:
+//
+//	MessagePushService rotate-keys [-new-data-key]
+func rotateKeys(contentCipher interfaces.ILogicsContentCipher, args []string) {
+	flags := flag.NewFlagSet("rotate-keys", flag.ExitOnError)
+	newDataKey := flags.Bool("new-data-key", false, "generate a new data key before re-encrypting")
+	flags.Parse(args)
+
+	result, err := contentCipher.Rotate(context.Background(), *newDataKey)
+	data, _ := json.Marshal(result)
+	if err != nil {
+		log.Fatalf("Failed to rotate keys: %v, result: %s", err, data)
+	}
+	log.Printf("[INFO] rotate keys finished, result: %s", data)
+}
@@ -4,24 +4,145 @@ USE `message_push`;
 
 CREATE TABLE IF NOT EXISTS `t_message` (
   `id` VARCHAR(64) NOT NULL COMMENT '消息ID',
+  `org_id` VARCHAR(64) NOT NULL DEFAULT '' COMMENT '消息所属组织(租户), 为空表示不属于任何组织',
   `type` INT(11) NOT NULL COMMENT '消息类型',
-  `content` TEXT NOT NULL COMMENT '消息内容',
+  `content` MEDIUMTEXT NOT NULL COMMENT '消息内容, 加密时为 base64 编码的密文',
+  `key_id` VARCHAR(64) NOT NULL DEFAULT '' COMMENT '加密内容的数据密钥ID, 为空表示明文',
   `timestamp` BIGINT(20) NOT NULL COMMENT '消息时间戳',
+  `audience_type` TINYINT(4) NOT NULL DEFAULT 0 COMMENT '受众类型: 0-指定用户 1-组织 2-在线用户 3-全部用户 4-频道',
+  `audience_id` VARCHAR(128) NOT NULL DEFAULT '' COMMENT '受众标识, 受众类型为组织时为组织ID, 为频道时为频道名',
+  `sender_id` VARCHAR(64) NOT NULL DEFAULT '' COMMENT '发送者用户ID, 仅聊天消息',
+  `room_id` VARCHAR(64) NOT NULL DEFAULT '' COMMENT '聊天室ID, 仅聊天消息',
+  `topic` VARCHAR(128) NOT NULL DEFAULT '' COMMENT '消息来源的MQ topic',
+  `callback_url` VARCHAR(512) NOT NULL DEFAULT '' COMMENT '投递状态回调地址, 为空时使用 topic 配置的回调地址',
+  `deliver_at` BIGINT(20) NOT NULL DEFAULT 0 COMMENT '定时投递时间(unix秒), 0表示立即投递',
+  `scheduled_dispatched` TINYINT(4) NOT NULL DEFAULT 0 COMMENT '定时消息是否已分派推送: 0-否 1-是',
+  `expires_at` BIGINT(20) NOT NULL DEFAULT 0 COMMENT '过期时间(unix秒), 0表示永不过期',
+  `priority` TINYINT(4) NOT NULL DEFAULT 2 COMMENT '优先级: 1-低 2-普通 3-高',
+  `recalled_at` BIGINT(20) NOT NULL DEFAULT 0 COMMENT '撤回时间(unix秒), 0表示未撤回',
+  `edited_at` BIGINT(20) NOT NULL DEFAULT 0 COMMENT '最后编辑时间(unix秒), 0表示未编辑',
   `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT '创建时间',
   `updated_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP COMMENT '更新时间',
   PRIMARY KEY (`id`),
-  KEY `idx_type` (`type`),
-  KEY `idx_created_at` (`created_at`)
+  KEY `idx_type_created_at` (`type`, `created_at`),
+  KEY `idx_created_at` (`created_at`),
+  KEY `idx_audience_created_at` (`audience_type`, `audience_id`, `created_at`),
+  KEY `idx_topic_created_at` (`topic`, `created_at`),
+  KEY `idx_scheduled_dispatched_deliver_at` (`scheduled_dispatched`, `deliver_at`),
+  KEY `idx_org_id_sender_id` (`org_id`, `sender_id`)
 ) ENGINE=InnoDB COMMENT='消息表';
 
 CREATE TABLE IF NOT EXISTS `t_user_message` (
   `id` BIGINT(20) NOT NULL AUTO_INCREMENT COMMENT '主键ID',
+  `org_id` VARCHAR(64) NOT NULL DEFAULT '' COMMENT '接收用户所属组织(租户)',
   `user_id` VARCHAR(64) NOT NULL COMMENT '用户ID',
   `message_id` VARCHAR(64) NOT NULL COMMENT '消息表主键ID',
-  `push_status` TINYINT(4) NOT NULL DEFAULT 0 COMMENT '消息推送状态',
+  `seq` BIGINT(20) NOT NULL DEFAULT 0 COMMENT '用户收件箱序号, 按用户递增; 广播类消息的推送记录在投递后分配, 分配前为 0',
+  `push_status` TINYINT(4) NOT NULL DEFAULT 0 COMMENT '消息推送状态: 0-待处理 1-推送中 2-推送成功 3-推送失败 4-客户端已确认 5-已过期 6-已撤回 7-补偿次数用完已放弃',
+  `read_at` TIMESTAMP NULL DEFAULT NULL COMMENT '已读时间, 为空表示未读',
+  `attempts` INT(11) NOT NULL DEFAULT 0 COMMENT '补偿推送次数',
+  `lease_until` TIMESTAMP NULL DEFAULT NULL COMMENT '补偿推送租约到期时间, 租约内其它实例不会重复推送',
   `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT '创建时间',
   `updated_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP COMMENT '更新时间',
   PRIMARY KEY (`id`),
-  UNIQUE KEY `uk_user_id_message_id` (`user_id`, `message_id`),
-  KEY `idx_message_id_push_status` (`message_id`, `push_status`)
+  UNIQUE KEY `uk_org_id_user_id_message_id` (`org_id`, `user_id`, `message_id`),
+  KEY `idx_message_id_push_status` (`message_id`, `push_status`),
+  KEY `idx_org_id_user_id_read_at` (`org_id`, `user_id`, `read_at`),
+  KEY `idx_org_id_user_id_push_status` (`org_id`, `user_id`, `push_status`),
+  KEY `idx_org_id_user_id_seq` (`org_id`, `user_id`, `seq`),
+  KEY `idx_push_status_created_at` (`push_status`, `created_at`)
 ) ENGINE=InnoDB COMMENT='用户消息推送记录表';
+
+CREATE TABLE IF NOT EXISTS `t_message_edit` (
+  `id` BIGINT(20) NOT NULL AUTO_INCREMENT COMMENT '主键ID',
+  `message_id` VARCHAR(64) NOT NULL COMMENT '消息ID',
+  `content` MEDIUMTEXT NOT NULL COMMENT '编辑前的消息内容, 加密时为 base64 编码的密文',
+  `key_id` VARCHAR(64) NOT NULL DEFAULT '' COMMENT '加密内容的数据密钥ID, 为空表示明文',
+  `editor_id` VARCHAR(64) NOT NULL DEFAULT '' COMMENT '编辑者用户ID',
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT '编辑时间',
+  PRIMARY KEY (`id`),
+  KEY `idx_message_id` (`message_id`),
+  KEY `idx_editor_id` (`editor_id`)
+) ENGINE=InnoDB COMMENT='消息编辑历史表';
+
+CREATE TABLE IF NOT EXISTS `t_user_seq` (
+  `org_id` VARCHAR(64) NOT NULL DEFAULT '' COMMENT '用户所属组织(租户)',
+  `user_id` VARCHAR(64) NOT NULL COMMENT '用户ID',
+  `seq` BIGINT(20) NOT NULL DEFAULT 0 COMMENT '用户收件箱当前最大序号',
+  PRIMARY KEY (`org_id`, `user_id`)
+) ENGINE=InnoDB COMMENT='用户收件箱序号表';
+
+CREATE TABLE IF NOT EXISTS `t_user_presence` (
+  `org_id` VARCHAR(64) NOT NULL DEFAULT '' COMMENT '用户所属组织(租户)',
+  `user_id` VARCHAR(64) NOT NULL COMMENT '用户ID',
+  `last_seen_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT '最后活跃时间',
+  `updated_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP COMMENT '更新时间',
+  PRIMARY KEY (`org_id`, `user_id`)
+) ENGINE=InnoDB COMMENT='用户在线状态表';
+
+CREATE TABLE IF NOT EXISTS `t_fallback_attempt` (
+  `id` BIGINT(20) NOT NULL AUTO_INCREMENT COMMENT '主键ID',
+  `org_id` VARCHAR(64) NOT NULL DEFAULT '' COMMENT '接收用户所属组织(租户)',
+  `user_id` VARCHAR(64) NOT NULL COMMENT '用户ID',
+  `message_id` VARCHAR(64) NOT NULL COMMENT '消息ID',
+  `channel` VARCHAR(32) NOT NULL COMMENT '降级通道: webhook/email/mobile',
+  `status` TINYINT(4) NOT NULL DEFAULT 0 COMMENT '投递状态: 1-成功 2-失败',
+  `attempts` INT(11) NOT NULL DEFAULT 0 COMMENT '尝试次数',
+  `error` VARCHAR(512) NOT NULL DEFAULT '' COMMENT '最近一次失败原因',
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT '创建时间',
+  `updated_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP COMMENT '更新时间',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `uk_org_id_user_id_message_id_channel` (`org_id`, `user_id`, `message_id`, `channel`)
+) ENGINE=InnoDB COMMENT='离线降级通知投递记录表';
+
+CREATE TABLE IF NOT EXISTS `t_callback_outbox` (
+  `id` BIGINT(20) NOT NULL AUTO_INCREMENT COMMENT '主键ID',
+  `event_id` VARCHAR(64) NOT NULL COMMENT '事件ID, 接收方据此去重',
+  `message_id` VARCHAR(64) NOT NULL COMMENT '消息ID',
+  `org_id` VARCHAR(64) NOT NULL DEFAULT '' COMMENT '接收用户所属组织(租户)',
+  `user_id` VARCHAR(64) NOT NULL DEFAULT '' COMMENT '用户ID',
+  `event` VARCHAR(32) NOT NULL COMMENT '事件类型: delivered/acked/failed/expired',
+  `url` VARCHAR(512) NOT NULL COMMENT '回调地址',
+  `payload` TEXT NOT NULL COMMENT '回调请求体',
+  `status` TINYINT(4) NOT NULL DEFAULT 0 COMMENT '状态: 0-待发送 1-已发送 2-放弃',
+  `attempts` INT(11) NOT NULL DEFAULT 0 COMMENT '已尝试次数',
+  `last_error` VARCHAR(512) NOT NULL DEFAULT '' COMMENT '最近一次失败原因',
+  `next_attempt_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT '下次尝试时间',
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT '创建时间',
+  `updated_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP COMMENT '更新时间',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `uk_event_id` (`event_id`),
+  KEY `idx_status_next_attempt_at` (`status`, `next_attempt_at`),
+  KEY `idx_org_id_user_id` (`org_id`, `user_id`)
+) ENGINE=InnoDB COMMENT='投递状态回调发件箱';
+
+CREATE TABLE IF NOT EXISTS `t_audit_log` (
+  `id` BIGINT(20) NOT NULL AUTO_INCREMENT COMMENT '主键ID',
+  `action` VARCHAR(32) NOT NULL COMMENT '操作: export/erase',
+  `subject_org_id` VARCHAR(64) NOT NULL DEFAULT '' COMMENT '数据主体所属组织(租户)',
+  `subject_user_id` VARCHAR(64) NOT NULL COMMENT '数据主体用户ID',
+  `operator` VARCHAR(128) NOT NULL COMMENT '发起请求的操作人',
+  `reason` VARCHAR(512) NOT NULL DEFAULT '' COMMENT '请求原因, 如工单号',
+  `status` VARCHAR(16) NOT NULL COMMENT '状态: pending/succeeded/failed',
+  `details` TEXT NOT NULL COMMENT '执行结果(JSON), 如导出/删除的行数与失败原因',
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT '请求时间',
+  `finished_at` TIMESTAMP NULL DEFAULT NULL COMMENT '完成时间',
+  PRIMARY KEY (`id`),
+  KEY `idx_subject_org_id_user_id` (`subject_org_id`, `subject_user_id`)
+) ENGINE=InnoDB COMMENT='用户数据请求审计日志表';
+
+CREATE TABLE IF NOT EXISTS `t_data_key` (
+  `id` VARCHAR(64) NOT NULL COMMENT '数据密钥ID',
+  `master_key_id` VARCHAR(64) NOT NULL COMMENT '加密数据密钥的主密钥ID',
+  `wrapped_key` VARBINARY(512) NOT NULL COMMENT '主密钥加密后的数据密钥',
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT '创建时间',
+  PRIMARY KEY (`id`),
+  KEY `idx_master_key_id_created_at` (`master_key_id`, `created_at`)
+) ENGINE=InnoDB COMMENT='消息内容数据密钥表';
+
+CREATE TABLE IF NOT EXISTS `t_org_usage` (
+  `org_id` VARCHAR(64) NOT NULL COMMENT '组织ID',
+  `day` DATE NOT NULL COMMENT '日期(UTC)',
+  `messages` BIGINT(20) NOT NULL DEFAULT 0 COMMENT '当天发布的消息数',
+  PRIMARY KEY (`org_id`, `day`)
+) ENGINE=InnoDB COMMENT='组织每日用量表';
@@ -0,0 +1,154 @@
+-- 将旧版本(未支持受众、组织、序号等功能)的表结构升级到当前 init.sql 的表结构, 新部署直接执行 init.sql 即可。
+-- 按顺序执行一次, 需要 MySQL 8.0 及以上(第 5 步使用窗口函数); 执行前停止所有实例并备份数据。
+-- 升级后原有数据属于空组织(org_id 为空), 启用 tenancy 时这些历史消息不属于任何组织。
+
+USE `message_push`;
+
+-- 1. t_message: 受众、聊天、定时/过期、优先级、撤回/编辑、加密与组织字段
+ALTER TABLE `t_message`
+  ADD COLUMN `org_id` VARCHAR(64) NOT NULL DEFAULT '' COMMENT '消息所属组织(租户), 为空表示不属于任何组织' AFTER `id`,
+  MODIFY COLUMN `content` MEDIUMTEXT NOT NULL COMMENT '消息内容, 加密时为 base64 编码的密文',
+  ADD COLUMN `key_id` VARCHAR(64) NOT NULL DEFAULT '' COMMENT '加密内容的数据密钥ID, 为空表示明文' AFTER `content`,
+  ADD COLUMN `audience_type` TINYINT(4) NOT NULL DEFAULT 0 COMMENT '受众类型: 0-指定用户 1-组织 2-在线用户 3-全部用户 4-频道' AFTER `timestamp`,
+  ADD COLUMN `audience_id` VARCHAR(128) NOT NULL DEFAULT '' COMMENT '受众标识, 受众类型为组织时为组织ID, 为频道时为频道名' AFTER `audience_type`,
+  ADD COLUMN `sender_id` VARCHAR(64) NOT NULL DEFAULT '' COMMENT '发送者用户ID, 仅聊天消息' AFTER `audience_id`,
+  ADD COLUMN `room_id` VARCHAR(64) NOT NULL DEFAULT '' COMMENT '聊天室ID, 仅聊天消息' AFTER `sender_id`,
+  ADD COLUMN `topic` VARCHAR(128) NOT NULL DEFAULT '' COMMENT '消息来源的MQ topic' AFTER `room_id`,
+  ADD COLUMN `callback_url` VARCHAR(512) NOT NULL DEFAULT '' COMMENT '投递状态回调地址, 为空时使用 topic 配置的回调地址' AFTER `topic`,
+  ADD COLUMN `deliver_at` BIGINT(20) NOT NULL DEFAULT 0 COMMENT '定时投递时间(unix秒), 0表示立即投递' AFTER `callback_url`,
+  ADD COLUMN `scheduled_dispatched` TINYINT(4) NOT NULL DEFAULT 0 COMMENT '定时消息是否已分派推送: 0-否 1-是' AFTER `deliver_at`,
+  ADD COLUMN `expires_at` BIGINT(20) NOT NULL DEFAULT 0 COMMENT '过期时间(unix秒), 0表示永不过期' AFTER `scheduled_dispatched`,
+  ADD COLUMN `priority` TINYINT(4) NOT NULL DEFAULT 2 COMMENT '优先级: 1-低 2-普通 3-高' AFTER `expires_at`,
+  ADD COLUMN `recalled_at` BIGINT(20) NOT NULL DEFAULT 0 COMMENT '撤回时间(unix秒), 0表示未撤回' AFTER `priority`,
+  ADD COLUMN `edited_at` BIGINT(20) NOT NULL DEFAULT 0 COMMENT '最后编辑时间(unix秒), 0表示未编辑' AFTER `recalled_at`,
+  DROP INDEX `idx_type`,
+  ADD KEY `idx_type_created_at` (`type`, `created_at`),
+  ADD KEY `idx_audience_created_at` (`audience_type`, `audience_id`, `created_at`),
+  ADD KEY `idx_topic_created_at` (`topic`, `created_at`),
+  ADD KEY `idx_scheduled_dispatched_deliver_at` (`scheduled_dispatched`, `deliver_at`),
+  ADD KEY `idx_org_id_sender_id` (`org_id`, `sender_id`);
+
+-- 2. t_user_message: 组织、序号、已读与补偿推送字段; 唯一键改为 (org_id, user_id, message_id)
+ALTER TABLE `t_user_message`
+  ADD COLUMN `org_id` VARCHAR(64) NOT NULL DEFAULT '' COMMENT '接收用户所属组织(租户)' AFTER `id`,
+  ADD COLUMN `seq` BIGINT(20) NOT NULL DEFAULT 0 COMMENT '用户收件箱序号, 按用户递增; 广播类消息的推送记录在投递后分配, 分配前为 0' AFTER `message_id`,
+  MODIFY COLUMN `push_status` TINYINT(4) NOT NULL DEFAULT 0 COMMENT '消息推送状态: 0-待处理 1-推送中 2-推送成功 3-推送失败 4-客户端已确认 5-已过期 6-已撤回 7-补偿次数用完已放弃',
+  ADD COLUMN `read_at` TIMESTAMP NULL DEFAULT NULL COMMENT '已读时间, 为空表示未读' AFTER `push_status`,
+  ADD COLUMN `attempts` INT(11) NOT NULL DEFAULT 0 COMMENT '补偿推送次数' AFTER `read_at`,
+  ADD COLUMN `lease_until` TIMESTAMP NULL DEFAULT NULL COMMENT '补偿推送租约到期时间, 租约内其它实例不会重复推送' AFTER `attempts`,
+  ADD UNIQUE KEY `uk_org_id_user_id_message_id` (`org_id`, `user_id`, `message_id`),
+  DROP INDEX `uk_user_id_message_id`,
+  ADD KEY `idx_org_id_user_id_read_at` (`org_id`, `user_id`, `read_at`),
+  ADD KEY `idx_org_id_user_id_push_status` (`org_id`, `user_id`, `push_status`),
+  ADD KEY `idx_org_id_user_id_seq` (`org_id`, `user_id`, `seq`),
+  ADD KEY `idx_push_status_created_at` (`push_status`, `created_at`);
+
+-- 3. 新增的表, 与 init.sql 相同
+CREATE TABLE IF NOT EXISTS `t_message_edit` (
+  `id` BIGINT(20) NOT NULL AUTO_INCREMENT COMMENT '主键ID',
+  `message_id` VARCHAR(64) NOT NULL COMMENT '消息ID',
+  `content` MEDIUMTEXT NOT NULL COMMENT '编辑前的消息内容, 加密时为 base64 编码的密文',
+  `key_id` VARCHAR(64) NOT NULL DEFAULT '' COMMENT '加密内容的数据密钥ID, 为空表示明文',
+  `editor_id` VARCHAR(64) NOT NULL DEFAULT '' COMMENT '编辑者用户ID',
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT '编辑时间',
+  PRIMARY KEY (`id`),
+  KEY `idx_message_id` (`message_id`),
+  KEY `idx_editor_id` (`editor_id`)
+) ENGINE=InnoDB COMMENT='消息编辑历史表';
+
+CREATE TABLE IF NOT EXISTS `t_user_seq` (
+  `org_id` VARCHAR(64) NOT NULL DEFAULT '' COMMENT '用户所属组织(租户)',
+  `user_id` VARCHAR(64) NOT NULL COMMENT '用户ID',
+  `seq` BIGINT(20) NOT NULL DEFAULT 0 COMMENT '用户收件箱当前最大序号',
+  PRIMARY KEY (`org_id`, `user_id`)
+) ENGINE=InnoDB COMMENT='用户收件箱序号表';
+
+CREATE TABLE IF NOT EXISTS `t_user_presence` (
+  `org_id` VARCHAR(64) NOT NULL DEFAULT '' COMMENT '用户所属组织(租户)',
+  `user_id` VARCHAR(64) NOT NULL COMMENT '用户ID',
+  `last_seen_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT '最后活跃时间',
+  `updated_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP COMMENT '更新时间',
+  PRIMARY KEY (`org_id`, `user_id`)
+) ENGINE=InnoDB COMMENT='用户在线状态表';
+
+CREATE TABLE IF NOT EXISTS `t_fallback_attempt` (
+  `id` BIGINT(20) NOT NULL AUTO_INCREMENT COMMENT '主键ID',
+  `org_id` VARCHAR(64) NOT NULL DEFAULT '' COMMENT '接收用户所属组织(租户)',
+  `user_id` VARCHAR(64) NOT NULL COMMENT '用户ID',
+  `message_id` VARCHAR(64) NOT NULL COMMENT '消息ID',
+  `channel` VARCHAR(32) NOT NULL COMMENT '降级通道: webhook/email/mobile',
+  `status` TINYINT(4) NOT NULL DEFAULT 0 COMMENT '投递状态: 1-成功 2-失败',
+  `attempts` INT(11) NOT NULL DEFAULT 0 COMMENT '尝试次数',
+  `error` VARCHAR(512) NOT NULL DEFAULT '' COMMENT '最近一次失败原因',
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT '创建时间',
+  `updated_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP COMMENT '更新时间',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `uk_org_id_user_id_message_id_channel` (`org_id`, `user_id`, `message_id`, `channel`)
+) ENGINE=InnoDB COMMENT='离线降级通知投递记录表';
+
+CREATE TABLE IF NOT EXISTS `t_callback_outbox` (
+  `id` BIGINT(20) NOT NULL AUTO_INCREMENT COMMENT '主键ID',
+  `event_id` VARCHAR(64) NOT NULL COMMENT '事件ID, 接收方据此去重',
+  `message_id` VARCHAR(64) NOT NULL COMMENT '消息ID',
+  `org_id` VARCHAR(64) NOT NULL DEFAULT '' COMMENT '接收用户所属组织(租户)',
+  `user_id` VARCHAR(64) NOT NULL DEFAULT '' COMMENT '用户ID',
+  `event` VARCHAR(32) NOT NULL COMMENT '事件类型: delivered/acked/failed/expired',
+  `url` VARCHAR(512) NOT NULL COMMENT '回调地址',
+  `payload` TEXT NOT NULL COMMENT '回调请求体',
+  `status` TINYINT(4) NOT NULL DEFAULT 0 COMMENT '状态: 0-待发送 1-已发送 2-放弃',
+  `attempts` INT(11) NOT NULL DEFAULT 0 COMMENT '已尝试次数',
+  `last_error` VARCHAR(512) NOT NULL DEFAULT '' COMMENT '最近一次失败原因',
+  `next_attempt_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT '下次尝试时间',
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT '创建时间',
+  `updated_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP COMMENT '更新时间',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `uk_event_id` (`event_id`),
+  KEY `idx_status_next_attempt_at` (`status`, `next_attempt_at`),
+  KEY `idx_org_id_user_id` (`org_id`, `user_id`)
+) ENGINE=InnoDB COMMENT='投递状态回调发件箱';
+
+CREATE TABLE IF NOT EXISTS `t_audit_log` (
+  `id` BIGINT(20) NOT NULL AUTO_INCREMENT COMMENT '主键ID',
+  `action` VARCHAR(32) NOT NULL COMMENT '操作: export/erase',
+  `subject_org_id` VARCHAR(64) NOT NULL DEFAULT '' COMMENT '数据主体所属组织(租户)',
+  `subject_user_id` VARCHAR(64) NOT NULL COMMENT '数据主体用户ID',
+  `operator` VARCHAR(128) NOT NULL COMMENT '发起请求的操作人',
+  `reason` VARCHAR(512) NOT NULL DEFAULT '' COMMENT '请求原因, 如工单号',
+  `status` VARCHAR(16) NOT NULL COMMENT '状态: pending/succeeded/failed',
+  `details` TEXT NOT NULL COMMENT '执行结果(JSON), 如导出/删除的行数与失败原因',
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT '请求时间',
+  `finished_at` TIMESTAMP NULL DEFAULT NULL COMMENT '完成时间',
+  PRIMARY KEY (`id`),
+  KEY `idx_subject_org_id_user_id` (`subject_org_id`, `subject_user_id`)
+) ENGINE=InnoDB COMMENT='用户数据请求审计日志表';
+
+CREATE TABLE IF NOT EXISTS `t_data_key` (
+  `id` VARCHAR(64) NOT NULL COMMENT '数据密钥ID',
+  `master_key_id` VARCHAR(64) NOT NULL COMMENT '加密数据密钥的主密钥ID',
+  `wrapped_key` VARBINARY(512) NOT NULL COMMENT '主密钥加密后的数据密钥',
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT '创建时间',
+  PRIMARY KEY (`id`),
+  KEY `idx_master_key_id_created_at` (`master_key_id`, `created_at`)
+) ENGINE=InnoDB COMMENT='消息内容数据密钥表';
+
+CREATE TABLE IF NOT EXISTS `t_org_usage` (
+  `org_id` VARCHAR(64) NOT NULL COMMENT '组织ID',
+  `day` DATE NOT NULL COMMENT '日期(UTC)',
+  `messages` BIGINT(20) NOT NULL DEFAULT 0 COMMENT '当天发布的消息数',
+  PRIMARY KEY (`org_id`, `day`)
+) ENGINE=InnoDB COMMENT='组织每日用量表';
+
+-- 4. 原有消息均已立即推送, 标记为已分派, 避免定时投递任务重复推送
+UPDATE `t_message` SET `scheduled_dispatched` = 1;
+
+-- 5. 按写入顺序为原有推送记录分配收件箱序号, 并初始化 t_user_seq
+UPDATE `t_user_message` um
+  JOIN (
+    SELECT `id`, ROW_NUMBER() OVER (PARTITION BY `org_id`, `user_id` ORDER BY `id`) AS `seq`
+    FROM `t_user_message`
+  ) s ON um.`id` = s.`id`
+SET um.`seq` = s.`seq`;
+
+INSERT INTO `t_user_seq` (`org_id`, `user_id`, `seq`)
+SELECT `org_id`, `user_id`, MAX(`seq`) FROM `t_user_message` GROUP BY `org_id`, `user_id`
+ON DUPLICATE KEY UPDATE `seq` = GREATEST(`t_user_seq`.`seq`, VALUES(`seq`));